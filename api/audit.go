@@ -0,0 +1,96 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/cluster"
+	"github.com/gorilla/mux"
+)
+
+type AuditController struct {
+	ClusterService cluster.Service
+	Audit          *audit.Log
+}
+
+func (t *AuditController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/audit", t.httpQueryAudit).Methods("GET")
+}
+
+// httpQueryAudit returns audit records newest first filtered by the from, to (RFC3339),
+// user, device, kind and limit query parameters. The format query parameter or Accept
+// header selects json (default), csv or ndjson output.
+func (t *AuditController) httpQueryAudit(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	q := &audit.Query{
+		User:   r.URL.Query().Get("user"),
+		Device: r.URL.Query().Get("device"),
+		Kind:   r.URL.Query().Get("kind"),
+		Limit:  queryLimit(r, 1000),
+	}
+
+	var err error
+
+	if from := r.URL.Query().Get("from"); from != "" {
+		if q.From, err = time.Parse(time.RFC3339, from); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("from must be an RFC3339 time"))
+			return
+		}
+	}
+
+	if to := r.URL.Query().Get("to"); to != "" {
+		if q.To, err = time.Parse(time.RFC3339, to); err != nil {
+			rw.WriteHeader(http.StatusBadRequest)
+			rw.Write([]byte("to must be an RFC3339 time"))
+			return
+		}
+	}
+
+	records, err := t.Audit.Query(q)
+
+	if err != nil {
+		requestLogger(r).WithField("error", err).Error("audit query failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("audit query failed. review logs for further details"))
+		return
+	}
+
+	switch auditFormat(r) {
+	case "csv":
+		rw.Header().Set("Content-Type", "text/csv")
+		rw.Header().Set("Content-Disposition", "attachment; filename=audit.csv")
+		err = audit.WriteCSV(rw, records)
+	case "ndjson":
+		rw.Header().Set("Content-Type", "application/x-ndjson")
+		err = audit.WriteNDJSON(rw, records)
+	default:
+		writeJSON(rw, http.StatusOK, records)
+	}
+
+	if err != nil {
+		requestLogger(r).WithField("error", err.Error()).Error("failed to write audit export")
+	}
+}
+
+func auditFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return strings.ToLower(format)
+	}
+
+	accept := r.Header.Get("Accept")
+
+	switch {
+	case strings.Contains(accept, "text/csv"):
+		return "csv"
+	case strings.Contains(accept, "application/x-ndjson"):
+		return "ndjson"
+	}
+
+	return "json"
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/cluster"
+)
+
+// rejectRequest writes the response of a request that failed authentication. The
+// request is rejected with 503 when the cluster cannot authenticate it yet.
+// Every other failure, including lockouts, gets the same empty 403 so callers
+// cannot learn which part of their credentials was wrong or that they were
+// throttled. The reason is only logged and audited.
+func rejectRequest(rw http.ResponseWriter, r *http.Request, err error) {
+	status := http.StatusForbidden
+
+	if _, ok := err.(*cluster.ServiceUnavailable); ok {
+		status = http.StatusServiceUnavailable
+	}
+
+	rw.WriteHeader(status)
+	rw.Write([]byte(""))
+
+	requestLogger(r).WithFields(logrus.Fields{
+		"remoteAddr": r.RemoteAddr,
+	}).Error(err.Error())
+}
+
+// unavailable writes 503 if the error is a cluster.ServiceUnavailable, such as a
+// change that could not be audited, and reports if it did
+func unavailable(rw http.ResponseWriter, err error) bool {
+	failed, ok := err.(*cluster.ServiceUnavailable)
+
+	if !ok {
+		return false
+	}
+
+	rw.WriteHeader(http.StatusServiceUnavailable)
+	rw.Write([]byte(failed.Error()))
+
+	return true
+}
+
+// authenticateAdmin authenticates the request and ensures the user is an admin. If
+// the request is rejected the response has been written and nil is returned.
+func authenticateAdmin(clusterService cluster.Service, rw http.ResponseWriter, r *http.Request) *cluster.User {
+	user, err := clusterService.AuthenticateAPIUser(r)
+
+	if err != nil {
+		rejectRequest(rw, r, err)
+		return nil
+	}
+
+	if !user.Admin {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte(""))
+
+		requestLogger(r).WithFields(logrus.Fields{
+			"remoteAddr": r.RemoteAddr,
+			"user":       user.ID,
+		}).Error("admin access denied")
+
+		return nil
+	}
+
+	return user
+}
@@ -2,16 +2,24 @@ package api
 
 import (
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/audit"
 	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/trace"
 	"github.com/gorilla/mux"
 )
 
 type DeviceController struct {
 	ClusterService cluster.Service
+
+	// Audit records every proxied device request
+	Audit *audit.Log
 }
 
 func (t *DeviceController) RegisterRoutes(router *mux.Router) {
@@ -20,24 +28,87 @@ func (t *DeviceController) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/device/{deviceid}", t.httpProxyDevice)
 	router.HandleFunc("/device/{deviceid}/", t.httpProxyDevice)
 	router.HandleFunc("/device/{deviceid}/{path:.*}", t.httpProxyDevice)
+	router.HandleFunc("/v1/devices", t.httpGetDevices).Methods("GET")
+	router.HandleFunc("/v1/devices/{deviceid}", t.httpGetDevice).Methods("GET")
+	router.HandleFunc("/v1/device/{deviceid}/events", t.httpGetDeviceEvents).Methods("GET")
 }
 
+// httpGetDevices lists the devices known to the cluster ordered by hostname
 func (t *DeviceController) httpGetDevices(rw http.ResponseWriter, r *http.Request) {
+	if err := t.ClusterService.AuthenticateAPIRequest(r); err != nil {
+		rejectRequest(rw, r, err)
+		return
+	}
+
+	devices, err := t.ClusterService.Devices()
+
+	if err != nil {
+		requestLogger(r).WithField("error", err).Error("device list request failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("failed to retrieve devices. review logs for further details"))
+		return
+	}
 
+	writeJSON(rw, http.StatusOK, devices)
 }
 
-func (t *DeviceController) httpProxyDevice(rw http.ResponseWriter, r *http.Request) {
-	var err error
+// httpGetDevice returns the device with the id or hostname
+func (t *DeviceController) httpGetDevice(rw http.ResponseWriter, r *http.Request) {
+	if err := t.ClusterService.AuthenticateAPIRequest(r); err != nil {
+		rejectRequest(rw, r, err)
+		return
+	}
+
+	device, err := t.ClusterService.Device(mux.Vars(r)["deviceid"])
+
+	if notfound, ok := err.(*cluster.NotFound); ok {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(notfound.Error()))
+		return
+	}
+
+	if err != nil {
+		requestLogger(r).WithField("error", err).Error("device request failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("failed to retrieve device. review logs for further details"))
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, device)
+}
+
+func (t *DeviceController) httpGetDeviceEvents(rw http.ResponseWriter, r *http.Request) {
+	if err := t.ClusterService.AuthenticateAPIRequest(r); err != nil {
+		rejectRequest(rw, r, err)
+		return
+	}
+
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	var types []string
+
+	if r.URL.Query().Get("type") != "" {
+		types = strings.Split(r.URL.Query().Get("type"), ",")
+	}
+
+	events, err := t.ClusterService.DeviceEvents(mux.Vars(r)["deviceid"], limit, types)
+
+	if err != nil {
+		requestLogger(r).WithField("error", err).Error("device events request failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("failed to retrieve device events. review logs for further details"))
+		return
+	}
 
-	if err = t.ClusterService.AuthenticateAPIRequest(r); err != nil {
-		rw.WriteHeader(http.StatusForbidden)
-		rw.Write([]byte(""))
+	writeJSON(rw, http.StatusOK, events)
+}
 
-		logrus.WithFields(logrus.Fields{
-			"remoteAddr":    r.RemoteAddr,
-			"authorization": r.Header.Get("Authorization"),
-		}).Error(err.Error())
+func (t *DeviceController) httpProxyDevice(rw http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	user, err := t.ClusterService.AuthenticateAPIUser(r)
 
+	if err != nil {
+		rejectRequest(rw, r, err)
 		return
 	}
 
@@ -48,26 +119,95 @@ func (t *DeviceController) httpProxyDevice(rw http.ResponseWriter, r *http.Reque
 		fmt.Sprintf("/device/%v", vars["deviceid"]),
 	)
 
-	logrus.WithFields(logrus.Fields{
-		"remoteAddr": r.RemoteAddr,
-		"user": strings.Split(
-			strings.Split(r.Header.Get("Authorization"), " ")[1],
-			":",
-		)[0],
+	requestLogger(r).WithFields(logrus.Fields{
+		"remoteAddr":     r.RemoteAddr,
+		"user":           user.ID,
 		"deviceId":       vars["deviceid"],
 		"deviceEndpoint": vars["path"],
 	}).Info("device access")
 
+	recorder := &responseRecorder{ResponseWriter: rw}
+	body := &countingReader{ReadCloser: r.Body}
+
+	if r.Body != nil {
+		r.Body = body
+	}
+
+	query := r.URL.RawQuery
+
+	// revoking the user's sessions aborts the proxied request
+	ctx, cancel := t.ClusterService.SessionContext(r.Context(), user)
+	defer cancel()
+
+	r = r.WithContext(ctx)
+
 	err = t.ClusterService.ProxyDeviceRequest(
 		vars["deviceid"],
 		vars["path"],
-		rw,
+		recorder,
 		r,
 	)
 
+	if blocked, ok := err.(*cluster.DeviceBlocked); ok {
+		requestLogger(r).WithField("error", err).Warn("device proxy request refused")
+		recorder.WriteHeader(http.StatusForbidden)
+		recorder.Write([]byte(blocked.Error()))
+	} else if err != nil {
+		requestLogger(r).WithField("error", err).Error("device proxy request failed")
+		recorder.WriteHeader(http.StatusBadGateway)
+		recorder.Write([]byte("failed to proxy request to specified device. review logs for further details"))
+	}
+
+	t.audit(user, vars["deviceid"], vars["path"], query, r, recorder, body, start)
+}
+
+// audit writes the device access record of a proxied request
+func (t *DeviceController) audit(user *cluster.User, deviceid string, path string, query string, r *http.Request, recorder *responseRecorder, body *countingReader, start time.Time) {
+	if t.Audit == nil {
+		return
+	}
+
+	rec := &audit.Record{
+		Kind:          audit.DeviceAccess,
+		Time:          start.UTC(),
+		UserID:        user.ID,
+		UserLogin:     user.Login,
+		SourceIP:      remoteIP(r),
+		DeviceID:      strings.ToLower(deviceid),
+		Method:        r.Method,
+		Path:          "/" + path,
+		Query:         query,
+		RequestBytes:  body.bytes,
+		ResponseBytes: recorder.bytes,
+		StatusCode:    recorder.status,
+		DurationMS:    float64(time.Since(start)) / float64(time.Millisecond),
+		RequestID:     trace.RequestID(r.Context()),
+	}
+
+	if span := trace.SpanFromContext(r.Context()); span != nil {
+		rec.TraceID = span.Context.TraceIDString()
+	}
+
+	if device := t.ClusterService.LookupDevice(deviceid); device != nil {
+		rec.DeviceID = device.ID
+		rec.Hostname = device.Hostname
+	}
+
+	if err := t.Audit.Write(rec); err != nil {
+		requestLogger(r).WithFields(logrus.Fields{
+			"deviceId": deviceid,
+			"error":    err.Error(),
+		}).Error("failed to write device access audit record")
+	}
+}
+
+// remoteIP returns the ip address of the client connection
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+
 	if err != nil {
-		logrus.WithField("error", err).Error("device proxy request failed")
-		rw.WriteHeader(http.StatusBadGateway)
-		rw.Write([]byte("failed to proxy request to specified device. review logs for further details"))
+		return r.RemoteAddr
 	}
+
+	return host
 }
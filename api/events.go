@@ -0,0 +1,188 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/event"
+	"github.com/gorilla/mux"
+)
+
+// eventKeepAliveInterval is how often an idle event stream is sent a comment to
+// keep intermediaries from closing the connection
+const eventKeepAliveInterval = 15 * time.Second
+
+// replayWindow is how long after the backlog is sent live events are checked
+// against it. Events published while the backlog was read arrive in both.
+const replayWindow = 10 * time.Second
+
+// publicEventTypes are the event types streamed to every user. Every other type
+// reveals users, members or sign-in attempts and is reserved to admins.
+var publicEventTypes = []string{"device.*"}
+
+type EventController struct {
+	ClusterService cluster.Service
+}
+
+func (t *EventController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/events", t.httpStreamEvents).Methods("GET")
+}
+
+// httpStreamEvents streams cluster wide hub events as Server-Sent Events. The
+// type query parameter filters by comma separated type patterns (device.*,auth.failed)
+// and the Last-Event-ID header or lastEventId query parameter resumes a stream.
+// Users who are not admins only receive device events.
+func (t *EventController) httpStreamEvents(rw http.ResponseWriter, r *http.Request) {
+	user, err := t.ClusterService.AuthenticateAPIUser(r)
+
+	if err != nil {
+		rejectRequest(rw, r, err)
+		return
+	}
+
+	ctx, cancel := t.ClusterService.SessionContext(r.Context(), user)
+	defer cancel()
+
+	flusher, ok := rw.(http.Flusher)
+
+	if !ok {
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("streaming unsupported"))
+		return
+	}
+
+	var types []string
+
+	if r.URL.Query().Get("type") != "" {
+		types = strings.Split(r.URL.Query().Get("type"), ",")
+	}
+
+	lastEventID := r.Header.Get("Last-Event-ID")
+
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+
+	backlog, sub, err := t.ClusterService.SubscribeEvents(lastEventID, types)
+
+	if err != nil {
+		requestLogger(r).WithField("error", err).Error("event stream subscription failed")
+		rw.WriteHeader(http.StatusInternalServerError)
+		rw.Write([]byte("failed to subscribe to events. review logs for further details"))
+		return
+	}
+
+	defer sub.Close()
+
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	rw.Header().Set("Connection", "keep-alive")
+	rw.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for _, e := range backlog {
+		if !visibleTo(user, e) {
+			continue
+		}
+
+		if err := writeEvent(rw, e); err != nil {
+			return
+		}
+	}
+
+	flusher.Flush()
+
+	sent := newReplayed(backlog, time.Now())
+
+	keepalive := time.NewTicker(eventKeepAliveInterval)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(rw, ": keepalive\n\n"); err != nil {
+				return
+			}
+			flusher.Flush()
+		case e, ok := <-sub.C:
+			if !ok {
+				return
+			}
+
+			if sent.seen(e, time.Now()) || !visibleTo(user, e) {
+				continue
+			}
+
+			if err := writeEvent(rw, e); err != nil {
+				return
+			}
+
+			flusher.Flush()
+		}
+	}
+}
+
+// visibleTo reports if the user may see the event
+func visibleTo(user *cluster.User, e *event.Event) bool {
+	return user.Admin || event.MatchAny(publicEventTypes, e.Type)
+}
+
+// replayed holds the ids of the backlog sent to a stream so events that also
+// arrive live are not sent twice. Live event ids are not ordered across members,
+// so only the replayed ids are skipped, and only until the window has passed.
+type replayed struct {
+	ids   map[string]bool
+	until time.Time
+}
+
+func newReplayed(backlog []*event.Event, now time.Time) *replayed {
+	ids := map[string]bool{}
+
+	for _, e := range backlog {
+		ids[e.ID] = true
+	}
+
+	return &replayed{
+		ids:   ids,
+		until: now.Add(replayWindow),
+	}
+}
+
+// seen reports if the live event was already sent from the backlog
+func (t *replayed) seen(e *event.Event, now time.Time) bool {
+	if len(t.ids) == 0 {
+		return false
+	}
+
+	if now.After(t.until) {
+		t.ids = nil
+		return false
+	}
+
+	if !t.ids[e.ID] {
+		return false
+	}
+
+	delete(t.ids, e.ID)
+
+	return true
+}
+
+// writeEvent writes a single event in Server-Sent Events framing
+func writeEvent(rw http.ResponseWriter, e *event.Event) error {
+	data, err := json.Marshal(e)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(rw, "id: %v\nevent: %v\ndata: %s\n\n", e.ID, e.Type, data)
+
+	return err
+}
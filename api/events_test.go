@@ -0,0 +1,49 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type EventsTestSuite struct {
+	suite.Suite
+}
+
+func (t *EventsTestSuite) Test_visibleTo_streams_only_device_events_to_users() {
+	user := &cluster.User{ID: "1"}
+	admin := &cluster.User{ID: "2", Admin: true}
+
+	for _, typ := range []string{event.DeviceAlert, event.DeviceState, event.DeviceLog, event.DeviceConnected, event.DeviceDisconnected} {
+		assert.True(t.T(), visibleTo(user, &event.Event{Type: typ}), typ)
+		assert.True(t.T(), visibleTo(admin, &event.Event{Type: typ}), typ)
+	}
+
+	for _, typ := range []string{event.UserCreated, event.UserUpdated, event.UserDeleted, event.UserRecovered, event.MemberJoined, event.AuthFailed, "webhook.created"} {
+		assert.False(t.T(), visibleTo(user, &event.Event{Type: typ}), typ)
+		assert.True(t.T(), visibleTo(admin, &event.Event{Type: typ}), typ)
+	}
+}
+
+func (t *EventsTestSuite) Test_replayed_skips_only_backlog_events() {
+	now := time.Now()
+
+	sent := newReplayed([]*event.Event{{ID: "0005"}, {ID: "0007"}}, now)
+
+	// an event of another member may carry an earlier id than the backlog
+	assert.False(t.T(), sent.seen(&event.Event{ID: "0006"}, now))
+	assert.False(t.T(), sent.seen(&event.Event{ID: "0001"}, now))
+	assert.True(t.T(), sent.seen(&event.Event{ID: "0005"}, now))
+	assert.False(t.T(), sent.seen(&event.Event{ID: "0005"}, now))
+
+	assert.False(t.T(), sent.seen(&event.Event{ID: "0007"}, now.Add(replayWindow+time.Second)))
+	assert.Nil(t.T(), sent.ids)
+}
+
+func TestEventsTestSuite(t *testing.T) {
+	suite.Run(t, new(EventsTestSuite))
+}
@@ -0,0 +1,99 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/gorilla/mux"
+)
+
+// LockoutController lets admins review and clear authentication lockouts
+type LockoutController struct {
+	ClusterService cluster.Service
+}
+
+// lockoutView is a lockout as returned by the api
+type lockoutView struct {
+	ID           string     `json:"id"`
+	Kind         string     `json:"kind"`
+	Subject      string     `json:"subject"`
+	Failures     int        `json:"failures"`
+	FirstFailure time.Time  `json:"firstFailure"`
+	LastFailure  time.Time  `json:"lastFailure"`
+	LockedUntil  *time.Time `json:"lockedUntil,omitempty"`
+}
+
+func newLockoutView(lockout *cluster.Lockout) *lockoutView {
+	view := &lockoutView{
+		ID:           lockout.ID,
+		Kind:         lockout.Kind,
+		Subject:      lockout.Subject,
+		Failures:     lockout.Failures,
+		FirstFailure: lockout.FirstFailure,
+		LastFailure:  lockout.LastFailure,
+	}
+
+	if lockout.Locked(time.Now()) {
+		view.LockedUntil = &lockout.LockedUntil
+	}
+
+	return view
+}
+
+func (t *LockoutController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/lockouts", t.httpListLockouts).Methods("GET")
+	router.HandleFunc("/v1/lockouts/{lockout}", t.httpClearLockout).Methods("DELETE")
+}
+
+func (t *LockoutController) httpListLockouts(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	lockouts, err := t.ClusterService.Lockouts()
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	views := []*lockoutView{}
+
+	for _, lockout := range lockouts {
+		views = append(views, newLockoutView(lockout))
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+func (t *LockoutController) httpClearLockout(rw http.ResponseWriter, r *http.Request) {
+	actor := authenticateAdmin(t.ClusterService, rw, r)
+
+	if actor == nil {
+		return
+	}
+
+	if err := t.ClusterService.ClearLockout(actor, mux.Vars(r)["lockout"]); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (t *LockoutController) fail(rw http.ResponseWriter, r *http.Request, err error) {
+	if unavailable(rw, err) {
+		return
+	}
+
+	if notfound, ok := err.(*cluster.NotFound); ok {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(notfound.Error()))
+		return
+	}
+
+	requestLogger(r).WithField("error", err).Error("lockout request failed")
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write([]byte("lockout request failed. review logs for further details"))
+}
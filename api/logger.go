@@ -0,0 +1,5 @@
+package api
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("api")
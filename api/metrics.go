@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	apiRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deviceio_hub_api_requests_total",
+		Help: "Number of api requests by route, method and status",
+	}, []string{"route", "method", "status"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "deviceio_hub_api_request_duration_seconds",
+		Help:    "Latency of api requests by route, method and status",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+)
+
+// requestMethods are the methods labelled as themselves, any other is labelled
+// "other" so clients cannot create new series
+var requestMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"POST":    true,
+	"PUT":     true,
+	"PATCH":   true,
+	"DELETE":  true,
+	"OPTIONS": true,
+}
+
+func init() {
+	prometheus.MustRegister(apiRequests, apiRequestDuration)
+}
+
+// MetricsController serves the prometheus metrics of every hub component
+type MetricsController struct {
+}
+
+func (t *MetricsController) RegisterRoutes(router *mux.Router) {
+	router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+}
+
+// instrument records the count and latency of every request served by the router.
+// Requests are labelled by their route template so device ids do not create new
+// series.
+func instrument(router *mux.Router) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := routeTemplate(router, r)
+		recorder := &responseRecorder{ResponseWriter: rw}
+		router.ServeHTTP(recorder, r)
+
+		status := recorder.status
+
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		labels := []string{route, requestMethod(r), strconv.Itoa(status)}
+
+		apiRequests.WithLabelValues(labels...).Inc()
+		apiRequestDuration.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+	})
+}
+
+// requestMethod returns the method label of r
+func requestMethod(r *http.Request) string {
+	if requestMethods[r.Method] {
+		return r.Method
+	}
+
+	return "other"
+}
+
+// routeTemplate returns the template of the route matching r, or "unmatched"
+func routeTemplate(router *mux.Router, r *http.Request) string {
+	var match mux.RouteMatch
+
+	if router.Match(r, &match) && match.Route != nil {
+		if template, err := match.Route.GetPathTemplate(); err == nil {
+			return template
+		}
+	}
+
+	return "unmatched"
+}
@@ -0,0 +1,240 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/oidc"
+	"github.com/deviceio/hub/secret"
+	"github.com/gorilla/mux"
+)
+
+// oidcCookie holds the sealed auth request between the login redirect and the
+// callback
+const oidcCookie = "deviceio_hub_oidc"
+
+// oidcLoginTimeout is how long a user has to complete the login at the identity
+// provider
+const oidcLoginTimeout = 10 * time.Minute
+
+// OIDCController signs users in through the identity provider with the OpenID
+// Connect authorization code flow, issuing each a session key
+type OIDCController struct {
+	ClusterService cluster.Service
+	Provider       *oidc.Provider
+	Mapping        *oidc.Mapping
+
+	// SessionLifetime is how long the session keys issued at sign in are valid
+	SessionLifetime time.Duration
+}
+
+// pendingLogin is the auth request sealed into the login cookie
+type pendingLogin struct {
+	Request *oidc.AuthRequest `json:"request"`
+	Expires time.Time         `json:"expires"`
+}
+
+func (t *OIDCController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/auth/oidc/login", t.httpLogin).Methods("GET")
+	router.HandleFunc("/v1/auth/oidc/callback", t.httpCallback).Methods("GET")
+}
+
+// httpLogin redirects the user to the identity provider. The state, nonce and
+// PKCE verifier are sealed with the master key into a cookie so any hub of the
+// cluster can complete the login.
+func (t *OIDCController) httpLogin(rw http.ResponseWriter, r *http.Request) {
+	req, err := oidc.NewAuthRequest()
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	authURL, err := t.Provider.AuthCodeURL(req)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	encoded, err := json.Marshal(&pendingLogin{
+		Request: req,
+		Expires: time.Now().Add(oidcLoginTimeout).UTC(),
+	})
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	sealed, err := secret.Seal(encoded)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	cookie, err := json.Marshal(sealed)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	setLoginCookie(rw, &http.Cookie{
+		Name:     oidcCookie,
+		Value:    base64.RawURLEncoding.EncodeToString(cookie),
+		Path:     "/v1/auth/oidc",
+		MaxAge:   int(oidcLoginTimeout / time.Second),
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	http.Redirect(rw, r, authURL, http.StatusFound)
+}
+
+// httpCallback completes the login. The response has the shape of the json
+// printed by the user key commands so it may be saved as a profile.
+func (t *OIDCController) httpCallback(rw http.ResponseWriter, r *http.Request) {
+	// the response carries the session key credentials
+	rw.Header().Set("Cache-Control", "no-store")
+	rw.Header().Set("Pragma", "no-cache")
+
+	login, ok := t.pendingLogin(r)
+
+	// the cookie is single use
+	setLoginCookie(rw, &http.Cookie{
+		Name:     oidcCookie,
+		Path:     "/v1/auth/oidc",
+		MaxAge:   -1,
+		Secure:   true,
+		HttpOnly: true,
+	})
+
+	if !ok {
+		t.reject(rw, r, "no login in progress, or it expired")
+		return
+	}
+
+	query := r.URL.Query()
+
+	if subtle.ConstantTimeCompare([]byte(query.Get("state")), []byte(login.Request.State)) != 1 {
+		t.reject(rw, r, "state mismatch")
+		return
+	}
+
+	if providerErr := query.Get("error"); providerErr != "" {
+		t.reject(rw, r, "identity provider refused the login: "+providerErr)
+		return
+	}
+
+	token, err := t.Provider.Exchange(query.Get("code"), login.Request)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	identity, err := t.Mapping.Identity(token)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	user, key, creds, err := t.ClusterService.SignIn(identity, t.SessionLifetime)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	requestLogger(r).WithFields(logrus.Fields{
+		"userId": user.ID,
+		"login":  user.Login,
+		"keyId":  key.ID,
+	}).Info("user signed in with oidc")
+
+	writeJSON(rw, http.StatusOK, map[string]interface{}{
+		"user":        newUserView(user),
+		"key":         newKeyView(key),
+		"credentials": creds,
+	})
+}
+
+// setLoginCookie sets the login cookie with SameSite=Lax, so it is sent on the
+// provider's top level redirect to the callback but not on cross site
+// subrequests
+func setLoginCookie(rw http.ResponseWriter, cookie *http.Cookie) {
+	rw.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Lax")
+}
+
+// pendingLogin opens the login cookie of the request
+func (t *OIDCController) pendingLogin(r *http.Request) (*pendingLogin, bool) {
+	cookie, err := r.Cookie(oidcCookie)
+
+	if err != nil {
+		return nil, false
+	}
+
+	decoded, err := base64.RawURLEncoding.DecodeString(cookie.Value)
+
+	if err != nil {
+		return nil, false
+	}
+
+	sealed := &secret.Envelope{}
+
+	if err = json.Unmarshal(decoded, sealed); err != nil {
+		return nil, false
+	}
+
+	plain, err := secret.Open(sealed)
+
+	if err != nil {
+		return nil, false
+	}
+
+	login := &pendingLogin{}
+
+	if err = json.Unmarshal(plain, login); err != nil || login.Request == nil || time.Now().After(login.Expires) {
+		return nil, false
+	}
+
+	return login, true
+}
+
+func (t *OIDCController) reject(rw http.ResponseWriter, r *http.Request, reason string) {
+	requestLogger(r).WithFields(logrus.Fields{
+		"remoteAddr": r.RemoteAddr,
+		"reason":     reason,
+	}).Error("oidc sign in rejected")
+
+	rw.WriteHeader(http.StatusForbidden)
+	rw.Write([]byte("sign in rejected: " + reason))
+}
+
+func (t *OIDCController) fail(rw http.ResponseWriter, r *http.Request, err error) {
+	if unavailable(rw, err) {
+		return
+	}
+
+	if rejected, ok := err.(*oidc.Rejected); ok {
+		t.reject(rw, r, rejected.Reason)
+		return
+	}
+
+	if failed, ok := err.(*cluster.AuthenticationFailed); ok {
+		t.reject(rw, r, failed.Reason)
+		return
+	}
+
+	requestLogger(r).WithField("error", err).Error("oidc sign in failed")
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write([]byte("sign in failed. review logs for further details"))
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/deviceio/hub/trace"
+)
+
+// responseRecorder wraps a http.ResponseWriter recording the status code and number
+// of body bytes written
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+
+	// requestID is set as the X-Request-ID response header when not empty,
+	// replacing any value copied from a proxied device response
+	requestID string
+}
+
+func (t *responseRecorder) WriteHeader(status int) {
+	if t.status == 0 {
+		t.status = status
+
+		if t.requestID != "" {
+			t.Header().Set(trace.RequestIDHeader, t.requestID)
+		}
+	}
+
+	t.ResponseWriter.WriteHeader(status)
+}
+
+func (t *responseRecorder) Write(b []byte) (int, error) {
+	if t.status == 0 {
+		t.WriteHeader(http.StatusOK)
+	}
+
+	n, err := t.ResponseWriter.Write(b)
+	t.bytes += int64(n)
+
+	return n, err
+}
+
+func (t *responseRecorder) Flush() {
+	if flusher, ok := t.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (t *responseRecorder) CloseNotify() <-chan bool {
+	if notifier, ok := t.ResponseWriter.(http.CloseNotifier); ok {
+		return notifier.CloseNotify()
+	}
+
+	return make(chan bool)
+}
+
+// countingReader wraps a request body counting the bytes read from it
+type countingReader struct {
+	io.ReadCloser
+	bytes int64
+}
+
+func (t *countingReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	t.bytes += int64(n)
+
+	return n, err
+}
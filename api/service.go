@@ -2,6 +2,7 @@ package api
 
 import (
 	"bytes"
+	"crypto/tls"
 	"io"
 	"io/ioutil"
 	"net/http"
@@ -9,6 +10,7 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/health"
 	"github.com/deviceio/hub/www"
 	"github.com/deviceio/shared/types"
 	"github.com/gorilla/mux"
@@ -19,6 +21,8 @@ type Service struct {
 	TLSCertPath string
 	TLSKeyPath  string
 	Controllers []Controller
+
+	listener health.Listener
 }
 
 func (t *Service) Start() {
@@ -34,7 +38,7 @@ func (t *Service) Start() {
 	//server.Handle("/", http.FileServer(www.EmbedFS))
 	//server.Handle("/", t.auth(router))
 
-	logrus.WithFields(logrus.Fields{
+	logger.WithFields(logrus.Fields{
 		"bindAddr":    t.BindAddr,
 		"tlsCertPath": t.TLSCertPath,
 		"tlsKeyPath":  t.TLSKeyPath,
@@ -46,23 +50,42 @@ func (t *Service) Start() {
 	if t.TLSCertPath == "" && t.TLSKeyPath == "" {
 		certpath, keypath = t.makeTempCertificates()
 
-		logrus.WithField("cert", certpath).Info("api temporary certificate")
-		logrus.WithField("key", keypath).Info("api temporary key")
+		logger.WithField("cert", certpath).Info("api temporary certificate")
+		logger.WithField("key", keypath).Info("api temporary key")
 
 		defer os.Remove(certpath)
 		defer os.Remove(keypath)
 	}
 
-	if err := http.ListenAndServeTLS(
-		t.BindAddr,
-		certpath,
-		keypath,
-		router,
-	); err != nil {
-		logrus.Fatal(err.Error())
+	cer, err := tls.LoadX509KeyPair(certpath, keypath)
+
+	if err != nil {
+		t.listener.Failed(t.BindAddr, err)
+		logger.Fatal(err.Error())
+	}
+
+	ln, err := tls.Listen("tcp", t.BindAddr, &tls.Config{
+		Certificates: []tls.Certificate{cer},
+	})
+
+	if err != nil {
+		t.listener.Failed(t.BindAddr, err)
+		logger.Fatal(err.Error())
+	}
+
+	t.listener.Bound(t.BindAddr, cer)
+
+	if err := http.Serve(ln, correlate(router, instrument(router))); err != nil {
+		t.listener.Failed(t.BindAddr, err)
+		logger.Fatal(err.Error())
 	}
 }
 
+// Health reports the api listener and the expiry of its certificate
+func (t *Service) Health() *health.Component {
+	return t.listener.Component("api")
+}
+
 func (t *Service) makeTempCertificates() (string, string) {
 	certgen := &types.CertGen{
 		Host:      "localhost",
@@ -81,12 +104,12 @@ func (t *Service) makeTempCertificates() (string, string) {
 	certBytes, keyBytes = certgen.Generate()
 
 	if certTemp, err = ioutil.TempFile("", "deviceio-hub"); err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	defer certTemp.Close()
 
 	if keyTemp, err = ioutil.TempFile("", "deviceio-hub"); err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	defer keyTemp.Close()
 
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/gorilla/mux"
+)
+
+// ServiceAccountController lets admins manage service accounts and their tokens
+type ServiceAccountController struct {
+	ClusterService cluster.Service
+}
+
+// serviceAccountView is a service account as returned by the api
+type serviceAccountView struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Created     time.Time    `json:"created"`
+	Disabled    bool         `json:"disabled"`
+	Tokens      []*tokenView `json:"tokens"`
+}
+
+func newServiceAccountView(account *cluster.ServiceAccount) *serviceAccountView {
+	view := &serviceAccountView{
+		ID:          account.ID,
+		Name:        account.Name,
+		Description: account.Description,
+		Created:     account.Created,
+		Disabled:    account.Disabled,
+		Tokens:      []*tokenView{},
+	}
+
+	for _, token := range account.Tokens {
+		view.Tokens = append(view.Tokens, newTokenView(token))
+	}
+
+	return view
+}
+
+// tokenView is a service account token as returned by the api. Its hash is never
+// included.
+type tokenView struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Devices  []string   `json:"devices"`
+	Paths    []string   `json:"paths,omitempty"`
+	Methods  []string   `json:"methods,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Revoked  bool       `json:"revoked"`
+}
+
+func newTokenView(token *cluster.Token) *tokenView {
+	view := &tokenView{
+		ID:      token.ID,
+		Label:   token.Label,
+		Created: token.Created,
+		Expires: token.Expires,
+		Revoked: token.Revoked,
+	}
+
+	if token.Scope != nil {
+		view.Devices = token.Scope.Devices
+		view.Paths = token.Scope.Paths
+		view.Methods = token.Scope.Methods
+	}
+
+	if !token.LastUsed.IsZero() {
+		view.LastUsed = &token.LastUsed
+	}
+
+	return view
+}
+
+// serviceAccountRequest is the body of service account create requests
+type serviceAccountRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// tokenRequest is the body of token add requests. expiresIn is in
+// time.ParseDuration format such as 720h.
+type tokenRequest struct {
+	Label     string   `json:"label"`
+	Devices   []string `json:"devices"`
+	Paths     []string `json:"paths"`
+	Methods   []string `json:"methods"`
+	ExpiresIn string   `json:"expiresIn"`
+}
+
+func (t *ServiceAccountController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/service-accounts", t.httpListServiceAccounts).Methods("GET")
+	router.HandleFunc("/v1/service-accounts", t.httpCreateServiceAccount).Methods("POST")
+	router.HandleFunc("/v1/service-accounts/{account}", t.httpGetServiceAccount).Methods("GET")
+	router.HandleFunc("/v1/service-accounts/{account}", t.httpDeleteServiceAccount).Methods("DELETE")
+	router.HandleFunc("/v1/service-accounts/{account}/disable", t.httpDisableServiceAccount).Methods("POST")
+	router.HandleFunc("/v1/service-accounts/{account}/enable", t.httpEnableServiceAccount).Methods("POST")
+	router.HandleFunc("/v1/service-accounts/{account}/tokens", t.httpAddToken).Methods("POST")
+	router.HandleFunc("/v1/service-accounts/{account}/tokens/{token}", t.httpRevokeToken).Methods("DELETE")
+}
+
+func (t *ServiceAccountController) httpListServiceAccounts(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	accounts, err := t.ClusterService.ServiceAccounts()
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	views := []*serviceAccountView{}
+
+	for _, account := range accounts {
+		views = append(views, newServiceAccountView(account))
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+func (t *ServiceAccountController) httpCreateServiceAccount(rw http.ResponseWriter, r *http.Request) {
+	actor := authenticateAdmin(t.ClusterService, rw, r)
+
+	if actor == nil {
+		return
+	}
+
+	body := &serviceAccountRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		badRequest(rw, "request body must be a json service account request")
+		return
+	}
+
+	account, err := t.ClusterService.AddServiceAccount(actor, body.Name, body.Description)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, newServiceAccountView(account))
+}
+
+func (t *ServiceAccountController) httpGetServiceAccount(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	account, err := t.ClusterService.ServiceAccount(mux.Vars(r)["account"])
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, newServiceAccountView(account))
+}
+
+func (t *ServiceAccountController) httpDeleteServiceAccount(rw http.ResponseWriter, r *http.Request) {
+	actor := authenticateAdmin(t.ClusterService, rw, r)
+
+	if actor == nil {
+		return
+	}
+
+	if err := t.ClusterService.DeleteServiceAccount(actor, mux.Vars(r)["account"]); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (t *ServiceAccountController) httpDisableServiceAccount(rw http.ResponseWriter, r *http.Request) {
+	t.setDisabled(rw, r, true)
+}
+
+func (t *ServiceAccountController) httpEnableServiceAccount(rw http.ResponseWriter, r *http.Request) {
+	t.setDisabled(rw, r, false)
+}
+
+func (t *ServiceAccountController) setDisabled(rw http.ResponseWriter, r *http.Request, disabled bool) {
+	actor := authenticateAdmin(t.ClusterService, rw, r)
+
+	if actor == nil {
+		return
+	}
+
+	if err := t.ClusterService.SetServiceAccountDisabled(actor, mux.Vars(r)["account"], disabled); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// httpAddToken issues a token. The response has the shape of the json printed by
+// service-account token add so it may be saved as a profile.
+func (t *ServiceAccountController) httpAddToken(rw http.ResponseWriter, r *http.Request) {
+	actor := authenticateAdmin(t.ClusterService, rw, r)
+
+	if actor == nil {
+		return
+	}
+
+	body := &tokenRequest{}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		badRequest(rw, "request body must be a json token request")
+		return
+	}
+
+	ttl, err := parseDuration(body.ExpiresIn)
+
+	if err != nil || ttl <= 0 {
+		badRequest(rw, "expiresIn must be a duration such as 720h")
+		return
+	}
+
+	scope := &cluster.TokenScope{
+		Devices: body.Devices,
+		Paths:   body.Paths,
+		Methods: body.Methods,
+	}
+
+	token, value, err := t.ClusterService.AddServiceAccountToken(actor, mux.Vars(r)["account"], body.Label, scope, ttl)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	account, err := t.ClusterService.ServiceAccount(mux.Vars(r)["account"])
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, map[string]interface{}{
+		"serviceAccount": newServiceAccountView(account),
+		"issued":         newTokenView(token),
+		"token":          value,
+	})
+}
+
+func (t *ServiceAccountController) httpRevokeToken(rw http.ResponseWriter, r *http.Request) {
+	actor := authenticateAdmin(t.ClusterService, rw, r)
+
+	if actor == nil {
+		return
+	}
+
+	vars := mux.Vars(r)
+
+	if err := t.ClusterService.RevokeServiceAccountToken(actor, vars["account"], vars["token"]); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (t *ServiceAccountController) fail(rw http.ResponseWriter, r *http.Request, err error) {
+	if unavailable(rw, err) {
+		return
+	}
+
+	if notfound, ok := err.(*cluster.NotFound); ok {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(notfound.Error()))
+		return
+	}
+
+	if invalid, ok := err.(*cluster.Invalid); ok {
+		badRequest(rw, invalid.Error())
+		return
+	}
+
+	requestLogger(r).WithField("error", err).Error("service account request failed")
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write([]byte("service account request failed. review logs for further details"))
+}
@@ -3,16 +3,40 @@ package api
 import (
 	"net/http"
 
+	"github.com/deviceio/hub/health"
 	"github.com/gorilla/mux"
 )
 
 type StatusController struct {
+	// Reporters are the components checked for readiness
+	Reporters []health.Reporter
 }
 
 func (t *StatusController) RegisterRoutes(router *mux.Router) {
 	router.HandleFunc("/v1/status", t.getV1Status).Methods("GET")
+	router.HandleFunc("/v1/health/live", t.getV1Live).Methods("GET")
+	router.HandleFunc("/v1/health/ready", t.getV1Ready).Methods("GET")
 }
 
+// getV1Status is retained for existing monitors and reports liveness only
 func (t *StatusController) getV1Status(rw http.ResponseWriter, r *http.Request) {
 	rw.Write([]byte("OK"))
 }
+
+// getV1Live reports the process is running and serving the api
+func (t *StatusController) getV1Live(rw http.ResponseWriter, r *http.Request) {
+	rw.Write([]byte("OK"))
+}
+
+// getV1Ready reports the health of every component, responding 503 when the hub
+// should not receive traffic
+func (t *StatusController) getV1Ready(rw http.ResponseWriter, r *http.Request) {
+	report := health.Check(t.Reporters)
+
+	if !report.Ready {
+		writeJSON(rw, http.StatusServiceUnavailable, report)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, report)
+}
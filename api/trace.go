@@ -0,0 +1,43 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/trace"
+	"github.com/gorilla/mux"
+)
+
+// correlate assigns every request a request id, accepting the caller's
+// X-Request-ID when valid, and records a server span continuing any W3C
+// traceparent supplied by the caller. The request id is returned in the response
+// and forwarded to devices with proxied requests.
+func correlate(router *mux.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		r, requestID := trace.EnsureRequestID(r)
+		r, span := trace.StartServerSpan(r, r.Method+" "+routeTemplate(router, r))
+
+		trace.Inject(r)
+		rw.Header().Set(trace.RequestIDHeader, requestID)
+
+		recorder := &responseRecorder{
+			ResponseWriter: rw,
+			requestID:      requestID,
+		}
+
+		next.ServeHTTP(recorder, r)
+
+		if recorder.status == 0 {
+			recorder.WriteHeader(http.StatusOK)
+		}
+
+		span.SetAttribute("http.status_code", strconv.Itoa(recorder.status))
+		span.Finish()
+	})
+}
+
+// requestLogger returns a log entry carrying the request id of r
+func requestLogger(r *http.Request) *logrus.Entry {
+	return logger.WithField("requestId", trace.RequestID(r.Context()))
+}
@@ -1,13 +1,569 @@
 package api
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+
+	"github.com/deviceio/hub/cluster"
 	"github.com/deviceio/hub/user"
 	"github.com/gorilla/mux"
 )
 
 type UserController struct {
-	UserService *user.Service
+	UserService    *user.Service
+	ClusterService cluster.Service
+}
+
+// userView is a user as returned by the api. Credential material is never included.
+type userView struct {
+	ID        string `json:"id"`
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	Admin     bool   `json:"admin"`
+	Disabled  bool   `json:"disabled"`
+	PublicKey string `json:"publicKey"`
+}
+
+func newUserView(user *cluster.User) *userView {
+	return &userView{
+		ID:        user.ID,
+		Login:     user.Login,
+		Email:     user.Email,
+		Admin:     user.Admin,
+		Disabled:  user.Disabled,
+		PublicKey: base64.StdEncoding.EncodeToString(user.ED25519PublicKey),
+	}
+}
+
+// keyView is a named key as returned by the api. Its totp secret is never included.
+type keyView struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label"`
+	PublicKey string     `json:"publicKey"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Revoked   bool       `json:"revoked"`
+
+	// SSHPublicKey and Fingerprint are set for ssh keys
+	SSHPublicKey string `json:"sshPublicKey,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+}
+
+func newKeyView(key *cluster.Key) *keyView {
+	view := &keyView{
+		ID:        key.ID,
+		Label:     key.Label,
+		PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey),
+		Created:   key.Created,
+		Revoked:   key.Revoked,
+	}
+
+	view.SSHPublicKey, view.Fingerprint = key.SSHAuthorizedKey()
+
+	if !key.Expires.IsZero() {
+		view.Expires = &key.Expires
+	}
+
+	if !key.LastUsed.IsZero() {
+		view.LastUsed = &key.LastUsed
+	}
+
+	return view
+}
+
+// keyRequest is the body of key add and rotate requests. Durations are in
+// time.ParseDuration format such as 720h.
+type keyRequest struct {
+	Label     string `json:"label"`
+	ExpiresIn string `json:"expiresIn"`
+	Grace     string `json:"grace"`
+
+	// PublicKey is the OpenSSH public key, in authorized_keys format, of ssh
+	// key add requests
+	PublicKey string `json:"publicKey"`
 }
 
 func (t *UserController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/users", t.httpListUsers).Methods("GET")
+	router.HandleFunc("/v1/users/me", t.httpGetCurrentUser).Methods("GET")
+	router.HandleFunc("/v1/users/{user}", t.httpGetUser).Methods("GET")
+	router.HandleFunc("/v1/users/{user}/keys", t.httpListKeys).Methods("GET")
+	router.HandleFunc("/v1/users/{user}/keys", t.httpAddKey).Methods("POST")
+	router.HandleFunc("/v1/users/{user}/ssh-keys", t.httpAddSSHKey).Methods("POST")
+	router.HandleFunc("/v1/users/{user}/keys/{key}/rotate", t.httpRotateKey).Methods("POST")
+	router.HandleFunc("/v1/users/{user}/keys/{key}", t.httpRevokeKey).Methods("DELETE")
+	router.HandleFunc("/v1/users/{user}/hmac-keys", t.httpListHmacKeys).Methods("GET")
+	router.HandleFunc("/v1/users/{user}/hmac-keys", t.httpAddHmacKey).Methods("POST")
+	router.HandleFunc("/v1/users/{user}/hmac-keys/{key}", t.httpDeleteHmacKey).Methods("DELETE")
+}
+
+func (t *UserController) httpListUsers(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	users, err := t.ClusterService.Users()
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	views := []*userView{}
+
+	for _, user := range users {
+		views = append(views, newUserView(user))
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+// httpGetCurrentUser returns the user that signed the request
+func (t *UserController) httpGetCurrentUser(rw http.ResponseWriter, r *http.Request) {
+	user, err := t.ClusterService.AuthenticateAPIUser(r)
+
+	if err != nil {
+		rejectRequest(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, newUserView(user))
+}
+
+// httpGetUser returns the user with the id, login or email
+func (t *UserController) httpGetUser(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	user, err := t.ClusterService.User(mux.Vars(r)["user"])
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, newUserView(user))
+}
+
+func (t *UserController) httpListKeys(rw http.ResponseWriter, r *http.Request) {
+	_, target := t.authenticateKeyRequest(rw, r)
+
+	if target == "" {
+		return
+	}
+
+	keys, err := t.ClusterService.UserKeys(target)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	views := []*keyView{}
+
+	for _, key := range keys {
+		views = append(views, newKeyView(key))
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+func (t *UserController) httpAddKey(rw http.ResponseWriter, r *http.Request) {
+	actor, target := t.authenticateKeyRequest(rw, r)
+
+	if target == "" {
+		return
+	}
+
+	body, ok := readKeyRequest(rw, r)
+
+	if !ok {
+		return
+	}
+
+	ttl, err := parseDuration(body.ExpiresIn)
+
+	if err != nil {
+		badRequest(rw, "expiresIn must be a duration such as 720h")
+		return
+	}
+
+	if body.Label == "" {
+		badRequest(rw, "label is required")
+		return
+	}
+
+	key, creds, err := t.ClusterService.AddUserKey(actor, target, body.Label, ttl)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	t.writeKey(rw, r, key, creds)
+}
+
+// httpAddSSHKey registers an ssh key of the user. It is listed and revoked with
+// the user's other keys.
+func (t *UserController) httpAddSSHKey(rw http.ResponseWriter, r *http.Request) {
+	actor, target := t.authenticateKeyRequest(rw, r)
+
+	if target == "" {
+		return
+	}
+
+	body, ok := readKeyRequest(rw, r)
+
+	if !ok {
+		return
+	}
+
+	ttl, err := parseDuration(body.ExpiresIn)
+
+	if err != nil {
+		badRequest(rw, "expiresIn must be a duration such as 720h")
+		return
+	}
+
+	if body.Label == "" {
+		badRequest(rw, "label is required")
+		return
+	}
+
+	if body.PublicKey == "" {
+		badRequest(rw, "publicKey is required")
+		return
+	}
+
+	key, err := t.ClusterService.AddUserSSHKey(actor, target, body.Label, body.PublicKey, ttl)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	user, err := t.ClusterService.User(target)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, map[string]interface{}{
+		"user": newUserView(user),
+		"key":  newKeyView(key),
+	})
+}
+
+func (t *UserController) httpRotateKey(rw http.ResponseWriter, r *http.Request) {
+	actor, target := t.authenticateKeyRequest(rw, r)
+
+	if target == "" {
+		return
+	}
+
+	body, ok := readKeyRequest(rw, r)
+
+	if !ok {
+		return
+	}
+
+	grace, err := parseDuration(body.Grace)
+
+	if err != nil {
+		badRequest(rw, "grace must be a duration such as 1h")
+		return
+	}
+
+	key, creds, err := t.ClusterService.RotateUserKey(actor, target, mux.Vars(r)["key"], grace)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	t.writeKey(rw, r, key, creds)
+}
+
+func (t *UserController) httpRevokeKey(rw http.ResponseWriter, r *http.Request) {
+	actor, target := t.authenticateKeyRequest(rw, r)
+
+	if target == "" {
+		return
+	}
+
+	if err := t.ClusterService.RevokeUserKey(actor, target, mux.Vars(r)["key"]); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateKeyRequest authenticates a request managing the keys of the user
+// in the path. Users manage their own keys, which "me" refers to, and admins
+// those of every user. If the request is rejected the response has been written
+// and the target is empty.
+func (t *UserController) authenticateKeyRequest(rw http.ResponseWriter, r *http.Request) (*cluster.User, string) {
+	actor, err := t.ClusterService.AuthenticateAPIUser(r)
+
+	if err != nil {
+		rejectRequest(rw, r, err)
+		return nil, ""
+	}
+
+	if refuseHmacActor(rw, r, actor) {
+		return nil, ""
+	}
+
+	target := mux.Vars(r)["user"]
+
+	if target == "me" || target == actor.ID {
+		return actor, actor.ID
+	}
+
+	if !actor.Admin {
+		rw.WriteHeader(http.StatusForbidden)
+		rw.Write([]byte(""))
+
+		requestLogger(r).WithFields(logrus.Fields{
+			"remoteAddr": r.RemoteAddr,
+			"user":       actor.ID,
+		}).Error("admin access denied")
+
+		return nil, ""
+	}
+
+	return actor, target
+}
+
+// refuseHmacActor refuses key management to requests signed with an hmac
+// credential, which is bound to the addresses it is permitted from and would
+// otherwise issue keys usable from anywhere. It reports if the response has
+// been written.
+func refuseHmacActor(rw http.ResponseWriter, r *http.Request, actor *cluster.User) bool {
+	if actor.Scheme != user.AuthScheme {
+		return false
+	}
+
+	rw.WriteHeader(http.StatusForbidden)
+	rw.Write([]byte("keys cannot be managed with an hmac credential"))
+
+	requestLogger(r).WithFields(logrus.Fields{
+		"remoteAddr": r.RemoteAddr,
+		"user":       actor.ID,
+	}).Error("key management with hmac credential refused")
+
+	return true
+}
+
+// writeKey writes a newly issued key and its credentials. The response has the
+// shape of the json printed by the user key commands so it may be saved as a
+// profile.
+func (t *UserController) writeKey(rw http.ResponseWriter, r *http.Request, key *cluster.Key, creds *cluster.KeyCredentials) {
+	user, err := t.ClusterService.User(creds.UserID)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, map[string]interface{}{
+		"user":        newUserView(user),
+		"key":         newKeyView(key),
+		"credentials": creds,
+	})
+}
+
+func readKeyRequest(rw http.ResponseWriter, r *http.Request) (*keyRequest, bool) {
+	body := &keyRequest{}
+
+	if r.ContentLength == 0 {
+		return body, true
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+		badRequest(rw, "request body must be a json key request")
+		return nil, false
+	}
+
+	return body, true
+}
+
+// parseDuration parses an optional duration, zero if empty
+func parseDuration(value string) (time.Duration, error) {
+	if value == "" {
+		return 0, nil
+	}
+
+	return time.ParseDuration(value)
+}
+
+// hmacKeyView is an hmac credential as returned by the api. Its secret is never
+// included.
+type hmacKeyView struct {
+	ID         string    `json:"id"`
+	Login      string    `json:"login"`
+	HmacKey    string    `json:"hmacKey"`
+	PermitAddr []string  `json:"permitAddr"`
+	Created    time.Time `json:"created"`
+}
+
+func newHmacKeyView(entity *user.Entity) *hmacKeyView {
+	view := &hmacKeyView{
+		ID:         entity.ID,
+		Login:      entity.Username,
+		HmacKey:    entity.HmacKey,
+		PermitAddr: entity.PermitAddr,
+		Created:    entity.Created,
+	}
+
+	if view.PermitAddr == nil {
+		view.PermitAddr = []string{}
+	}
+
+	return view
+}
+
+// hmacKeyRequest is the body of hmac key add requests
+type hmacKeyRequest struct {
+	PermitAddr []string `json:"permitAddr"`
+}
+
+func (t *UserController) httpListHmacKeys(rw http.ResponseWriter, r *http.Request) {
+	_, owner := t.authenticateHmacKeyRequest(rw, r)
+
+	if owner == nil {
+		return
+	}
+
+	entities, err := t.UserService.List(owner.Login)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	views := []*hmacKeyView{}
+
+	for _, entity := range entities {
+		views = append(views, newHmacKeyView(entity))
+	}
+
+	writeJSON(rw, http.StatusOK, views)
+}
+
+// httpAddHmacKey issues an hmac credential. The secret is returned only in this
+// response.
+func (t *UserController) httpAddHmacKey(rw http.ResponseWriter, r *http.Request) {
+	actor, owner := t.authenticateHmacKeyRequest(rw, r)
+
+	if owner == nil {
+		return
+	}
+
+	body := &hmacKeyRequest{}
+
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(body); err != nil {
+			badRequest(rw, "request body must be a json hmac key request")
+			return
+		}
+	}
+
+	entity, hmacSecret, err := t.UserService.Add(actor, owner.Login, body.PermitAddr)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, map[string]interface{}{
+		"hmacKey":    newHmacKeyView(entity),
+		"hmacSecret": hmacSecret,
+	})
+}
+
+func (t *UserController) httpDeleteHmacKey(rw http.ResponseWriter, r *http.Request) {
+	actor, owner := t.authenticateHmacKeyRequest(rw, r)
+
+	if owner == nil {
+		return
+	}
+
+	if err := t.UserService.Delete(actor, owner.Login, mux.Vars(r)["key"]); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+// authenticateHmacKeyRequest authenticates an admin request managing the hmac
+// keys of the user in the path. If the request is rejected the response has been
+// written and the owner is nil.
+func (t *UserController) authenticateHmacKeyRequest(rw http.ResponseWriter, r *http.Request) (*user.Actor, *cluster.User) {
+	admin := authenticateAdmin(t.ClusterService, rw, r)
+
+	if admin == nil || refuseHmacActor(rw, r, admin) {
+		return nil, nil
+	}
+
+	if t.UserService == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("hmac authentication is not enabled"))
+		return nil, nil
+	}
+
+	owner, err := t.ClusterService.User(mux.Vars(r)["user"])
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return nil, nil
+	}
+
+	return &user.Actor{ID: admin.ID, Login: admin.Login}, owner
+}
+
+func badRequest(rw http.ResponseWriter, message string) {
+	rw.WriteHeader(http.StatusBadRequest)
+	rw.Write([]byte(message))
+}
+
+func (t *UserController) fail(rw http.ResponseWriter, r *http.Request, err error) {
+	if unavailable(rw, err) {
+		return
+	}
+
+	if notfound, ok := err.(*cluster.NotFound); ok {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(notfound.Error()))
+		return
+	}
+
+	if invalid, ok := err.(*cluster.Invalid); ok {
+		badRequest(rw, invalid.Error())
+		return
+	}
+
+	if notfound, ok := err.(*user.NotFound); ok {
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte(notfound.Error()))
+		return
+	}
+
+	if invalid, ok := err.(*user.Invalid); ok {
+		badRequest(rw, invalid.Error())
+		return
+	}
+
+	requestLogger(r).WithField("error", err).Error("user request failed")
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write([]byte("user request failed. review logs for further details"))
 }
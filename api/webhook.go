@@ -0,0 +1,179 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/webhook"
+	"github.com/gorilla/mux"
+)
+
+type WebhookController struct {
+	ClusterService cluster.Service
+	WebhookService *webhook.Service
+}
+
+func (t *WebhookController) RegisterRoutes(router *mux.Router) {
+	router.HandleFunc("/v1/webhooks", t.httpListWebhooks).Methods("GET")
+	router.HandleFunc("/v1/webhooks", t.httpCreateWebhook).Methods("POST")
+	router.HandleFunc("/v1/webhooks/{id}", t.httpGetWebhook).Methods("GET")
+	router.HandleFunc("/v1/webhooks/{id}", t.httpUpdateWebhook).Methods("PUT")
+	router.HandleFunc("/v1/webhooks/{id}", t.httpDeleteWebhook).Methods("DELETE")
+	router.HandleFunc("/v1/webhooks/{id}/deliveries", t.httpGetWebhookDeliveries).Methods("GET")
+	router.HandleFunc("/v1/webhooks/{id}/dead-letters", t.httpGetWebhookDeadLetters).Methods("GET")
+}
+
+func (t *WebhookController) httpListWebhooks(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	subs, err := t.WebhookService.List()
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, subs)
+}
+
+func (t *WebhookController) httpCreateWebhook(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	sub := &webhook.Subscription{}
+
+	if err := json.NewDecoder(r.Body).Decode(sub); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("request body must be a json webhook subscription"))
+		return
+	}
+
+	sub, err := t.WebhookService.Create(sub)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusCreated, sub)
+}
+
+func (t *WebhookController) httpGetWebhook(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	sub, err := t.WebhookService.Get(mux.Vars(r)["id"])
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	if sub == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, sub)
+}
+
+func (t *WebhookController) httpUpdateWebhook(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	sub := &webhook.Subscription{}
+
+	if err := json.NewDecoder(r.Body).Decode(sub); err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte("request body must be a json webhook subscription"))
+		return
+	}
+
+	sub, err := t.WebhookService.Update(mux.Vars(r)["id"], sub)
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	if sub == nil {
+		rw.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, sub)
+}
+
+func (t *WebhookController) httpDeleteWebhook(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	if err := t.WebhookService.Delete(mux.Vars(r)["id"]); err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	rw.WriteHeader(http.StatusNoContent)
+}
+
+func (t *WebhookController) httpGetWebhookDeliveries(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	deliveries, err := t.WebhookService.Deliveries(mux.Vars(r)["id"], queryLimit(r, 100))
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, deliveries)
+}
+
+func (t *WebhookController) httpGetWebhookDeadLetters(rw http.ResponseWriter, r *http.Request) {
+	if authenticateAdmin(t.ClusterService, rw, r) == nil {
+		return
+	}
+
+	letters, err := t.WebhookService.DeadLetters(mux.Vars(r)["id"], queryLimit(r, 100))
+
+	if err != nil {
+		t.fail(rw, r, err)
+		return
+	}
+
+	writeJSON(rw, http.StatusOK, letters)
+}
+
+func (t *WebhookController) fail(rw http.ResponseWriter, r *http.Request, err error) {
+	if invalid, ok := err.(*webhook.ErrInvalidSubscription); ok {
+		rw.WriteHeader(http.StatusBadRequest)
+		rw.Write([]byte(invalid.Message))
+		return
+	}
+
+	requestLogger(r).WithField("error", err).Error("webhook request failed")
+	rw.WriteHeader(http.StatusInternalServerError)
+	rw.Write([]byte("webhook request failed. review logs for further details"))
+}
+
+// queryLimit parses the limit query parameter falling back to def when absent or
+// out of range
+func queryLimit(r *http.Request, def int) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+
+	if err != nil || limit <= 0 || limit > 1000 {
+		return def
+	}
+
+	return limit
+}
@@ -0,0 +1,109 @@
+package audit
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Head is the latest record of a chain
+type Head struct {
+	Chain string `gorethink:"id"`
+	Seq   int64  `gorethink:"seq"`
+	Hash  string `gorethink:"hash"`
+}
+
+// Checkpoint is a signed attestation of a chain head. A verifier holding the hub's
+// public key can detect rewritten chains and records deleted from before the
+// checkpoint.
+type Checkpoint struct {
+	ID        string    `gorethink:"id,omitempty" json:"id"`
+	Chain     string    `gorethink:"chain" json:"chain"`
+	Seq       int64     `gorethink:"seq" json:"seq"`
+	Hash      string    `gorethink:"hash" json:"hash"`
+	Time      time.Time `gorethink:"time" json:"time"`
+	KeyID     string    `gorethink:"key_id" json:"keyId"`
+	Signature string    `gorethink:"signature" json:"signature"`
+}
+
+// ComputeHash returns the hex SHA-256 digest over the record's content and PrevHash.
+// Every field except Hash contributes.
+func (t *Record) ComputeHash() string {
+	h := sha256.New()
+
+	writeField(h, t.Chain)
+	writeField(h, strconv.FormatInt(t.Seq, 10))
+	writeField(h, t.PrevHash)
+	writeField(h, t.Time.UTC().Format(time.RFC3339Nano))
+	writeField(h, t.Kind)
+	writeField(h, t.Member)
+	writeField(h, t.UserID)
+	writeField(h, t.UserLogin)
+	writeField(h, t.SourceIP)
+	writeField(h, t.DeviceID)
+	writeField(h, t.Hostname)
+	writeField(h, t.Method)
+	writeField(h, t.Path)
+	writeField(h, t.Query)
+	writeField(h, strconv.FormatInt(t.RequestBytes, 10))
+	writeField(h, strconv.FormatInt(t.ResponseBytes, 10))
+	writeField(h, strconv.Itoa(t.StatusCode))
+	writeField(h, strconv.FormatFloat(t.DurationMS, 'g', -1, 64))
+	writeField(h, t.Target)
+
+	// encoding/json sorts map keys giving a stable encoding
+	detail, _ := json.Marshal(t.Detail)
+	writeField(h, string(detail))
+
+	writeField(h, t.RequestID)
+	writeField(h, t.TraceID)
+	writeField(h, t.ID)
+
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeField writes a length prefixed field so adjacent fields cannot be shifted
+// into one another without changing the digest
+func writeField(h hash.Hash, value string) {
+	length := make([]byte, 8)
+	binary.BigEndian.PutUint64(length, uint64(len(value)))
+
+	h.Write(length)
+	h.Write([]byte(value))
+}
+
+// message returns the bytes signed by a checkpoint
+func (t *Checkpoint) message() []byte {
+	return []byte(fmt.Sprintf(
+		"%v\n%v\n%v\n%v",
+		t.Chain,
+		t.Seq,
+		t.Hash,
+		t.Time.UTC().Format(time.RFC3339Nano),
+	))
+}
+
+// Sign signs the checkpoint with the supplied key
+func (t *Checkpoint) Sign(key ed25519.PrivateKey) {
+	t.KeyID = KeyID(key.Public().(ed25519.PublicKey))
+	t.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, t.message()))
+}
+
+// Verify reports if the checkpoint signature is valid for the supplied public key
+func (t *Checkpoint) Verify(pub ed25519.PublicKey) bool {
+	sig, err := base64.StdEncoding.DecodeString(t.Signature)
+
+	if err != nil {
+		return false
+	}
+
+	return ed25519.Verify(pub, t.message(), sig)
+}
@@ -0,0 +1,202 @@
+package audit
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/embedded"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+)
+
+// EmbeddedStore is the Store of single node hubs using the embedded database
+type EmbeddedStore struct {
+	DB *embedded.DB
+}
+
+// headMoved is returned within an embedded head update that loses a race
+type headMoved struct {
+}
+
+func (t *headMoved) Error() string {
+	return errHeadMoved
+}
+
+func (t *EmbeddedStore) Insert(record *Record) error {
+	if record.ID == "" {
+		record.ID = uuid.New().String()
+	}
+
+	if err := t.DB.Insert(string(db.AuditTable), record.ID, record); err != nil {
+		return stacktrace.Propagate(err, "failed to insert audit record")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedStore) Delete(id string) error {
+	if _, err := t.DB.Delete(string(db.AuditTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete audit record")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedStore) Query(q *Query) ([]*Record, error) {
+	records := []*Record{}
+	user := q.User
+	device := strings.ToLower(q.Device)
+
+	err := t.DB.Scan(string(db.AuditTable), true, func(id string, doc []byte) (bool, error) {
+		rec := &Record{}
+
+		if err := json.Unmarshal(doc, rec); err != nil {
+			return false, err
+		}
+
+		switch {
+		case !q.From.IsZero() && rec.Time.Before(q.From):
+			return true, nil
+		case !q.To.IsZero() && !rec.Time.Before(q.To):
+			return true, nil
+		case user != "" && rec.UserID != user && rec.UserLogin != user:
+			return true, nil
+		case device != "" && rec.DeviceID != device && rec.Hostname != device:
+			return true, nil
+		case q.Kind != "" && rec.Kind != q.Kind:
+			return true, nil
+		}
+
+		records = append(records, rec)
+
+		return q.Limit <= 0 || len(records) < q.Limit, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit records")
+	}
+
+	return records, nil
+}
+
+func (t *EmbeddedStore) ChainRecords(chain string, fn func(rec *Record) error) error {
+	return t.DB.Scan(string(db.AuditTable), false, func(id string, doc []byte) (bool, error) {
+		rec := &Record{}
+
+		if err := json.Unmarshal(doc, rec); err != nil {
+			return false, stacktrace.Propagate(err, "failed to read audit chain")
+		}
+
+		if rec.Chain != chain {
+			return true, nil
+		}
+
+		return true, fn(rec)
+	})
+}
+
+func (t *EmbeddedStore) Head(chain string) (*Head, error) {
+	head := &Head{}
+
+	found, err := t.DB.Get(string(db.AuditChainTable), chain, head)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit chain head")
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return head, nil
+}
+
+func (t *EmbeddedStore) Heads() ([]*Head, error) {
+	heads := []*Head{}
+
+	err := t.DB.Scan(string(db.AuditChainTable), false, func(id string, doc []byte) (bool, error) {
+		head := &Head{}
+
+		if err := json.Unmarshal(doc, head); err != nil {
+			return false, err
+		}
+
+		heads = append(heads, head)
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit chain heads")
+	}
+
+	return heads, nil
+}
+
+func (t *EmbeddedStore) AdvanceHead(prev *Head, next *Head) (bool, error) {
+	err := t.DB.Update(string(db.AuditChainTable), next.Chain, func(current []byte) (interface{}, error) {
+		head := &Head{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, head); err != nil {
+				return nil, err
+			}
+		}
+
+		if head.Seq != prev.Seq || head.Hash != prev.Hash {
+			return nil, &headMoved{}
+		}
+
+		return next, nil
+	})
+
+	if _, ok := err.(*headMoved); ok {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to advance audit chain head")
+	}
+
+	return true, nil
+}
+
+func (t *EmbeddedStore) InsertCheckpoint(checkpoint *Checkpoint) error {
+	if checkpoint.ID == "" {
+		checkpoint.ID = uuid.New().String()
+	}
+
+	if err := t.DB.Insert(string(db.AuditCheckpointTable), checkpoint.ID, checkpoint); err != nil {
+		return stacktrace.Propagate(err, "failed to insert audit checkpoint")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedStore) Checkpoints() ([]*Checkpoint, error) {
+	checkpoints := []*Checkpoint{}
+
+	err := t.DB.Scan(string(db.AuditCheckpointTable), false, func(id string, doc []byte) (bool, error) {
+		checkpoint := &Checkpoint{}
+
+		if err := json.Unmarshal(doc, checkpoint); err != nil {
+			return false, err
+		}
+
+		checkpoints = append(checkpoints, checkpoint)
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit checkpoints")
+	}
+
+	sort.SliceStable(checkpoints, func(i, j int) bool {
+		return checkpoints[i].Time.Before(checkpoints[j].Time)
+	})
+
+	return checkpoints, nil
+}
@@ -0,0 +1,84 @@
+package audit
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+)
+
+// csvHeader are the columns written by WriteCSV
+var csvHeader = []string{
+	"id",
+	"time",
+	"kind",
+	"member",
+	"user_id",
+	"user_login",
+	"source_ip",
+	"device_id",
+	"hostname",
+	"method",
+	"path",
+	"query",
+	"request_bytes",
+	"response_bytes",
+	"status_code",
+	"duration_ms",
+	"request_id",
+	"trace_id",
+}
+
+// WriteCSV writes the records as csv with a header row
+func WriteCSV(w io.Writer, records []*Record) error {
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		err := cw.Write([]string{
+			rec.ID,
+			rec.Time.Format(time.RFC3339Nano),
+			rec.Kind,
+			rec.Member,
+			rec.UserID,
+			rec.UserLogin,
+			rec.SourceIP,
+			rec.DeviceID,
+			rec.Hostname,
+			rec.Method,
+			rec.Path,
+			rec.Query,
+			strconv.FormatInt(rec.RequestBytes, 10),
+			strconv.FormatInt(rec.ResponseBytes, 10),
+			strconv.Itoa(rec.StatusCode),
+			strconv.FormatFloat(rec.DurationMS, 'f', 3, 64),
+			rec.RequestID,
+			rec.TraceID,
+		})
+
+		if err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
+
+// WriteNDJSON writes the records as newline delimited json
+func WriteNDJSON(w io.Writer, records []*Record) error {
+	encoder := json.NewEncoder(w)
+
+	for _, rec := range records {
+		if err := encoder.Encode(rec); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package audit
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ExportTestSuite struct {
+	suite.Suite
+	records []*Record
+}
+
+func (t *ExportTestSuite) SetupTest() {
+	t.records = []*Record{
+		&Record{
+			ID:            "1",
+			Time:          time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC),
+			Kind:          DeviceAccess,
+			UserLogin:     "admin",
+			DeviceID:      "abc",
+			Hostname:      "web-1",
+			Method:        "GET",
+			Path:          "/filesystem/etc/hosts",
+			Query:         "a=1,2",
+			RequestBytes:  0,
+			ResponseBytes: 512,
+			StatusCode:    200,
+			DurationMS:    12.5,
+			RequestID:     "req-1",
+		},
+	}
+}
+
+func (t *ExportTestSuite) Test_WriteCSV() {
+	buf := &bytes.Buffer{}
+
+	assert.Nil(t.T(), WriteCSV(buf, t.records))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	assert.Equal(t.T(), 2, len(lines))
+	assert.Equal(t.T(), strings.Join(csvHeader, ","), lines[0])
+	assert.Equal(t.T(), `1,2017-06-01T12:00:00Z,device.access,,,admin,,abc,web-1,GET,/filesystem/etc/hosts,"a=1,2",0,512,200,12.500,req-1,`, lines[1])
+}
+
+func (t *ExportTestSuite) Test_WriteNDJSON() {
+	buf := &bytes.Buffer{}
+
+	assert.Nil(t.T(), WriteNDJSON(buf, append(t.records, t.records[0])))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+
+	assert.Equal(t.T(), 2, len(lines))
+
+	rec := &Record{}
+
+	assert.Nil(t.T(), json.Unmarshal([]byte(lines[1]), rec))
+	assert.Equal(t.T(), "web-1", rec.Hostname)
+	assert.Equal(t.T(), int64(512), rec.ResponseBytes)
+}
+
+func TestExportTestSuite(t *testing.T) {
+	suite.Run(t, new(ExportTestSuite))
+}
@@ -0,0 +1,75 @@
+package audit
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+)
+
+// LoadOrCreateKey reads the base64 encoded ed25519 audit signing key at path,
+// generating and writing a new key if the file does not exist.
+func LoadOrCreateKey(path string) (ed25519.PrivateKey, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to generate audit signing key")
+		}
+
+		if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to create audit signing key directory")
+		}
+
+		encoded := base64.StdEncoding.EncodeToString(key)
+
+		if err = ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to write audit signing key")
+		}
+
+		return key, nil
+	}
+
+	return LoadKey(path)
+}
+
+// LoadKey reads the base64 encoded ed25519 audit signing key at path
+func LoadKey(path string) (ed25519.PrivateKey, error) {
+	encoded, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit signing key")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+
+	if err != nil || len(key) != ed25519.PrivateKeySize {
+		return nil, stacktrace.NewError("audit signing key at '%v' is not a base64 ed25519 private key", path)
+	}
+
+	return ed25519.PrivateKey(key), nil
+}
+
+// ParsePublicKey decodes a base64 encoded ed25519 public key
+func ParsePublicKey(encoded string) (ed25519.PublicKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, stacktrace.NewError("'%v' is not a base64 ed25519 public key", encoded)
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// KeyID returns a short stable identifier of a public key
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
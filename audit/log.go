@@ -0,0 +1,265 @@
+package audit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/deviceio/hub/event"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+)
+
+const (
+	// defaultCheckpointInterval is the number of records between signed checkpoints
+	defaultCheckpointInterval = 100
+
+	// checkpointPeriod is how often Start checkpoints a chain that has advanced
+	checkpointPeriod = 1 * time.Minute
+
+	// maxHeadRetries bounds how many times Write retries after losing a head race
+	maxHeadRetries = 10
+)
+
+// IndexChain is the chain recording the opening of every other chain. A chain
+// anchored in the index cannot be deleted as a whole without Verify noticing.
+const IndexChain = "index"
+
+// Log appends records to a hash chain in the audit store on behalf of a single
+// writer. Each record carries the hash of the previous record of the chain and the
+// chain is periodically checkpointed with an ed25519 signature.
+type Log struct {
+	Store Store
+
+	// Member is the ID of this hub cluster member, stamped on every record
+	Member string
+
+	// Chain names the hash chain appended to. Defaults to Member.
+	Chain string
+
+	// Key signs checkpoints. Checkpoints are not written if nil.
+	Key ed25519.PrivateKey
+
+	// CheckpointInterval is the number of records between checkpoints. Defaults
+	// to 100.
+	CheckpointInterval int64
+
+	head           *Head
+	checkpointedAt int64
+	mu             sync.Mutex
+}
+
+// Write stamps the record with an id, time, member and chain position and appends
+// it to the store. The first write to a chain opens it with a genesis record
+// anchored in the index chain.
+func (t *Log) Write(rec *Record) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rec.Time.IsZero() {
+		rec.Time = time.Now()
+	}
+
+	// the store keeps millisecond precision, hash what will be read back
+	rec.Time = rec.Time.UTC().Truncate(time.Millisecond)
+	rec.Member = t.Member
+	rec.Chain = t.chain()
+
+	for attempt := 0; attempt < maxHeadRetries; attempt++ {
+		if t.head == nil {
+			if err := t.loadHead(rec.Time); err != nil {
+				return err
+			}
+
+			// another writer opened the chain first
+			if t.head == nil {
+				continue
+			}
+		}
+
+		ok, err := t.append(rec)
+
+		if err != nil {
+			return err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if rec.Seq%t.checkpointInterval() == 0 {
+			return t.checkpoint()
+		}
+
+		return nil
+	}
+
+	return stacktrace.NewError("audit chain '%v' head contended after %v attempts", rec.Chain, maxHeadRetries)
+}
+
+// loadHead reads the head of the chain, opening the chain if it has none. The
+// head is left nil if another writer opened the chain concurrently.
+func (t *Log) loadHead(at time.Time) error {
+	head, err := t.Store.Head(t.chain())
+
+	if err != nil {
+		return err
+	}
+
+	if head != nil {
+		t.head = head
+		return nil
+	}
+
+	t.head = &Head{Chain: t.chain()}
+
+	genesis := &Record{
+		Kind:   ChainOpen,
+		Time:   at,
+		Member: t.Member,
+		Chain:  t.chain(),
+	}
+
+	ok, err := t.append(genesis)
+
+	if err != nil || !ok {
+		return err
+	}
+
+	return t.anchor(genesis)
+}
+
+// append links the record to the head and inserts it, then advances the head if
+// it has not moved. ok is false if another writer advanced the head first, in
+// which case the record is removed again and the head must be reloaded.
+func (t *Log) append(rec *Record) (ok bool, err error) {
+	rec.ID = event.NewID(rec.Time)
+	rec.Seq = t.head.Seq + 1
+	rec.PrevHash = t.head.Hash
+	rec.Hash = rec.ComputeHash()
+
+	// the record is stored before the head points at it so a failed insert
+	// never leaves the head ahead of the chain
+	if err = t.Store.Insert(rec); err != nil {
+		return false, err
+	}
+
+	next := &Head{
+		Chain: rec.Chain,
+		Seq:   rec.Seq,
+		Hash:  rec.Hash,
+	}
+
+	if ok, err = t.Store.AdvanceHead(t.head, next); err == nil && ok {
+		t.head = next
+		return true, nil
+	}
+
+	t.head = nil
+
+	if deleteErr := t.Store.Delete(rec.ID); deleteErr != nil {
+		return false, stacktrace.Propagate(deleteErr, "failed to remove audit record %v after the chain head moved", rec.ID)
+	}
+
+	return false, err
+}
+
+// anchor records the opening of the chain in the index chain and checkpoints
+// both, so deleting the whole chain is detected by Verify
+func (t *Log) anchor(genesis *Record) error {
+	if genesis.Chain == IndexChain {
+		return nil
+	}
+
+	index := &Log{
+		Store:  t.Store,
+		Member: t.Member,
+		Chain:  IndexChain,
+		Key:    t.Key,
+	}
+
+	err := index.Write(&Record{
+		Kind:   ChainOpen,
+		Time:   genesis.Time,
+		Target: genesis.Chain,
+		Detail: map[string]string{
+			"genesis": genesis.Hash,
+		},
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if err = index.Checkpoint(); err != nil {
+		return err
+	}
+
+	return t.checkpoint()
+}
+
+// Checkpoint writes a signed checkpoint of the chain head if it has advanced since
+// the last checkpoint
+func (t *Log) Checkpoint() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.checkpoint()
+}
+
+func (t *Log) checkpoint() error {
+	if t.Key == nil || t.head == nil || t.head.Seq == 0 || t.head.Seq == t.checkpointedAt {
+		return nil
+	}
+
+	checkpoint := &Checkpoint{
+		ID:    fmt.Sprintf("%v:%v", t.head.Chain, t.head.Seq),
+		Chain: t.head.Chain,
+		Seq:   t.head.Seq,
+		Hash:  t.head.Hash,
+		Time:  time.Now().UTC().Truncate(time.Millisecond),
+	}
+
+	checkpoint.Sign(t.Key)
+
+	if err := t.Store.InsertCheckpoint(checkpoint); err != nil {
+		return err
+	}
+
+	t.checkpointedAt = checkpoint.Seq
+
+	return nil
+}
+
+// Start periodically checkpoints the chain. It never returns.
+func (t *Log) Start() {
+	ticker := time.NewTicker(checkpointPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := t.Checkpoint(); err != nil {
+			logger.WithField("error", err.Error()).Error("failed to checkpoint audit chain")
+		}
+	}
+}
+
+// Query returns matching records newest first
+func (t *Log) Query(q *Query) ([]*Record, error) {
+	return t.Store.Query(q)
+}
+
+func (t *Log) chain() string {
+	if t.Chain == "" {
+		return t.Member
+	}
+
+	return t.Chain
+}
+
+func (t *Log) checkpointInterval() int64 {
+	if t.CheckpointInterval <= 0 {
+		return defaultCheckpointInterval
+	}
+
+	return t.CheckpointInterval
+}
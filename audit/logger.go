@@ -0,0 +1,5 @@
+package audit
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("audit")
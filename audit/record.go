@@ -0,0 +1,145 @@
+package audit
+
+import (
+	"time"
+)
+
+const (
+	// DeviceAccess records a request proxied to a device
+	DeviceAccess = "device.access"
+
+	// AuthFailed records an api request that failed authentication
+	AuthFailed = "auth.failed"
+
+	// UserCreate records the creation of a user
+	UserCreate = "user.create"
+
+	// UserDisable and UserEnable record a user being disabled or enabled
+	UserDisable = "user.disable"
+	UserEnable  = "user.enable"
+
+	// UserRotateKeys records new credentials being issued to a user
+	UserRotateKeys = "user.rotate_keys"
+
+	// UserKeyAdd, UserKeyRotate and UserKeyRevoke record changes to the named
+	// keys of a user
+	UserKeyAdd    = "user.key_add"
+	UserKeyRotate = "user.key_rotate"
+	UserKeyRevoke = "user.key_revoke"
+
+	// UserHmacKeyAdd and UserHmacKeyDelete record hmac credentials being issued
+	// to or removed from a user
+	UserHmacKeyAdd    = "user.hmac_key_add"
+	UserHmacKeyDelete = "user.hmac_key_delete"
+
+	// UserSSOLink records an existing user being linked to its identity at the
+	// identity provider on first single sign-on
+	UserSSOLink = "user.sso_link"
+
+	// UserAdminGrant and UserAdminRevoke record the admin role of a user being
+	// changed to follow its groups at the identity provider
+	UserAdminGrant  = "user.admin_grant"
+	UserAdminRevoke = "user.admin_revoke"
+
+	// UserDelete records the deletion of a user
+	UserDelete = "user.delete"
+
+	// DeviceBlock and DeviceUnblock record a device being blocked or unblocked
+	DeviceBlock   = "device.block"
+	DeviceUnblock = "device.unblock"
+
+	// ServiceAccountCreate, ServiceAccountDisable, ServiceAccountEnable and
+	// ServiceAccountDelete record changes to service accounts
+	ServiceAccountCreate  = "service_account.create"
+	ServiceAccountDisable = "service_account.disable"
+	ServiceAccountEnable  = "service_account.enable"
+	ServiceAccountDelete  = "service_account.delete"
+
+	// ServiceAccountTokenAdd and ServiceAccountTokenRevoke record tokens being
+	// issued to or revoked from a service account
+	ServiceAccountTokenAdd    = "service_account.token_add"
+	ServiceAccountTokenRevoke = "service_account.token_revoke"
+
+	// MemberEvict records a member being removed from the cluster
+	MemberEvict = "member.evict"
+
+	// AdminRecover records the break-glass reset of an admin's credentials
+	AdminRecover = "admin.recover"
+
+	// AuthLockout records a user or source address locked out after repeated
+	// authentication failures and AuthLockoutClear an admin ending a lockout
+	AuthLockout      = "auth.lockout"
+	AuthLockoutClear = "auth.lockout_clear"
+
+	// ChainOpen is the genesis record of a hash chain and, in the index chain,
+	// the record anchoring it
+	ChainOpen = "audit.chain_open"
+)
+
+// Record is a single entry of the audit log
+type Record struct {
+	// ID is time ordered, see event.NewID
+	ID   string    `gorethink:"id,omitempty" json:"id"`
+	Time time.Time `gorethink:"time" json:"time"`
+	Kind string    `gorethink:"kind" json:"kind"`
+
+	// Member is the ID of the hub cluster member that served the request
+	Member string `gorethink:"member,omitempty" json:"member,omitempty"`
+
+	UserID    string `gorethink:"user_id,omitempty" json:"userId,omitempty"`
+	UserLogin string `gorethink:"user_login,omitempty" json:"userLogin,omitempty"`
+	SourceIP  string `gorethink:"source_ip,omitempty" json:"sourceIp,omitempty"`
+
+	DeviceID string `gorethink:"device_id,omitempty" json:"deviceId,omitempty"`
+	Hostname string `gorethink:"hostname,omitempty" json:"hostname,omitempty"`
+
+	Method        string  `gorethink:"method,omitempty" json:"method,omitempty"`
+	Path          string  `gorethink:"path,omitempty" json:"path,omitempty"`
+	Query         string  `gorethink:"query,omitempty" json:"query,omitempty"`
+	RequestBytes  int64   `gorethink:"request_bytes" json:"requestBytes"`
+	ResponseBytes int64   `gorethink:"response_bytes" json:"responseBytes"`
+	StatusCode    int     `gorethink:"status_code,omitempty" json:"statusCode,omitempty"`
+	DurationMS    float64 `gorethink:"duration_ms" json:"durationMs"`
+
+	// RequestID is the X-Request-ID of the api request that produced the record
+	RequestID string `gorethink:"request_id,omitempty" json:"requestId,omitempty"`
+
+	// TraceID is the W3C trace id of the api request that produced the record
+	TraceID string `gorethink:"trace_id,omitempty" json:"traceId,omitempty"`
+
+	// Target identifies the subject of an administrative action such as the
+	// user being created
+	Target string `gorethink:"target,omitempty" json:"target,omitempty"`
+
+	// Detail carries kind specific information such as an authentication failure
+	// reason
+	Detail map[string]string `gorethink:"detail,omitempty" json:"detail,omitempty"`
+
+	// Chain is the hash chain the record belongs to. Each writer (hub member or
+	// cli) appends to its own chain.
+	Chain string `gorethink:"chain" json:"chain"`
+
+	// Seq is the position of the record in its chain starting at 1
+	Seq int64 `gorethink:"seq" json:"seq"`
+
+	// PrevHash is the Hash of the previous record in the chain
+	PrevHash string `gorethink:"prev_hash" json:"prevHash"`
+
+	// Hash is the hex SHA-256 digest of this record's content and PrevHash
+	Hash string `gorethink:"hash" json:"hash"`
+}
+
+// Query filters records returned from the audit log. Zero values are not applied.
+type Query struct {
+	From time.Time
+	To   time.Time
+
+	// User matches the user id or login
+	User string
+
+	// Device matches the device id or hostname
+	Device string
+
+	Kind  string
+	Limit int
+}
@@ -0,0 +1,235 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/db"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// Store persists audit records
+type Store interface {
+	Insert(record *Record) error
+
+	// Delete removes a record a writer inserted before losing the race to
+	// advance the chain head
+	Delete(id string) error
+
+	// Query returns matching records newest first
+	Query(q *Query) ([]*Record, error)
+
+	// ChainRecords calls fn for every record of the chain in no particular order
+	ChainRecords(chain string, fn func(rec *Record) error) error
+
+	// Head returns the head of the chain or nil if the chain has no records
+	Head(chain string) (*Head, error)
+
+	// Heads returns the head of every chain
+	Heads() ([]*Head, error)
+
+	// AdvanceHead atomically replaces the chain head prev with next. ok is false
+	// if the stored head no longer has the seq and hash of prev because another
+	// writer advanced it.
+	AdvanceHead(prev *Head, next *Head) (ok bool, err error)
+
+	InsertCheckpoint(checkpoint *Checkpoint) error
+	Checkpoints() ([]*Checkpoint, error)
+}
+
+// errHeadMoved is raised within rethinkdb when a head advance loses a race
+const errHeadMoved = "audit chain head moved"
+
+// RethinkStore is the rethinkdb backed Store
+type RethinkStore struct {
+}
+
+func (t *RethinkStore) Insert(record *Record) error {
+	if _, err := db.Table(db.AuditTable).Insert(record).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to insert audit record")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) Delete(id string) error {
+	if _, err := db.Table(db.AuditTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete audit record")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) Query(q *Query) ([]*Record, error) {
+	lower := interface{}(r.MinVal)
+	upper := interface{}(r.MaxVal)
+
+	// record ids are prefixed with their hex creation time so a time range maps
+	// to a range of the primary key
+	if !q.From.IsZero() {
+		lower = timeID(q.From)
+	}
+
+	if !q.To.IsZero() {
+		upper = timeID(q.To)
+	}
+
+	term := db.Table(db.AuditTable).
+		Between(lower, upper).
+		OrderBy(r.OrderByOpts{Index: r.Desc("id")})
+
+	if q.User != "" {
+		user := q.User
+		term = term.Filter(func(row r.Term) r.Term {
+			return row.Field("user_id").Default("").Eq(user).Or(row.Field("user_login").Default("").Eq(user))
+		})
+	}
+
+	if q.Device != "" {
+		device := strings.ToLower(q.Device)
+		term = term.Filter(func(row r.Term) r.Term {
+			return row.Field("device_id").Default("").Eq(device).Or(row.Field("hostname").Default("").Eq(device))
+		})
+	}
+
+	if q.Kind != "" {
+		term = term.Filter(db.Filter{"kind": q.Kind})
+	}
+
+	if q.Limit > 0 {
+		term = term.Limit(q.Limit)
+	}
+
+	cursor, err := term.Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query audit records")
+	}
+
+	records := []*Record{}
+
+	if err = cursor.All(&records); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit records")
+	}
+
+	return records, nil
+}
+
+func (t *RethinkStore) ChainRecords(chain string, fn func(rec *Record) error) error {
+	cursor, err := db.Table(db.AuditTable).GetAllByIndex("chain", chain).Run(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query audit chain")
+	}
+
+	defer cursor.Close()
+
+	rec := &Record{}
+
+	for cursor.Next(rec) {
+		if err = fn(rec); err != nil {
+			return err
+		}
+
+		rec = &Record{}
+	}
+
+	if err = cursor.Err(); err != nil {
+		return stacktrace.Propagate(err, "failed to read audit chain")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) Head(chain string) (*Head, error) {
+	cursor, err := db.Table(db.AuditChainTable).Get(chain).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query audit chain head")
+	}
+
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	head := &Head{}
+
+	if err = cursor.One(head); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit chain head")
+	}
+
+	return head, nil
+}
+
+func (t *RethinkStore) Heads() ([]*Head, error) {
+	heads := []*Head{}
+
+	cursor, err := db.Table(db.AuditChainTable).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query audit chain heads")
+	}
+
+	if err = cursor.All(&heads); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit chain heads")
+	}
+
+	return heads, nil
+}
+
+func (t *RethinkStore) AdvanceHead(prev *Head, next *Head) (bool, error) {
+	_, err := db.Table(db.AuditChainTable).Get(next.Chain).Replace(func(row r.Term) interface{} {
+		return r.Branch(
+			r.Branch(
+				row.Eq(nil),
+				prev.Seq == 0,
+				row.Field("seq").Eq(prev.Seq).And(row.Field("hash").Eq(prev.Hash)),
+			),
+			next,
+			r.Error(errHeadMoved),
+		)
+	}).RunWrite(db.Session)
+
+	if err != nil && strings.Contains(err.Error(), errHeadMoved) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to advance audit chain head")
+	}
+
+	return true, nil
+}
+
+func (t *RethinkStore) InsertCheckpoint(checkpoint *Checkpoint) error {
+	if _, err := db.Table(db.AuditCheckpointTable).Insert(checkpoint).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to insert audit checkpoint")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) Checkpoints() ([]*Checkpoint, error) {
+	checkpoints := []*Checkpoint{}
+
+	cursor, err := db.Table(db.AuditCheckpointTable).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query audit checkpoints")
+	}
+
+	if err = cursor.All(&checkpoints); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read audit checkpoints")
+	}
+
+	return checkpoints, nil
+}
+
+// timeID returns the record id prefix for the supplied time
+func timeID(at time.Time) string {
+	return fmt.Sprintf("%016x", at.UnixNano())
+}
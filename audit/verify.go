@@ -0,0 +1,326 @@
+package audit
+
+import (
+	"fmt"
+	"sort"
+
+	"golang.org/x/crypto/ed25519"
+)
+
+// Problem is a single integrity failure found while verifying the audit log
+type Problem struct {
+	Chain   string
+	Seq     int64
+	Message string
+}
+
+func (t *Problem) String() string {
+	return fmt.Sprintf("chain %v seq %v: %v", t.Chain, t.Seq, t.Message)
+}
+
+// ChainReport summarizes the verification of a single chain
+type ChainReport struct {
+	Chain   string
+	Records int64
+	HeadSeq int64
+
+	// Checkpoints is the number of checkpoints with a valid signature from a
+	// trusted key matching the chain
+	Checkpoints int
+
+	// CheckpointedSeq is the highest seq covered by a valid checkpoint. Records
+	// after it could be removed from the tail of the chain undetected.
+	CheckpointedSeq int64
+}
+
+// Report is the outcome of Verify
+type Report struct {
+	Chains   []*ChainReport
+	Problems []*Problem
+}
+
+// OK reports if no problems were found
+func (t *Report) OK() bool {
+	return len(t.Problems) == 0
+}
+
+func (t *Report) problem(chain string, seq int64, format string, args ...interface{}) {
+	t.Problems = append(t.Problems, &Problem{
+		Chain:   chain,
+		Seq:     seq,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+// anchor is the index entry of a chain, recording the hash of its genesis record
+type anchor struct {
+	seq     int64
+	genesis string
+
+	// seqs are the index records opening the chain, more than one means the
+	// chain was opened again after its genesis
+	seqs []int64
+}
+
+// link is the minimal state retained per record while walking a chain
+type link struct {
+	hash     string
+	prevHash string
+	valid    bool
+	genesis  bool
+}
+
+// Verify walks every chain in the store checking that each record's hash matches
+// its content, that each record links to its predecessor without gaps, that every
+// chain opened with a genesis record is anchored in the index chain and that
+// every checkpoint is signed by one of the trusted keys and matches the chain.
+func Verify(store Store, trusted []ed25519.PublicKey) (*Report, error) {
+	report := &Report{}
+
+	keys := map[string]ed25519.PublicKey{}
+
+	for _, key := range trusted {
+		keys[KeyID(key)] = key
+	}
+
+	heads, err := store.Heads()
+
+	if err != nil {
+		return nil, err
+	}
+
+	checkpoints, err := store.Checkpoints()
+
+	if err != nil {
+		return nil, err
+	}
+
+	chains := map[string]*Head{}
+	chainCheckpoints := map[string][]*Checkpoint{}
+
+	for _, head := range heads {
+		chains[head.Chain] = head
+	}
+
+	// a chain whose head was deleted is still discovered through its checkpoints
+	for _, checkpoint := range checkpoints {
+		if _, ok := chains[checkpoint.Chain]; !ok {
+			chains[checkpoint.Chain] = nil
+		}
+
+		chainCheckpoints[checkpoint.Chain] = append(chainCheckpoints[checkpoint.Chain], checkpoint)
+	}
+
+	// a chain deleted as a whole is still discovered through its index entry.
+	// Index records are read in no particular order, the earliest entry of a
+	// chain is its anchor.
+	anchors := map[string]*anchor{}
+
+	err = store.ChainRecords(IndexChain, func(rec *Record) error {
+		if rec.Kind != ChainOpen || rec.Target == "" {
+			return nil
+		}
+
+		a, ok := anchors[rec.Target]
+
+		if !ok {
+			a = &anchor{}
+			anchors[rec.Target] = a
+		}
+
+		a.seqs = append(a.seqs, rec.Seq)
+
+		if len(a.seqs) == 1 || rec.Seq < a.seq {
+			a.seq = rec.Seq
+			a.genesis = rec.Detail["genesis"]
+		}
+
+		if _, ok := chains[rec.Target]; !ok {
+			chains[rec.Target] = nil
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+
+	for name := range chains {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		chainReport, err := verifyChain(store, report, name, chains[name], chainCheckpoints[name], anchors, keys)
+
+		if err != nil {
+			return nil, err
+		}
+
+		report.Chains = append(report.Chains, chainReport)
+	}
+
+	return report, nil
+}
+
+func verifyChain(store Store, report *Report, chain string, head *Head, checkpoints []*Checkpoint, anchors map[string]*anchor, keys map[string]ed25519.PublicKey) (*ChainReport, error) {
+	chainReport := &ChainReport{
+		Chain: chain,
+	}
+
+	links := map[int64]*link{}
+	var maxSeq int64
+
+	err := store.ChainRecords(chain, func(rec *Record) error {
+		chainReport.Records++
+
+		if _, ok := links[rec.Seq]; ok {
+			report.problem(chain, rec.Seq, "duplicate record %v", rec.ID)
+		}
+
+		computed := rec.ComputeHash()
+
+		links[rec.Seq] = &link{
+			hash:     rec.Hash,
+			prevHash: rec.PrevHash,
+			valid:    computed == rec.Hash,
+			genesis:  rec.Kind == ChainOpen && rec.Seq == 1,
+		}
+
+		if computed != rec.Hash {
+			report.problem(chain, rec.Seq, "record %v content does not match its hash (modified)", rec.ID)
+		}
+
+		if rec.Seq > maxSeq {
+			maxSeq = rec.Seq
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if head == nil {
+		report.problem(chain, 0, "chain head is missing")
+	} else {
+		chainReport.HeadSeq = head.Seq
+
+		if maxSeq > head.Seq {
+			report.problem(chain, maxSeq, "records exist beyond the chain head at seq %v", head.Seq)
+		}
+
+		if l, ok := links[head.Seq]; ok && l.hash != head.Hash {
+			report.problem(chain, head.Seq, "chain head hash does not match the record at its seq")
+		}
+	}
+
+	if head != nil && head.Seq > maxSeq {
+		maxSeq = head.Seq
+	}
+
+	prevHash := ""
+
+	for seq := int64(1); seq <= maxSeq; seq++ {
+		l, ok := links[seq]
+
+		if !ok {
+			report.problem(chain, seq, "record missing (gap in chain)")
+			prevHash = ""
+			continue
+		}
+
+		if seq > 1 && prevHash != "" && l.prevHash != prevHash {
+			report.problem(chain, seq, "previous hash does not match record %v (chain broken)", seq-1)
+		}
+
+		if seq == 1 && l.prevHash != "" {
+			report.problem(chain, seq, "first record references a previous hash")
+		}
+
+		prevHash = l.hash
+	}
+
+	verifyAnchor(report, chain, links[1], anchors)
+
+	for _, checkpoint := range checkpoints {
+		key, ok := keys[checkpoint.KeyID]
+
+		if !ok {
+			report.problem(chain, checkpoint.Seq, "checkpoint signed by untrusted key %v", checkpoint.KeyID)
+			continue
+		}
+
+		if !checkpoint.Verify(key) {
+			report.problem(chain, checkpoint.Seq, "checkpoint signature invalid")
+			continue
+		}
+
+		l, ok := links[checkpoint.Seq]
+
+		if !ok {
+			report.problem(chain, checkpoint.Seq, "checkpointed record missing")
+			continue
+		}
+
+		if l.hash != checkpoint.Hash {
+			report.problem(chain, checkpoint.Seq, "checkpoint hash does not match the record (chain rewritten)")
+			continue
+		}
+
+		if head != nil && checkpoint.Seq > head.Seq {
+			report.problem(chain, checkpoint.Seq, "chain head is behind a signed checkpoint (truncated)")
+		}
+
+		chainReport.Checkpoints++
+
+		if checkpoint.Seq > chainReport.CheckpointedSeq {
+			chainReport.CheckpointedSeq = checkpoint.Seq
+		}
+	}
+
+	return chainReport, nil
+}
+
+// verifyAnchor checks the genesis record of the chain against its entry in the
+// index chain
+func verifyAnchor(report *Report, chain string, first *link, anchors map[string]*anchor) {
+	a, anchored := anchors[chain]
+
+	if anchored && len(a.seqs) > 1 {
+		seqs := append([]int64{}, a.seqs...)
+		sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+
+		for _, seq := range seqs[1:] {
+			report.problem(chain, 1, "chain opened again by index record %v (chain replaced)", seq)
+		}
+	}
+
+	if anchored && first == nil {
+		report.problem(chain, 1, "chain anchored in the index has no genesis record (deleted)")
+		return
+	}
+
+	if anchored && first.hash != a.genesis {
+		report.problem(chain, 1, "genesis record does not match the index (chain replaced)")
+		return
+	}
+
+	if chain == IndexChain {
+		return
+	}
+
+	if first == nil || !first.genesis {
+		report.problem(chain, 1, "chain does not open with a genesis record")
+		return
+	}
+
+	if !anchored {
+		report.problem(chain, 1, "chain is not anchored in the index")
+	}
+}
@@ -0,0 +1,368 @@
+package audit
+
+import (
+	"crypto/rand"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ed25519"
+)
+
+type memoryStore struct {
+	records     map[string]*Record
+	heads       map[string]*Head
+	checkpoints []*Checkpoint
+	failInsert  bool
+	mu          *sync.Mutex
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{
+		records: map[string]*Record{},
+		heads:   map[string]*Head{},
+		mu:      &sync.Mutex{},
+	}
+}
+
+func (t *memoryStore) Insert(rec *Record) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failInsert {
+		return errors.New("insert failed")
+	}
+
+	copied := *rec
+	t.records[rec.ID] = &copied
+
+	return nil
+}
+
+func (t *memoryStore) Delete(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.records, id)
+
+	return nil
+}
+
+func (t *memoryStore) Query(q *Query) ([]*Record, error) {
+	records := []*Record{}
+
+	for _, rec := range t.records {
+		records = append(records, rec)
+	}
+
+	sort.Slice(records, func(i, j int) bool { return records[i].ID > records[j].ID })
+
+	return records, nil
+}
+
+func (t *memoryStore) ChainRecords(chain string, fn func(rec *Record) error) error {
+	for _, rec := range t.records {
+		if rec.Chain != chain {
+			continue
+		}
+
+		copied := *rec
+
+		if err := fn(&copied); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (t *memoryStore) Head(chain string) (*Head, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	head, ok := t.heads[chain]
+
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *head
+
+	return &copied, nil
+}
+
+func (t *memoryStore) Heads() ([]*Head, error) {
+	heads := []*Head{}
+
+	for _, head := range t.heads {
+		heads = append(heads, head)
+	}
+
+	return heads, nil
+}
+
+func (t *memoryStore) AdvanceHead(prev *Head, next *Head) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	current, ok := t.heads[next.Chain]
+
+	if (!ok && prev.Seq != 0) || (ok && (current.Seq != prev.Seq || current.Hash != prev.Hash)) {
+		return false, nil
+	}
+
+	copied := *next
+	t.heads[next.Chain] = &copied
+
+	return true, nil
+}
+
+func (t *memoryStore) InsertCheckpoint(checkpoint *Checkpoint) error {
+	t.checkpoints = append(t.checkpoints, checkpoint)
+	return nil
+}
+
+func (t *memoryStore) Checkpoints() ([]*Checkpoint, error) {
+	return t.checkpoints, nil
+}
+
+func (t *memoryStore) bySeq(seq int64) *Record {
+	for _, rec := range t.records {
+		if rec.Chain == "member-1" && rec.Seq == seq {
+			return rec
+		}
+	}
+
+	return nil
+}
+
+type VerifyTestSuite struct {
+	suite.Suite
+	store *memoryStore
+	key   ed25519.PrivateKey
+	pub   ed25519.PublicKey
+	log   *Log
+}
+
+func (t *VerifyTestSuite) SetupTest() {
+	t.pub, t.key, _ = ed25519.GenerateKey(rand.Reader)
+	t.store = newMemoryStore()
+	t.log = &Log{
+		Store:              t.store,
+		Member:             "member-1",
+		Key:                t.key,
+		CheckpointInterval: 5,
+	}
+
+	for i := 0; i < 12; i++ {
+		err := t.log.Write(&Record{
+			Kind:      DeviceAccess,
+			UserLogin: "admin",
+			DeviceID:  "abc",
+			Path:      "/info",
+		})
+
+		if err != nil {
+			t.T().Fatal(err)
+		}
+	}
+}
+
+func (t *VerifyTestSuite) verify() *Report {
+	report, err := Verify(t.store, []ed25519.PublicKey{t.pub})
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	return report
+}
+
+func (t *VerifyTestSuite) Test_untampered_chain_verifies() {
+	assert.Nil(t.T(), t.log.Checkpoint())
+
+	report := t.verify()
+
+	assert.True(t.T(), report.OK())
+	assert.Equal(t.T(), 2, len(report.Chains))
+
+	// the index chain records the opening of member-1
+	assert.Equal(t.T(), IndexChain, report.Chains[0].Chain)
+	assert.Equal(t.T(), int64(2), report.Chains[0].Records)
+
+	// genesis record plus the 12 written, checkpointed at open, 5, 10 and 13
+	assert.Equal(t.T(), "member-1", report.Chains[1].Chain)
+	assert.Equal(t.T(), int64(13), report.Chains[1].Records)
+	assert.Equal(t.T(), 4, report.Chains[1].Checkpoints)
+	assert.Equal(t.T(), int64(13), report.Chains[1].CheckpointedSeq)
+}
+
+func (t *VerifyTestSuite) Test_modified_record_is_detected() {
+	t.store.bySeq(3).UserLogin = "someone-else"
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Equal(t.T(), int64(3), report.Problems[0].Seq)
+}
+
+func (t *VerifyTestSuite) Test_modified_request_id_is_detected() {
+	t.store.bySeq(5).RequestID = "forged"
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Equal(t.T(), int64(5), report.Problems[0].Seq)
+}
+
+func (t *VerifyTestSuite) Test_modified_record_id_is_detected() {
+	t.store.bySeq(4).ID = "forged"
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Equal(t.T(), int64(4), report.Problems[0].Seq)
+}
+
+func (t *VerifyTestSuite) Test_deleted_chain_is_detected() {
+	for id, rec := range t.store.records {
+		if rec.Chain == "member-1" {
+			delete(t.store.records, id)
+		}
+	}
+
+	delete(t.store.heads, "member-1")
+
+	checkpoints := []*Checkpoint{}
+
+	for _, checkpoint := range t.store.checkpoints {
+		if checkpoint.Chain != "member-1" {
+			checkpoints = append(checkpoints, checkpoint)
+		}
+	}
+
+	t.store.checkpoints = checkpoints
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Contains(t.T(), report.Problems[0].String(), "chain member-1")
+	assert.Contains(t.T(), report.Problems[len(report.Problems)-1].String(), "deleted")
+}
+
+func (t *VerifyTestSuite) Test_replaced_chain_is_detected() {
+	// the chain is rebuilt from a new genesis record by someone without the key
+	for id, rec := range t.store.records {
+		if rec.Chain == "member-1" {
+			delete(t.store.records, id)
+		}
+	}
+
+	delete(t.store.heads, "member-1")
+	t.store.checkpoints = nil
+
+	forged := &Log{
+		Store:  t.store,
+		Member: "member-1",
+	}
+
+	assert.Nil(t.T(), forged.Write(&Record{Kind: DeviceAccess}))
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+
+	messages := []string{}
+
+	for _, problem := range report.Problems {
+		messages = append(messages, problem.String())
+	}
+
+	assert.Contains(t.T(), messages, "chain member-1 seq 1: genesis record does not match the index (chain replaced)")
+	assert.Contains(t.T(), strings.Join(messages, "\n"), "chain opened again by index record")
+}
+
+func (t *VerifyTestSuite) Test_failed_insert_leaves_no_gap() {
+	t.store.failInsert = true
+	assert.NotNil(t.T(), t.log.Write(&Record{Kind: DeviceAccess}))
+	t.store.failInsert = false
+
+	assert.Equal(t.T(), int64(13), t.store.heads["member-1"].Seq)
+	assert.Nil(t.T(), t.log.Write(&Record{Kind: DeviceAccess}))
+	assert.Nil(t.T(), t.log.Checkpoint())
+
+	assert.True(t.T(), t.verify().OK())
+	assert.Equal(t.T(), int64(14), t.store.heads["member-1"].Seq)
+}
+
+func (t *VerifyTestSuite) Test_deleted_record_is_detected() {
+	delete(t.store.records, t.store.bySeq(7).ID)
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Contains(t.T(), report.Problems[0].String(), "gap")
+}
+
+func (t *VerifyTestSuite) Test_rewritten_chain_is_detected_by_checkpoint() {
+	// an attacker without the signing key recomputes every hash after altering a record
+	prev := ""
+
+	for seq := int64(1); seq <= 13; seq++ {
+		rec := t.store.bySeq(seq)
+
+		if seq == 2 {
+			rec.Path = "/something-innocent"
+		}
+
+		rec.PrevHash = prev
+		rec.Hash = rec.ComputeHash()
+		prev = rec.Hash
+	}
+
+	t.store.heads["member-1"].Hash = prev
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Contains(t.T(), report.Problems[0].String(), "chain rewritten")
+}
+
+func (t *VerifyTestSuite) Test_untrusted_checkpoint_key_is_detected() {
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+
+	checkpoint := &Checkpoint{
+		Chain: "member-1",
+		Seq:   13,
+		Hash:  t.store.heads["member-1"].Hash,
+	}
+	checkpoint.Sign(other)
+
+	t.store.checkpoints = append(t.store.checkpoints, checkpoint)
+
+	report := t.verify()
+
+	assert.False(t.T(), report.OK())
+	assert.Contains(t.T(), report.Problems[0].String(), "untrusted key")
+}
+
+func (t *VerifyTestSuite) Test_Write_recovers_from_lost_head_race() {
+	other := &Log{
+		Store:  t.store,
+		Member: "member-1",
+	}
+
+	assert.Nil(t.T(), other.Write(&Record{Kind: DeviceAccess}))
+	assert.Nil(t.T(), t.log.Write(&Record{Kind: DeviceAccess}))
+
+	assert.True(t.T(), t.verify().OK())
+	assert.Equal(t.T(), int64(15), t.store.heads["member-1"].Seq)
+}
+
+func TestVerifyTestSuite(t *testing.T) {
+	suite.Run(t, new(VerifyTestSuite))
+}
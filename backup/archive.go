@@ -0,0 +1,281 @@
+package backup
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	// magic starts every archive
+	magic = "DIOHUBBK"
+
+	// Version is the archive format version written by this hub
+	Version = 1
+
+	modePlain      byte = 0
+	modePassphrase byte = 1
+)
+
+// ErrPassphraseRequired is returned when reading an encrypted archive without a
+// passphrase
+var ErrPassphraseRequired = stacktrace.NewError("archive is encrypted, a passphrase is required")
+
+// Header describes the hub an archive was taken from
+type Header struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+
+	// Driver is the storage backend the documents were read from. Documents are
+	// stored in the backend's own encoding so archives only restore to the same
+	// backend.
+	Driver string `json:"driver"`
+
+	// Schema is the migration version of the database the documents were read
+	// from
+	Schema int `json:"schema"`
+
+	// Encrypted is set when the archive is encrypted with a passphrase
+	Encrypted bool `json:"-"`
+}
+
+// Record is a single document of a table
+type Record struct {
+	Table string          `json:"table"`
+	ID    string          `json:"id"`
+	Doc   json.RawMessage `json:"doc"`
+}
+
+// Trailer ends an archive with the number of documents of each table, so
+// truncated archives are detected
+type Trailer struct {
+	Counts map[string]int `json:"counts"`
+}
+
+// line is a line of the archive body
+type line struct {
+	Header  *Header  `json:"header,omitempty"`
+	Record  *Record  `json:"record,omitempty"`
+	Trailer *Trailer `json:"trailer,omitempty"`
+}
+
+// Writer writes an archive. Close must be called to complete it.
+type Writer struct {
+	enc    *encryptWriter
+	gz     *gzip.Writer
+	json   *json.Encoder
+	counts map[string]int
+}
+
+// NewWriter starts an archive on w. The archive is encrypted when passphrase is
+// not empty.
+func NewWriter(w io.Writer, header *Header, passphrase []byte) (*Writer, error) {
+	prefix := []byte(magic)
+	prefix = append(prefix, Version)
+
+	t := &Writer{
+		counts: map[string]int{},
+	}
+
+	body := w
+
+	if len(passphrase) > 0 {
+		salt := make([]byte, saltSize)
+
+		if _, err := rand.Read(salt); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to generate salt")
+		}
+
+		prefix = append(prefix, modePassphrase)
+		prefix = append(prefix, salt...)
+
+		enc, err := newEncryptWriter(w, passphrase, salt, prefix)
+
+		if err != nil {
+			return nil, err
+		}
+
+		t.enc = enc
+		body = enc
+	} else {
+		prefix = append(prefix, modePlain)
+	}
+
+	if _, err := w.Write(prefix); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to write archive")
+	}
+
+	t.gz = gzip.NewWriter(body)
+	t.json = json.NewEncoder(t.gz)
+
+	h := *header
+	h.Version = Version
+
+	if err := t.json.Encode(&line{Header: &h}); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to write archive header")
+	}
+
+	return t, nil
+}
+
+// Write adds the record to the archive
+func (t *Writer) Write(rec *Record) error {
+	if err := t.json.Encode(&line{Record: rec}); err != nil {
+		return stacktrace.Propagate(err, "failed to write record '%v' of table '%v'", rec.ID, rec.Table)
+	}
+
+	t.counts[rec.Table]++
+
+	return nil
+}
+
+// Count records a table with no documents so it is restored empty
+func (t *Writer) Count(table string) {
+	if _, ok := t.counts[table]; !ok {
+		t.counts[table] = 0
+	}
+}
+
+// Close writes the trailer and flushes the archive. It does not close the
+// underlying writer.
+func (t *Writer) Close() (*Trailer, error) {
+	trailer := &Trailer{Counts: t.counts}
+
+	if err := t.json.Encode(&line{Trailer: trailer}); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to write archive trailer")
+	}
+
+	if err := t.gz.Close(); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to compress archive")
+	}
+
+	if t.enc != nil {
+		if err := t.enc.Close(); err != nil {
+			return nil, err
+		}
+	}
+
+	return trailer, nil
+}
+
+// Read reads the archive calling fn for every record. The archive is checked
+// to be complete, but fn sees records before the end is reached so callers
+// applying records should read the archive once to validate it first.
+func Read(r io.Reader, passphrase []byte, fn func(rec *Record) error) (*Header, *Trailer, error) {
+	prefix := make([]byte, len(magic)+2)
+
+	if _, err := io.ReadFull(r, prefix); err != nil || !bytes.Equal(prefix[:len(magic)], []byte(magic)) {
+		return nil, nil, stacktrace.NewError("not a hub backup archive")
+	}
+
+	if prefix[len(magic)] != Version {
+		return nil, nil, stacktrace.NewError("unsupported archive version %v, this hub reads version %v", prefix[len(magic)], Version)
+	}
+
+	body := io.Reader(bufio.NewReader(r))
+	encrypted := false
+
+	switch prefix[len(magic)+1] {
+	case modePlain:
+	case modePassphrase:
+		if len(passphrase) == 0 {
+			return nil, nil, ErrPassphraseRequired
+		}
+
+		salt := make([]byte, saltSize)
+
+		if _, err := io.ReadFull(body, salt); err != nil {
+			return nil, nil, stacktrace.NewError("archive is truncated")
+		}
+
+		dec, err := newDecryptReader(body, passphrase, salt, append(prefix, salt...))
+
+		if err != nil {
+			return nil, nil, err
+		}
+
+		body = dec
+		encrypted = true
+	default:
+		return nil, nil, stacktrace.NewError("unsupported archive encryption %v", prefix[len(magic)+1])
+	}
+
+	gz, err := gzip.NewReader(body)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed to read archive")
+	}
+
+	dec := json.NewDecoder(gz)
+
+	var header *Header
+	var trailer *Trailer
+	counts := map[string]int{}
+
+	for {
+		l := &line{}
+
+		if err := dec.Decode(l); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, stacktrace.Propagate(err, "archive is corrupt or truncated")
+		}
+
+		switch {
+		case trailer != nil:
+			return nil, nil, stacktrace.NewError("archive has data after its trailer")
+
+		case l.Header != nil:
+			if header != nil {
+				return nil, nil, stacktrace.NewError("archive has more than one header")
+			}
+
+			header = l.Header
+			header.Encrypted = encrypted
+
+		case header == nil:
+			return nil, nil, stacktrace.NewError("archive has no header")
+
+		case l.Record != nil:
+			if l.Record.Table == "" || l.Record.ID == "" || len(l.Record.Doc) == 0 {
+				return nil, nil, stacktrace.NewError("archive has an incomplete record")
+			}
+
+			counts[l.Record.Table]++
+
+			if err := fn(l.Record); err != nil {
+				return nil, nil, err
+			}
+
+		case l.Trailer != nil:
+			trailer = l.Trailer
+
+		default:
+			return nil, nil, stacktrace.NewError("archive has an unknown line")
+		}
+	}
+
+	if trailer == nil {
+		return nil, nil, stacktrace.NewError("archive is truncated")
+	}
+
+	for table, n := range trailer.Counts {
+		if counts[table] != n {
+			return nil, nil, stacktrace.NewError("archive holds %v documents of table '%v', its trailer records %v", counts[table], table, n)
+		}
+	}
+
+	for table := range counts {
+		if _, ok := trailer.Counts[table]; !ok {
+			return nil, nil, stacktrace.NewError("archive trailer is missing table '%v'", table)
+		}
+	}
+
+	return header, trailer, nil
+}
@@ -0,0 +1,265 @@
+package backup
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/db"
+	"github.com/palantir/stacktrace"
+)
+
+// loadBatchSize is the number of documents loaded per write when restoring
+const loadBatchSize = 200
+
+// Tables reads and writes the raw documents of the hub tables of a storage
+// backend
+type Tables interface {
+	// Driver names the storage backend
+	Driver() string
+
+	// Schema returns the migration version of the database and the newest version
+	// this hub knows
+	Schema() (current int, latest int, err error)
+
+	// Migrate applies migrations up to version target, every pending migration
+	// when target is 0
+	Migrate(target int) error
+
+	Count(table string) (int, error)
+	Scan(table string, fn func(rec *Record) error) error
+	Clear(table string) error
+
+	// Load writes the records, replacing documents with the same id
+	Load(table string, recs []*Record) error
+}
+
+// ErrSafeguardRequired is returned when replacing the database without backing
+// it up first
+var ErrSafeguardRequired = stacktrace.NewError("replacing the database requires a backup of it first")
+
+// RestoreOptions controls Restore
+type RestoreOptions struct {
+	Passphrase []byte
+
+	// Replace deletes the documents of every hub table before loading the
+	// archive. Without it restoring into tables that hold documents fails.
+	Replace bool
+
+	// Safeguard backs up the database before a Replace deletes anything. A
+	// restore failing part way through leaves tables half loaded, so Replace
+	// is refused without a Safeguard and aborted if it fails.
+	Safeguard func() error
+
+	// DryRun validates the archive against the database without writing
+	DryRun bool
+}
+
+// TableReport is the number of documents of a table in the archive and the
+// database before restoring
+type TableReport struct {
+	Table    string
+	Archived int
+	Existing int
+}
+
+// Report describes a restore
+type Report struct {
+	Header *Header
+	Schema int
+	Tables []*TableReport
+}
+
+// Backup writes every hub table to w, encrypted when passphrase is not empty.
+// Documents written while the backup runs may or may not be included.
+func Backup(w io.Writer, tables Tables, passphrase []byte) (*Trailer, error) {
+	schema, _, err := tables.Schema()
+
+	if err != nil {
+		return nil, err
+	}
+
+	archive, err := NewWriter(w, &Header{
+		Created: time.Now().UTC(),
+		Driver:  tables.Driver(),
+		Schema:  schema,
+	}, passphrase)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, table := range db.DataTables() {
+		archive.Count(table)
+
+		if err := tables.Scan(table, archive.Write); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to back up table '%v'", table)
+		}
+	}
+
+	return archive.Close()
+}
+
+// Restore loads the archive returned by open into tables. The archive is read
+// once to validate it is complete and compatible with the database before
+// anything is written, then again to load it.
+func Restore(open func() (io.ReadCloser, error), tables Tables, opts *RestoreOptions) (*Report, error) {
+	if opts.Replace && !opts.DryRun && opts.Safeguard == nil {
+		return nil, ErrSafeguardRequired
+	}
+
+	report, err := validate(open, tables, opts)
+
+	if err != nil || opts.DryRun {
+		return report, err
+	}
+
+	if opts.Replace {
+		if err := opts.Safeguard(); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to back up the database before replacing it, nothing was restored")
+		}
+	}
+
+	if err := tables.Migrate(report.Header.Schema); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to migrate database to archive schema %v", report.Header.Schema)
+	}
+
+	if opts.Replace {
+		for _, table := range db.DataTables() {
+			if err := tables.Clear(table); err != nil {
+				return nil, stacktrace.Propagate(err, "failed to clear table '%v'", table)
+			}
+		}
+	}
+
+	r, err := open()
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open archive")
+	}
+
+	defer r.Close()
+
+	batch := []*Record{}
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		if err := tables.Load(batch[0].Table, batch); err != nil {
+			return stacktrace.Propagate(err, "failed to restore table '%v'", batch[0].Table)
+		}
+
+		batch = []*Record{}
+
+		return nil
+	}
+
+	_, _, err = Read(r, opts.Passphrase, func(rec *Record) error {
+		if len(batch) == loadBatchSize || (len(batch) > 0 && batch[0].Table != rec.Table) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+
+		batch = append(batch, rec)
+
+		return nil
+	})
+
+	if err == nil {
+		err = flush()
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err := tables.Migrate(0); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to migrate restored database")
+	}
+
+	return report, nil
+}
+
+// validate reads the whole archive and checks it can be restored into tables
+func validate(open func() (io.ReadCloser, error), tables Tables, opts *RestoreOptions) (*Report, error) {
+	r, err := open()
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open archive")
+	}
+
+	defer r.Close()
+
+	known := map[string]bool{}
+
+	for _, table := range db.DataTables() {
+		known[table] = true
+	}
+
+	header, trailer, err := Read(r, opts.Passphrase, func(rec *Record) error {
+		if !known[rec.Table] {
+			return stacktrace.NewError("archive holds unknown table '%v'", rec.Table)
+		}
+
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Driver != tables.Driver() {
+		return nil, stacktrace.NewError("archive was taken from a %v database and cannot be restored to %v", header.Driver, tables.Driver())
+	}
+
+	current, latest, err := tables.Schema()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if header.Schema > latest {
+		return nil, stacktrace.NewError("archive schema %v is newer than this hub supports (%v), restore with a newer hub", header.Schema, latest)
+	}
+
+	if current > header.Schema {
+		return nil, stacktrace.NewError("database schema %v is newer than archive schema %v, restore into a new database or migrate down to %v first", current, header.Schema, header.Schema)
+	}
+
+	report := &Report{
+		Header: header,
+		Schema: current,
+	}
+
+	occupied := []string{}
+
+	for _, table := range db.DataTables() {
+		existing, err := tables.Count(table)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to count table '%v'", table)
+		}
+
+		if existing > 0 {
+			occupied = append(occupied, table)
+		}
+
+		report.Tables = append(report.Tables, &TableReport{
+			Table:    table,
+			Archived: trailer.Counts[table],
+			Existing: existing,
+		})
+	}
+
+	sort.Strings(occupied)
+
+	if len(occupied) > 0 && !opts.Replace {
+		return report, stacktrace.NewError("tables %v hold documents, restore into an empty database or replace them", strings.Join(occupied, ", "))
+	}
+
+	return report, nil
+}
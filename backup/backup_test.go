@@ -0,0 +1,220 @@
+package backup
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/embedded"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type doc struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type BackupTestSuite struct {
+	suite.Suite
+	source *EmbeddedTables
+	target *EmbeddedTables
+}
+
+func (t *BackupTestSuite) SetupTest() {
+	sdb, _ := embedded.Open("")
+	tdb, _ := embedded.Open("")
+
+	t.source = &EmbeddedTables{DB: sdb}
+	t.target = &EmbeddedTables{DB: tdb}
+
+	sdb.Put(string(db.UserTable), "u1", &doc{ID: "u1", Name: "admin"})
+	sdb.Put(string(db.DeviceTable), "d1", &doc{ID: "d1", Name: "web01"})
+	sdb.Put(string(db.DeviceTable), "d2", &doc{ID: "d2", Name: "web02"})
+}
+
+func (t *BackupTestSuite) backup(passphrase string) []byte {
+	buf := &bytes.Buffer{}
+
+	trailer, err := Backup(buf, t.source, []byte(passphrase))
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 2, trailer.Counts[string(db.DeviceTable)])
+	assert.Equal(t.T(), 0, trailer.Counts[string(db.MemberTable)])
+
+	return buf.Bytes()
+}
+
+func opener(archive []byte) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(archive)), nil
+	}
+}
+
+func (t *BackupTestSuite) names(tables *EmbeddedTables, table string) []string {
+	names := []string{}
+
+	tables.DB.Scan(table, false, func(id string, raw []byte) (bool, error) {
+		names = append(names, id)
+		return true, nil
+	})
+
+	return names
+}
+
+func (t *BackupTestSuite) Test_encrypted_archive_restores_every_table() {
+	archive := t.backup("hunter2")
+
+	assert.False(t.T(), bytes.Contains(archive, []byte("web01")))
+
+	report, err := Restore(opener(archive), t.target, &RestoreOptions{Passphrase: []byte("hunter2")})
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), report.Header.Encrypted)
+	assert.Equal(t.T(), "embedded", report.Header.Driver)
+	assert.Equal(t.T(), []string{"u1"}, t.names(t.target, string(db.UserTable)))
+	assert.Equal(t.T(), []string{"d1", "d2"}, t.names(t.target, string(db.DeviceTable)))
+
+	d := &doc{}
+	t.target.DB.Get(string(db.DeviceTable), "d2", d)
+	assert.Equal(t.T(), "web02", d.Name)
+}
+
+func (t *BackupTestSuite) Test_encrypted_archive_spans_chunks() {
+	noise := make([]byte, 3*chunkSize)
+	rand.Read(noise)
+
+	t.source.DB.Put(string(db.EventTable), "e1", &doc{ID: "e1", Name: hex.EncodeToString(noise)})
+
+	_, err := Restore(opener(t.backup("hunter2")), t.target, &RestoreOptions{Passphrase: []byte("hunter2")})
+
+	assert.Nil(t.T(), err)
+
+	d := &doc{}
+	t.target.DB.Get(string(db.EventTable), "e1", d)
+	assert.Equal(t.T(), hex.EncodeToString(noise), d.Name)
+}
+
+func (t *BackupTestSuite) Test_encrypted_archive_requires_the_passphrase() {
+	archive := t.backup("hunter2")
+
+	_, err := Restore(opener(archive), t.target, &RestoreOptions{})
+	assert.Equal(t.T(), ErrPassphraseRequired, err)
+
+	_, err = Restore(opener(archive), t.target, &RestoreOptions{Passphrase: []byte("wrong")})
+	assert.NotNil(t.T(), err)
+	assert.Equal(t.T(), 0, t.target.DB.Count(string(db.DeviceTable)))
+}
+
+func (t *BackupTestSuite) Test_truncated_archive_restores_nothing() {
+	for _, passphrase := range []string{"", "hunter2"} {
+		archive := t.backup(passphrase)
+
+		_, err := Restore(opener(archive[:len(archive)-10]), t.target, &RestoreOptions{Passphrase: []byte(passphrase)})
+
+		assert.NotNil(t.T(), err, passphrase)
+		assert.Equal(t.T(), 0, t.target.DB.Count(string(db.UserTable)), passphrase)
+	}
+}
+
+func (t *BackupTestSuite) Test_dry_run_reports_without_writing() {
+	t.target.DB.Put(string(db.DeviceTable), "d9", &doc{ID: "d9"})
+
+	report, err := Restore(opener(t.backup("")), t.target, &RestoreOptions{DryRun: true, Replace: true})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"d9"}, t.names(t.target, string(db.DeviceTable)))
+
+	for _, table := range report.Tables {
+		if table.Table == string(db.DeviceTable) {
+			assert.Equal(t.T(), 2, table.Archived)
+			assert.Equal(t.T(), 1, table.Existing)
+		}
+	}
+}
+
+func (t *BackupTestSuite) Test_restore_into_occupied_tables_requires_replace() {
+	t.target.DB.Put(string(db.DeviceTable), "d9", &doc{ID: "d9"})
+	archive := t.backup("")
+
+	_, err := Restore(opener(archive), t.target, &RestoreOptions{})
+
+	assert.NotNil(t.T(), err)
+	assert.True(t.T(), strings.Contains(err.Error(), string(db.DeviceTable)))
+	assert.Equal(t.T(), 0, t.target.DB.Count(string(db.UserTable)))
+
+	safeguarded := 0
+	safeguard := func() error {
+		safeguarded++
+		return nil
+	}
+
+	_, err = Restore(opener(archive), t.target, &RestoreOptions{Replace: true, Safeguard: safeguard})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, safeguarded)
+	assert.Equal(t.T(), []string{"d1", "d2"}, t.names(t.target, string(db.DeviceTable)))
+}
+
+func (t *BackupTestSuite) Test_replace_requires_a_safeguard_backup() {
+	t.target.DB.Put(string(db.DeviceTable), "d9", &doc{ID: "d9"})
+	archive := t.backup("")
+
+	_, err := Restore(opener(archive), t.target, &RestoreOptions{Replace: true})
+
+	assert.Equal(t.T(), ErrSafeguardRequired, err)
+	assert.Equal(t.T(), []string{"d9"}, t.names(t.target, string(db.DeviceTable)))
+
+	_, err = Restore(opener(archive), t.target, &RestoreOptions{
+		Replace: true,
+		Safeguard: func() error {
+			return errors.New("disk full")
+		},
+	})
+
+	assert.NotNil(t.T(), err)
+	assert.Equal(t.T(), []string{"d9"}, t.names(t.target, string(db.DeviceTable)))
+	assert.Equal(t.T(), 0, t.target.DB.Count(string(db.UserTable)))
+}
+
+func (t *BackupTestSuite) Test_safeguard_backup_restores_the_replaced_database() {
+	t.target.DB.Put(string(db.DeviceTable), "d9", &doc{ID: "d9"})
+	safety := &bytes.Buffer{}
+
+	_, err := Restore(opener(t.backup("")), t.target, &RestoreOptions{
+		Replace: true,
+		Safeguard: func() error {
+			_, err := Backup(safety, t.target, nil)
+			return err
+		},
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"d1", "d2"}, t.names(t.target, string(db.DeviceTable)))
+
+	_, err = Restore(opener(safety.Bytes()), t.target, &RestoreOptions{Replace: true, Safeguard: func() error { return nil }})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"d9"}, t.names(t.target, string(db.DeviceTable)))
+	assert.Equal(t.T(), 0, t.target.DB.Count(string(db.UserTable)))
+}
+
+func (t *BackupTestSuite) Test_encrypted_archive_with_trailing_data_restores_nothing() {
+	archive := append(t.backup("hunter2"), 0)
+
+	_, err := Restore(opener(archive), t.target, &RestoreOptions{Passphrase: []byte("hunter2")})
+
+	assert.NotNil(t.T(), err)
+	assert.True(t.T(), strings.Contains(err.Error(), "after its final chunk"))
+	assert.Equal(t.T(), 0, t.target.DB.Count(string(db.UserTable)))
+}
+
+func TestBackupTestSuite(t *testing.T) {
+	suite.Run(t, new(BackupTestSuite))
+}
@@ -0,0 +1,205 @@
+package backup
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"io"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	saltSize = 16
+
+	// chunkSize is the plaintext size of each encrypted chunk. Chunks are
+	// authenticated separately so archives are encrypted and decrypted as they
+	// stream.
+	chunkSize = 64 * 1024
+
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+// deriveKey derives the archive key from the passphrase
+func deriveKey(passphrase []byte, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to derive archive key")
+	}
+
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create cipher")
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of a chunk. The key is unique to the archive so a
+// counter is a safe nonce. The last chunk is flagged so a truncated archive
+// cannot pass as complete.
+func chunkNonce(aead cipher.AEAD, counter uint64, final bool) []byte {
+	nonce := make([]byte, aead.NonceSize())
+
+	if final {
+		nonce[0] = 1
+	}
+
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+
+	return nonce
+}
+
+// encryptWriter writes length prefixed AES-256-GCM chunks
+type encryptWriter struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+}
+
+func newEncryptWriter(w io.Writer, passphrase []byte, salt []byte, aad []byte) (*encryptWriter, error) {
+	aead, err := deriveKey(passphrase, salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptWriter{
+		w:    w,
+		aead: aead,
+		aad:  aad,
+	}, nil
+}
+
+func (t *encryptWriter) Write(p []byte) (int, error) {
+	t.buf = append(t.buf, p...)
+
+	// a full chunk is held back until more data arrives as the last chunk must
+	// be written flagged as final
+	for len(t.buf) > chunkSize {
+		if err := t.flush(t.buf[:chunkSize], false); err != nil {
+			return 0, err
+		}
+
+		t.buf = t.buf[chunkSize:]
+	}
+
+	return len(p), nil
+}
+
+// Close writes the final chunk
+func (t *encryptWriter) Close() error {
+	err := t.flush(t.buf, true)
+	t.buf = nil
+
+	return err
+}
+
+func (t *encryptWriter) flush(plain []byte, final bool) error {
+	ciphertext := t.aead.Seal(nil, chunkNonce(t.aead, t.counter, final), plain, t.aad)
+	t.counter++
+
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(len(ciphertext)))
+
+	if _, err := t.w.Write(append(size, ciphertext...)); err != nil {
+		return stacktrace.Propagate(err, "failed to write archive")
+	}
+
+	return nil
+}
+
+// decryptReader reads the chunks written by encryptWriter
+type decryptReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	aad     []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, passphrase []byte, salt []byte, aad []byte) (*decryptReader, error) {
+	aead, err := deriveKey(passphrase, salt)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:    r,
+		aead: aead,
+		aad:  aad,
+	}, nil
+}
+
+func (t *decryptReader) Read(p []byte) (int, error) {
+	for len(t.buf) == 0 {
+		if t.done {
+			return 0, io.EOF
+		}
+
+		if err := t.next(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, t.buf)
+	t.buf = t.buf[n:]
+
+	return n, nil
+}
+
+func (t *decryptReader) next() error {
+	size := make([]byte, 4)
+
+	if _, err := io.ReadFull(t.r, size); err != nil {
+		return stacktrace.NewError("archive is truncated")
+	}
+
+	n := binary.BigEndian.Uint32(size)
+
+	if n > chunkSize+uint32(t.aead.Overhead()) {
+		return stacktrace.NewError("archive is corrupt")
+	}
+
+	ciphertext := make([]byte, n)
+
+	if _, err := io.ReadFull(t.r, ciphertext); err != nil {
+		return stacktrace.NewError("archive is truncated")
+	}
+
+	plain, err := t.aead.Open(nil, chunkNonce(t.aead, t.counter, false), ciphertext, t.aad)
+
+	if err != nil {
+		plain, err = t.aead.Open(nil, chunkNonce(t.aead, t.counter, true), ciphertext, t.aad)
+
+		if err != nil {
+			return stacktrace.NewError("failed to decrypt archive, the passphrase is wrong or the archive is corrupt")
+		}
+
+		t.done = true
+
+		_, err = io.ReadFull(t.r, make([]byte, 1))
+
+		if err == nil {
+			return stacktrace.NewError("archive has data after its final chunk")
+		}
+
+		if err != io.EOF {
+			return stacktrace.Propagate(err, "failed to read archive")
+		}
+	}
+
+	t.counter++
+	t.buf = plain
+
+	return nil
+}
@@ -0,0 +1,55 @@
+package backup
+
+import (
+	"github.com/deviceio/hub/embedded"
+)
+
+// EmbeddedTables reads and writes the hub tables of an embedded database
+type EmbeddedTables struct {
+	DB *embedded.DB
+}
+
+func (t *EmbeddedTables) Driver() string {
+	return "embedded"
+}
+
+// Schema returns 0 as the embedded backend has no schema
+func (t *EmbeddedTables) Schema() (int, int, error) {
+	return 0, 0, nil
+}
+
+func (t *EmbeddedTables) Migrate(target int) error {
+	return nil
+}
+
+func (t *EmbeddedTables) Count(table string) (int, error) {
+	return t.DB.Count(table), nil
+}
+
+func (t *EmbeddedTables) Scan(table string, fn func(rec *Record) error) error {
+	return t.DB.Scan(table, false, func(id string, doc []byte) (bool, error) {
+		if err := fn(&Record{Table: table, ID: id, Doc: doc}); err != nil {
+			return false, err
+		}
+
+		return true, nil
+	})
+}
+
+func (t *EmbeddedTables) Clear(table string) error {
+	_, err := t.DB.DeleteWhere(table, func(id string, doc []byte) bool {
+		return true
+	})
+
+	return err
+}
+
+func (t *EmbeddedTables) Load(table string, recs []*Record) error {
+	for _, rec := range recs {
+		if err := t.DB.Put(table, rec.ID, rec.Doc); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
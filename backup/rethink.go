@@ -0,0 +1,121 @@
+package backup
+
+import (
+	"encoding/json"
+
+	"github.com/deviceio/hub/db"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// RethinkTables reads and writes the hub tables of the rethinkdb database of
+// db.Session. Times and binary values are kept in rethinkdb's own json encoding
+// so documents restore unchanged.
+type RethinkTables struct{}
+
+func (t *RethinkTables) Driver() string {
+	return "rethinkdb"
+}
+
+func (t *RethinkTables) Schema() (int, int, error) {
+	current, err := db.SchemaVersion()
+
+	if err != nil {
+		return 0, 0, err
+	}
+
+	return current, db.LatestVersion(), nil
+}
+
+func (t *RethinkTables) Migrate(target int) error {
+	return db.MigrateUp(target)
+}
+
+func (t *RethinkTables) Count(table string) (int, error) {
+	cursor, err := r.DB(db.Database).Table(table).Count().Run(db.Session)
+
+	if err != nil {
+		return 0, stacktrace.Propagate(err, "failed to count table '%v'", table)
+	}
+
+	n := 0
+
+	if err = cursor.One(&n); err != nil {
+		return 0, stacktrace.Propagate(err, "failed to read count of table '%v'", table)
+	}
+
+	return n, nil
+}
+
+func (t *RethinkTables) Scan(table string, fn func(rec *Record) error) error {
+	cursor, err := r.DB(db.Database).Table(table).OrderBy(r.OrderByOpts{Index: "id"}).Run(db.Session, r.RunOpts{
+		TimeFormat:   "raw",
+		BinaryFormat: "raw",
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query table '%v'", table)
+	}
+
+	defer cursor.Close()
+
+	for {
+		raw, ok := cursor.NextResponse()
+
+		if !ok {
+			break
+		}
+
+		doc := struct {
+			ID string `json:"id"`
+		}{}
+
+		if err := json.Unmarshal(raw, &doc); err != nil {
+			return stacktrace.Propagate(err, "failed to read document of table '%v'", table)
+		}
+
+		if err := fn(&Record{Table: table, ID: doc.ID, Doc: raw}); err != nil {
+			return err
+		}
+	}
+
+	if err := cursor.Err(); err != nil {
+		return stacktrace.Propagate(err, "failed to read table '%v'", table)
+	}
+
+	return nil
+}
+
+func (t *RethinkTables) Clear(table string) error {
+	if _, err := r.DB(db.Database).Table(table).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete documents of table '%v'", table)
+	}
+
+	return nil
+}
+
+func (t *RethinkTables) Load(table string, recs []*Record) error {
+	docs := []json.RawMessage{}
+
+	for _, rec := range recs {
+		docs = append(docs, rec.Doc)
+	}
+
+	encoded, err := json.Marshal(docs)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode documents")
+	}
+
+	// r.JSON has the server parse the documents, turning the raw time and binary
+	// pseudo types back into values
+	_, err = r.DB(db.Database).Table(table).Insert(r.JSON(string(encoded)), r.InsertOpts{
+		Conflict: "replace",
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to insert documents into table '%v'", table)
+	}
+
+	return nil
+}
@@ -0,0 +1,306 @@
+package cache
+
+import (
+	"reflect"
+	"sync"
+	"time"
+)
+
+// Config describes a cache
+type Config struct {
+	// Name labels the cache in logs and metrics
+	Name string
+
+	Source Source
+
+	// Key returns the primary key of an item
+	Key func(item interface{}) string
+
+	// Indexes are secondary indexes by name. Each returns the keys an item is
+	// found under.
+	Indexes map[string]func(item interface{}) []string
+
+	// OnChange is called with every change applied after the cache first became
+	// ready, including differences found when resyncing after a reconnect. Old is
+	// nil for created items and New is nil for deleted items.
+	OnChange func(old interface{}, new interface{})
+}
+
+// Cache is an in-memory copy of a table kept current by its changefeed. Every
+// (re)connection of the feed loads the full table so a broken feed never leaves
+// the cache stale.
+type Cache struct {
+	config *Config
+
+	mu      sync.RWMutex
+	items   map[string]interface{}
+	indexes map[string]map[string]map[string]interface{}
+
+	// pending collects the initial items of a (re)connected feed until it is ready
+	pending map[string]interface{}
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// New instantiates an empty cache. It is not ready until Start has loaded the
+// source or Replace is called.
+func New(config *Config) *Cache {
+	return &Cache{
+		config:  config,
+		items:   map[string]interface{}{},
+		indexes: buildIndexes(config, map[string]interface{}{}),
+		ready:   make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+}
+
+// Start follows the source until Stop is called
+func (t *Cache) Start() {
+	Follow(t.config.Name, t.config.Source, true, t.stop, t.apply)
+}
+
+// Stop ends Start
+func (t *Cache) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
+
+// Ready reports if the cache has completed its initial load
+func (t *Cache) Ready() bool {
+	select {
+	case <-t.ready:
+		return true
+	default:
+		return false
+	}
+}
+
+// WaitReady blocks until the cache is ready, failing with ErrNotReady after timeout
+func (t *Cache) WaitReady(timeout time.Duration) error {
+	if t.Ready() {
+		return nil
+	}
+
+	select {
+	case <-t.ready:
+		return nil
+	case <-time.After(timeout):
+		return &ErrNotReady{Cache: t.config.Name}
+	}
+}
+
+// Get returns the item with the primary key or nil
+func (t *Cache) Get(key string) interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.items[key]
+}
+
+// Lookup returns the items found under key in the named secondary index
+func (t *Cache) Lookup(index string, key string) []interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	items := []interface{}{}
+
+	for _, item := range t.indexes[index][key] {
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// List returns every item
+func (t *Cache) List() []interface{} {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	items := make([]interface{}, 0, len(t.items))
+
+	for _, item := range t.items {
+		items = append(items, item)
+	}
+
+	return items
+}
+
+// Len returns the number of items
+func (t *Cache) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.items)
+}
+
+// Replace sets the contents of the cache as a resync of the source would,
+// reporting differences to OnChange once ready, and marks the cache ready. It
+// must not be called while Start is running.
+func (t *Cache) Replace(items ...interface{}) {
+	t.apply(&Change{State: StateInitializing})
+
+	for _, item := range items {
+		t.apply(&Change{New: item})
+	}
+
+	t.apply(&Change{State: StateReady})
+}
+
+func (t *Cache) apply(change *Change) {
+	switch change.State {
+	case StateInitializing:
+		t.mu.Lock()
+		t.pending = map[string]interface{}{}
+		t.mu.Unlock()
+		return
+	case StateReady:
+		t.resync()
+		return
+	case "":
+	default:
+		return
+	}
+
+	t.mu.Lock()
+
+	if t.pending != nil {
+		if change.New == nil {
+			delete(t.pending, t.config.Key(change.Old))
+		} else {
+			t.pending[t.config.Key(change.New)] = change.New
+		}
+
+		t.mu.Unlock()
+		return
+	}
+
+	if change.Old != nil {
+		key := t.config.Key(change.Old)
+
+		if current, ok := t.items[key]; ok {
+			t.unindex(key, current)
+			delete(t.items, key)
+		}
+	}
+
+	if change.New != nil {
+		key := t.config.Key(change.New)
+
+		if current, ok := t.items[key]; ok {
+			t.unindex(key, current)
+		}
+
+		t.items[key] = change.New
+		t.index(key, change.New)
+	}
+
+	cacheSize.WithLabelValues(t.config.Name).Set(float64(len(t.items)))
+	t.mu.Unlock()
+
+	if t.config.OnChange != nil && t.Ready() {
+		t.config.OnChange(change.Old, change.New)
+	}
+}
+
+// resync swaps in the items collected since the feed was (re)connected and
+// reports what changed while the feed was down
+func (t *Cache) resync() {
+	t.mu.Lock()
+
+	if t.pending == nil {
+		t.mu.Unlock()
+		return
+	}
+
+	previous := t.items
+
+	t.items = t.pending
+	t.indexes = buildIndexes(t.config, t.items)
+	t.pending = nil
+
+	cacheSize.WithLabelValues(t.config.Name).Set(float64(len(t.items)))
+	t.mu.Unlock()
+
+	wasReady := t.Ready()
+
+	t.readyOnce.Do(func() {
+		close(t.ready)
+	})
+
+	if !wasReady || t.config.OnChange == nil {
+		return
+	}
+
+	for key, old := range previous {
+		current, ok := t.items[key]
+
+		if !ok {
+			t.config.OnChange(old, nil)
+		} else if !reflect.DeepEqual(old, current) {
+			t.config.OnChange(old, current)
+		}
+	}
+
+	for key, current := range t.items {
+		if _, ok := previous[key]; !ok {
+			t.config.OnChange(nil, current)
+		}
+	}
+}
+
+func (t *Cache) index(key string, item interface{}) {
+	for name, fn := range t.config.Indexes {
+		for _, ikey := range fn(item) {
+			if t.indexes[name][ikey] == nil {
+				t.indexes[name][ikey] = map[string]interface{}{}
+			}
+
+			t.indexes[name][ikey][key] = item
+		}
+	}
+}
+
+func (t *Cache) unindex(key string, item interface{}) {
+	for name, fn := range t.config.Indexes {
+		for _, ikey := range fn(item) {
+			delete(t.indexes[name][ikey], key)
+
+			if len(t.indexes[name][ikey]) == 0 {
+				delete(t.indexes[name], ikey)
+			}
+		}
+	}
+}
+
+func buildIndexes(config *Config, items map[string]interface{}) map[string]map[string]map[string]interface{} {
+	indexes := map[string]map[string]map[string]interface{}{}
+
+	for name, fn := range config.Indexes {
+		indexes[name] = map[string]map[string]interface{}{}
+
+		for key, item := range items {
+			for _, ikey := range fn(item) {
+				if indexes[name][ikey] == nil {
+					indexes[name][ikey] = map[string]interface{}{}
+				}
+
+				indexes[name][ikey][key] = item
+			}
+		}
+	}
+
+	return indexes
+}
+
+// ErrNotReady is returned when a cache has not completed its initial load in time
+type ErrNotReady struct {
+	Cache string
+}
+
+func (t *ErrNotReady) Error() string {
+	return "cache '" + t.Cache + "' is not ready"
+}
@@ -0,0 +1,212 @@
+package cache
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cenk/backoff"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type item struct {
+	ID    string
+	Login string
+}
+
+// memoryFeed replays a fixed list of changes then ends with err
+type memoryFeed struct {
+	changes []*Change
+	err     error
+	wait    chan struct{}
+}
+
+func (t *memoryFeed) Next() (*Change, bool) {
+	if len(t.changes) == 0 {
+		if t.wait != nil {
+			<-t.wait
+		}
+
+		return nil, false
+	}
+
+	change := t.changes[0]
+	t.changes = t.changes[1:]
+
+	return change, true
+}
+
+func (t *memoryFeed) Err() error {
+	return t.err
+}
+
+func (t *memoryFeed) Close() error {
+	return nil
+}
+
+// memorySource returns its feeds in order, failing when they run out
+type memorySource struct {
+	mu     sync.Mutex
+	feeds  []*memoryFeed
+	opened int
+}
+
+func (t *memorySource) Changes(includeInitial bool) (Feed, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.opened++
+
+	if len(t.feeds) == 0 {
+		return nil, errors.New("connection refused")
+	}
+
+	feed := t.feeds[0]
+	t.feeds = t.feeds[1:]
+
+	return feed, nil
+}
+
+func initial(items ...*item) []*Change {
+	changes := []*Change{{State: StateInitializing}}
+
+	for _, i := range items {
+		changes = append(changes, &Change{New: i})
+	}
+
+	return append(changes, &Change{State: StateReady})
+}
+
+type CacheTestSuite struct {
+	suite.Suite
+	changes [][2]interface{}
+	mu      sync.Mutex
+}
+
+func (t *CacheTestSuite) SetupTest() {
+	t.changes = nil
+
+	newBackOff = func() backoff.BackOff {
+		return &backoff.ZeroBackOff{}
+	}
+}
+
+func (t *CacheTestSuite) newCache(source Source) *Cache {
+	return New(&Config{
+		Name:   "test",
+		Source: source,
+		Key: func(i interface{}) string {
+			return i.(*item).ID
+		},
+		Indexes: map[string]func(interface{}) []string{
+			"login": func(i interface{}) []string {
+				return []string{i.(*item).Login}
+			},
+		},
+		OnChange: func(old interface{}, new interface{}) {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.changes = append(t.changes, [2]interface{}{old, new})
+		},
+	})
+}
+
+func (t *CacheTestSuite) Test_WaitReady_fails_fast_before_initial_load() {
+	c := t.newCache(&memorySource{})
+
+	err := c.WaitReady(10 * time.Millisecond)
+
+	assert.IsType(t.T(), &ErrNotReady{}, err)
+	assert.False(t.T(), c.Ready())
+}
+
+func (t *CacheTestSuite) Test_Replace_indexes_items() {
+	c := t.newCache(&memorySource{})
+
+	c.Replace(&item{ID: "1", Login: "admin"}, &item{ID: "2", Login: "ops"})
+
+	assert.Nil(t.T(), c.WaitReady(0))
+	assert.Equal(t.T(), "admin", c.Get("1").(*item).Login)
+	assert.Equal(t.T(), "2", c.Lookup("login", "ops")[0].(*item).ID)
+	assert.Equal(t.T(), 0, len(c.Lookup("login", "nobody")))
+	assert.Equal(t.T(), 0, len(t.changes), "initial load is not reported as changes")
+}
+
+func (t *CacheTestSuite) Test_changes_update_items_and_indexes() {
+	c := t.newCache(&memorySource{})
+	c.Replace(&item{ID: "1", Login: "admin"})
+
+	c.apply(&Change{Old: &item{ID: "1", Login: "admin"}, New: &item{ID: "1", Login: "root"}})
+	c.apply(&Change{New: &item{ID: "2", Login: "ops"}})
+	c.apply(&Change{Old: &item{ID: "2", Login: "ops"}})
+
+	assert.Equal(t.T(), 1, c.Len())
+	assert.Equal(t.T(), 0, len(c.Lookup("login", "admin")))
+	assert.Equal(t.T(), "1", c.Lookup("login", "root")[0].(*item).ID)
+	assert.Equal(t.T(), 0, len(c.Lookup("login", "ops")))
+	assert.Equal(t.T(), 3, len(t.changes))
+}
+
+func (t *CacheTestSuite) Test_Start_reconnects_and_resyncs_after_feed_breaks() {
+	stop := make(chan struct{})
+	defer close(stop)
+
+	source := &memorySource{
+		feeds: []*memoryFeed{
+			{
+				changes: initial(&item{ID: "1", Login: "admin"}, &item{ID: "2", Login: "ops"}),
+				err:     errors.New("connection reset"),
+			},
+			{
+				// while disconnected user 2 was deleted and user 3 created
+				changes: initial(&item{ID: "1", Login: "admin"}, &item{ID: "3", Login: "dev"}),
+				wait:    stop,
+			},
+		},
+	}
+
+	c := t.newCache(source)
+	go c.Start()
+	defer c.Stop()
+
+	assert.Nil(t.T(), c.WaitReady(time.Second))
+
+	deadline := time.Now().Add(time.Second)
+
+	for c.Get("3") == nil && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.NotNil(t.T(), c.Get("3"))
+	assert.Nil(t.T(), c.Get("2"))
+	assert.Equal(t.T(), "3", c.Lookup("login", "dev")[0].(*item).ID)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	assert.Equal(t.T(), 2, len(t.changes), "resync reports what changed while disconnected")
+}
+
+func (t *CacheTestSuite) Test_Follow_retries_when_source_is_unavailable() {
+	stop := make(chan struct{})
+	source := &memorySource{}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		close(stop)
+	}()
+
+	Follow("test", source, true, stop, func(*Change) {})
+
+	source.mu.Lock()
+	defer source.mu.Unlock()
+
+	assert.True(t.T(), source.opened > 1)
+}
+
+func TestCacheTestSuite(t *testing.T) {
+	suite.Run(t, new(CacheTestSuite))
+}
@@ -0,0 +1,88 @@
+package cache
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cenk/backoff"
+)
+
+// newBackOff returns the reconnect policy of a feed. It retries forever.
+var newBackOff = func() backoff.BackOff {
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = 500 * time.Millisecond
+	b.MaxInterval = 30 * time.Second
+	b.MaxElapsedTime = 0
+
+	return b
+}
+
+// Follow delivers every change of the source's changefeed to fn, reopening the
+// feed with exponential backoff whenever it fails or ends. It returns only when
+// stop is closed. When includeInitial is set every reopened feed starts with
+// the full contents of the table so the receiver can resync.
+func Follow(name string, source Source, includeInitial bool, stop <-chan struct{}, fn func(*Change)) {
+	b := newBackOff()
+
+	for {
+		feed, err := source.Changes(includeInitial)
+
+		if err == nil {
+			received := false
+			closed := make(chan struct{})
+
+			go func() {
+				select {
+				case <-stop:
+					feed.Close()
+				case <-closed:
+				}
+			}()
+
+			for {
+				change, ok := feed.Next()
+
+				if !ok {
+					break
+				}
+
+				if !received {
+					received = true
+					b.Reset()
+				}
+
+				fn(change)
+			}
+
+			err = feed.Err()
+			close(closed)
+			feed.Close()
+		}
+
+		select {
+		case <-stop:
+			return
+		default:
+		}
+
+		changefeedRestarts.WithLabelValues(name).Inc()
+
+		wait := b.NextBackOff()
+		entry := logger.WithFields(logrus.Fields{
+			"feed":  name,
+			"retry": wait.String(),
+		})
+
+		if err != nil {
+			entry = entry.WithField("error", err.Error())
+		}
+
+		entry.Error("changefeed ended, reconnecting")
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
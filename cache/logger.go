@@ -0,0 +1,5 @@
+package cache
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("cache")
@@ -0,0 +1,19 @@
+package cache
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	cacheSize = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "deviceio_hub_cluster_cache_entries",
+		Help: "Number of entries held in each cluster cache",
+	}, []string{"cache"})
+
+	changefeedRestarts = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deviceio_hub_cluster_changefeed_restarts_total",
+		Help: "Number of times a cluster changefeed ended and had to be re-established",
+	}, []string{"feed"})
+)
+
+func init() {
+	prometheus.MustRegister(cacheSize, changefeedRestarts)
+}
@@ -0,0 +1,130 @@
+package cache
+
+import (
+	"github.com/deviceio/hub/db"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+	"gopkg.in/gorethink/gorethink.v2/encoding"
+)
+
+const (
+	// StateInitializing is reported by a feed before it delivers the initial items
+	StateInitializing = "initializing"
+
+	// StateReady is reported by a feed once every initial item has been delivered
+	StateReady = "ready"
+)
+
+// Change is a single message of a changefeed. State messages carry no items.
+type Change struct {
+	Old   interface{}
+	New   interface{}
+	State string
+}
+
+// Feed is an open changefeed
+type Feed interface {
+	// Next blocks until the next change is available. It returns false when the
+	// feed has ended.
+	Next() (*Change, bool)
+
+	// Err returns the error that ended the feed, if any
+	Err() error
+
+	Close() error
+}
+
+// Source opens changefeeds over a table
+type Source interface {
+	// Changes opens a changefeed. When includeInitial is set the feed first
+	// reports StateInitializing, then every current item as a change without an
+	// Old value, then StateReady.
+	Changes(includeInitial bool) (Feed, error)
+}
+
+// RethinkSource is a Source over a rethinkdb table
+type RethinkSource struct {
+	Table string
+
+	// New returns a pointer to decode an item of the table into
+	New func() interface{}
+}
+
+func (t *RethinkSource) Changes(includeInitial bool) (Feed, error) {
+	opts := r.ChangesOpts{}
+
+	if includeInitial {
+		opts.IncludeInitial = true
+		opts.IncludeStates = true
+	}
+
+	cursor, err := r.DB(db.Database).Table(t.Table).Changes(opts).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open changefeed on table '%v'", t.Table)
+	}
+
+	return &rethinkFeed{
+		source: t,
+		cursor: cursor,
+	}, nil
+}
+
+type rethinkFeed struct {
+	source *RethinkSource
+	cursor *r.Cursor
+	err    error
+}
+
+func (t *rethinkFeed) Next() (*Change, bool) {
+	for {
+		var raw map[string]interface{}
+
+		if !t.cursor.Next(&raw) {
+			return nil, false
+		}
+
+		change := &Change{}
+
+		if state, ok := raw["state"].(string); ok {
+			change.State = state
+			return change, true
+		}
+
+		if v := raw["old_val"]; v != nil {
+			change.Old = t.source.New()
+
+			if err := encoding.Decode(change.Old, v); err != nil {
+				t.err = stacktrace.Propagate(err, "failed to decode changefeed item of table '%v'", t.source.Table)
+				return nil, false
+			}
+		}
+
+		if v := raw["new_val"]; v != nil {
+			change.New = t.source.New()
+
+			if err := encoding.Decode(change.New, v); err != nil {
+				t.err = stacktrace.Propagate(err, "failed to decode changefeed item of table '%v'", t.source.Table)
+				return nil, false
+			}
+		}
+
+		if change.Old == nil && change.New == nil {
+			continue
+		}
+
+		return change, true
+	}
+}
+
+func (t *rethinkFeed) Err() error {
+	if t.err != nil {
+		return t.err
+	}
+
+	return t.cursor.Err()
+}
+
+func (t *rethinkFeed) Close() error {
+	return t.cursor.Close()
+}
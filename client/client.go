@@ -0,0 +1,313 @@
+// Package client is the Go client of the hub api. Requests are signed with the
+// DEVICEIO-HUB-AUTH scheme by Transport, with a registered ssh key by
+// SSHTransport, or bear a service account token with TokenTransport. Each may
+// also be used on its own with any http.Client.
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/event"
+	"github.com/palantir/stacktrace"
+)
+
+type Config struct {
+	// URL of the hub api such as https://hub.example.com:4431
+	URL string
+
+	Credentials *Credentials
+
+	// Token is a service account token sent instead of signing with
+	// Credentials
+	Token string
+
+	// SSHCredentials sign with a registered ssh key instead of Credentials
+	SSHCredentials *SSHCredentials
+
+	// TLSConfig of connections to the hub. A hub started without a certificate
+	// serves a temporary self signed one which is only accepted with
+	// InsecureSkipVerify.
+	TLSConfig *tls.Config
+}
+
+// Client calls the hub api
+type Client struct {
+	url  *url.URL
+	http *http.Client
+}
+
+// Error is returned when the hub responds with an unexpected status
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (t *Error) Error() string {
+	if t.Message == "" {
+		return fmt.Sprintf("hub responded %v %v", t.StatusCode, http.StatusText(t.StatusCode))
+	}
+
+	return fmt.Sprintf("hub responded %v %v: %v", t.StatusCode, http.StatusText(t.StatusCode), t.Message)
+}
+
+// Device is a device known to the hub cluster
+type Device struct {
+	ID           string    `json:"id"`
+	Hostname     string    `json:"hostname,omitempty"`
+	Platform     string    `json:"platform,omitempty"`
+	Architecture string    `json:"architecture,omitempty"`
+	Tags         []string  `json:"tags,omitempty"`
+	Connected    bool      `json:"connected"`
+	Member       string    `json:"member,omitempty"`
+	LastSeen     time.Time `json:"lastSeen"`
+	Blocked      bool      `json:"blocked,omitempty"`
+}
+
+// User is a hub user
+type User struct {
+	ID        string `json:"id"`
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	Admin     bool   `json:"admin"`
+	Disabled  bool   `json:"disabled"`
+	PublicKey string `json:"publicKey"`
+}
+
+// DeviceEventOptions filter the events of a device
+type DeviceEventOptions struct {
+	// Limit is the maximum number of events returned. The hub default applies if zero.
+	Limit int
+
+	// Types are event type patterns such as device.alert or device.*
+	Types []string
+}
+
+func New(config *Config) (*Client, error) {
+	if config.Credentials == nil && config.Token == "" && config.SSHCredentials == nil {
+		return nil, stacktrace.NewError("credentials are nil")
+	}
+
+	u, err := url.Parse(config.URL)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid hub url %v", config.URL)
+	}
+
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, stacktrace.NewError("hub url %v must be http or https", config.URL)
+	}
+
+	base := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		TLSClientConfig:     config.TLSConfig,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        100,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	var transport http.RoundTripper = &Transport{
+		Credentials: config.Credentials,
+		Base:        base,
+	}
+
+	if config.Token != "" {
+		transport = &TokenTransport{
+			Token: config.Token,
+			Base:  base,
+		}
+	} else if config.SSHCredentials != nil {
+		transport = &SSHTransport{
+			Credentials: config.SSHCredentials,
+			Base:        base,
+		}
+	}
+
+	return &Client{
+		url: u,
+		http: &http.Client{
+			Transport: transport,
+		},
+	}, nil
+}
+
+// NewRequest returns a request of the api path, which may include a query, that
+// is signed when sent with Do
+func (t *Client) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	ref, err := url.Parse(path)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid path %v", path)
+	}
+
+	u := *t.url
+	u.Path = strings.TrimSuffix(t.url.Path, "/") + "/" + strings.TrimPrefix(ref.Path, "/")
+	u.RawPath = ""
+	u.RawQuery = ref.RawQuery
+
+	req, err := http.NewRequest(method, u.String(), body)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create request")
+	}
+
+	return req.WithContext(ctx), nil
+}
+
+// Do signs and sends the request. Responses are returned whatever their status.
+func (t *Client) Do(req *http.Request) (*http.Response, error) {
+	return t.http.Do(req)
+}
+
+// NewDeviceRequest returns a request proxied to the path of the device with the
+// id or hostname
+func (t *Client) NewDeviceRequest(ctx context.Context, deviceID string, method string, path string, body io.Reader) (*http.Request, error) {
+	if deviceID == "" {
+		return nil, stacktrace.NewError("device id empty")
+	}
+
+	return t.NewRequest(ctx, method, "/device/"+url.PathEscape(deviceID)+"/"+strings.TrimPrefix(path, "/"), body)
+}
+
+// DeviceRequest sends a request to the path of the device with the id or
+// hostname. The response is the device's and must be closed by the caller. The
+// hub responds 403 for blocked devices and 502 when the device is unreachable.
+func (t *Client) DeviceRequest(ctx context.Context, deviceID string, method string, path string, body io.Reader) (*http.Response, error) {
+	req, err := t.NewDeviceRequest(ctx, deviceID, method, path, body)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return t.Do(req)
+}
+
+// Devices lists the devices known to the hub cluster ordered by hostname
+func (t *Client) Devices(ctx context.Context) ([]*Device, error) {
+	devices := []*Device{}
+
+	if err := t.getJSON(ctx, "/v1/devices", &devices); err != nil {
+		return nil, err
+	}
+
+	return devices, nil
+}
+
+// Device returns the device with the id or hostname
+func (t *Client) Device(ctx context.Context, idOrHostname string) (*Device, error) {
+	device := &Device{}
+
+	if err := t.getJSON(ctx, "/v1/devices/"+url.PathEscape(idOrHostname), device); err != nil {
+		return nil, err
+	}
+
+	return device, nil
+}
+
+// DeviceEvents returns the retained events of the device newest first
+func (t *Client) DeviceEvents(ctx context.Context, deviceID string, opts *DeviceEventOptions) ([]*event.Event, error) {
+	query := url.Values{}
+
+	if opts != nil && opts.Limit > 0 {
+		query.Set("limit", strconv.Itoa(opts.Limit))
+	}
+
+	if opts != nil && len(opts.Types) > 0 {
+		query.Set("type", strings.Join(opts.Types, ","))
+	}
+
+	path := "/v1/device/" + url.PathEscape(deviceID) + "/events"
+
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	events := []*event.Event{}
+
+	if err := t.getJSON(ctx, path, &events); err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// Me returns the user the client is authenticated as
+func (t *Client) Me(ctx context.Context) (*User, error) {
+	user := &User{}
+
+	if err := t.getJSON(ctx, "/v1/users/me", user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// Users lists the hub users ordered by login. Requires an admin.
+func (t *Client) Users(ctx context.Context) ([]*User, error) {
+	users := []*User{}
+
+	if err := t.getJSON(ctx, "/v1/users", &users); err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+// User returns the user with the id, login or email. Requires an admin.
+func (t *Client) User(ctx context.Context, idLoginOrEmail string) (*User, error) {
+	user := &User{}
+
+	if err := t.getJSON(ctx, "/v1/users/"+url.PathEscape(idLoginOrEmail), user); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// getJSON decodes the json response of a GET request to the path into v
+func (t *Client) getJSON(ctx context.Context, path string, v interface{}) error {
+	req, err := t.NewRequest(ctx, "GET", path, nil)
+
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := t.Do(req)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "GET %v failed", path)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return stacktrace.Propagate(err, "GET %v returned invalid json", path)
+	}
+
+	return nil
+}
+
+// responseError reads the body of an unexpected response into an *Error
+func responseError(resp *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+
+	return &Error{
+		StatusCode: resp.StatusCode,
+		Message:    strings.TrimSpace(string(body)),
+	}
+}
@@ -0,0 +1,475 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deviceio/hub/api"
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/embedded"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+	"github.com/deviceio/shared/types"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// ClientTestSuite runs the client against an in-process hub backed by an
+// in-memory embedded store
+type ClientTestSuite struct {
+	suite.Suite
+	dir    string
+	edb    *embedded.DB
+	store  *cluster.Store
+	events *event.Bus
+	server *httptest.Server
+	admin  *Client
+	ops    *Client
+}
+
+func (t *ClientTestSuite) SetupSuite() {
+	key, _ := secret.GenerateKey()
+	keyring, _ := secret.NewKeyring(key)
+	secret.SetKeyring(keyring)
+
+	t.dir, _ = ioutil.TempDir("", "deviceio-hub-client")
+
+	cert, certkey := (&types.CertGen{
+		Host:      "localhost",
+		ValidFrom: "Jan 1 15:04:05 2011",
+		ValidFor:  time.Hour,
+		RsaBits:   2048,
+	}).Generate()
+
+	ioutil.WriteFile(filepath.Join(t.dir, "cert.pem"), cert, 0600)
+	ioutil.WriteFile(filepath.Join(t.dir, "key.pem"), certkey, 0600)
+
+	t.edb, _ = embedded.Open("")
+	t.store = cluster.NewEmbeddedStore(t.edb)
+	t.events = event.NewBus()
+
+	config := &cluster.Config{
+		BindAddr:    "127.0.0.1:0",
+		TLSCertPath: filepath.Join(t.dir, "cert.pem"),
+		TLSKeyPath:  filepath.Join(t.dir, "key.pem"),
+		Events:      t.events,
+		Store:       t.store,
+		LocalDeviceProxyFunc: func(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error {
+			body, _ := ioutil.ReadAll(r.Body)
+
+			rw.Header().Set("X-Device", deviceid)
+			rw.WriteHeader(http.StatusAccepted)
+			rw.Write([]byte(r.Method + " /" + path + "?" + r.URL.RawQuery + " " + string(body)))
+
+			return nil
+		},
+	}
+
+	clusterService := cluster.NewService(config)
+	go clusterService.Start()
+
+	router := mux.NewRouter()
+
+	for _, controller := range []api.Controller{
+		&api.UserController{ClusterService: clusterService},
+		&api.DeviceController{ClusterService: clusterService},
+		&api.EventController{ClusterService: clusterService},
+	} {
+		controller.RegisterRoutes(router)
+	}
+
+	t.server = httptest.NewTLSServer(router)
+
+	admin := cluster.NewAdmin(config)
+
+	t.admin = t.newClient(admin.AddUser("admin", "admin@localhost", true))
+	t.ops = t.newClient(admin.AddUser("ops", "ops@localhost", false))
+
+	t.store.Devices.Upsert(&cluster.Device{
+		ID:        "c5b9e3a2-0000-4000-8000-000000000001",
+		Hostname:  "web1",
+		Platform:  "linux",
+		Connected: true,
+	})
+
+	// wait for the cluster caches to load the users
+	deadline := time.Now().Add(10 * time.Second)
+
+	for {
+		_, err := t.admin.Me(context.Background())
+
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func (t *ClientTestSuite) TearDownSuite() {
+	t.server.Close()
+	t.edb.Close()
+	os.RemoveAll(t.dir)
+}
+
+func (t *ClientTestSuite) newClient(user *cluster.User, creds *cluster.Credentials, err error) *Client {
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	credentials, err := NewCredentials(user.ID, creds.TOTPSecret, creds.PrivateKey)
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	c, err := New(&Config{
+		URL:         t.server.URL,
+		Credentials: credentials,
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+	})
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	return c
+}
+
+func (t *ClientTestSuite) Test_Me_returns_the_signing_user() {
+	user, err := t.ops.Me(context.Background())
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "ops", user.Login)
+	assert.False(t.T(), user.Admin)
+}
+
+func (t *ClientTestSuite) Test_invalid_signatures_are_rejected() {
+	creds := *t.ops.http.Transport.(*Transport).Credentials
+	creds.PrivateKey = t.admin.http.Transport.(*Transport).Credentials.PrivateKey
+
+	c, _ := New(&Config{
+		URL:         t.server.URL,
+		Credentials: &creds,
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+	})
+
+	_, err := c.Me(context.Background())
+
+	failed, ok := err.(*Error)
+
+	assert.True(t.T(), ok)
+	assert.Equal(t.T(), http.StatusForbidden, failed.StatusCode)
+}
+
+func (t *ClientTestSuite) Test_Users_requires_an_admin() {
+	users, err := t.admin.Users(context.Background())
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 2, len(users))
+
+	user, err := t.admin.User(context.Background(), "ops@localhost")
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "ops", user.Login)
+
+	_, err = t.admin.User(context.Background(), "nobody")
+	assert.Equal(t.T(), http.StatusNotFound, err.(*Error).StatusCode)
+
+	_, err = t.ops.Users(context.Background())
+	assert.Equal(t.T(), http.StatusForbidden, err.(*Error).StatusCode)
+}
+
+func (t *ClientTestSuite) Test_Devices_lists_and_finds_devices() {
+	devices, err := t.ops.Devices(context.Background())
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, len(devices))
+	assert.Equal(t.T(), "web1", devices[0].Hostname)
+
+	device, err := t.ops.Device(context.Background(), "WEB1")
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), device.Connected)
+}
+
+func (t *ClientTestSuite) Test_DeviceRequest_proxies_to_the_device() {
+	resp, err := t.ops.DeviceRequest(context.Background(), "web1", "POST", "/fs/read?path=/etc", strings.NewReader("hello"))
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, _ := ioutil.ReadAll(resp.Body)
+
+	assert.Equal(t.T(), http.StatusAccepted, resp.StatusCode)
+	assert.Equal(t.T(), "web1", resp.Header.Get("X-Device"))
+	assert.Equal(t.T(), "POST /fs/read?path=/etc hello", string(body))
+}
+
+func (t *ClientTestSuite) Test_Events_streams_and_DeviceEvents_lists_events() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	stream, err := t.ops.Events(ctx, &EventOptions{Types: []string{"device.alert"}})
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	defer stream.Close()
+
+	published := event.New(event.DeviceAlert, map[string]interface{}{"message": "disk full"})
+	published.DeviceID = "c5b9e3a2-0000-4000-8000-000000000001"
+
+	t.events.Publish(published)
+
+	e, err := stream.Next()
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), published.ID, e.ID)
+	assert.Equal(t.T(), "disk full", e.Data["message"])
+	assert.Equal(t.T(), published.ID, stream.LastEventID())
+
+	var events []*event.Event
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if events, err = t.ops.DeviceEvents(ctx, published.DeviceID, &DeviceEventOptions{Limit: 10}); len(events) > 0 {
+			break
+		}
+	}
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, len(events))
+	assert.Equal(t.T(), published.ID, events[0].ID)
+}
+
+func (t *ClientTestSuite) Test_PinnedTLSConfig_accepts_only_the_pinned_certificate() {
+	cert, _ := x509.ParseCertificate(t.server.TLS.Certificates[0].Certificate[0])
+
+	pinned, err := PinnedTLSConfig("sha256:" + Fingerprint(cert))
+	assert.Nil(t.T(), err)
+
+	c, _ := New(&Config{
+		URL:         t.server.URL,
+		Credentials: t.ops.http.Transport.(*Transport).Credentials,
+		TLSConfig:   pinned,
+	})
+
+	_, err = c.Me(context.Background())
+	assert.Nil(t.T(), err)
+
+	other, _ := PinnedTLSConfig(strings.Repeat("ab", 32))
+	c, _ = New(&Config{
+		URL:         t.server.URL,
+		Credentials: t.ops.http.Transport.(*Transport).Credentials,
+		TLSConfig:   other,
+	})
+
+	_, err = c.Me(context.Background())
+	assert.NotNil(t.T(), err)
+
+	_, err = PinnedTLSConfig("not-a-fingerprint")
+	assert.NotNil(t.T(), err)
+}
+
+func (t *ClientTestSuite) Test_named_keys_sign_until_revoked() {
+	ctx := context.Background()
+
+	key, creds, err := t.ops.AddKey(ctx, "me", "laptop", 24*time.Hour)
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	assert.Equal(t.T(), key.ID, creds.KeyID)
+	assert.NotNil(t.T(), key.Expires)
+
+	laptop, _ := New(&Config{
+		URL:         t.server.URL,
+		Credentials: creds,
+		TLSConfig:   &tls.Config{InsecureSkipVerify: true},
+	})
+
+	// the key is usable once the hub observes it
+	var user *User
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if user, err = laptop.Me(ctx); err == nil {
+			break
+		}
+	}
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "ops", user.Login)
+
+	_, _, err = t.ops.AddKey(ctx, "admin", "sneaky", 0)
+	assert.Equal(t.T(), http.StatusForbidden, err.(*Error).StatusCode)
+
+	keys, err := t.admin.Keys(ctx, "ops")
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, len(keys))
+
+	assert.Nil(t.T(), t.ops.RevokeKey(ctx, "me", key.ID))
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err = laptop.Me(ctx); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t.T(), http.StatusForbidden, err.(*Error).StatusCode)
+
+	// the primary key is unaffected
+	_, err = t.ops.Me(ctx)
+	assert.Nil(t.T(), err)
+}
+
+func (t *ClientTestSuite) Test_service_account_tokens_reach_devices_in_scope() {
+	ctx := context.Background()
+	admin := cluster.NewAdmin(&cluster.Config{Store: t.store})
+
+	admin.AddServiceAccount(nil, "ci", "")
+
+	_, token, err := admin.AddServiceAccountToken(nil, "ci", "deploy", &cluster.TokenScope{
+		Devices: []string{"web*"},
+		Paths:   []string{"/fs"},
+		Methods: []string{"GET"},
+	}, time.Hour)
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	ci, _ := New(&Config{
+		URL:       t.server.URL,
+		Token:     token,
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	})
+
+	// the token is usable once the hub observes it
+	var resp *http.Response
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if resp, err = ci.DeviceRequest(ctx, "web1", "GET", "/fs/read", nil); err == nil && resp.StatusCode == http.StatusAccepted {
+			break
+		}
+	}
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), http.StatusAccepted, resp.StatusCode)
+	resp.Body.Close()
+
+	resp, err = ci.DeviceRequest(ctx, "web1", "POST", "/fs/write", nil)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), http.StatusForbidden, resp.StatusCode)
+	resp.Body.Close()
+
+	_, err = ci.Devices(ctx)
+	assert.Equal(t.T(), http.StatusForbidden, err.(*Error).StatusCode)
+
+	device, err := ci.Device(ctx, "web1")
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "web1", device.Hostname)
+}
+
+func (t *ClientTestSuite) Test_ssh_keys_sign_through_the_agent() {
+	ctx := context.Background()
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keyring := agent.NewKeyring()
+	keyring.Add(agent.AddedKey{PrivateKey: &edKey})
+
+	socket := filepath.Join(t.dir, "agent.sock")
+	listener, err := net.Listen("unix", socket)
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	defer listener.Close()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+
+			if err != nil {
+				return
+			}
+
+			go agent.ServeAgent(keyring, conn)
+		}
+	}()
+
+	previous := os.Getenv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", socket)
+	defer os.Setenv("SSH_AUTH_SOCK", previous)
+
+	signers, _ := keyring.Signers()
+	authorizedKey := string(ssh.MarshalAuthorizedKey(signers[0].PublicKey()))
+
+	key, err := t.admin.AddSSHKey(ctx, "me", "yubikey", authorizedKey, 0)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), ssh.FingerprintSHA256(signers[0].PublicKey()), key.Fingerprint)
+
+	signer, closer, err := AgentSigner(key.Fingerprint)
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	defer closer.Close()
+
+	me, _ := t.admin.Me(ctx)
+
+	yubikey, _ := New(&Config{
+		URL:            t.server.URL,
+		SSHCredentials: &SSHCredentials{UserID: me.ID, Signer: signer},
+		TLSConfig:      &tls.Config{InsecureSkipVerify: true},
+	})
+
+	var user *User
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if user, err = yubikey.Me(ctx); err == nil {
+			break
+		}
+	}
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "admin", user.Login)
+
+	_, _, err = AgentSigner("SHA256:unknown")
+	assert.NotNil(t.T(), err)
+
+	assert.Nil(t.T(), t.admin.RevokeKey(ctx, "me", key.ID))
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if _, err = yubikey.Me(ctx); err != nil {
+			break
+		}
+	}
+
+	assert.Equal(t.T(), http.StatusForbidden, err.(*Error).StatusCode)
+}
+
+func TestClientTestSuite(t *testing.T) {
+	suite.Run(t, new(ClientTestSuite))
+}
@@ -0,0 +1,94 @@
+package client
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Credentials identify a hub user and sign its api requests
+type Credentials struct {
+	// UserID is the id of the user. The hub also accepts its login or email.
+	UserID string
+
+	// KeyID selects the named key of the user the credentials are for. The
+	// user's primary key is used if empty.
+	KeyID string
+
+	// TOTPSecret is the base32 secret the passcode of each request is generated from
+	TOTPSecret string
+
+	// PrivateKey is the ed25519 key requests are signed with
+	PrivateKey ed25519.PrivateKey
+}
+
+// NewCredentials returns the credentials of a user from the id, totp secret and
+// base64 private key issued by the hub
+func NewCredentials(userID string, totpSecret string, privateKey string) (*Credentials, error) {
+	if userID == "" {
+		return nil, stacktrace.NewError("user id empty")
+	}
+
+	if totpSecret == "" {
+		return nil, stacktrace.NewError("totp secret empty")
+	}
+
+	key, err := base64.StdEncoding.DecodeString(privateKey)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "private key is not base64")
+	}
+
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, stacktrace.NewError("private key must be %v bytes, got %v", ed25519.PrivateKeySize, len(key))
+	}
+
+	return &Credentials{
+		UserID:     userID,
+		TOTPSecret: totpSecret,
+		PrivateKey: ed25519.PrivateKey(key),
+	}, nil
+}
+
+// credentialsFile is the json printed by the user add, user rotate-keys, user
+// key and recover-admin commands with -o json
+type credentialsFile struct {
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+
+	Credentials struct {
+		KeyID      string `json:"keyId"`
+		TOTPSecret string `json:"totpSecret"`
+		PrivateKey string `json:"privateKey"`
+	} `json:"credentials"`
+}
+
+// LoadCredentials reads credentials saved from the json output of the user
+// administration commands
+func LoadCredentials(path string) (*Credentials, error) {
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read credentials file %v", path)
+	}
+
+	file := &credentialsFile{}
+
+	if err := json.Unmarshal(data, file); err != nil {
+		return nil, stacktrace.Propagate(err, "credentials file %v is not valid json", path)
+	}
+
+	creds, err := NewCredentials(file.User.ID, file.Credentials.TOTPSecret, file.Credentials.PrivateKey)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid credentials file %v", path)
+	}
+
+	creds.KeyID = file.Credentials.KeyID
+
+	return creds, nil
+}
@@ -0,0 +1,127 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/deviceio/hub/event"
+	"github.com/palantir/stacktrace"
+)
+
+// EventOptions select the events of an event stream
+type EventOptions struct {
+	// Types are event type patterns such as device.* or auth.failed. Every
+	// event is streamed if empty.
+	Types []string
+
+	// LastEventID resumes a stream after the event with the id
+	LastEventID string
+}
+
+// EventStream reads the cluster wide events streamed by the hub
+type EventStream struct {
+	body        io.ReadCloser
+	reader      *bufio.Reader
+	lastEventID string
+}
+
+// Events opens an event stream. The stream ends when the context is cancelled,
+// the stream is closed or the hub ends it, such as when the user's sessions are
+// revoked. Open a new stream with the LastEventID of the old to resume it.
+func (t *Client) Events(ctx context.Context, opts *EventOptions) (*EventStream, error) {
+	if opts == nil {
+		opts = &EventOptions{}
+	}
+
+	path := "/v1/events"
+
+	if len(opts.Types) > 0 {
+		path += "?" + url.Values{"type": []string{strings.Join(opts.Types, ",")}}.Encode()
+	}
+
+	req, err := t.NewRequest(ctx, "GET", path, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "text/event-stream")
+
+	if opts.LastEventID != "" {
+		req.Header.Set("Last-Event-ID", opts.LastEventID)
+	}
+
+	resp, err := t.Do(req)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open event stream")
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+
+	return &EventStream{
+		body:        resp.Body,
+		reader:      bufio.NewReader(resp.Body),
+		lastEventID: opts.LastEventID,
+	}, nil
+}
+
+// Next blocks until the next event arrives. io.EOF is returned when the hub
+// ends the stream.
+func (t *EventStream) Next() (*event.Event, error) {
+	var data []string
+
+	for {
+		line, err := t.reader.ReadString('\n')
+
+		if err != nil {
+			if err == io.EOF && line == "" {
+				return nil, io.EOF
+			}
+
+			if err != io.EOF {
+				return nil, stacktrace.Propagate(err, "failed to read event stream")
+			}
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+
+		switch {
+		case line == "":
+			if len(data) == 0 {
+				continue
+			}
+
+			e := &event.Event{}
+
+			if err := json.Unmarshal([]byte(strings.Join(data, "\n")), e); err != nil {
+				return nil, stacktrace.Propagate(err, "event stream sent invalid event")
+			}
+
+			t.lastEventID = e.ID
+
+			return e, nil
+		case strings.HasPrefix(line, ":"):
+			// keepalive comment
+		case strings.HasPrefix(line, "data:"):
+			data = append(data, strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+}
+
+// LastEventID is the id of the last event read, or the id the stream was resumed from
+func (t *EventStream) LastEventID() string {
+	return t.lastEventID
+}
+
+func (t *EventStream) Close() error {
+	return t.body.Close()
+}
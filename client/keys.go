@@ -0,0 +1,191 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Key is a named key of a user
+type Key struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label"`
+	PublicKey string     `json:"publicKey"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Revoked   bool       `json:"revoked"`
+
+	// SSHPublicKey and Fingerprint are set for ssh keys, in authorized_keys
+	// and SHA256 fingerprint format
+	SSHPublicKey string `json:"sshPublicKey,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+}
+
+// issuedKey is the response of key add and rotate requests
+type issuedKey struct {
+	Key         *Key `json:"key"`
+	Credentials struct {
+		UserID     string `json:"userId"`
+		KeyID      string `json:"keyId"`
+		TOTPSecret string `json:"totpSecret"`
+		PrivateKey string `json:"privateKey"`
+	} `json:"credentials"`
+}
+
+// Keys lists the named keys of the user with the id, login or email, or "me".
+// Users other than the client's own require an admin.
+func (t *Client) Keys(ctx context.Context, user string) ([]*Key, error) {
+	keys := []*Key{}
+
+	if err := t.getJSON(ctx, keysPath(user), &keys); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// AddKey issues a named key to the user and returns credentials signing with
+// it. The key expires after ttl, or never if zero.
+func (t *Client) AddKey(ctx context.Context, user string, label string, ttl time.Duration) (*Key, *Credentials, error) {
+	body := map[string]string{"label": label}
+
+	if ttl > 0 {
+		body["expiresIn"] = ttl.String()
+	}
+
+	return t.issueKey(ctx, keysPath(user), body)
+}
+
+// AddSSHKey registers the OpenSSH public key, in authorized_keys format, as a
+// named key of the user. Requests are then signed with it through SSHTransport.
+// The key expires after ttl, or never if zero.
+func (t *Client) AddSSHKey(ctx context.Context, user string, label string, authorizedKey string, ttl time.Duration) (*Key, error) {
+	body := map[string]string{
+		"label":     label,
+		"publicKey": authorizedKey,
+	}
+
+	if ttl > 0 {
+		body["expiresIn"] = ttl.String()
+	}
+
+	encoded, err := json.Marshal(body)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to encode key request")
+	}
+
+	path := "/v1/users/" + url.PathEscape(user) + "/ssh-keys"
+	req, err := t.NewRequest(ctx, "POST", path, bytes.NewReader(encoded))
+
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Do(req)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "POST %v failed", path)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, responseError(resp)
+	}
+
+	registered := &issuedKey{}
+
+	if err := json.NewDecoder(resp.Body).Decode(registered); err != nil {
+		return nil, stacktrace.Propagate(err, "POST %v returned invalid json", path)
+	}
+
+	return registered.Key, nil
+}
+
+// RotateKey replaces the named key of the user with a new key. The old key
+// keeps working for grace, or is revoked at once if grace is zero.
+func (t *Client) RotateKey(ctx context.Context, user string, keyID string, grace time.Duration) (*Key, *Credentials, error) {
+	return t.issueKey(ctx, keysPath(user)+"/"+url.PathEscape(keyID)+"/rotate", map[string]string{
+		"grace": grace.String(),
+	})
+}
+
+// RevokeKey revokes the named key of the user
+func (t *Client) RevokeKey(ctx context.Context, user string, keyID string) error {
+	req, err := t.NewRequest(ctx, "DELETE", keysPath(user)+"/"+url.PathEscape(keyID), nil)
+
+	if err != nil {
+		return err
+	}
+
+	resp, err := t.Do(req)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to revoke key")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		return responseError(resp)
+	}
+
+	return nil
+}
+
+func (t *Client) issueKey(ctx context.Context, path string, body interface{}) (*Key, *Credentials, error) {
+	encoded, err := json.Marshal(body)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed to encode key request")
+	}
+
+	req, err := t.NewRequest(ctx, "POST", path, bytes.NewReader(encoded))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := t.Do(req)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "POST %v failed", path)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, nil, responseError(resp)
+	}
+
+	issued := &issuedKey{}
+
+	if err := json.NewDecoder(resp.Body).Decode(issued); err != nil {
+		return nil, nil, stacktrace.Propagate(err, "POST %v returned invalid json", path)
+	}
+
+	creds, err := NewCredentials(issued.Credentials.UserID, issued.Credentials.TOTPSecret, issued.Credentials.PrivateKey)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "hub issued invalid credentials")
+	}
+
+	creds.KeyID = issued.Credentials.KeyID
+
+	return issued.Key, creds, nil
+}
+
+func keysPath(user string) string {
+	return "/v1/users/" + url.PathEscape(user) + "/keys"
+}
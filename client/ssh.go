@@ -0,0 +1,192 @@
+package client
+
+import (
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/sshsig"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// SSHAuthScheme is the Authorization header scheme of requests signed with an
+// ssh key registered to the user
+const SSHAuthScheme = "DEVICEIO-HUB-SSH"
+
+// TimestampHeader carries the unix time in seconds an ssh signed request was
+// signed at
+const TimestampHeader = "X-Deviceio-Timestamp"
+
+// SSHCredentials sign the api requests of a user with one of its registered
+// ssh keys
+type SSHCredentials struct {
+	// UserID is the id of the user. The hub also accepts its login or email.
+	UserID string
+
+	// Signer signs with the private key, usually held by ssh-agent
+	Signer ssh.Signer
+}
+
+// SSHTransport is an http.RoundTripper signing every request with an ssh key
+type SSHTransport struct {
+	Credentials *SSHCredentials
+
+	// Base performs the signed requests. http.DefaultTransport is used if nil.
+	Base http.RoundTripper
+
+	// Now returns the time requests are signed at. time.Now is used if nil.
+	Now func() time.Time
+}
+
+func (t *SSHTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	now := time.Now
+
+	if t.Now != nil {
+		now = t.Now
+	}
+
+	// a RoundTripper must not modify the request it was given
+	signed := new(http.Request)
+	*signed = *r
+
+	signed.Header = make(http.Header, len(r.Header))
+
+	for k, v := range r.Header {
+		signed.Header[k] = append([]string(nil), v...)
+	}
+
+	if err := SignSSH(signed, t.Credentials, now()); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	base := t.Base
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return base.RoundTrip(signed)
+}
+
+// SignSSH sets the Authorization and X-Deviceio-Timestamp headers of the
+// request. The SSHSIG signature covers the same message as Sign with the
+// timestamp in place of the totp passcode.
+func SignSSH(r *http.Request, creds *SSHCredentials, at time.Time) error {
+	if creds == nil || creds.Signer == nil {
+		return stacktrace.NewError("ssh credentials are nil")
+	}
+
+	method := r.Method
+
+	if method == "" {
+		method = "GET"
+	}
+
+	// the hub verifies against the Host header the client sends
+	host := r.Host
+
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+
+	message := strings.Join(
+		[]string{
+			creds.UserID,
+			timestamp,
+			method,
+			host,
+			r.URL.Path,
+			r.URL.RawQuery,
+			r.Header.Get("Content-Type"),
+		},
+		"\r\n",
+	)
+
+	signature, err := sshsig.Sign(creds.Signer, sshsig.Namespace, []byte(message))
+
+	if err != nil {
+		return err
+	}
+
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set("Authorization", SSHAuthScheme+" "+creds.UserID+":"+base64.StdEncoding.EncodeToString(signature))
+
+	return nil
+}
+
+// AgentSigner returns a signer of the ssh-agent listening on SSH_AUTH_SOCK for
+// the key with the public key, in authorized_keys format, or SHA256
+// fingerprint. If key is empty the agent must hold exactly one key. The closer
+// ends the connection to the agent.
+func AgentSigner(key string) (ssh.Signer, io.Closer, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+
+	if socket == "" {
+		return nil, nil, stacktrace.NewError("SSH_AUTH_SOCK is not set, start ssh-agent and add the key with ssh-add")
+	}
+
+	conn, err := net.Dial("unix", socket)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed to connect to ssh-agent at %v", socket)
+	}
+
+	signer, err := findSigner(agent.NewClient(conn), key)
+
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	return signer, conn, nil
+}
+
+// findSigner returns the signer of the agent for the key
+func findSigner(keyring agent.Agent, key string) (ssh.Signer, error) {
+	signers, err := keyring.Signers()
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to list ssh-agent keys")
+	}
+
+	if key == "" {
+		if len(signers) != 1 {
+			return nil, stacktrace.NewError("ssh-agent holds %v keys, select one by public key or fingerprint", len(signers))
+		}
+
+		return signers[0], nil
+	}
+
+	fingerprint := key
+
+	if !strings.HasPrefix(key, "SHA256:") {
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(key))
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "ssh key must be a public key in authorized_keys format or a SHA256 fingerprint")
+		}
+
+		fingerprint = ssh.FingerprintSHA256(publicKey)
+	}
+
+	for _, signer := range signers {
+		if ssh.FingerprintSHA256(signer.PublicKey()) == fingerprint {
+			return signer, nil
+		}
+	}
+
+	return nil, stacktrace.NewError("ssh-agent does not hold the key %v", fingerprint)
+}
@@ -0,0 +1,51 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"strings"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Fingerprint returns the hex SHA-256 fingerprint of the certificate as printed
+// by openssl x509 -fingerprint -sha256, without the colons
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// PinnedTLSConfig returns a tls config accepting only a hub certificate with the
+// SHA-256 fingerprint. Colons and a sha256: prefix are ignored. Pinning suits the
+// self signed certificates hubs generate as they are not otherwise verifiable.
+func PinnedTLSConfig(fingerprint string) (*tls.Config, error) {
+	pin := strings.ToLower(strings.Replace(strings.TrimPrefix(strings.ToLower(fingerprint), "sha256:"), ":", "", -1))
+
+	if raw, err := hex.DecodeString(pin); err != nil || len(raw) != sha256.Size {
+		return nil, stacktrace.NewError("fingerprint '%v' is not a hex SHA-256 digest", fingerprint)
+	}
+
+	return &tls.Config{
+		// the chain is not verified, the pin replaces it
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return stacktrace.NewError("hub presented no certificate")
+			}
+
+			cert, err := x509.ParseCertificate(rawCerts[0])
+
+			if err != nil {
+				return stacktrace.Propagate(err, "hub presented an invalid certificate")
+			}
+
+			if actual := Fingerprint(cert); actual != pin {
+				return stacktrace.NewError("hub certificate fingerprint %v does not match the pinned %v", actual, pin)
+			}
+
+			return nil
+		},
+	}, nil
+}
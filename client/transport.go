@@ -0,0 +1,150 @@
+package client
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// AuthScheme is the Authorization header scheme of signed hub requests
+const AuthScheme = "DEVICEIO-HUB-AUTH"
+
+// Transport is an http.RoundTripper signing every request with the credentials
+type Transport struct {
+	Credentials *Credentials
+
+	// Base performs the signed requests. http.DefaultTransport is used if nil.
+	Base http.RoundTripper
+
+	// Now returns the time the totp passcode of a request is generated for.
+	// time.Now is used if nil.
+	Now func() time.Time
+}
+
+func (t *Transport) RoundTrip(r *http.Request) (*http.Response, error) {
+	now := time.Now
+
+	if t.Now != nil {
+		now = t.Now
+	}
+
+	// a RoundTripper must not modify the request it was given
+	signed := new(http.Request)
+	*signed = *r
+
+	signed.Header = make(http.Header, len(r.Header))
+
+	for k, v := range r.Header {
+		signed.Header[k] = append([]string(nil), v...)
+	}
+
+	if err := Sign(signed, t.Credentials, now()); err != nil {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+
+		return nil, err
+	}
+
+	base := t.Base
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return base.RoundTrip(signed)
+}
+
+// TokenTransport is an http.RoundTripper sending every request with a service
+// account token
+type TokenTransport struct {
+	Token string
+
+	// Base performs the requests. http.DefaultTransport is used if nil.
+	Base http.RoundTripper
+}
+
+func (t *TokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	// a RoundTripper must not modify the request it was given
+	authorized := new(http.Request)
+	*authorized = *r
+
+	authorized.Header = make(http.Header, len(r.Header))
+
+	for k, v := range r.Header {
+		authorized.Header[k] = append([]string(nil), v...)
+	}
+
+	authorized.Header.Set("Authorization", "Bearer "+t.Token)
+
+	base := t.Base
+
+	if base == nil {
+		base = http.DefaultTransport
+	}
+
+	return base.RoundTrip(authorized)
+}
+
+// Sign sets the Authorization header of the request, naming the key of the
+// credentials if they are for a named key. The signature covers the
+// user id, the totp passcode at the time, the method, host, path, raw query and
+// content type of the request, so none of them may change once signed.
+func Sign(r *http.Request, creds *Credentials, at time.Time) error {
+	if creds == nil {
+		return stacktrace.NewError("credentials are nil")
+	}
+
+	passcode, err := totp.GenerateCode(creds.TOTPSecret, at)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to generate totp passcode")
+	}
+
+	method := r.Method
+
+	if method == "" {
+		method = "GET"
+	}
+
+	// the hub verifies against the Host header the client sends
+	host := r.Host
+
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	message := strings.Join(
+		[]string{
+			creds.UserID,
+			passcode,
+			method,
+			host,
+			r.URL.Path,
+			r.URL.RawQuery,
+			r.Header.Get("Content-Type"),
+		},
+		"\r\n",
+	)
+
+	hash := sha512.New()
+	hash.Write([]byte(message))
+
+	signature := ed25519.Sign(creds.PrivateKey, hash.Sum(nil))
+
+	value := creds.UserID + ":"
+
+	if creds.KeyID != "" {
+		value += creds.KeyID + ":"
+	}
+
+	r.Header.Set("Authorization", AuthScheme+" "+value+base64.StdEncoding.EncodeToString(signature))
+
+	return nil
+}
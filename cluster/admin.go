@@ -0,0 +1,562 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/secret"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// Admin administers users, devices and members directly against the store. It
+// is used by the command line tools and does not require a running hub.
+type Admin interface {
+	KeyAdmin
+	ServiceAccountAdmin
+	LockoutAdmin
+
+	AddUser(login string, email string, admin bool) (*User, *Credentials, error)
+	Users() ([]*User, error)
+
+	// User returns the user with the id, login or email
+	User(idLoginOrEmail string) (*User, error)
+
+	SetUserDisabled(id string, disabled bool) error
+
+	// RotateUserKeys issues new credentials to the user, invalidating the old
+	// and ending the user's open sessions
+	RotateUserKeys(id string) (*Credentials, error)
+
+	// RecoverAdmin is the break-glass reset of an admin whose credentials were
+	// lost. The admin is issued new credentials, enabled, and its sessions are
+	// revoked. operator identifies who ran the recovery for the audit log.
+	RecoverAdmin(idLoginOrEmail string, operator string) (*User, *Credentials, error)
+
+	// LinkUserSSO links the user to the identity with the subject at the
+	// issuer so it signs in as that user. Admins are only linked this way.
+	LinkUserSSO(idLoginOrEmail string, issuer string, subject string) (*User, error)
+
+	DeleteUser(id string) error
+
+	Devices() ([]*Device, error)
+
+	// Device returns the device with the id or hostname
+	Device(idOrHostname string) (*Device, error)
+
+	SetDeviceBlocked(id string, blocked bool) error
+
+	Members() ([]*Member, error)
+
+	// EvictMember removes the member from the cluster, marking the devices it
+	// recorded as connected disconnected. Members seen within the expiry are only
+	// evicted when force is set as a running member would keep serving.
+	EvictMember(id string, force bool) (devices int, err error)
+}
+
+// Credentials are the secrets issued to a user. Only their verifiers are
+// stored so they can be shown once, when issued.
+type Credentials struct {
+	Password   string `json:"password"`
+	TOTPSecret string `json:"totpSecret"`
+
+	// PrivateKey is the base64 ed25519 key signing the user's api requests
+	PrivateKey string `json:"privateKey"`
+}
+
+// NewAdmin returns the administration interface over the store of the config
+func NewAdmin(config *Config) Admin {
+	return NewService(config).(*service)
+}
+
+// issueCredentials generates new credentials for the user, replacing its
+// password hash, totp secret and public key
+func issueCredentials(user *User) (*Credentials, error) {
+	totpKey, err := totp.Generate(totp.GenerateOpts{
+		Algorithm:   otp.AlgorithmSHA512,
+		Issuer:      "deviceio-hub",
+		AccountName: user.Email,
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "error generating TOTP secret")
+	}
+
+	password, err := uuid.NewRandom()
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "error generating password")
+	}
+
+	salt, err := uuid.NewRandom()
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "error generating password salt")
+	}
+
+	hash := sha512.New()
+	hash.Write([]byte(salt.String() + password.String()))
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "error generating ED255519 keypair")
+	}
+
+	sealedTOTPSecret, err := secret.Seal([]byte(totpKey.Secret()))
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "error encrypting TOTP secret")
+	}
+
+	user.TOTPSecret = sealedTOTPSecret
+	user.PasswordHash = hash.Sum(nil)
+	user.PasswordSalt = salt.String()
+	user.ED25519PublicKey = pubKey
+
+	return &Credentials{
+		Password:   password.String(),
+		TOTPSecret: totpKey.Secret(),
+		PrivateKey: base64.StdEncoding.EncodeToString(privKey),
+	}, nil
+}
+
+func (t *service) AddUser(login string, email string, admin bool) (*User, *Credentials, error) {
+	if login == "" || email == "" {
+		return nil, nil, stacktrace.NewError("login and email are required")
+	}
+
+	users, err := t.store.Users.List()
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	for _, existing := range users {
+		if strings.EqualFold(existing.Login, login) || strings.EqualFold(existing.Email, email) {
+			return nil, nil, stacktrace.NewError("user '%v' already has login '%v' or email '%v'", existing.ID, login, email)
+		}
+	}
+
+	user := &User{
+		Login: login,
+		Email: email,
+		Admin: admin,
+	}
+
+	creds, err := issueCredentials(user)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err = t.store.Users.Insert(user); err != nil {
+		return nil, nil, err
+	}
+
+	detail := map[string]string{
+		"login":  user.Login,
+		"source": "cli",
+	}
+
+	if admin {
+		detail["admin"] = "true"
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.UserCreate,
+		Target: user.ID,
+		Detail: detail,
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return user, creds, nil
+}
+
+func (t *service) Users() ([]*User, error) {
+	users, err := t.store.Users.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(users, func(i, j int) bool {
+		return users[i].Login < users[j].Login
+	})
+
+	return users, nil
+}
+
+func (t *service) User(idLoginOrEmail string) (*User, error) {
+	users, err := t.store.Users.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, user := range users {
+		if user.ID == idLoginOrEmail || user.Login == idLoginOrEmail || user.Email == idLoginOrEmail {
+			return user, nil
+		}
+	}
+
+	return nil, &NotFound{
+		Reason: "no user with id, login or email '" + idLoginOrEmail + "'",
+	}
+}
+
+func (t *service) SetUserDisabled(id string, disabled bool) error {
+	user, err := t.User(id)
+
+	if err != nil {
+		return err
+	}
+
+	if disabled {
+		if err = t.keepAdmin(user); err != nil {
+			return err
+		}
+	}
+
+	if err = t.store.Users.SetDisabled(user.ID, disabled); err != nil {
+		return err
+	}
+
+	kind := audit.UserEnable
+
+	if disabled {
+		kind = audit.UserDisable
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:   kind,
+		Target: user.ID,
+		Detail: map[string]string{
+			"login":  user.Login,
+			"source": "cli",
+		},
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *service) RotateUserKeys(id string) (*Credentials, error) {
+	user, err := t.User(id)
+
+	if err != nil {
+		return nil, err
+	}
+
+	creds, err := issueCredentials(user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// hmac credentials sign requests as the user and are replaced with the rest
+	hmacKeys, err := t.deleteHMAC(user)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if err = t.store.Users.ReplaceCredentials(user.ID, user); err != nil {
+		return nil, err
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.UserRotateKeys,
+		Target: user.ID,
+		Detail: map[string]string{
+			"login":           user.Login,
+			"hmacKeysDeleted": strconv.Itoa(hmacKeys),
+			"source":          "cli",
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	return creds, nil
+}
+
+func (t *service) RecoverAdmin(idLoginOrEmail string, operator string) (*User, *Credentials, error) {
+	user, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !user.Admin {
+		return nil, nil, stacktrace.NewError("user '%v' is not an admin", user.Login)
+	}
+
+	creds, err := issueCredentials(user)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	wasDisabled := user.Disabled
+	recoveredAt := time.Now().UTC()
+
+	// the named keys and hmac credentials may be what was compromised
+	hmacKeys, err := t.deleteHMAC(user)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = t.store.Users.RecoverCredentials(user.ID, user, recoveredAt); err != nil {
+		return nil, nil, err
+	}
+
+	recovered, err := t.store.Users.Get(user.ID)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if recovered == nil {
+		return nil, nil, &NotFound{
+			Reason: "user '" + user.Login + "' was deleted during recovery",
+		}
+	}
+
+	user = recovered
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.AdminRecover,
+		Time:   recoveredAt,
+		Target: user.ID,
+		Detail: map[string]string{
+			"login":           user.Login,
+			"operator":        operator,
+			"wasDisabled":     strconv.FormatBool(wasDisabled),
+			"hmacKeysDeleted": strconv.Itoa(hmacKeys),
+			"source":          "cli",
+		},
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return user, creds, nil
+}
+
+func (t *service) DeleteUser(id string) error {
+	user, err := t.User(id)
+
+	if err != nil {
+		return err
+	}
+
+	if err = t.keepAdmin(user); err != nil {
+		return err
+	}
+
+	// hmac credentials are bound to the login, which a later user may reuse
+	hmacKeys, err := t.deleteHMAC(user)
+
+	if err != nil {
+		return err
+	}
+
+	if err = t.store.Users.Delete(user.ID); err != nil {
+		return err
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.UserDelete,
+		Target: user.ID,
+		Detail: map[string]string{
+			"login":           user.Login,
+			"hmacKeysDeleted": strconv.Itoa(hmacKeys),
+			"source":          "cli",
+		},
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// keepAdmin fails if user is the last enabled admin, which would leave nobody
+// able to administer the hub through the api
+func (t *service) keepAdmin(user *User) error {
+	if !user.Admin || user.Disabled {
+		return nil
+	}
+
+	users, err := t.store.Users.List()
+
+	if err != nil {
+		return err
+	}
+
+	for _, other := range users {
+		if other.ID != user.ID && other.Admin && !other.Disabled {
+			return nil
+		}
+	}
+
+	return stacktrace.NewError("user '%v' is the last enabled admin", user.Login)
+}
+
+func (t *service) Devices() ([]*Device, error) {
+	devices, err := t.store.Devices.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(devices, func(i, j int) bool {
+		return devices[i].Hostname < devices[j].Hostname
+	})
+
+	return devices, nil
+}
+
+func (t *service) Device(idOrHostname string) (*Device, error) {
+	devices, err := t.store.Devices.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, device := range devices {
+		if strings.EqualFold(device.ID, idOrHostname) || strings.EqualFold(device.Hostname, idOrHostname) {
+			return device, nil
+		}
+	}
+
+	return nil, &NotFound{
+		Reason: "no device with id or hostname '" + idOrHostname + "'",
+	}
+}
+
+func (t *service) SetDeviceBlocked(id string, blocked bool) error {
+	device, err := t.Device(id)
+
+	if err != nil {
+		return err
+	}
+
+	if err = t.store.Devices.SetBlocked(device.ID, blocked); err != nil {
+		return err
+	}
+
+	kind := audit.DeviceUnblock
+
+	if blocked {
+		kind = audit.DeviceBlock
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:     kind,
+		Target:   device.ID,
+		DeviceID: device.ID,
+		Hostname: device.Hostname,
+		Detail: map[string]string{
+			"source": "cli",
+		},
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *service) Members() ([]*Member, error) {
+	members, err := t.store.Members.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].ID < members[j].ID
+	})
+
+	return members, nil
+}
+
+func (t *service) EvictMember(id string, force bool) (int, error) {
+	members, err := t.store.Members.List()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var member *Member
+
+	for _, m := range members {
+		if m.ID == id {
+			member = m
+		}
+	}
+
+	if member == nil {
+		return 0, &NotFound{
+			Reason: "no cluster member '" + id + "'",
+		}
+	}
+
+	if !force && time.Since(member.LastSeen) < memberExpiry {
+		return 0, stacktrace.NewError("member '%v' was last seen at %v and may still be running, stop it or force the eviction", id, member.LastSeen.Format(time.RFC3339))
+	}
+
+	if err = t.store.Members.Delete(id); err != nil {
+		return 0, err
+	}
+
+	devices, err := t.store.Devices.List()
+
+	if err != nil {
+		return 0, err
+	}
+
+	disconnected := 0
+
+	for _, device := range devices {
+		if device.Member != id || !device.Connected {
+			continue
+		}
+
+		err = t.store.Devices.Upsert(&Device{
+			ID:        device.ID,
+			Connected: false,
+			LastSeen:  device.LastSeen,
+		})
+
+		if err != nil {
+			return disconnected, err
+		}
+
+		disconnected++
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.MemberEvict,
+		Target: id,
+		Detail: map[string]string{
+			"hostname": member.Hostname,
+			"forced":   strconv.FormatBool(force),
+			"source":   "cli",
+		},
+	}); err != nil {
+		return disconnected, err
+	}
+
+	return disconnected, nil
+}
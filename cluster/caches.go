@@ -0,0 +1,153 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/event"
+)
+
+// cacheReadyTimeout is how long a request waits for a cache to finish its initial
+// load before failing
+var cacheReadyTimeout = 5 * time.Second
+
+// newCaches creates the changefeed backed user, member, device and service
+// account caches
+func (t *service) newCaches() {
+	t.users = cache.New(&cache.Config{
+		Name:   "user",
+		Source: t.store.Users.Source(),
+		Key: func(item interface{}) string {
+			return item.(*User).ID
+		},
+		Indexes: map[string]func(item interface{}) []string{
+			"login": func(item interface{}) []string {
+				return []string{item.(*User).Login}
+			},
+			"email": func(item interface{}) []string {
+				return []string{item.(*User).Email}
+			},
+		},
+		OnChange: func(old interface{}, new interface{}) {
+			switch {
+			case new == nil:
+				t.publishDerived(event.New(event.UserDeleted, old.(*User).eventData()))
+			case old == nil:
+				t.publishDerived(event.New(event.UserCreated, new.(*User).eventData()))
+			case new.(*User).onlyKeysUsed(old.(*User)):
+				// key usage is not a change worth an event
+			default:
+				t.publishDerived(event.New(event.UserUpdated, new.(*User).eventData()))
+
+				if new.(*User).RecoveredAt.After(old.(*User).RecoveredAt) {
+					data := new.(*User).eventData()
+					data["recoveredAt"] = new.(*User).RecoveredAt
+
+					t.publishDerived(event.New(event.UserRecovered, data))
+				}
+			}
+		},
+	})
+
+	t.members = cache.New(&cache.Config{
+		Name:   "member",
+		Source: t.store.Members.Source(),
+		Key: func(item interface{}) string {
+			return item.(*Member).ID
+		},
+		OnChange: func(old interface{}, new interface{}) {
+			switch {
+			case new == nil:
+				t.publishDerived(event.New(event.MemberLeft, old.(*Member).eventData()))
+			case old == nil:
+				t.publishDerived(event.New(event.MemberJoined, new.(*Member).eventData()))
+			}
+		},
+	})
+
+	t.devices = cache.New(&cache.Config{
+		Name:   "device",
+		Source: t.store.Devices.Source(),
+		Key: func(item interface{}) string {
+			return item.(*Device).ID
+		},
+		Indexes: map[string]func(item interface{}) []string{
+			"hostname": func(item interface{}) []string {
+				return []string{strings.ToLower(item.(*Device).Hostname)}
+			},
+		},
+	})
+
+	t.serviceAccounts = cache.New(&cache.Config{
+		Name:   "serviceAccount",
+		Source: t.store.ServiceAccounts.Source(),
+		Key: func(item interface{}) string {
+			return item.(*ServiceAccount).ID
+		},
+		Indexes: map[string]func(item interface{}) []string{
+			"token": func(item interface{}) []string {
+				ids := []string{}
+
+				for _, token := range item.(*ServiceAccount).Tokens {
+					ids = append(ids, token.ID)
+				}
+
+				return ids
+			},
+		},
+	})
+
+	t.lockouts = cache.New(&cache.Config{
+		Name:   "lockout",
+		Source: t.store.Lockouts.Source(),
+		Key: func(item interface{}) string {
+			return item.(*Lockout).ID
+		},
+	})
+}
+
+// lookupUser returns the user with the given id, login or email, or nil if there
+// is none. It waits for the user cache to finish loading and fails with a
+// ServiceUnavailable error if it does not in time.
+func (t *service) lookupUser(idLoginOrEmail string) (*User, error) {
+	if err := t.users.WaitReady(cacheReadyTimeout); err != nil {
+		return nil, &ServiceUnavailable{
+			Reason: err.Error(),
+		}
+	}
+
+	if user, ok := t.users.Get(idLoginOrEmail).(*User); ok {
+		return user, nil
+	}
+
+	for _, index := range []string{"login", "email"} {
+		for _, item := range t.users.Lookup(index, idLoginOrEmail) {
+			return item.(*User), nil
+		}
+	}
+
+	return nil, nil
+}
+
+// cacheStatus reports whether each cache has finished its initial load
+func (t *service) cacheStatus() map[string]bool {
+	return map[string]bool{
+		"user":           t.users.Ready(),
+		"member":         t.members.Ready(),
+		"device":         t.devices.Ready(),
+		"serviceAccount": t.serviceAccounts.Ready(),
+		"lockout":        t.lockouts.Ready(),
+	}
+}
+
+// memberIDs returns the ids of every known member
+func (t *service) memberIDs() []string {
+	ids := []string{}
+
+	for _, item := range t.members.List() {
+		ids = append(ids, item.(*Member).ID)
+	}
+
+	return ids
+}
@@ -1,10 +1,51 @@
 package cluster
 
-import "net/http"
+import (
+	"net/http"
+	"time"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/user"
+	"github.com/deviceio/hub/webhook"
+)
 
 type Config struct {
 	BindAddr             string
 	TLSCertPath          string
 	TLSKeyPath           string
 	LocalDeviceProxyFunc func(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error
+
+	// Events is the hub event bus. Device events published on it are persisted
+	// by the cluster.
+	Events *event.Bus
+
+	// DeviceEventLimit is the maximum number of events retained per device
+	DeviceEventLimit int
+
+	// EventRetention is how long cluster wide events are retained for stream resumption
+	EventRetention time.Duration
+
+	// Audit records user administration performed by the cluster service
+	Audit *audit.Log
+
+	// MemberID identifies this hub instance in the cluster. A random ID is
+	// generated if empty.
+	MemberID string
+
+	// Store persists users, members, devices and events. The rethinkdb store is
+	// used if nil.
+	Store *Store
+
+	// HMAC authenticates requests signed with the hmac credentials of users.
+	// Such requests are refused if nil.
+	HMAC *user.Service
+
+	// Webhooks has its subscription secrets re-wrapped by the leader with the
+	// credentials of users. They are not re-wrapped if nil.
+	Webhooks *webhook.Service
+
+	// Lockout throttles and locks out users and source addresses with repeated
+	// authentication failures. No limits apply if nil.
+	Lockout *LockoutPolicy
 }
@@ -1,5 +1,17 @@
 package cluster
 
+import "time"
+
 type Device struct {
-	ID string `gorethink:"id,omitempty"`
+	ID           string    `gorethink:"id,omitempty" json:"id"`
+	Hostname     string    `gorethink:"hostname,omitempty" json:"hostname,omitempty"`
+	Platform     string    `gorethink:"platform,omitempty" json:"platform,omitempty"`
+	Architecture string    `gorethink:"architecture,omitempty" json:"architecture,omitempty"`
+	Tags         []string  `gorethink:"tags,omitempty" json:"tags,omitempty"`
+	Connected    bool      `gorethink:"connected" json:"connected"`
+	Member       string    `gorethink:"member,omitempty" json:"member,omitempty"`
+	LastSeen     time.Time `gorethink:"last_seen,omitempty" json:"lastSeen"`
+
+	// Blocked devices are refused gateway connections and proxied requests
+	Blocked bool `gorethink:"blocked,omitempty" json:"blocked,omitempty"`
 }
@@ -0,0 +1,926 @@
+package cluster
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/embedded"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+)
+
+// NewEmbeddedStore returns a cluster store kept in an embedded database. It suits
+// single node hubs and tests; an embedded database opened without a path is an
+// in-memory store.
+func NewEmbeddedStore(edb *embedded.DB) *Store {
+	return &Store{
+		Users:           &embeddedUsers{db: edb},
+		Members:         &embeddedMembers{db: edb},
+		Devices:         &embeddedDevices{db: edb},
+		Events:          &embeddedEvents{db: edb},
+		DeviceEvents:    &embeddedDeviceEvents{db: edb},
+		ServiceAccounts: &embeddedServiceAccounts{db: edb},
+		Lockouts:        &embeddedLockouts{db: edb},
+	}
+}
+
+// unchanged aborts an embedded update whose condition no longer holds
+type unchanged struct{}
+
+func (t *unchanged) Error() string {
+	return "document changed"
+}
+
+type embeddedUsers struct {
+	db *embedded.DB
+}
+
+func (t *embeddedUsers) Source() cache.Source {
+	return t.db.Source(string(db.UserTable), func() interface{} {
+		return &User{}
+	})
+}
+
+func (t *embeddedUsers) List() ([]*User, error) {
+	users := []*User{}
+
+	err := t.db.Scan(string(db.UserTable), false, func(id string, doc []byte) (bool, error) {
+		user := &User{}
+
+		if err := json.Unmarshal(doc, user); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode user '%v'", id)
+		}
+
+		users = append(users, user)
+
+		return true, nil
+	})
+
+	return users, err
+}
+
+func (t *embeddedUsers) Get(id string) (*User, error) {
+	user := &User{}
+
+	found, err := t.db.Get(string(db.UserTable), id, user)
+
+	if err != nil || !found {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+func (t *embeddedUsers) Insert(user *User) (string, error) {
+	if user.ID == "" {
+		user.ID = uuid.New().String()
+	}
+
+	if err := t.db.Insert(string(db.UserTable), user.ID, user); err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert user")
+	}
+
+	return user.ID, nil
+}
+
+func (t *embeddedUsers) Update(user *User) error {
+	err := t.db.Update(string(db.UserTable), user.ID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.UserTable), ID: user.ID}
+		}
+
+		return user, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) TouchKey(userID string, keyID string, at time.Time) error {
+	err := t.db.Update(string(db.UserTable), userID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.UserTable), ID: userID}
+		}
+
+		user := &User{}
+
+		if err := json.Unmarshal(current, user); err != nil {
+			return nil, err
+		}
+
+		if key := user.key(keyID); key != nil {
+			key.LastUsed = at
+		}
+
+		return user, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user key")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) AddKey(userID string, key *Key) error {
+	err := t.update(userID, func(user *User) {
+		user.Keys = append(user.Keys, key)
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to add user key")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) RevokeKey(userID string, keyID string) error {
+	err := t.update(userID, func(user *User) {
+		if key := user.key(keyID); key != nil {
+			key.Revoked = true
+		}
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user key")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) ExpireKey(userID string, keyID string, at time.Time) error {
+	err := t.update(userID, func(user *User) {
+		if key := user.key(keyID); key != nil {
+			key.Expires = at
+		}
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user key")
+	}
+
+	return nil
+}
+
+// update atomically applies fn to the stored user
+func (t *embeddedUsers) update(userID string, fn func(user *User)) error {
+	return t.db.Update(string(db.UserTable), userID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.UserTable), ID: userID}
+		}
+
+		user := &User{}
+
+		if err := json.Unmarshal(current, user); err != nil {
+			return nil, err
+		}
+
+		fn(user)
+
+		return user, nil
+	})
+}
+
+func (t *embeddedUsers) SetAdmin(userID string, admin bool) error {
+	err := t.update(userID, func(user *User) {
+		user.Admin = admin
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user admin role")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) SetDisabled(userID string, disabled bool) error {
+	err := t.update(userID, func(user *User) {
+		user.Disabled = disabled
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user disabled state")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) ReplaceCredentials(userID string, creds *User) error {
+	err := t.update(userID, func(user *User) {
+		replaceCredentials(user, creds)
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user credentials")
+	}
+
+	return nil
+}
+
+func (t *embeddedUsers) RecoverCredentials(userID string, creds *User, at time.Time) error {
+	err := t.update(userID, func(user *User) {
+		replaceCredentials(user, creds)
+		user.Disabled = false
+		user.RecoveredAt = at
+
+		for _, key := range user.Keys {
+			key.Revoked = true
+		}
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user credentials")
+	}
+
+	return nil
+}
+
+// replaceCredentials replaces the primary credentials of the user with those of
+// creds
+func replaceCredentials(user *User, creds *User) {
+	user.PasswordHash = creds.PasswordHash
+	user.PasswordSalt = creds.PasswordSalt
+	user.TOTPSecret = creds.TOTPSecret
+	user.ED25519PublicKey = creds.ED25519PublicKey
+	user.SessionEpoch++
+}
+
+func (t *embeddedUsers) LinkSSO(userID string, issuer string, subject string) (bool, error) {
+	linked := func(id string, doc []byte) bool {
+		other := &User{}
+
+		if err := json.Unmarshal(doc, other); err != nil {
+			return false
+		}
+
+		return other.OIDCIssuer == issuer && other.OIDCSubject == subject
+	}
+
+	err := t.db.UpdateUnless(string(db.UserTable), userID, linked, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.UserTable), ID: userID}
+		}
+
+		user := &User{}
+
+		if err := json.Unmarshal(current, user); err != nil {
+			return nil, err
+		}
+
+		user.OIDCIssuer = issuer
+		user.OIDCSubject = subject
+
+		return user, nil
+	})
+
+	if _, ok := err.(*embedded.ErrConflict); ok {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to link user identity")
+	}
+
+	return true, nil
+}
+
+func (t *embeddedUsers) AddSessionKey(userID string, key *Key, now time.Time) (bool, error) {
+	err := t.db.Update(string(db.UserTable), userID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &unchanged{}
+		}
+
+		user := &User{}
+
+		if err := json.Unmarshal(current, user); err != nil {
+			return nil, err
+		}
+
+		if user.Disabled {
+			return nil, &unchanged{}
+		}
+
+		keys := []*Key{}
+
+		for _, existing := range user.Keys {
+			if !existing.SSO || existing.Active(now) {
+				keys = append(keys, existing)
+			}
+		}
+
+		user.Keys = append(keys, key)
+
+		return user, nil
+	})
+
+	if _, ok := err.(*unchanged); ok {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to add user session key")
+	}
+
+	return true, nil
+}
+
+func (t *embeddedUsers) RewrapTOTPSecret(userID string, keyID string, prevKeyID string, envelope *secret.Envelope) (bool, error) {
+	err := t.db.Update(string(db.UserTable), userID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &unchanged{}
+		}
+
+		user := &User{}
+
+		if err := json.Unmarshal(current, user); err != nil {
+			return nil, err
+		}
+
+		sealed := &user.TOTPSecret
+
+		if keyID != "" {
+			key := user.key(keyID)
+
+			if key == nil {
+				return nil, &unchanged{}
+			}
+
+			sealed = &key.TOTPSecret
+		}
+
+		if *sealed == nil || (*sealed).KeyID != prevKeyID {
+			return nil, &unchanged{}
+		}
+
+		*sealed = envelope
+
+		return user, nil
+	})
+
+	if _, ok := err.(*unchanged); ok {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to update user totp secret")
+	}
+
+	return true, nil
+}
+
+func (t *embeddedUsers) Delete(id string) error {
+	if _, err := t.db.Delete(string(db.UserTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete user")
+	}
+
+	return nil
+}
+
+type embeddedServiceAccounts struct {
+	db *embedded.DB
+}
+
+func (t *embeddedServiceAccounts) Source() cache.Source {
+	return t.db.Source(string(db.ServiceAccountTable), func() interface{} {
+		return &ServiceAccount{}
+	})
+}
+
+func (t *embeddedServiceAccounts) List() ([]*ServiceAccount, error) {
+	accounts := []*ServiceAccount{}
+
+	err := t.db.Scan(string(db.ServiceAccountTable), false, func(id string, doc []byte) (bool, error) {
+		account := &ServiceAccount{}
+
+		if err := json.Unmarshal(doc, account); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode service account '%v'", id)
+		}
+
+		accounts = append(accounts, account)
+
+		return true, nil
+	})
+
+	return accounts, err
+}
+
+func (t *embeddedServiceAccounts) Insert(account *ServiceAccount) (string, error) {
+	if account.ID == "" {
+		account.ID = uuid.New().String()
+	}
+
+	if err := t.db.Insert(string(db.ServiceAccountTable), account.ID, account); err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert service account")
+	}
+
+	return account.ID, nil
+}
+
+func (t *embeddedServiceAccounts) Update(account *ServiceAccount) error {
+	err := t.db.Update(string(db.ServiceAccountTable), account.ID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.ServiceAccountTable), ID: account.ID}
+		}
+
+		return account, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update service account")
+	}
+
+	return nil
+}
+
+func (t *embeddedServiceAccounts) TouchToken(accountID string, tokenID string, at time.Time) error {
+	err := t.db.Update(string(db.ServiceAccountTable), accountID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.ServiceAccountTable), ID: accountID}
+		}
+
+		account := &ServiceAccount{}
+
+		if err := json.Unmarshal(current, account); err != nil {
+			return nil, err
+		}
+
+		if token := account.token(tokenID); token != nil {
+			token.LastUsed = at
+		}
+
+		return account, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update service account token")
+	}
+
+	return nil
+}
+
+func (t *embeddedServiceAccounts) AddToken(accountID string, token *Token) error {
+	err := t.update(accountID, func(account *ServiceAccount) {
+		account.Tokens = append(account.Tokens, token)
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to add service account token")
+	}
+
+	return nil
+}
+
+func (t *embeddedServiceAccounts) RevokeToken(accountID string, tokenID string) error {
+	err := t.update(accountID, func(account *ServiceAccount) {
+		if token := account.token(tokenID); token != nil {
+			token.Revoked = true
+		}
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to revoke service account token")
+	}
+
+	return nil
+}
+
+// update atomically applies fn to the stored service account
+func (t *embeddedServiceAccounts) update(accountID string, fn func(account *ServiceAccount)) error {
+	return t.db.Update(string(db.ServiceAccountTable), accountID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.ServiceAccountTable), ID: accountID}
+		}
+
+		account := &ServiceAccount{}
+
+		if err := json.Unmarshal(current, account); err != nil {
+			return nil, err
+		}
+
+		fn(account)
+
+		return account, nil
+	})
+}
+
+func (t *embeddedServiceAccounts) Delete(id string) error {
+	if _, err := t.db.Delete(string(db.ServiceAccountTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete service account")
+	}
+
+	return nil
+}
+
+type embeddedLockouts struct {
+	db *embedded.DB
+}
+
+func (t *embeddedLockouts) Source() cache.Source {
+	return t.db.Source(string(db.LockoutTable), func() interface{} {
+		return &Lockout{}
+	})
+}
+
+func (t *embeddedLockouts) List() ([]*Lockout, error) {
+	lockouts := []*Lockout{}
+
+	err := t.db.Scan(string(db.LockoutTable), false, func(id string, doc []byte) (bool, error) {
+		lockout := &Lockout{}
+
+		if err := json.Unmarshal(doc, lockout); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode lockout '%v'", id)
+		}
+
+		lockouts = append(lockouts, lockout)
+
+		return true, nil
+	})
+
+	return lockouts, err
+}
+
+func (t *embeddedLockouts) RecordFailure(lockout *Lockout, at time.Time, since time.Time) (*Lockout, error) {
+	recorded := &Lockout{}
+
+	err := t.db.Update(string(db.LockoutTable), lockout.ID, func(current []byte) (interface{}, error) {
+		if current != nil {
+			if err := json.Unmarshal(current, recorded); err != nil {
+				return nil, err
+			}
+		}
+
+		if current == nil || recorded.LastFailure.Before(since) {
+			*recorded = *lockout
+			recorded.FirstFailure = at
+		}
+
+		recorded.Failures++
+		recorded.LastFailure = at
+
+		return recorded, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to record authentication failure")
+	}
+
+	return recorded, nil
+}
+
+func (t *embeddedLockouts) Lock(id string, until time.Time) error {
+	err := t.db.Update(string(db.LockoutTable), id, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.LockoutTable), ID: id}
+		}
+
+		lockout := &Lockout{}
+
+		if err := json.Unmarshal(current, lockout); err != nil {
+			return nil, err
+		}
+
+		lockout.LockedUntil = until
+
+		return lockout, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to lock out '%v'", id)
+	}
+
+	return nil
+}
+
+func (t *embeddedLockouts) DeleteExpired(before time.Time) error {
+	_, err := t.db.DeleteWhere(string(db.LockoutTable), func(id string, doc []byte) bool {
+		lockout := &Lockout{}
+		return json.Unmarshal(doc, lockout) == nil && lockout.expired(before)
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to remove expired lockouts")
+	}
+
+	return nil
+}
+
+func (t *embeddedLockouts) Delete(id string) error {
+	if _, err := t.db.Delete(string(db.LockoutTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete lockout")
+	}
+
+	return nil
+}
+
+type embeddedMembers struct {
+	db *embedded.DB
+}
+
+func (t *embeddedMembers) Source() cache.Source {
+	return t.db.Source(string(db.MemberTable), func() interface{} {
+		return &Member{}
+	})
+}
+
+func (t *embeddedMembers) List() ([]*Member, error) {
+	members := []*Member{}
+
+	err := t.db.Scan(string(db.MemberTable), false, func(id string, doc []byte) (bool, error) {
+		member := &Member{}
+
+		if err := json.Unmarshal(doc, member); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode cluster member '%v'", id)
+		}
+
+		members = append(members, member)
+
+		return true, nil
+	})
+
+	return members, err
+}
+
+func (t *embeddedMembers) Upsert(member *Member) error {
+	if err := t.db.Put(string(db.MemberTable), member.ID, member); err != nil {
+		return stacktrace.Propagate(err, "failed to store cluster member")
+	}
+
+	return nil
+}
+
+func (t *embeddedMembers) Touch(id string, at time.Time) error {
+	err := t.db.Update(string(db.MemberTable), id, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.MemberTable), ID: id}
+		}
+
+		member := &Member{}
+
+		if err := json.Unmarshal(current, member); err != nil {
+			return nil, err
+		}
+
+		member.LastSeen = at
+
+		return member, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update cluster member")
+	}
+
+	return nil
+}
+
+func (t *embeddedMembers) DeleteExpired(before time.Time) error {
+	_, err := t.db.DeleteWhere(string(db.MemberTable), func(id string, doc []byte) bool {
+		member := &Member{}
+		return json.Unmarshal(doc, member) == nil && member.LastSeen.Before(before)
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to remove expired cluster members")
+	}
+
+	return nil
+}
+
+func (t *embeddedMembers) Delete(id string) error {
+	if _, err := t.db.Delete(string(db.MemberTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete cluster member")
+	}
+
+	return nil
+}
+
+type embeddedDevices struct {
+	db *embedded.DB
+}
+
+func (t *embeddedDevices) Source() cache.Source {
+	return t.db.Source(string(db.DeviceTable), func() interface{} {
+		return &Device{}
+	})
+}
+
+func (t *embeddedDevices) List() ([]*Device, error) {
+	devices := []*Device{}
+
+	err := t.db.Scan(string(db.DeviceTable), false, func(id string, doc []byte) (bool, error) {
+		device := &Device{}
+
+		if err := json.Unmarshal(doc, device); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode device '%v'", id)
+		}
+
+		devices = append(devices, device)
+
+		return true, nil
+	})
+
+	return devices, err
+}
+
+// Upsert merges the fields present in the device into the stored document, as
+// the rethinkdb store's update on conflict does
+func (t *embeddedDevices) Upsert(device *Device) error {
+	err := t.db.Update(string(db.DeviceTable), device.ID, func(current []byte) (interface{}, error) {
+		merged := map[string]json.RawMessage{}
+
+		if current != nil {
+			if err := json.Unmarshal(current, &merged); err != nil {
+				return nil, err
+			}
+		}
+
+		raw, err := json.Marshal(device)
+
+		if err != nil {
+			return nil, err
+		}
+
+		fields := map[string]json.RawMessage{}
+
+		if err = json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+
+		for k, v := range fields {
+			merged[k] = v
+		}
+
+		return merged, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to store device")
+	}
+
+	return nil
+}
+
+func (t *embeddedDevices) SetBlocked(id string, blocked bool) error {
+	err := t.db.Update(string(db.DeviceTable), id, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.DeviceTable), ID: id}
+		}
+
+		device := map[string]json.RawMessage{}
+
+		if err := json.Unmarshal(current, &device); err != nil {
+			return nil, err
+		}
+
+		device["blocked"] = json.RawMessage("false")
+
+		if blocked {
+			device["blocked"] = json.RawMessage("true")
+		}
+
+		return device, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update device")
+	}
+
+	return nil
+}
+
+func (t *embeddedDevices) Delete(id string) error {
+	if _, err := t.db.Delete(string(db.DeviceTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete device")
+	}
+
+	return nil
+}
+
+type embeddedEvents struct {
+	db *embedded.DB
+}
+
+func (t *embeddedEvents) Source() cache.Source {
+	return t.db.Source(string(db.EventTable), func() interface{} {
+		return &event.Event{}
+	})
+}
+
+func (t *embeddedEvents) Insert(e *event.Event) error {
+	if err := t.db.Insert(string(db.EventTable), e.ID, e); err != nil {
+		return stacktrace.Propagate(err, "failed to insert event")
+	}
+
+	return nil
+}
+
+func (t *embeddedEvents) After(after string, fn func(e *event.Event) bool) error {
+	err := t.db.Scan(string(db.EventTable), false, func(id string, doc []byte) (bool, error) {
+		if id <= after {
+			return true, nil
+		}
+
+		e := &event.Event{}
+
+		if err := json.Unmarshal(doc, e); err != nil {
+			return false, err
+		}
+
+		return fn(e), nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to read events")
+	}
+
+	return nil
+}
+
+func (t *embeddedEvents) DeleteBefore(before string) error {
+	_, err := t.db.DeleteWhere(string(db.EventTable), func(id string, doc []byte) bool {
+		return id < before
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to remove events")
+	}
+
+	return nil
+}
+
+type embeddedDeviceEvents struct {
+	db *embedded.DB
+}
+
+func (t *embeddedDeviceEvents) Insert(e *event.Event) error {
+	if err := t.db.Insert(string(db.DeviceEventTable), e.ID, e); err != nil {
+		return stacktrace.Propagate(err, "failed to insert device event")
+	}
+
+	return nil
+}
+
+func (t *embeddedDeviceEvents) Recent(idOrHostname string, fn func(e *event.Event) bool) error {
+	err := t.db.Scan(string(db.DeviceEventTable), true, func(id string, doc []byte) (bool, error) {
+		e := &event.Event{}
+
+		if err := json.Unmarshal(doc, e); err != nil {
+			return false, err
+		}
+
+		if e.DeviceID != idOrHostname && e.Hostname != idOrHostname {
+			return true, nil
+		}
+
+		return fn(e), nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to read device events")
+	}
+
+	return nil
+}
+
+func (t *embeddedDeviceEvents) Trim(deviceID string, keep int) error {
+	kept := 0
+	trim := map[string]bool{}
+
+	err := t.db.Scan(string(db.DeviceEventTable), true, func(id string, doc []byte) (bool, error) {
+		e := &event.Event{}
+
+		if err := json.Unmarshal(doc, e); err != nil {
+			return false, err
+		}
+
+		if e.DeviceID != deviceID {
+			return true, nil
+		}
+
+		if kept < keep {
+			kept++
+		} else {
+			trim[id] = true
+		}
+
+		return true, nil
+	})
+
+	if err == nil && len(trim) > 0 {
+		_, err = t.db.DeleteWhere(string(db.DeviceEventTable), func(id string, doc []byte) bool {
+			return trim[id]
+		})
+	}
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to trim device events")
+	}
+
+	return nil
+}
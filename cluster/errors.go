@@ -1,9 +1,64 @@
 package cluster
 
+// Codes of authentication failures. Failures are counted by code, a fixed set,
+// while the detailed reason is only logged and audited.
+const (
+	FailureMalformed    = "malformed"
+	FailureUnknownUser  = "unknown_user"
+	FailureBadSignature = "bad_signature"
+	FailureExpired      = "expired"
+	FailureLocked       = "locked"
+	FailureDisabled     = "disabled"
+	FailureScope        = "scope"
+)
+
 type AuthenticationFailed struct {
 	Reason string
+
+	// Code classifies the failure of an api request, empty for sign-in
+	// failures
+	Code string
 }
 
 func (t *AuthenticationFailed) Error() string {
 	return t.Reason
 }
+
+// ServiceUnavailable is returned when a request cannot be served until the
+// cluster has finished loading its state
+type ServiceUnavailable struct {
+	Reason string
+}
+
+func (t *ServiceUnavailable) Error() string {
+	return t.Reason
+}
+
+// DeviceBlocked is returned when proxying a request to a blocked device
+type DeviceBlocked struct {
+	Reason string
+}
+
+func (t *DeviceBlocked) Error() string {
+	return t.Reason
+}
+
+// NotFound is returned when the subject of an administrative action does not
+// exist
+type NotFound struct {
+	Reason string
+}
+
+func (t *NotFound) Error() string {
+	return t.Reason
+}
+
+// Invalid is returned when the arguments of an administrative action are not
+// acceptable
+type Invalid struct {
+	Reason string
+}
+
+func (t *Invalid) Error() string {
+	return t.Reason
+}
@@ -0,0 +1,77 @@
+package cluster
+
+import (
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/event"
+	"github.com/palantir/stacktrace"
+)
+
+// defaultDeviceEventLimit is used when the config does not specify a limit
+const defaultDeviceEventLimit = 500
+
+func (t *service) DeviceEvents(deviceid string, limit int, types []string) ([]*event.Event, error) {
+	if deviceid == "" {
+		return nil, stacktrace.NewError("deviceid empty")
+	}
+
+	if limit <= 0 || limit > t.deviceEventLimit() {
+		limit = t.deviceEventLimit()
+	}
+
+	deviceid = strings.ToLower(deviceid)
+
+	events := []*event.Event{}
+
+	err := t.store.DeviceEvents.Recent(deviceid, func(e *event.Event) bool {
+		if event.MatchAny(types, e.Type) {
+			events = append(events, e)
+		}
+
+		return len(events) < limit
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return events, nil
+}
+
+// persistDeviceEvents stores every device event published on the bus, trimming each
+// device's history to the configured limit.
+func (t *service) persistDeviceEvents() {
+	sub := t.config.Events.Subscribe(1024, "device.*")
+	defer sub.Close()
+
+	for e := range sub.C {
+		if e.DeviceID == "" {
+			continue
+		}
+
+		if err := t.store.DeviceEvents.Insert(e); err != nil {
+			logger.WithFields(logrus.Fields{
+				"deviceId": e.DeviceID,
+				"type":     e.Type,
+				"error":    err.Error(),
+			}).Error("failed to persist device event")
+			continue
+		}
+
+		if err := t.store.DeviceEvents.Trim(e.DeviceID, t.deviceEventLimit()); err != nil {
+			logger.WithFields(logrus.Fields{
+				"deviceId": e.DeviceID,
+				"error":    err.Error(),
+			}).Error("failed to trim device events")
+		}
+	}
+}
+
+func (t *service) deviceEventLimit() int {
+	if t.config.DeviceEventLimit <= 0 {
+		return defaultDeviceEventLimit
+	}
+
+	return t.config.DeviceEventLimit
+}
@@ -0,0 +1,23 @@
+package cluster
+
+import "github.com/deviceio/hub/health"
+
+// Health reports the cluster listener and whether each cache has finished its
+// initial load
+func (t *service) Health() *health.Component {
+	c := t.listener.Component("cluster")
+	caches := t.cacheStatus()
+
+	for _, name := range []string{"user", "member", "device", "serviceAccount"} {
+		if !caches[name] && c.Ready {
+			c.Ready = false
+			c.Error = "cache '" + name + "' has not finished loading"
+		}
+	}
+
+	c.Details["memberId"] = t.memberID
+	c.Details["leader"] = t.isLeader()
+	c.Details["caches"] = caches
+
+	return c
+}
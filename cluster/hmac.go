@@ -0,0 +1,83 @@
+package cluster
+
+import (
+	"net/http"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/user"
+)
+
+// authenticateHMAC returns the user owning the hmac credential that signed the
+// request
+func (t *service) authenticateHMAC(r *http.Request) (*User, error) {
+	if t.config.HMAC == nil {
+		return nil, &AuthenticationFailed{
+			Reason: "hmac authentication is not enabled",
+			Code:   FailureMalformed,
+		}
+	}
+
+	credential, err := t.config.HMAC.Authenticate(r)
+
+	if failed, ok := err.(*user.AuthenticationFailed); ok {
+		return nil, &AuthenticationFailed{
+			Reason: failed.Reason,
+			Code:   failed.Code,
+		}
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	owner, err := t.lookupUser(credential.Username)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == nil {
+		return nil, &AuthenticationFailed{
+			Reason: "no such user",
+			Code:   FailureUnknownUser,
+		}
+	}
+
+	if owner.Disabled {
+		return nil, &AuthenticationFailed{
+			Reason: "user disabled",
+			Code:   FailureDisabled,
+		}
+	}
+
+	return owner, nil
+}
+
+// deleteHMAC removes every hmac credential of the user, returning the number
+// removed
+func (t *service) deleteHMAC(user *User) (int, error) {
+	if t.config.HMAC == nil {
+		return 0, nil
+	}
+
+	return t.config.HMAC.DeleteAll(nil, user.Login)
+}
+
+// rewrapHMAC re-wraps the hmac secrets still sealed by a retired master key
+func (t *service) rewrapHMAC() {
+	if t.config.HMAC == nil {
+		return
+	}
+
+	rewrapped, err := t.config.HMAC.Rewrap()
+
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("failed to re-wrap hmac secrets")
+	}
+
+	if rewrapped > 0 {
+		logger.WithFields(logrus.Fields{
+			"hmacKeys": rewrapped,
+		}).Info("re-wrapped hmac secrets with the active master key")
+	}
+}
@@ -0,0 +1,349 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/secret"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"golang.org/x/crypto/ed25519"
+)
+
+// keyTouchInterval is the least time between updates of the LastUsed time of
+// a key or token
+const keyTouchInterval = 1 * time.Minute
+
+// KeyAdmin manages the named keys of users. actor is the user making the change
+// through the api, or nil for the command line. Keys issued to an actor signed
+// in through single sign-on expire no later than its session.
+type KeyAdmin interface {
+	UserKeys(idLoginOrEmail string) ([]*Key, error)
+
+	// AddUserKey issues a named key to the user. The key expires after ttl, or
+	// never if zero.
+	AddUserKey(actor *User, idLoginOrEmail string, label string, ttl time.Duration) (*Key, *KeyCredentials, error)
+
+	// AddUserSSHKey registers the OpenSSH public key, in authorized_keys
+	// format, as a named key of the user. The key expires after ttl, or never
+	// if zero.
+	AddUserSSHKey(actor *User, idLoginOrEmail string, label string, authorizedKey string, ttl time.Duration) (*Key, error)
+
+	// RotateUserKey replaces the key with a new key of the same label and
+	// lifetime. The old key keeps working for grace, or is revoked at once if
+	// grace is zero.
+	RotateUserKey(actor *User, idLoginOrEmail string, keyID string, grace time.Duration) (*Key, *KeyCredentials, error)
+
+	// RevokeUserKey revokes the key, ending the sessions it opened
+	RevokeUserKey(actor *User, idLoginOrEmail string, keyID string) error
+}
+
+// KeyCredentials are the secrets of a named key. Only their verifiers are
+// stored so they can be shown once, when issued.
+type KeyCredentials struct {
+	UserID     string `json:"userId"`
+	KeyID      string `json:"keyId"`
+	TOTPSecret string `json:"totpSecret"`
+
+	// PrivateKey is the base64 ed25519 key signing requests with the key
+	PrivateKey string `json:"privateKey"`
+}
+
+// issueKey generates a named key of the user
+func issueKey(user *User, label string, ttl time.Duration) (*Key, *KeyCredentials, error) {
+	id, err := uuid.NewRandom()
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "error generating key id")
+	}
+
+	totpKey, err := totp.Generate(totp.GenerateOpts{
+		Algorithm:   otp.AlgorithmSHA512,
+		Issuer:      "deviceio-hub",
+		AccountName: user.Email + "/" + id.String(),
+	})
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "error generating TOTP secret")
+	}
+
+	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "error generating ED255519 keypair")
+	}
+
+	sealedTOTPSecret, err := secret.Seal([]byte(totpKey.Secret()))
+
+	if err != nil {
+		return nil, nil, stacktrace.Propagate(err, "error encrypting TOTP secret")
+	}
+
+	key := &Key{
+		ID:         id.String(),
+		Label:      label,
+		TOTPSecret: sealedTOTPSecret,
+		PublicKey:  pubKey,
+		Created:    time.Now().UTC(),
+	}
+
+	if ttl > 0 {
+		key.Expires = key.Created.Add(ttl)
+	}
+
+	return key, &KeyCredentials{
+		UserID:     user.ID,
+		KeyID:      key.ID,
+		TOTPSecret: totpKey.Secret(),
+		PrivateKey: base64.StdEncoding.EncodeToString(privKey),
+	}, nil
+}
+
+// capToSession keeps a key issued through a single sign-on session from
+// outliving the session key that authenticated the actor
+func capToSession(actor *User, key *Key) {
+	if actor == nil {
+		return
+	}
+
+	session := actor.key(actor.KeyID)
+
+	if session == nil || !session.SSO || session.Expires.IsZero() {
+		return
+	}
+
+	if key.Expires.IsZero() || key.Expires.After(session.Expires) {
+		key.Expires = session.Expires
+	}
+}
+
+func (t *service) UserKeys(idLoginOrEmail string) ([]*Key, error) {
+	user, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if user.Keys == nil {
+		return []*Key{}, nil
+	}
+
+	return user.Keys, nil
+}
+
+func (t *service) AddUserKey(actor *User, idLoginOrEmail string, label string, ttl time.Duration) (*Key, *KeyCredentials, error) {
+	if label == "" {
+		return nil, nil, &Invalid{
+			Reason: "key label is required",
+		}
+	}
+
+	if ttl < 0 {
+		return nil, nil, &Invalid{
+			Reason: "key lifetime cannot be negative",
+		}
+	}
+
+	user, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	key, creds, err := issueKey(user, label, ttl)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	capToSession(actor, key)
+
+	if err = t.store.Users.AddKey(user.ID, key); err != nil {
+		return nil, nil, err
+	}
+
+	if err = t.auditKey(actor, audit.UserKeyAdd, user, key, nil); err != nil {
+		return nil, nil, err
+	}
+
+	return key, creds, nil
+}
+
+func (t *service) RotateUserKey(actor *User, idLoginOrEmail string, keyID string, grace time.Duration) (*Key, *KeyCredentials, error) {
+	if grace < 0 {
+		return nil, nil, &Invalid{
+			Reason: "grace period cannot be negative",
+		}
+	}
+
+	user, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	old := user.key(keyID)
+
+	if old == nil {
+		return nil, nil, &NotFound{
+			Reason: "user '" + user.Login + "' has no key '" + keyID + "'",
+		}
+	}
+
+	if old.SSHPublicKey != nil {
+		return nil, nil, &Invalid{
+			Reason: "ssh keys cannot be rotated, add the new public key and revoke the old one",
+		}
+	}
+
+	now := time.Now().UTC()
+
+	if !old.Active(now) {
+		return nil, nil, &Invalid{
+			Reason: "key '" + keyID + "' is revoked or expired",
+		}
+	}
+
+	var ttl time.Duration
+
+	if !old.Expires.IsZero() {
+		ttl = old.Expires.Sub(old.Created)
+	}
+
+	key, creds, err := issueKey(user, old.Label, ttl)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	capToSession(actor, key)
+
+	// the new key is stored first so a failure never leaves the user without
+	// a working key
+	if err = t.store.Users.AddKey(user.ID, key); err != nil {
+		return nil, nil, err
+	}
+
+	if grace == 0 {
+		err = t.store.Users.RevokeKey(user.ID, old.ID)
+	} else if old.Expires.IsZero() || now.Add(grace).Before(old.Expires) {
+		err = t.store.Users.ExpireKey(user.ID, old.ID, now.Add(grace))
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err = t.auditKey(actor, audit.UserKeyRotate, user, key, map[string]string{
+		"replacedKeyId": old.ID,
+		"grace":         grace.String(),
+	}); err != nil {
+		return nil, nil, err
+	}
+
+	return key, creds, nil
+}
+
+func (t *service) RevokeUserKey(actor *User, idLoginOrEmail string, keyID string) error {
+	user, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return err
+	}
+
+	key := user.key(keyID)
+
+	if key == nil {
+		return &NotFound{
+			Reason: "user '" + user.Login + "' has no key '" + keyID + "'",
+		}
+	}
+
+	if key.Revoked {
+		return nil
+	}
+
+	if err = t.store.Users.RevokeKey(user.ID, key.ID); err != nil {
+		return err
+	}
+
+	if err = t.auditKey(actor, audit.UserKeyRevoke, user, key, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// auditKey writes the audit record of a change to a named key. The source is
+// the cli or api unless detail names it.
+func (t *service) auditKey(actor *User, kind string, user *User, key *Key, detail map[string]string) error {
+	if detail == nil {
+		detail = map[string]string{}
+	}
+
+	source := "cli"
+
+	detail["login"] = user.Login
+	detail["keyId"] = key.ID
+	detail["label"] = key.Label
+
+	rec := &audit.Record{
+		Kind:   kind,
+		Target: user.ID,
+		Detail: detail,
+	}
+
+	if actor != nil {
+		source = "api"
+		rec.UserID = actor.ID
+		rec.UserLogin = actor.Login
+	}
+
+	if detail["source"] == "" {
+		detail["source"] = source
+	}
+
+	return t.audit(rec)
+}
+
+// touchKey records the use of the key, at most once per keyTouchInterval
+func (t *service) touchKey(userID string, key *Key, at time.Time) {
+	if !t.touchDue(key.ID, key.LastUsed, at) {
+		return
+	}
+
+	go func() {
+		if err := t.store.Users.TouchKey(userID, key.ID, at.UTC()); err != nil {
+			logger.WithFields(logrus.Fields{
+				"userId": userID,
+				"keyId":  key.ID,
+				"error":  err.Error(),
+			}).Error("failed to record key use")
+		}
+	}()
+}
+
+// touchDue reports if the LastUsed time of the key or token with the id, stored
+// as last, is due an update for a use at the time. A true result reserves the
+// update.
+func (t *service) touchDue(id string, last time.Time, at time.Time) bool {
+	t.touchedMu.Lock()
+	defer t.touchedMu.Unlock()
+
+	if touched, ok := t.touched[id]; ok {
+		last = touched
+	}
+
+	if at.Sub(last) < keyTouchInterval {
+		return false
+	}
+
+	t.touched[id] = at
+
+	return true
+}
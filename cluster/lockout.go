@@ -0,0 +1,366 @@
+package cluster
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/user"
+)
+
+const (
+	// LockoutUser, LockoutHmacKey, LockoutToken and LockoutAddr are the kinds of
+	// lockout, counting the failures of a user, a hmac key, a service account
+	// token and a source address
+	LockoutUser    = "user"
+	LockoutHmacKey = "hmac_key"
+	LockoutToken   = "token"
+	LockoutAddr    = "addr"
+)
+
+// LockoutPolicy limits the failed authentication attempts of each user and
+// source address. Failures are counted in the store so every member of the
+// cluster applies the same limits.
+type LockoutPolicy struct {
+	// Window is how long a failure counts towards the limits
+	Window time.Duration
+
+	// FreeAttempts is how many failures are allowed before further attempts
+	// are delayed
+	FreeAttempts int
+
+	// Delay is how long the next attempt must wait after the first delayed
+	// failure. It doubles with each further failure up to MaxDelay.
+	Delay    time.Duration
+	MaxDelay time.Duration
+
+	// UserThreshold and AddrThreshold are the failures within the window that
+	// lock a user or source address out for Duration. Hmac keys and service
+	// account tokens lock out at UserThreshold. Zero never locks out.
+	UserThreshold int
+	AddrThreshold int
+	Duration      time.Duration
+}
+
+// DefaultLockoutPolicy returns the limits the hub applies unless configured
+// otherwise
+func DefaultLockoutPolicy() *LockoutPolicy {
+	return &LockoutPolicy{
+		Window:        15 * time.Minute,
+		FreeAttempts:  3,
+		Delay:         1 * time.Second,
+		MaxDelay:      1 * time.Minute,
+		UserThreshold: 10,
+		AddrThreshold: 50,
+		Duration:      15 * time.Minute,
+	}
+}
+
+// Lockout counts the recent authentication failures of a user or source
+// address
+type Lockout struct {
+	// ID is <kind>:<subject>
+	ID string `gorethink:"id"`
+
+	// Kind is LockoutUser, LockoutHmacKey, LockoutToken or LockoutAddr
+	Kind string `gorethink:"kind"`
+
+	// Subject is the id of the user, the hmac key, the token id or the source ip
+	// address
+	Subject string `gorethink:"subject"`
+
+	Failures     int       `gorethink:"failures"`
+	FirstFailure time.Time `gorethink:"first_failure"`
+	LastFailure  time.Time `gorethink:"last_failure"`
+
+	// LockedUntil is when the lockout ends, zero if the threshold was not
+	// reached
+	LockedUntil time.Time `gorethink:"locked_until,omitempty"`
+}
+
+// LockoutAdmin lets admins review and clear lockouts. actor is the user making
+// the change through the api, or nil for the command line.
+type LockoutAdmin interface {
+	// Lockouts lists the users and source addresses with recent failures.
+	// Lockouts are removed once their failures and lock have expired.
+	Lockouts() ([]*Lockout, error)
+
+	// ClearLockout forgets the failures of the lockout with the id, ending any
+	// lock at once
+	ClearLockout(actor *User, id string) error
+}
+
+// lockoutID returns the id of the lockout of the subject
+func lockoutID(kind string, subject string) string {
+	return kind + ":" + subject
+}
+
+// Locked reports if the lockout refuses every attempt at the time
+func (t *Lockout) Locked(at time.Time) bool {
+	return at.Before(t.LockedUntil)
+}
+
+// expired reports if the lockout no longer limits attempts made after the time
+// its failures are counted from
+func (t *Lockout) expired(since time.Time) bool {
+	return t.LastFailure.Before(since) && t.LockedUntil.Before(since)
+}
+
+// threshold returns the failures locking out the kind of subject
+func (t *LockoutPolicy) threshold(kind string) int {
+	if kind == LockoutAddr {
+		return t.AddrThreshold
+	}
+
+	return t.UserThreshold
+}
+
+// retryAt returns when the next attempt of the lockout is accepted
+func (t *LockoutPolicy) retryAt(lockout *Lockout) time.Time {
+	if lockout.Failures <= t.FreeAttempts {
+		return time.Time{}
+	}
+
+	delay := t.Delay
+
+	for i := t.FreeAttempts + 1; i < lockout.Failures && delay < t.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	if delay > t.MaxDelay {
+		delay = t.MaxDelay
+	}
+
+	return lockout.LastFailure.Add(delay)
+}
+
+// refusal returns why the lockout refuses an attempt at the time, or an empty
+// string if it is accepted
+func (t *LockoutPolicy) refusal(lockout *Lockout, at time.Time) string {
+	if lockout.Locked(at) {
+		return lockout.Kind + " locked out after repeated failures"
+	}
+
+	if lockout.expired(at.Add(-t.Window)) {
+		return ""
+	}
+
+	if at.Before(t.retryAt(lockout)) {
+		return lockout.Kind + " throttled after repeated failures"
+	}
+
+	return ""
+}
+
+// requestLockouts returns the lockouts the request counts against: its source
+// address and the user, hmac key or service account token it claims. Claims of
+// credentials that do not exist are only counted against the address.
+func (t *service) requestLockouts(r *http.Request) []*Lockout {
+	addr := r.RemoteAddr
+
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	lockouts := []*Lockout{
+		newLockout(LockoutAddr, addr),
+	}
+
+	typeAndValue := strings.Split(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+
+	if len(typeAndValue) != 2 {
+		return lockouts
+	}
+
+	claimed := strings.Split(typeAndValue[1], ":")[0]
+
+	switch typeAndValue[0] {
+	case "DEVICEIO-HUB-AUTH", SSHAuthScheme:
+		if owner, err := t.lookupUser(claimed); err == nil && owner != nil {
+			lockouts = append(lockouts, newLockout(LockoutUser, owner.ID))
+		}
+	case user.AuthScheme:
+		if t.config.HMAC == nil {
+			break
+		}
+
+		if exists, err := t.config.HMAC.Repository.ExistsByHmacKey(claimed); err == nil && exists {
+			lockouts = append(lockouts, newLockout(LockoutHmacKey, claimed))
+		}
+	case "Bearer":
+		tokenID := strings.Split(strings.TrimPrefix(typeAndValue[1], TokenPrefix), "_")[0]
+
+		if t.serviceAccounts.Ready() && len(t.serviceAccounts.Lookup("token", tokenID)) > 0 {
+			lockouts = append(lockouts, newLockout(LockoutToken, tokenID))
+		}
+	}
+
+	return lockouts
+}
+
+func newLockout(kind string, subject string) *Lockout {
+	return &Lockout{
+		ID:      lockoutID(kind, subject),
+		Kind:    kind,
+		Subject: subject,
+	}
+}
+
+// refuseLockedOut fails if any of the lockouts refuses the attempt. The
+// credentials of refused attempts are not checked, nor are they counted. Until
+// the lockouts are loaded every attempt is refused as unavailable.
+func (t *service) refuseLockedOut(lockouts []*Lockout, at time.Time) error {
+	if err := t.lockouts.WaitReady(cacheReadyTimeout); err != nil {
+		return &ServiceUnavailable{
+			Reason: err.Error(),
+		}
+	}
+
+	for _, lockout := range lockouts {
+		recorded, ok := t.lockouts.Get(lockout.ID).(*Lockout)
+
+		if !ok {
+			continue
+		}
+
+		if reason := t.config.Lockout.refusal(recorded, at); reason != "" {
+			return &AuthenticationFailed{
+				Reason: reason,
+				Code:   FailureLocked,
+			}
+		}
+	}
+
+	return nil
+}
+
+// recordFailure counts a failed attempt against each lockout, locking out those
+// reaching their threshold. It fails if a lockout could not be audited.
+func (t *service) recordFailure(lockouts []*Lockout, at time.Time) error {
+	policy := t.config.Lockout
+	var auditErr error
+
+	for _, lockout := range lockouts {
+		recorded, err := t.store.Lockouts.RecordFailure(lockout, at, at.Add(-policy.Window))
+
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"lockout": lockout.ID,
+				"error":   err.Error(),
+			}).Error("failed to record authentication failure")
+
+			continue
+		}
+
+		threshold := policy.threshold(recorded.Kind)
+
+		if threshold == 0 || recorded.Failures < threshold || recorded.Locked(at) {
+			continue
+		}
+
+		until := at.Add(policy.Duration)
+
+		if err = t.store.Lockouts.Lock(recorded.ID, until); err != nil {
+			logger.WithFields(logrus.Fields{
+				"lockout": recorded.ID,
+				"error":   err.Error(),
+			}).Error("failed to lock out after repeated failures")
+
+			continue
+		}
+
+		logger.WithFields(logrus.Fields{
+			"kind":     recorded.Kind,
+			"subject":  recorded.Subject,
+			"failures": recorded.Failures,
+			"until":    until,
+		}).Warn("locked out after repeated authentication failures")
+
+		err = t.audit(&audit.Record{
+			Kind:   audit.AuthLockout,
+			Target: recorded.ID,
+			Detail: map[string]string{
+				"kind":     recorded.Kind,
+				"subject":  recorded.Subject,
+				"failures": strconv.Itoa(recorded.Failures),
+				"until":    until.UTC().Format(time.RFC3339),
+			},
+		})
+
+		if err != nil {
+			auditErr = err
+		}
+	}
+
+	return auditErr
+}
+
+// resetFailures forgets the failures of the user or credential once it
+// authenticates. Failures of the source address are kept.
+func (t *service) resetFailures(lockouts []*Lockout) {
+	for _, lockout := range lockouts {
+		if lockout.Kind == LockoutAddr || t.lockouts.Get(lockout.ID) == nil {
+			continue
+		}
+
+		if err := t.store.Lockouts.Delete(lockout.ID); err != nil {
+			logger.WithFields(logrus.Fields{
+				"lockout": lockout.ID,
+				"error":   err.Error(),
+			}).Error("failed to reset authentication failures")
+		}
+	}
+}
+
+func (t *service) Lockouts() ([]*Lockout, error) {
+	return t.store.Lockouts.List()
+}
+
+func (t *service) ClearLockout(actor *User, id string) error {
+	lockouts, err := t.store.Lockouts.List()
+
+	if err != nil {
+		return err
+	}
+
+	var cleared *Lockout
+
+	for _, lockout := range lockouts {
+		if lockout.ID == id {
+			cleared = lockout
+		}
+	}
+
+	if cleared == nil {
+		return &NotFound{
+			Reason: "no lockout '" + id + "'",
+		}
+	}
+
+	if err = t.store.Lockouts.Delete(id); err != nil {
+		return err
+	}
+
+	rec := &audit.Record{
+		Kind:   audit.AuthLockoutClear,
+		Target: cleared.ID,
+		Detail: map[string]string{
+			"kind":     cleared.Kind,
+			"subject":  cleared.Subject,
+			"failures": strconv.Itoa(cleared.Failures),
+			"source":   "cli",
+		},
+	}
+
+	if actor != nil {
+		rec.UserID = actor.ID
+		rec.UserLogin = actor.Login
+		rec.Detail["source"] = "api"
+	}
+
+	return t.audit(rec)
+}
@@ -0,0 +1,5 @@
+package cluster
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("cluster")
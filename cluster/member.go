@@ -1,7 +1,22 @@
 package cluster
 
+import "time"
+
 type Member struct {
-	ID       string   `gorethink:"id,omitempty"`
-	BindPort string   `gorethink:"bind_port,omitempty"`
-	BindAddr []string `gorethink:"bind_addr,omitempty"`
+	ID        string    `gorethink:"id,omitempty" json:"id"`
+	Hostname  string    `gorethink:"hostname,omitempty" json:"hostname,omitempty"`
+	BindPort  string    `gorethink:"bind_port,omitempty" json:"bindPort,omitempty"`
+	BindAddr  []string  `gorethink:"bind_addr,omitempty" json:"bindAddr,omitempty"`
+	StartedAt time.Time `gorethink:"started_at,omitempty" json:"startedAt"`
+	LastSeen  time.Time `gorethink:"last_seen,omitempty" json:"lastSeen"`
+}
+
+// eventData describes the member for inclusion in events
+func (t *Member) eventData() map[string]interface{} {
+	return map[string]interface{}{
+		"id":       t.ID,
+		"hostname": t.Hostname,
+		"bindAddr": t.BindAddr,
+		"bindPort": t.BindPort,
+	}
 }
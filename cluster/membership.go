@@ -0,0 +1,96 @@
+package cluster
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/deviceio/hub/event"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	// memberHeartbeatInterval is how often a member refreshes its LastSeen time
+	memberHeartbeatInterval = 15 * time.Second
+
+	// memberExpiry is how long a member may go without a heartbeat before the
+	// leader removes it from the cluster
+	memberExpiry = 1 * time.Minute
+)
+
+// register records this hub instance in the member table
+func (t *service) register() error {
+	host, port, err := net.SplitHostPort(t.config.BindAddr)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "invalid cluster bind address '%v'", t.config.BindAddr)
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now().UTC()
+
+	member := &Member{
+		ID:        t.memberID,
+		Hostname:  hostname,
+		BindAddr:  []string{host},
+		BindPort:  port,
+		StartedAt: now,
+		LastSeen:  now,
+	}
+
+	if err = t.store.Members.Upsert(member); err != nil {
+		return stacktrace.Propagate(err, "failed to register cluster member")
+	}
+
+	return nil
+}
+
+// heartbeat periodically refreshes this member's LastSeen time. The leader also
+// removes expired members, events that have passed their retention and expired
+// lockouts.
+func (t *service) heartbeat() {
+	for {
+		time.Sleep(memberHeartbeatInterval)
+
+		now := time.Now().UTC()
+
+		if err := t.store.Members.Touch(t.memberID, now); err != nil {
+			logger.WithField("error", err.Error()).Error("cluster member heartbeat failed")
+			continue
+		}
+
+		if !t.isLeader() {
+			continue
+		}
+
+		if err := t.store.Members.DeleteExpired(now.Add(-memberExpiry)); err != nil {
+			logger.WithField("error", err.Error()).Error("failed to remove expired cluster members")
+		}
+
+		if err := t.store.Events.DeleteBefore(event.NewID(now.Add(-t.eventRetention()))); err != nil {
+			logger.WithField("error", err.Error()).Error("failed to remove expired events")
+		}
+
+		if t.config.Lockout != nil {
+			if err := t.store.Lockouts.DeleteExpired(now.Add(-t.config.Lockout.Window)); err != nil {
+				logger.WithField("error", err.Error()).Error("failed to remove expired lockouts")
+			}
+		}
+	}
+}
+
+// isLeader reports if this member has the lowest ID of all known members. The
+// leader performs cluster wide work that must only happen once.
+func (t *service) isLeader() bool {
+	if !t.members.Ready() || t.members.Get(t.memberID) == nil {
+		return false
+	}
+
+	for _, id := range t.memberIDs() {
+		if id < t.memberID {
+			return false
+		}
+	}
+
+	return true
+}
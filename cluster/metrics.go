@@ -0,0 +1,14 @@
+package cluster
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	authFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deviceio_hub_auth_failures_total",
+		Help: "Number of failed api authentications by failure code",
+	}, []string{"reason"})
+)
+
+func init() {
+	prometheus.MustRegister(authFailures)
+}
@@ -0,0 +1,792 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// NewRethinkStore returns the rethinkdb backed cluster store. It uses the global
+// db.Session.
+func NewRethinkStore() *Store {
+	return &Store{
+		Users:           &rethinkUsers{},
+		Members:         &rethinkMembers{},
+		Devices:         &rethinkDevices{},
+		Events:          &rethinkEvents{},
+		DeviceEvents:    &rethinkDeviceEvents{},
+		ServiceAccounts: &rethinkServiceAccounts{},
+		Lockouts:        &rethinkLockouts{},
+	}
+}
+
+const (
+	// errIdentityLinked and errUserDisabled abort conditional user updates
+	errIdentityLinked = "identity is linked to another user"
+	errUserDisabled   = "user disabled"
+)
+
+type rethinkUsers struct {
+}
+
+func (t *rethinkUsers) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.UserTable),
+		New: func() interface{} {
+			return &User{}
+		},
+	}
+}
+
+func (t *rethinkUsers) List() ([]*User, error) {
+	users := []*User{}
+
+	cursor, err := db.Table(db.UserTable).OrderBy("login").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query users")
+	}
+
+	if err = cursor.All(&users); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read users")
+	}
+
+	return users, nil
+}
+
+func (t *rethinkUsers) Get(id string) (*User, error) {
+	cursor, err := db.Table(db.UserTable).Get(id).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query user")
+	}
+
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	user := &User{}
+
+	if err = cursor.One(user); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read user")
+	}
+
+	return user, nil
+}
+
+func (t *rethinkUsers) Insert(user *User) (string, error) {
+	resp, err := db.Table(db.UserTable).Insert(user).RunWrite(db.Session)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert user")
+	}
+
+	if user.ID == "" && len(resp.GeneratedKeys) > 0 {
+		user.ID = resp.GeneratedKeys[0]
+	}
+
+	return user.ID, nil
+}
+
+func (t *rethinkUsers) Update(user *User) error {
+	if _, err := db.Table(db.UserTable).Get(user.ID).Replace(user).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to update user")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) TouchKey(userID string, keyID string, at time.Time) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		return map[string]interface{}{
+			"keys": user.Field("keys").Map(func(key r.Term) interface{} {
+				return r.Branch(
+					key.Field("id").Eq(keyID),
+					key.Merge(map[string]interface{}{"last_used": at}),
+					key,
+				)
+			}),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user key")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) AddKey(userID string, key *Key) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		return map[string]interface{}{
+			"keys": user.Field("keys").Default([]interface{}{}).Append(key),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to add user key")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) RevokeKey(userID string, keyID string) error {
+	return t.mergeKey(userID, keyID, map[string]interface{}{"revoked": true})
+}
+
+func (t *rethinkUsers) ExpireKey(userID string, keyID string, at time.Time) error {
+	return t.mergeKey(userID, keyID, map[string]interface{}{"expires": at})
+}
+
+// mergeKey atomically merges fields into the user's named key
+func (t *rethinkUsers) mergeKey(userID string, keyID string, fields map[string]interface{}) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		return map[string]interface{}{
+			"keys": user.Field("keys").Map(func(key r.Term) interface{} {
+				return r.Branch(
+					key.Field("id").Eq(keyID),
+					key.Merge(fields),
+					key,
+				)
+			}),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user key")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) SetAdmin(userID string, admin bool) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(map[string]interface{}{
+		"admin": admin,
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user admin role")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) SetDisabled(userID string, disabled bool) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(map[string]interface{}{
+		"disabled": disabled,
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user disabled state")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) ReplaceCredentials(userID string, creds *User) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		return credentialFields(user, creds)
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user credentials")
+	}
+
+	return nil
+}
+
+func (t *rethinkUsers) RecoverCredentials(userID string, creds *User, at time.Time) error {
+	_, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		fields := credentialFields(user, creds)
+		fields["disabled"] = false
+		fields["recovered_at"] = at
+		fields["keys"] = user.Field("keys").Default([]interface{}{}).Map(func(key r.Term) interface{} {
+			return key.Merge(map[string]interface{}{"revoked": true})
+		})
+
+		return fields
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update user credentials")
+	}
+
+	return nil
+}
+
+// credentialFields are the fields replacing the primary credentials of the user
+// with those of creds
+func credentialFields(user r.Term, creds *User) map[string]interface{} {
+	return map[string]interface{}{
+		"password_hash":      r.Binary(creds.PasswordHash),
+		"password_salt":      creds.PasswordSalt,
+		"totp_secret":        r.Literal(creds.TOTPSecret),
+		"ed22519_public_key": r.Binary(creds.ED25519PublicKey),
+		"session_epoch":      user.Field("session_epoch").Default(0).Add(1),
+	}
+}
+
+func (t *rethinkUsers) LinkSSO(userID string, issuer string, subject string) (bool, error) {
+	linked := db.Table(db.UserTable).Filter(func(other r.Term) r.Term {
+		return other.Field("id").Ne(userID).
+			And(other.Field("oidc_issuer").Default("").Eq(issuer)).
+			And(other.Field("oidc_subject").Default("").Eq(subject))
+	}).IsEmpty().Not()
+
+	// the check reads other documents so the update cannot be atomic, it is
+	// still made by the server in the same write
+	_, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		return r.Branch(
+			linked,
+			r.Error(errIdentityLinked),
+			map[string]interface{}{
+				"oidc_issuer":  issuer,
+				"oidc_subject": subject,
+			},
+		)
+	}, r.UpdateOpts{NonAtomic: true}).RunWrite(db.Session)
+
+	if err != nil && strings.Contains(err.Error(), errIdentityLinked) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to link user identity")
+	}
+
+	return true, nil
+}
+
+func (t *rethinkUsers) AddSessionKey(userID string, key *Key, now time.Time) (bool, error) {
+	resp, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		return r.Branch(
+			user.Field("disabled").Default(false),
+			r.Error(errUserDisabled),
+			map[string]interface{}{
+				"keys": user.Field("keys").Default([]interface{}{}).Filter(func(key r.Term) r.Term {
+					active := key.Field("revoked").Default(false).Not().And(
+						key.Field("expires").Default(nil).Eq(nil).Or(key.Field("expires").Gt(now)),
+					)
+
+					return key.Field("sso").Default(false).Not().Or(active)
+				}).Append(key),
+			},
+		)
+	}).RunWrite(db.Session)
+
+	if err != nil && strings.Contains(err.Error(), errUserDisabled) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to add user session key")
+	}
+
+	return resp.Replaced > 0, nil
+}
+
+func (t *rethinkUsers) RewrapTOTPSecret(userID string, keyID string, prevKeyID string, envelope *secret.Envelope) (bool, error) {
+	sealedBy := func(doc r.Term) r.Term {
+		return doc.Field("totp_secret").Field("kid").Default("").Eq(prevKeyID)
+	}
+
+	resp, err := db.Table(db.UserTable).Get(userID).Update(func(user r.Term) interface{} {
+		if keyID == "" {
+			return r.Branch(
+				sealedBy(user),
+				map[string]interface{}{"totp_secret": r.Literal(envelope)},
+				map[string]interface{}{},
+			)
+		}
+
+		return map[string]interface{}{
+			"keys": user.Field("keys").Map(func(key r.Term) interface{} {
+				return r.Branch(
+					key.Field("id").Eq(keyID).And(sealedBy(key)),
+					key.Merge(map[string]interface{}{"totp_secret": r.Literal(envelope)}),
+					key,
+				)
+			}),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to update user totp secret")
+	}
+
+	return resp.Replaced > 0, nil
+}
+
+func (t *rethinkUsers) Delete(id string) error {
+	if _, err := db.Table(db.UserTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete user")
+	}
+
+	return nil
+}
+
+type rethinkServiceAccounts struct {
+}
+
+func (t *rethinkServiceAccounts) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.ServiceAccountTable),
+		New: func() interface{} {
+			return &ServiceAccount{}
+		},
+	}
+}
+
+func (t *rethinkServiceAccounts) List() ([]*ServiceAccount, error) {
+	accounts := []*ServiceAccount{}
+
+	cursor, err := db.Table(db.ServiceAccountTable).OrderBy("name").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query service accounts")
+	}
+
+	if err = cursor.All(&accounts); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read service accounts")
+	}
+
+	return accounts, nil
+}
+
+func (t *rethinkServiceAccounts) Insert(account *ServiceAccount) (string, error) {
+	resp, err := db.Table(db.ServiceAccountTable).Insert(account).RunWrite(db.Session)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert service account")
+	}
+
+	if account.ID == "" && len(resp.GeneratedKeys) > 0 {
+		account.ID = resp.GeneratedKeys[0]
+	}
+
+	return account.ID, nil
+}
+
+func (t *rethinkServiceAccounts) Update(account *ServiceAccount) error {
+	if _, err := db.Table(db.ServiceAccountTable).Get(account.ID).Replace(account).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to update service account")
+	}
+
+	return nil
+}
+
+func (t *rethinkServiceAccounts) TouchToken(accountID string, tokenID string, at time.Time) error {
+	_, err := db.Table(db.ServiceAccountTable).Get(accountID).Update(func(account r.Term) interface{} {
+		return map[string]interface{}{
+			"tokens": account.Field("tokens").Map(func(token r.Term) interface{} {
+				return r.Branch(
+					token.Field("id").Eq(tokenID),
+					token.Merge(map[string]interface{}{"last_used": at}),
+					token,
+				)
+			}),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update service account token")
+	}
+
+	return nil
+}
+
+func (t *rethinkServiceAccounts) AddToken(accountID string, token *Token) error {
+	_, err := db.Table(db.ServiceAccountTable).Get(accountID).Update(func(account r.Term) interface{} {
+		return map[string]interface{}{
+			"tokens": account.Field("tokens").Default([]interface{}{}).Append(token),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to add service account token")
+	}
+
+	return nil
+}
+
+func (t *rethinkServiceAccounts) RevokeToken(accountID string, tokenID string) error {
+	_, err := db.Table(db.ServiceAccountTable).Get(accountID).Update(func(account r.Term) interface{} {
+		return map[string]interface{}{
+			"tokens": account.Field("tokens").Map(func(token r.Term) interface{} {
+				return r.Branch(
+					token.Field("id").Eq(tokenID),
+					token.Merge(map[string]interface{}{"revoked": true}),
+					token,
+				)
+			}),
+		}
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to revoke service account token")
+	}
+
+	return nil
+}
+
+func (t *rethinkServiceAccounts) Delete(id string) error {
+	if _, err := db.Table(db.ServiceAccountTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete service account")
+	}
+
+	return nil
+}
+
+type rethinkLockouts struct {
+}
+
+func (t *rethinkLockouts) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.LockoutTable),
+		New: func() interface{} {
+			return &Lockout{}
+		},
+	}
+}
+
+func (t *rethinkLockouts) List() ([]*Lockout, error) {
+	lockouts := []*Lockout{}
+
+	cursor, err := db.Table(db.LockoutTable).OrderBy("id").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query lockouts")
+	}
+
+	if err = cursor.All(&lockouts); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read lockouts")
+	}
+
+	return lockouts, nil
+}
+
+// RecordFailure counts the failure in a single replace so failures recorded by
+// every member add up
+func (t *rethinkLockouts) RecordFailure(lockout *Lockout, at time.Time, since time.Time) (*Lockout, error) {
+	fresh := *lockout
+	fresh.Failures = 1
+	fresh.FirstFailure = at
+	fresh.LastFailure = at
+
+	_, err := db.Table(db.LockoutTable).Get(lockout.ID).Replace(func(current r.Term) interface{} {
+		return r.Branch(
+			current.Eq(nil).Or(current.Field("last_failure").Lt(since)),
+			fresh,
+			current.Merge(map[string]interface{}{
+				"failures":     current.Field("failures").Add(1),
+				"last_failure": at,
+			}),
+		)
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to record authentication failure")
+	}
+
+	cursor, err := db.Table(db.LockoutTable).Get(lockout.ID).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query lockout")
+	}
+
+	defer cursor.Close()
+
+	recorded := &Lockout{}
+
+	if err = cursor.One(recorded); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read lockout")
+	}
+
+	return recorded, nil
+}
+
+func (t *rethinkLockouts) Lock(id string, until time.Time) error {
+	_, err := db.Table(db.LockoutTable).Get(id).Update(map[string]interface{}{
+		"locked_until": until,
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to lock out '%v'", id)
+	}
+
+	return nil
+}
+
+func (t *rethinkLockouts) DeleteExpired(before time.Time) error {
+	_, err := db.Table(db.LockoutTable).Filter(
+		r.Row.Field("last_failure").Lt(before).And(
+			r.Row.HasFields("locked_until").Not().Or(r.Row.Field("locked_until").Lt(before)),
+		),
+	).Delete().RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to remove expired lockouts")
+	}
+
+	return nil
+}
+
+func (t *rethinkLockouts) Delete(id string) error {
+	if _, err := db.Table(db.LockoutTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete lockout")
+	}
+
+	return nil
+}
+
+type rethinkMembers struct {
+}
+
+func (t *rethinkMembers) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.MemberTable),
+		New: func() interface{} {
+			return &Member{}
+		},
+	}
+}
+
+func (t *rethinkMembers) List() ([]*Member, error) {
+	members := []*Member{}
+
+	cursor, err := db.Table(db.MemberTable).OrderBy("id").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query cluster members")
+	}
+
+	if err = cursor.All(&members); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read cluster members")
+	}
+
+	return members, nil
+}
+
+func (t *rethinkMembers) Upsert(member *Member) error {
+	_, err := db.Table(db.MemberTable).Insert(member, r.InsertOpts{
+		Conflict: "replace",
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to store cluster member")
+	}
+
+	return nil
+}
+
+func (t *rethinkMembers) Touch(id string, at time.Time) error {
+	_, err := db.Table(db.MemberTable).Get(id).Update(map[string]interface{}{
+		"last_seen": at,
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update cluster member")
+	}
+
+	return nil
+}
+
+func (t *rethinkMembers) DeleteExpired(before time.Time) error {
+	_, err := db.Table(db.MemberTable).Filter(
+		r.Row.Field("last_seen").Lt(before),
+	).Delete().RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to remove expired cluster members")
+	}
+
+	return nil
+}
+
+func (t *rethinkMembers) Delete(id string) error {
+	if _, err := db.Table(db.MemberTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete cluster member")
+	}
+
+	return nil
+}
+
+type rethinkDevices struct {
+}
+
+func (t *rethinkDevices) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.DeviceTable),
+		New: func() interface{} {
+			return &Device{}
+		},
+	}
+}
+
+func (t *rethinkDevices) List() ([]*Device, error) {
+	devices := []*Device{}
+
+	cursor, err := db.Table(db.DeviceTable).OrderBy("hostname").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query devices")
+	}
+
+	if err = cursor.All(&devices); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read devices")
+	}
+
+	return devices, nil
+}
+
+func (t *rethinkDevices) Upsert(device *Device) error {
+	_, err := db.Table(db.DeviceTable).Insert(device, r.InsertOpts{
+		Conflict: "update",
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to store device")
+	}
+
+	return nil
+}
+
+func (t *rethinkDevices) SetBlocked(id string, blocked bool) error {
+	_, err := db.Table(db.DeviceTable).Get(id).Update(map[string]interface{}{
+		"blocked": blocked,
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update device")
+	}
+
+	return nil
+}
+
+func (t *rethinkDevices) Delete(id string) error {
+	if _, err := db.Table(db.DeviceTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete device")
+	}
+
+	return nil
+}
+
+type rethinkEvents struct {
+}
+
+func (t *rethinkEvents) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.EventTable),
+		New: func() interface{} {
+			return &event.Event{}
+		},
+	}
+}
+
+func (t *rethinkEvents) Insert(e *event.Event) error {
+	if _, err := db.Table(db.EventTable).Insert(e).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to insert event")
+	}
+
+	return nil
+}
+
+func (t *rethinkEvents) After(id string, fn func(e *event.Event) bool) error {
+	cursor, err := db.Table(db.EventTable).Between(id, r.MaxVal, r.BetweenOpts{
+		LeftBound: "open",
+	}).OrderBy(r.OrderByOpts{
+		Index: "id",
+	}).Run(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query events")
+	}
+
+	defer cursor.Close()
+
+	e := &event.Event{}
+
+	for cursor.Next(e) {
+		if !fn(e) {
+			return nil
+		}
+
+		e = &event.Event{}
+	}
+
+	if err = cursor.Err(); err != nil {
+		return stacktrace.Propagate(err, "failed to read events")
+	}
+
+	return nil
+}
+
+func (t *rethinkEvents) DeleteBefore(id string) error {
+	if _, err := db.Table(db.EventTable).Between(r.MinVal, id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to remove events")
+	}
+
+	return nil
+}
+
+type rethinkDeviceEvents struct {
+}
+
+func (t *rethinkDeviceEvents) Insert(e *event.Event) error {
+	if _, err := db.Table(db.DeviceEventTable).Insert(e).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to insert device event")
+	}
+
+	return nil
+}
+
+func (t *rethinkDeviceEvents) Recent(idOrHostname string, fn func(e *event.Event) bool) error {
+	cursor, err := db.Table(db.DeviceEventTable).Filter(func(row r.Term) r.Term {
+		return row.Field("device_id").Eq(idOrHostname).Or(row.Field("hostname").Eq(idOrHostname))
+	}).OrderBy(r.Desc("id")).Run(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query device events")
+	}
+
+	defer cursor.Close()
+
+	e := &event.Event{}
+
+	for cursor.Next(e) {
+		if !fn(e) {
+			return nil
+		}
+
+		e = &event.Event{}
+	}
+
+	if err = cursor.Err(); err != nil {
+		return stacktrace.Propagate(err, "failed to read device events")
+	}
+
+	return nil
+}
+
+func (t *rethinkDeviceEvents) Trim(deviceID string, keep int) error {
+	_, err := db.Table(db.DeviceEventTable).
+		GetAllByIndex("device_id", deviceID).
+		OrderBy(r.Desc("id")).
+		Skip(keep).
+		Delete().
+		RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to trim device events")
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/secret"
+)
+
+// rewrapInterval is how often the leader looks for credentials sealed by a
+// retired master key
+const rewrapInterval = 1 * time.Hour
+
+// rewrapSecrets re-wraps, on the leader, the credential material of every user
+// and the webhook secrets still sealed by a retired master key so retired keys
+// can be removed after a rotation
+func (t *service) rewrapSecrets() {
+	for {
+		time.Sleep(memberHeartbeatInterval)
+
+		if t.isLeader() && t.users.Ready() {
+			t.rewrapUsers()
+			t.rewrapHMAC()
+			t.rewrapWebhooks()
+		}
+
+		time.Sleep(rewrapInterval)
+	}
+}
+
+// rewrapUsers returns the number of users whose secrets were re-wrapped. Each
+// secret is stored with an atomic update that only applies while it is still
+// sealed by the retired key, so concurrent changes to the user are not lost.
+func (t *service) rewrapUsers() int {
+	keyring := secret.Default()
+
+	if keyring == nil {
+		return 0
+	}
+
+	rewrapped := 0
+
+	for _, item := range t.users.List() {
+		user := item.(*User)
+		changed := false
+
+		rewrap := func(keyID string, envelope *secret.Envelope) {
+			if envelope == nil || envelope.KeyID == keyring.Active() {
+				return
+			}
+
+			fields := logrus.Fields{
+				"userId": user.ID,
+				"keyId":  envelope.KeyID,
+			}
+
+			next, err := keyring.Rewrap(envelope)
+
+			if err != nil {
+				fields["error"] = err.Error()
+				logger.WithFields(fields).Error("failed to re-wrap totp secret")
+				return
+			}
+
+			ok, err := t.store.Users.RewrapTOTPSecret(user.ID, keyID, envelope.KeyID, next)
+
+			if err != nil {
+				fields["error"] = err.Error()
+				logger.WithFields(fields).Error("failed to store re-wrapped totp secret")
+				return
+			}
+
+			changed = changed || ok
+		}
+
+		rewrap("", user.TOTPSecret)
+
+		for _, key := range user.Keys {
+			rewrap(key.ID, key.TOTPSecret)
+		}
+
+		if changed {
+			rewrapped++
+		}
+	}
+
+	if rewrapped > 0 {
+		logger.WithFields(logrus.Fields{
+			"users": rewrapped,
+			"keyId": keyring.Active(),
+		}).Info("re-wrapped credentials with the active master key")
+	}
+
+	return rewrapped
+}
+
+// rewrapWebhooks re-wraps the webhook subscription secrets still sealed by a
+// retired master key
+func (t *service) rewrapWebhooks() {
+	if t.config.Webhooks == nil {
+		return
+	}
+
+	rewrapped, err := t.config.Webhooks.Rewrap()
+
+	if err != nil {
+		logger.WithField("error", err.Error()).Error("failed to re-wrap webhook secrets")
+	}
+
+	if rewrapped > 0 {
+		logger.WithFields(logrus.Fields{
+			"subscriptions": rewrapped,
+		}).Info("re-wrapped webhook secrets with the active master key")
+	}
+}
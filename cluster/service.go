@@ -2,12 +2,14 @@ package cluster
 
 import (
 	"bytes"
-	"crypto/rand"
+	"context"
 	"crypto/sha512"
+	"crypto/tls"
 	"encoding/base64"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"strings"
@@ -15,101 +17,333 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	linq "github.com/ahmetb/go-linq"
-	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/health"
+	"github.com/deviceio/hub/secret"
+	"github.com/deviceio/hub/trace"
+	"github.com/deviceio/hub/user"
 	"github.com/deviceio/shared/types"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/palantir/stacktrace"
-	"github.com/pquerna/otp"
 	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/ed25519"
 )
 
 type Service interface {
+	KeyAdmin
+	ServiceAccountAdmin
+	LockoutAdmin
+	SSO
+
 	AuthenticateAPIRequest(r *http.Request) (failure error)
+	AuthenticateAPIUser(r *http.Request) (*User, error)
+	DeviceEvents(deviceid string, limit int, types []string) ([]*event.Event, error)
+	Devices() ([]*Device, error)
+
+	// Device returns the device with the id or hostname
+	Device(idOrHostname string) (*Device, error)
+	Health() *health.Component
 	Initialize()
+	LookupDevice(idOrHostname string) *Device
+	MemberID() string
+
+	// SessionContext returns a context derived from ctx that is cancelled when
+	// the sessions of the user are revoked, or the user is disabled or deleted
+	SessionContext(ctx context.Context, user *User) (context.Context, context.CancelFunc)
 	ProxyDeviceRequest(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error
 	Start()
+	SubscribeEvents(lastEventID string, types []string) ([]*event.Event, *event.Subscription, error)
+	Users() ([]*User, error)
+
+	// User returns the user with the id, login or email
+	User(idLoginOrEmail string) (*User, error)
 }
 
 func NewService(config *Config) Service {
-	return &service{
-		config: config,
+	memberID := config.MemberID
+
+	if memberID == "" {
+		memberID = uuid.New().String()
+	}
+
+	store := config.Store
+
+	if store == nil {
+		store = NewRethinkStore()
+	}
+
+	t := &service{
+		config:   config,
+		memberID: memberID,
+		stream:   event.NewBus(),
+		store:    store,
+		touched:  map[string]time.Time{},
 	}
+
+	t.newCaches()
+
+	return t
 }
 
 type service struct {
-	config        *Config
-	userCache     map[string]*User
-	userCacheMu   *sync.Mutex
-	memberCache   map[string]*Member
-	memberCacheMu *sync.Mutex
-	deviceCache   map[string]*Device
-	deviceCacheMu *sync.Mutex
+	config   *Config
+	memberID string
+	stream   *event.Bus
+	store    *Store
+	users    *cache.Cache
+	members  *cache.Cache
+	devices  *cache.Cache
+	listener health.Listener
+
+	serviceAccounts *cache.Cache
+	lockouts        *cache.Cache
+
+	// touched is when the LastUsed time of each named key and token was last
+	// updated
+	touched   map[string]time.Time
+	touchedMu sync.Mutex
 }
 
 func (t *service) AuthenticateAPIRequest(r *http.Request) error {
+	_, err := t.AuthenticateAPIUser(r)
+	return err
+}
+
+// AuthenticateAPIUser returns the user the request authenticates as. With a
+// lockout policy, attempts of users and source addresses with repeated failures
+// are refused without checking their credentials.
+func (t *service) AuthenticateAPIUser(r *http.Request) (*User, error) {
+	var user *User
+	var err error
+
+	if t.config.Lockout == nil {
+		user, err = t.authenticateAPIRequest(r)
+	} else {
+		user, err = t.authenticateThrottled(r)
+	}
+
+	if failed, ok := err.(*AuthenticationFailed); ok {
+		authFailures.WithLabelValues(failed.Code).Inc()
+
+		// the reason is only audited, the event is seen by every member, event
+		// stream and webhook
+		e := event.New(event.AuthFailed, map[string]interface{}{
+			"remoteAddr": r.RemoteAddr,
+			"method":     r.Method,
+			"requestId":  r.Header.Get(trace.RequestIDHeader),
+		})
+
+		if span := trace.SpanFromContext(r.Context()); span != nil {
+			e.Data["traceId"] = span.Context.TraceIDString()
+		}
+
+		if r.URL != nil {
+			e.Data["path"] = r.URL.Path
+		}
+
+		t.publish(e)
+		t.auditAuthFailure(r, e, failed.Reason)
+	}
+
+	return user, err
+}
+
+// auditAuthFailure records the failed authentication of the request with its
+// reason. A failed write is logged, the request is rejected either way.
+func (t *service) auditAuthFailure(r *http.Request, e *event.Event, reason string) {
+	if t.config.Audit == nil {
+		return
+	}
+
+	sourceIP := r.RemoteAddr
+
+	if host, _, err := net.SplitHostPort(sourceIP); err == nil {
+		sourceIP = host
+	}
+
+	rec := &audit.Record{
+		Kind:      audit.AuthFailed,
+		Time:      e.Time,
+		SourceIP:  sourceIP,
+		Method:    r.Method,
+		RequestID: r.Header.Get(trace.RequestIDHeader),
+		Detail: map[string]string{
+			"reason":     reason,
+			"remoteAddr": r.RemoteAddr,
+		},
+	}
+
+	rec.TraceID, _ = e.Data["traceId"].(string)
+	rec.Path, _ = e.Data["path"].(string)
+
+	if err := t.config.Audit.Write(rec); err != nil {
+		logger.WithField("error", err.Error()).Error("failed to write authentication audit record")
+	}
+}
+
+// authenticateThrottled authenticates the request unless its user or source
+// address is locked out, counting failures against both
+func (t *service) authenticateThrottled(r *http.Request) (*User, error) {
+	now := time.Now()
+	lockouts := t.requestLockouts(r)
+
+	if err := t.refuseLockedOut(lockouts, now); err != nil {
+		return nil, err
+	}
+
+	user, err := t.authenticateAPIRequest(r)
+
+	if _, ok := err.(*AuthenticationFailed); ok {
+		if auditErr := t.recordFailure(lockouts, now); auditErr != nil {
+			return nil, auditErr
+		}
+	} else if err == nil {
+		t.resetFailures(lockouts)
+	}
+
+	return user, err
+}
+
+// authenticateAPIRequest returns a copy of the user the request authenticates
+// as, recording the scheme it authenticated with
+func (t *service) authenticateAPIRequest(r *http.Request) (*User, error) {
+	user, err := t.authenticateCredentials(r)
+
+	if err != nil {
+		return nil, err
+	}
+
+	authenticated := *user
+	authenticated.Scheme = strings.Fields(r.Header.Get("Authorization"))[0]
+
+	return &authenticated, nil
+}
+
+func (t *service) authenticateCredentials(r *http.Request) (*User, error) {
 	authheader := r.Header.Get("Authorization")
 
 	if authheader == "" {
-		return &AuthenticationFailed{
+		return nil, &AuthenticationFailed{
 			Reason: "authentication header empty",
+			Code:   FailureMalformed,
 		}
 	}
 
 	authHeaderTypeAndValue := strings.Split(strings.TrimSpace(authheader), " ")
 
 	if len(authHeaderTypeAndValue) != 2 {
-		return &AuthenticationFailed{
+		return nil, &AuthenticationFailed{
 			Reason: "authorization header does not contain valid type and value",
+			Code:   FailureMalformed,
 		}
 	}
 
+	if authHeaderTypeAndValue[0] == "Bearer" {
+		return t.authenticateToken(r, authHeaderTypeAndValue[1])
+	}
+
+	if authHeaderTypeAndValue[0] == user.AuthScheme {
+		return t.authenticateHMAC(r)
+	}
+
+	if authHeaderTypeAndValue[0] == SSHAuthScheme {
+		return t.authenticateSSH(r, authHeaderTypeAndValue[1])
+	}
+
 	if authHeaderTypeAndValue[0] != "DEVICEIO-HUB-AUTH" {
-		return &AuthenticationFailed{
+		return nil, &AuthenticationFailed{
 			Reason: "authorization header <type> must be 'DEVICEIO-HUB-AUTH'",
+			Code:   FailureMalformed,
 		}
 	}
 
+	// <user_id>:<signature> signs with the primary key of the user and
+	// <user_id>:<key_id>:<signature> with one of its named keys
 	authHeaderValues := strings.Split(authHeaderTypeAndValue[1], ":")
 
-	if len(authHeaderValues) != 2 {
-		return &AuthenticationFailed{
+	if len(authHeaderValues) != 2 && len(authHeaderValues) != 3 {
+		return nil, &AuthenticationFailed{
 			Reason: "authorization value does not have required format <user_id>:<ed25519_signature_base64>",
+			Code:   FailureMalformed,
 		}
 	}
 
 	suppliedID := authHeaderValues[0]
-	suppliedSignatrue, err := base64.StdEncoding.DecodeString(authHeaderValues[1])
+	suppliedKeyID := ""
+
+	if len(authHeaderValues) == 3 {
+		suppliedKeyID = authHeaderValues[1]
+	}
+
+	suppliedSignatrue, err := base64.StdEncoding.DecodeString(authHeaderValues[len(authHeaderValues)-1])
 
 	if err != nil {
-		return &AuthenticationFailed{
+		return nil, &AuthenticationFailed{
 			Reason: err.Error(),
+			Code:   FailureMalformed,
 		}
 	}
 
-	t.userCacheMu.Lock()
-	var user *User
-	for _, a := range t.userCache {
-		if a.ID == suppliedID || a.Login == suppliedID || a.Email == suppliedID {
-			user = a
-			break
-		}
+	user, err := t.lookupUser(suppliedID)
+
+	if err != nil {
+		return nil, err
 	}
-	t.userCacheMu.Unlock()
 
 	if user == nil {
-		return &AuthenticationFailed{
+		return nil, &AuthenticationFailed{
 			Reason: "no such user",
+			Code:   FailureUnknownUser,
 		}
 	}
 
-	passcode, err := totp.GenerateCode(string(user.TOTPSecret), time.Now())
+	sealedSecret := user.TOTPSecret
+	publicKey := user.ED25519PublicKey
+
+	var key *Key
+
+	if suppliedKeyID != "" {
+		if key = user.key(suppliedKeyID); key == nil {
+			return nil, &AuthenticationFailed{
+				Reason: "no such key",
+				Code:   FailureUnknownUser,
+			}
+		}
+
+		if key.SSHPublicKey != nil {
+			return nil, &AuthenticationFailed{
+				Reason: "ssh keys sign with the " + SSHAuthScheme + " scheme",
+				Code:   FailureMalformed,
+			}
+		}
+
+		sealedSecret = key.TOTPSecret
+		publicKey = key.PublicKey
+	}
+
+	totpSecret, err := secret.Open(sealedSecret)
 
 	if err != nil {
-		return &AuthenticationFailed{
+		logger.WithFields(logrus.Fields{
+			"userId": user.ID,
+			"error":  err.Error(),
+		}).Error("failed to decrypt totp secret")
+
+		return nil, &AuthenticationFailed{
+			Reason: "failed to decrypt totp secret",
+			Code:   FailureBadSignature,
+		}
+	}
+
+	passcode, err := totp.GenerateCode(string(totpSecret), time.Now())
+
+	if err != nil {
+		return nil, &AuthenticationFailed{
 			Reason: err.Error(),
+			Code:   FailureBadSignature,
 		}
 	}
 
@@ -130,20 +364,76 @@ func (t *service) AuthenticateAPIRequest(r *http.Request) error {
 	hash.Write([]byte(message))
 
 	sigok := ed25519.Verify(
-		ed25519.PublicKey(user.ED25519PublicKey),
+		ed25519.PublicKey(publicKey),
 		hash.Sum(nil),
 		suppliedSignatrue,
 	)
 
 	if !sigok {
-		return &AuthenticationFailed{
+		return nil, &AuthenticationFailed{
 			Reason: "signature mismatch",
+			Code:   FailureBadSignature,
+		}
+	}
+
+	if user.Disabled {
+		return nil, &AuthenticationFailed{
+			Reason: "user disabled",
+			Code:   FailureDisabled,
+		}
+	}
+
+	if key == nil {
+		return user, nil
+	}
+
+	now := time.Now()
+
+	if key.Revoked {
+		return nil, &AuthenticationFailed{
+			Reason: "key revoked",
+			Code:   FailureExpired,
 		}
 	}
 
+	if !key.Active(now) {
+		return nil, &AuthenticationFailed{
+			Reason: "key expired",
+			Code:   FailureExpired,
+		}
+	}
+
+	t.touchKey(user.ID, key, now)
+
+	authenticated := *user
+	authenticated.KeyID = key.ID
+
+	return &authenticated, nil
+}
+
+// LookupDevice returns the known device with the given id or hostname, or nil
+func (t *service) LookupDevice(idOrHostname string) *Device {
+	if !t.devices.Ready() {
+		return nil
+	}
+
+	idOrHostname = strings.ToLower(idOrHostname)
+
+	if device, ok := t.devices.Get(idOrHostname).(*Device); ok {
+		return device
+	}
+
+	for _, item := range t.devices.Lookup("hostname", idOrHostname) {
+		return item.(*Device)
+	}
+
 	return nil
 }
 
+func (t *service) MemberID() string {
+	return t.memberID
+}
+
 func (t *service) ProxyDeviceRequest(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error {
 	if deviceid == "" {
 		return stacktrace.NewError("deviceid empty")
@@ -157,10 +447,27 @@ func (t *service) ProxyDeviceRequest(deviceid string, path string, rw http.Respo
 		return stacktrace.NewError("http.Request is nil")
 	}
 
-	// TODO: proxy to other cluster members
-	err := t.config.LocalDeviceProxyFunc(deviceid, path, rw, r)
+	ctx, span := trace.StartSpan(r.Context(), "cluster.ProxyDeviceRequest", trace.SpanKindInternal)
+	defer span.Finish()
+
+	span.SetAttribute("device.id", deviceid)
+	span.SetAttribute("member.id", t.memberID)
+
+	if device := t.LookupDevice(deviceid); device != nil && device.Blocked {
+		err := &DeviceBlocked{
+			Reason: "device '" + device.ID + "' is blocked",
+		}
+
+		span.SetError(err)
+		return err
+	}
+
+	// TODO: proxy to other cluster members. Forwarded requests must keep the
+	// X-Request-ID header and carry the traceparent of this span.
+	err := t.config.LocalDeviceProxyFunc(deviceid, path, rw, r.WithContext(ctx))
 
 	if err != nil {
+		span.SetError(err)
 		return stacktrace.Propagate(err, "cluster failed proxy to local gateway")
 	}
 
@@ -168,15 +475,31 @@ func (t *service) ProxyDeviceRequest(deviceid string, path string, rw http.Respo
 }
 
 func (t *service) Start() {
-	logrus.WithFields(logrus.Fields{
+	logger.WithFields(logrus.Fields{
 		"bindAddr":    t.config.BindAddr,
 		"tlsCertPath": t.config.TLSCertPath,
 		"tlsKeyPath":  t.config.TLSKeyPath,
 	}).Info("cluster starting")
 
-	go t.hydrateUserCache()
-	go t.hydrateMemberCache()
-	go t.hydrateDeviceCache()
+	go t.users.Start()
+	go t.members.Start()
+	go t.devices.Start()
+	go t.serviceAccounts.Start()
+	go t.lockouts.Start()
+	go t.hydrateEventStream()
+
+	if err := t.register(); err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	go t.heartbeat()
+	go t.rewrapSecrets()
+
+	if t.config.Events != nil {
+		go t.persistDeviceEvents()
+		go t.relayEvents()
+		go t.recordDevices()
+	}
 
 	server := http.NewServeMux()
 	router := mux.NewRouter()
@@ -189,75 +512,80 @@ func (t *service) Start() {
 	if t.config.TLSCertPath == "" && t.config.TLSKeyPath == "" {
 		certpath, keypath = t.makeTempCertificates()
 
-		logrus.WithField("cert", certpath).Info("cluster temporary certificate")
-		logrus.WithField("key", keypath).Info("cluster temporary key")
+		logger.WithField("cert", certpath).Info("cluster temporary certificate")
+		logger.WithField("key", keypath).Info("cluster temporary key")
 
 		defer os.Remove(certpath)
 		defer os.Remove(keypath)
 	}
 
-	if err := http.ListenAndServeTLS(
-		t.config.BindAddr,
-		certpath,
-		keypath,
-		server,
-	); err != nil {
-		logrus.Fatal(err.Error())
-	}
-}
-
-func (t *service) Initialize() {
-	var count int
-
-	cursor, err := db.Table(db.UserTable).Filter(db.Filter{
-		"admin": true,
-		"login": "admin",
-	}).Count().Run(db.Session)
+	cer, err := tls.LoadX509KeyPair(certpath, keypath)
 
 	if err != nil {
-		logrus.Fatal(err.Error())
+		t.listener.Failed(t.config.BindAddr, err)
+		logger.WithField("error", err.Error()).Error("error loading cluster certificates")
+		return
 	}
 
-	if err = cursor.One(&count); err != nil {
-		logrus.Fatal(err.Error())
-	}
+	ln, err := tls.Listen("tcp", t.config.BindAddr, &tls.Config{
+		Certificates: []tls.Certificate{cer},
+	})
 
-	if count > 0 {
-		logrus.Fatal("cluster already initialized")
+	if err != nil {
+		t.listener.Failed(t.config.BindAddr, err)
+		logger.WithField("error", err.Error()).Error("error starting cluster tls listener")
+		return
 	}
 
-	adminTOTPKey, _ := totp.Generate(totp.GenerateOpts{
-		Algorithm:   otp.AlgorithmSHA512,
-		Issuer:      "deviceio-hub",
-		AccountName: "admin@localhost",
-	})
-
-	adminPasswordPlain, _ := uuid.NewRandom()
-	adminPasswordSalt, _ := uuid.NewRandom()
+	t.listener.Bound(t.config.BindAddr, cer)
 
-	hash := sha512.New()
-	hash.Write([]byte(adminPasswordSalt.String() + adminPasswordPlain.String()))
+	if err := http.Serve(ln, server); err != nil {
+		t.listener.Failed(t.config.BindAddr, err)
+		logger.WithField("error", err.Error()).Error("cluster listener stopped")
+	}
+}
 
-	pubKey, privKey, err := ed25519.GenerateKey(rand.Reader)
+func (t *service) Initialize() {
+	users, err := t.store.Users.List()
 
 	if err != nil {
-		logrus.WithField("error", err.Error()).Fatal("error generating ED255519 keypair")
+		logger.Fatal(err.Error())
+	}
+
+	for _, user := range users {
+		if user.Admin && user.Login == "admin" {
+			logger.Fatal("cluster already initialized")
+		}
 	}
 
 	user := &User{
-		Login:            "admin",
-		Admin:            true,
-		Email:            "admin@localhost",
-		TOTPSecret:       []byte(adminTOTPKey.Secret()),
-		PasswordHash:     hash.Sum(nil),
-		PasswordSalt:     adminPasswordSalt.String(),
-		ED25519PublicKey: pubKey,
+		Login: "admin",
+		Admin: true,
+		Email: "admin@localhost",
+	}
+
+	creds, err := issueCredentials(user)
+
+	if err != nil {
+		logger.Fatal(err.Error())
 	}
 
-	resp, err := db.Table(db.UserTable).Insert(user).RunWrite(db.Session)
+	adminID, err := t.store.Users.Insert(user)
 
 	if err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
+	}
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.UserCreate,
+		Target: adminID,
+		Detail: map[string]string{
+			"login":  user.Login,
+			"admin":  "true",
+			"source": "init",
+		},
+	}); err != nil {
+		logger.Fatal(err.Error())
 	}
 
 	fmt.Println(fmt.Sprintf(`
@@ -273,14 +601,38 @@ Admin TOTP Secret : %v
 Admin Private Key : %v
 ----------------------------------
 	`,
-		resp.GeneratedKeys[0],
+		adminID,
 		user.Login,
-		adminPasswordPlain,
-		string(user.TOTPSecret),
-		base64.StdEncoding.EncodeToString(privKey),
+		creds.Password,
+		creds.TOTPSecret,
+		creds.PrivateKey,
 	))
 }
 
+// audit writes the record of an administrative change to the configured audit
+// log. Changes are audited once stored, so a change whose record cannot be
+// written stays applied but unaudited; it is logged and reported to the caller
+// as ServiceUnavailable.
+func (t *service) audit(rec *audit.Record) error {
+	if t.config.Audit == nil {
+		return nil
+	}
+
+	if err := t.config.Audit.Write(rec); err != nil {
+		logger.WithFields(logrus.Fields{
+			"kind":   rec.Kind,
+			"target": rec.Target,
+			"error":  err.Error(),
+		}).Error("change applied but its audit record could not be written")
+
+		return &ServiceUnavailable{
+			Reason: "failed to write audit record",
+		}
+	}
+
+	return nil
+}
+
 func (t *service) makeTempCertificates() (string, string) {
 	certgen := &types.CertGen{
 		Host:      "localhost",
@@ -299,12 +651,12 @@ func (t *service) makeTempCertificates() (string, string) {
 	certBytes, keyBytes = certgen.Generate()
 
 	if certTemp, err = ioutil.TempFile("", "deviceio-hub"); err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	defer certTemp.Close()
 
 	if keyTemp, err = ioutil.TempFile("", "deviceio-hub"); err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	defer keyTemp.Close()
 
@@ -313,137 +665,3 @@ func (t *service) makeTempCertificates() (string, string) {
 
 	return certTemp.Name(), keyTemp.Name()
 }
-
-func (t *service) hydrateUserCache() {
-	t.userCache = map[string]*User{}
-	t.userCacheMu = &sync.Mutex{}
-
-	var users []*User
-
-	cursor, err := db.Table(db.UserTable).Run(db.Session)
-
-	if err != nil {
-		logrus.Fatal(err)
-	}
-
-	cursor.All(&users)
-	cursor.Close()
-
-	linq.From(users).ForEach(func(a interface{}) {
-		user := a.(*User)
-		t.userCache[user.ID] = user
-	})
-
-	var changed struct {
-		Old *User `gorethink:"old_val"`
-		New *User `gorethink:"new_val"`
-	}
-
-	changes, err := db.Table(db.UserTable).Changes().Run(db.Session)
-
-	for changes.Next(&changed) {
-		t.userCacheMu.Lock()
-
-		if changed.New == nil {
-			_, ok := t.userCache[changed.Old.ID]
-
-			if ok {
-				delete(t.userCache, changed.Old.ID)
-			}
-		} else {
-			t.userCache[changed.New.ID] = changed.New
-		}
-
-		t.userCacheMu.Unlock()
-	}
-}
-
-func (t *service) hydrateMemberCache() {
-	t.memberCache = map[string]*Member{}
-	t.memberCacheMu = &sync.Mutex{}
-
-	var members []*Member
-
-	cursor, err := db.Table(db.MemberTable).Run(db.Session)
-
-	if err != nil {
-		logrus.Fatal(err)
-	}
-
-	cursor.All(&members)
-	cursor.Close()
-
-	t.memberCacheMu.Lock()
-	for _, member := range members {
-		t.memberCache[member.ID] = member
-	}
-	t.memberCacheMu.Unlock()
-
-	var changed struct {
-		Old *Member `gorethink:"old_val"`
-		New *Member `gorethink:"new_val"`
-	}
-
-	changes, err := db.Table(db.MemberTable).Changes().Run(db.Session)
-
-	for changes.Next(&changed) {
-		t.memberCacheMu.Lock()
-
-		if changed.New == nil {
-			_, ok := t.memberCache[changed.Old.ID]
-
-			if ok {
-				delete(t.memberCache, changed.Old.ID)
-			}
-		} else {
-			t.memberCache[changed.New.ID] = changed.New
-		}
-
-		t.memberCacheMu.Unlock()
-	}
-}
-
-func (t *service) hydrateDeviceCache() {
-	t.deviceCache = map[string]*Device{}
-	t.deviceCacheMu = &sync.Mutex{}
-
-	var devices []*Device
-
-	cursor, err := db.Table(db.DeviceTable).Run(db.Session)
-
-	if err != nil {
-		logrus.Fatal(err)
-	}
-
-	cursor.All(&devices)
-	cursor.Close()
-
-	t.deviceCacheMu.Lock()
-	for _, device := range devices {
-		t.deviceCache[device.ID] = device
-	}
-	t.deviceCacheMu.Unlock()
-
-	var changed struct {
-		Old *Device `gorethink:"old_val"`
-		New *Device `gorethink:"new_val"`
-	}
-
-	changes, err := db.Table(db.DeviceTable).Changes().Run(db.Session)
-
-	for changes.Next(&changed) {
-		t.deviceCacheMu.Lock()
-
-		if changed.New == nil {
-			_, ok := t.deviceCache[changed.Old.ID]
-
-			if ok {
-				delete(t.deviceCache, changed.Old.ID)
-			}
-		} else {
-			t.deviceCache[changed.New.ID] = changed.New
-		}
-
-		t.deviceCacheMu.Unlock()
-	}
-}
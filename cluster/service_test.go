@@ -5,18 +5,28 @@ import (
 	"crypto/sha512"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"strings"
 	"testing"
 	"time"
 
-	"sync"
-
 	"encoding/base64"
+	"encoding/json"
 
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/client"
+	"github.com/deviceio/hub/embedded"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/oidc"
+	"github.com/deviceio/hub/secret"
+	"github.com/deviceio/hub/user"
 	"github.com/pquerna/otp/totp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/suite"
 	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
 )
 
 type ServiceTestSuite struct {
@@ -25,7 +35,16 @@ type ServiceTestSuite struct {
 }
 
 func (t *ServiceTestSuite) SetupTest() {
-	t.service = &service{}
+	key, _ := secret.GenerateKey()
+	keyring, _ := secret.NewKeyring(key)
+	secret.SetKeyring(keyring)
+
+	t.service = NewService(&Config{}).(*service)
+}
+
+func seal(plain string) *secret.Envelope {
+	e, _ := secret.Seal([]byte(plain))
+	return e
 }
 
 func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_failure_on_missing_auth_header_value() {
@@ -106,16 +125,13 @@ func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_signature_mismatch_when_t
 		t.T().Fatalf(err.Error())
 	}
 
-	t.service.userCacheMu = &sync.Mutex{}
-	t.service.userCache = map[string]*User{
-		"whatever": &User{
-			ID:               "whatever",
-			Login:            "admin",
-			Email:            "admin@localhost",
-			TOTPSecret:       []byte(totpkey.Secret()),
-			ED25519PublicKey: pubkey,
-		},
-	}
+	t.service.users.Replace(&User{
+		ID:               "whatever",
+		Login:            "admin",
+		Email:            "admin@localhost",
+		TOTPSecret:       seal(totpkey.Secret()),
+		ED25519PublicKey: pubkey,
+	})
 
 	r, err := http.NewRequest("GET", "https://something.com/?one=foo&two=bar", nil)
 
@@ -166,16 +182,13 @@ func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_valid_authentication() {
 		t.T().Fatalf(err.Error())
 	}
 
-	t.service.userCacheMu = &sync.Mutex{}
-	t.service.userCache = map[string]*User{
-		"whatever": &User{
-			ID:               "whatever",
-			Login:            "admin",
-			Email:            "admin@localhost",
-			TOTPSecret:       []byte(totpkey.Secret()),
-			ED25519PublicKey: pubkey,
-		},
-	}
+	t.service.users.Replace(&User{
+		ID:               "whatever",
+		Login:            "admin",
+		Email:            "admin@localhost",
+		TOTPSecret:       seal(totpkey.Secret()),
+		ED25519PublicKey: pubkey,
+	})
 
 	r, err := http.NewRequest("GET", "https://something.com/?one=foo&two=bar", nil)
 
@@ -209,6 +222,1354 @@ func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_valid_authentication() {
 	assert.Nil(t.T(), err)
 }
 
+func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_failure_publishes_auth_failed_event() {
+	bus := event.NewBus()
+	sub := bus.Subscribe(1, event.AuthFailed)
+	defer sub.Close()
+
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	auditLog := &audit.Log{
+		Store:  &audit.EmbeddedStore{DB: edb},
+		Member: "member",
+	}
+
+	t.service.config = &Config{
+		Events: bus,
+		Audit:  auditLog,
+	}
+
+	req, _ := http.NewRequest("GET", "https://something.com/device/foo", nil)
+	req.RemoteAddr = "10.0.0.1:5000"
+
+	err := t.service.AuthenticateAPIRequest(req)
+
+	assert.NotNil(t.T(), err)
+	assert.Equal(t.T(), 1, len(sub.C))
+
+	e := <-sub.C
+
+	assert.Equal(t.T(), "10.0.0.1:5000", e.Data["remoteAddr"])
+	assert.Equal(t.T(), "/device/foo", e.Data["path"])
+
+	// the reason is only audited
+	_, ok := e.Data["reason"]
+	assert.False(t.T(), ok)
+
+	records, err := auditLog.Query(&audit.Query{Kind: audit.AuthFailed})
+	assert.Nil(t.T(), err)
+	assert.Len(t.T(), records, 1)
+	assert.Equal(t.T(), "authentication header empty", records[0].Detail["reason"])
+	assert.Equal(t.T(), "10.0.0.1", records[0].SourceIP)
+	assert.Equal(t.T(), "/device/foo", records[0].Path)
+}
+
+func (t *ServiceTestSuite) Test_lookupUser_finds_users_by_id_login_or_email() {
+	t.service.users.Replace(&User{
+		ID:    "a1",
+		Login: "admin",
+		Email: "admin@localhost",
+	})
+
+	for _, supplied := range []string{"a1", "admin", "admin@localhost"} {
+		user, err := t.service.lookupUser(supplied)
+
+		assert.Nil(t.T(), err)
+		assert.Equal(t.T(), "a1", user.ID)
+	}
+
+	user, err := t.service.lookupUser("nobody")
+
+	assert.Nil(t.T(), err)
+	assert.Nil(t.T(), user)
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_fails_fast_before_users_are_loaded() {
+	defer func(timeout time.Duration) {
+		cacheReadyTimeout = timeout
+	}(cacheReadyTimeout)
+
+	cacheReadyTimeout = 10 * time.Millisecond
+
+	req, _ := http.NewRequest("GET", "https://something.com/", nil)
+	req.Header.Set("Authorization", "DEVICEIO-HUB-AUTH admin:"+base64.StdEncoding.EncodeToString([]byte("sig")))
+
+	err := t.service.AuthenticateAPIRequest(req)
+
+	assert.IsType(t.T(), &ServiceUnavailable{}, err)
+}
+
+func (t *ServiceTestSuite) Test_DeviceEvents_are_trimmed_to_the_limit_newest_first() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.config.DeviceEventLimit = 2
+
+	for i := 0; i < 3; i++ {
+		e := event.New(event.DeviceConnected, nil)
+		e.ID = fmt.Sprintf("%v", i)
+		e.DeviceID = "abc"
+		e.Hostname = "web-1"
+
+		assert.Nil(t.T(), t.service.store.DeviceEvents.Insert(e))
+		assert.Nil(t.T(), t.service.store.DeviceEvents.Trim("abc", t.service.deviceEventLimit()))
+	}
+
+	events, err := t.service.DeviceEvents("WEB-1", 0, nil)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 2, len(events))
+	assert.Equal(t.T(), "2", events[0].ID)
+	assert.Equal(t.T(), "1", events[1].ID)
+}
+
+func (t *ServiceTestSuite) Test_rewrapUsers_moves_secrets_to_the_active_key() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	retired, _ := secret.GenerateKey()
+	active, _ := secret.GenerateKey()
+
+	keyring, _ := secret.NewKeyring(retired)
+	secret.SetKeyring(keyring)
+
+	user := &User{ID: "1", Login: "admin", TOTPSecret: seal("JBSWY3DPEHPK3PXP")}
+	t.service.store.Users.Insert(user)
+	t.service.users.Replace(user)
+
+	keyring, _ = secret.NewKeyring(retired, active)
+	secret.SetKeyring(keyring)
+
+	assert.Equal(t.T(), 1, t.service.rewrapUsers())
+
+	stored, _ := t.service.store.Users.Get("1")
+	assert.Equal(t.T(), secret.KeyID(active), stored.TOTPSecret.KeyID)
+
+	keyring, _ = secret.NewKeyring(active)
+	plain, err := keyring.Open(stored.TOTPSecret)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "JBSWY3DPEHPK3PXP", string(plain))
+}
+
+func (t *ServiceTestSuite) Test_rewrapUsers_keeps_changes_made_after_the_cache_was_read() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	retired, _ := secret.GenerateKey()
+	active, _ := secret.GenerateKey()
+
+	keyring, _ := secret.NewKeyring(retired)
+	secret.SetKeyring(keyring)
+
+	user := &User{
+		ID:         "1",
+		Login:      "admin",
+		TOTPSecret: seal("JBSWY3DPEHPK3PXP"),
+		Keys: []*Key{
+			{ID: "laptop", TOTPSecret: seal("JBSWY3DPEHPK3PXP")},
+		},
+	}
+	t.service.store.Users.Insert(user)
+	t.service.users.Replace(user)
+
+	keyring, _ = secret.NewKeyring(retired, active)
+	secret.SetKeyring(keyring)
+
+	// the user is disabled and its named key re-enrolled after the cache was read
+	reenrolled := seal("KRSXG5CTMVRXEZLU")
+	changed := *user
+	changed.Disabled = true
+	changed.Keys = []*Key{{ID: "laptop", TOTPSecret: reenrolled}}
+	t.service.store.Users.Update(&changed)
+
+	assert.Equal(t.T(), 1, t.service.rewrapUsers())
+
+	stored, _ := t.service.store.Users.Get("1")
+	assert.True(t.T(), stored.Disabled)
+	assert.Equal(t.T(), secret.KeyID(active), stored.TOTPSecret.KeyID)
+	assert.Equal(t.T(), reenrolled.WrappedKey, stored.Keys[0].TOTPSecret.WrappedKey)
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIRequest_failure_when_user_disabled() {
+	pubkey, privkey, _ := ed25519.GenerateKey(rand.Reader)
+	totpkey, _ := totp.Generate(totp.GenerateOpts{
+		Issuer:      "deviceio-hub",
+		AccountName: "ops@localhost",
+	})
+
+	t.service.users.Replace(&User{
+		ID:               "ops",
+		Disabled:         true,
+		TOTPSecret:       seal(totpkey.Secret()),
+		ED25519PublicKey: pubkey,
+	})
+
+	r, _ := http.NewRequest("GET", "https://something.com/", nil)
+	passcode, _ := totp.GenerateCode(totpkey.Secret(), time.Now())
+
+	hash := sha512.New()
+	hash.Write([]byte(strings.Join([]string{"ops", passcode, r.Method, r.Host, r.URL.Path, "", ""}, "\r\n")))
+
+	r.Header.Set("Authorization", "DEVICEIO-HUB-AUTH ops:"+base64.StdEncoding.EncodeToString(ed25519.Sign(privkey, hash.Sum(nil))))
+
+	err := t.service.AuthenticateAPIRequest(r)
+
+	assert.NotNil(t.T(), err)
+	assert.Equal(t.T(), "user disabled", err.Error())
+}
+
+func (t *ServiceTestSuite) Test_ProxyDeviceRequest_refuses_blocked_devices() {
+	t.service.config = &Config{
+		LocalDeviceProxyFunc: func(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error {
+			t.T().Fatal("request proxied to a blocked device")
+			return nil
+		},
+	}
+
+	t.service.devices.Replace(&Device{ID: "d1", Hostname: "web01", Blocked: true})
+
+	r, _ := http.NewRequest("GET", "https://something.com/device/web01/info", nil)
+
+	err := t.service.ProxyDeviceRequest("web01", "info", httptest.NewRecorder(), r)
+
+	_, ok := err.(*DeviceBlocked)
+	assert.True(t.T(), ok)
+}
+
+func (t *ServiceTestSuite) Test_Admin_keeps_the_last_enabled_admin() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	admin, _, err := t.service.AddUser("admin", "admin@localhost", true)
+	assert.Nil(t.T(), err)
+
+	_, _, err = t.service.AddUser("ADMIN", "other@localhost", false)
+	assert.NotNil(t.T(), err)
+
+	assert.NotNil(t.T(), t.service.SetUserDisabled("admin", true))
+	assert.NotNil(t.T(), t.service.DeleteUser(admin.ID))
+
+	_, _, err = t.service.AddUser("ops", "ops@localhost", true)
+	assert.Nil(t.T(), err)
+
+	assert.Nil(t.T(), t.service.SetUserDisabled("admin", true))
+	assert.NotNil(t.T(), t.service.DeleteUser("ops"))
+}
+
+func (t *ServiceTestSuite) Test_RotateUserKeys_replaces_credentials() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	user, first, _ := t.service.AddUser("ops", "ops@localhost", false)
+
+	second, err := t.service.RotateUserKeys("ops@localhost")
+	assert.Nil(t.T(), err)
+	assert.NotEqual(t.T(), first.PrivateKey, second.PrivateKey)
+
+	stored, _ := t.service.store.Users.Get(user.ID)
+	privkey, _ := base64.StdEncoding.DecodeString(second.PrivateKey)
+	totpSecret, _ := secret.Open(stored.TOTPSecret)
+
+	assert.Equal(t.T(), []byte(ed25519.PrivateKey(privkey).Public().(ed25519.PublicKey)), stored.ED25519PublicKey)
+	assert.Equal(t.T(), second.TOTPSecret, string(totpSecret))
+}
+
+func (t *ServiceTestSuite) Test_EvictMember_requires_force_for_recent_members() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	t.service.store.Members.Upsert(&Member{ID: "m1", LastSeen: time.Now().UTC()})
+	t.service.store.Devices.Upsert(&Device{ID: "d1", Connected: true, Member: "m1"})
+	t.service.store.Devices.Upsert(&Device{ID: "d2", Connected: true, Member: "m2"})
+
+	_, err := t.service.EvictMember("m1", false)
+	assert.NotNil(t.T(), err)
+
+	devices, err := t.service.EvictMember("m1", true)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, devices)
+
+	members, _ := t.service.Members()
+	assert.Equal(t.T(), 0, len(members))
+
+	d1, _ := t.service.Device("d1")
+	d2, _ := t.service.Device("d2")
+	assert.False(t.T(), d1.Connected)
+	assert.True(t.T(), d2.Connected)
+}
+
+func (t *ServiceTestSuite) Test_RecoverAdmin_resets_credentials_and_revokes_sessions() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	bus := event.NewBus()
+	sub := bus.Subscribe(10, event.UserRecovered)
+	defer sub.Close()
+
+	t.service.config = &Config{Events: bus}
+	t.service.store = NewEmbeddedStore(edb)
+
+	// changefeed events are only published by the leader
+	t.service.memberID = "m1"
+	t.service.members.Replace(&Member{ID: "m1"})
+
+	t.service.AddUser("ops", "ops@localhost", true)
+	admin, _, _ := t.service.AddUser("admin", "admin@localhost", true)
+	t.service.SetUserDisabled("admin", true)
+
+	before, _ := t.service.store.Users.Get(admin.ID)
+	t.service.users.Replace(before)
+
+	_, _, err := t.service.RecoverAdmin("ops@localhost", "root@host")
+	assert.Nil(t.T(), err)
+
+	_, err = t.service.RotateUserKeys("ops")
+	assert.Nil(t.T(), err)
+
+	recovered, creds, err := t.service.RecoverAdmin("admin", "root@host")
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), recovered.Disabled)
+
+	stored, _ := t.service.store.Users.Get(admin.ID)
+	totpSecret, _ := secret.Open(stored.TOTPSecret)
+	assert.Equal(t.T(), creds.TOTPSecret, string(totpSecret))
+	assert.False(t.T(), stored.Disabled)
+
+	// sessions of the disabled user were already revoked
+	assert.True(t.T(), t.service.sessionRevoked(admin.ID, "", before.SessionEpoch))
+	t.service.users.Replace(stored)
+	assert.True(t.T(), t.service.sessionRevoked(admin.ID, "", before.SessionEpoch))
+	assert.False(t.T(), t.service.sessionRevoked(admin.ID, "", stored.SessionEpoch))
+
+	assert.Equal(t.T(), 1, len(sub.C))
+	e := <-sub.C
+	assert.Equal(t.T(), admin.ID, e.Data["id"])
+
+	// other members observe the same change without publishing it again
+	t.service.members.Replace(&Member{ID: "m0"}, &Member{ID: "m1"})
+	recovered.RecoveredAt = recovered.RecoveredAt.Add(time.Second)
+	t.service.users.Replace(recovered)
+	assert.Equal(t.T(), 0, len(sub.C))
+}
+
+func (t *ServiceTestSuite) Test_RecoverAdmin_and_RotateUserKeys_delete_hmac_keys() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.config.HMAC = &user.Service{
+		Repository: &user.EmbeddedRepository{DB: edb},
+	}
+
+	admin, _, _ := t.service.AddUser("admin", "admin@localhost", true)
+	ops, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+	t.service.users.Replace(admin, ops)
+
+	signed := func(hmacKey string, hmacSecret string) *http.Request {
+		r, _ := http.NewRequest("GET", "https://something.com/v1/users/me", nil)
+		r.RemoteAddr = "10.0.0.5:40000"
+		user.Sign(r, hmacKey, hmacSecret, time.Now())
+		return r
+	}
+
+	adminKey, adminSecret, _ := t.service.config.HMAC.Add(nil, "admin", nil)
+	opsKey, opsSecret, _ := t.service.config.HMAC.Add(nil, "ops", nil)
+
+	_, err := t.service.AuthenticateAPIUser(signed(adminKey.HmacKey, adminSecret))
+	assert.Nil(t.T(), err)
+
+	_, _, err = t.service.RecoverAdmin("admin", "root@host")
+	assert.Nil(t.T(), err)
+
+	_, err = t.service.AuthenticateAPIUser(signed(adminKey.HmacKey, adminSecret))
+	assert.IsType(t.T(), &AuthenticationFailed{}, err)
+
+	// other users keep their hmac keys until their own keys are rotated
+	_, err = t.service.AuthenticateAPIUser(signed(opsKey.HmacKey, opsSecret))
+	assert.Nil(t.T(), err)
+
+	_, err = t.service.RotateUserKeys("ops")
+	assert.Nil(t.T(), err)
+
+	_, err = t.service.AuthenticateAPIUser(signed(opsKey.HmacKey, opsSecret))
+	assert.IsType(t.T(), &AuthenticationFailed{}, err)
+}
+
+func (t *ServiceTestSuite) Test_DeleteUser_deletes_hmac_keys_before_the_login_is_reused() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.config.HMAC = &user.Service{
+		Repository: &user.EmbeddedRepository{DB: edb},
+	}
+
+	ops, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+	t.service.users.Replace(ops)
+
+	signed := func(hmacKey string, hmacSecret string) *http.Request {
+		r, _ := http.NewRequest("GET", "https://something.com/v1/users/me", nil)
+		r.RemoteAddr = "10.0.0.5:40000"
+		user.Sign(r, hmacKey, hmacSecret, time.Now())
+		return r
+	}
+
+	opsKey, opsSecret, _ := t.service.config.HMAC.Add(nil, "ops", nil)
+
+	_, err := t.service.AuthenticateAPIUser(signed(opsKey.HmacKey, opsSecret))
+	assert.Nil(t.T(), err)
+
+	assert.Nil(t.T(), t.service.DeleteUser("ops"))
+
+	// a new user given the same login does not inherit the old credentials
+	reused, _, _ := t.service.AddUser("ops", "ops2@localhost", false)
+	t.service.users.Replace(reused)
+
+	_, err = t.service.AuthenticateAPIUser(signed(opsKey.HmacKey, opsSecret))
+	assert.IsType(t.T(), &AuthenticationFailed{}, err)
+}
+
+func (t *ServiceTestSuite) Test_RecoverAdmin_refuses_non_admins() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.AddUser("ops", "ops@localhost", false)
+
+	_, _, err := t.service.RecoverAdmin("ops", "root@host")
+	assert.NotNil(t.T(), err)
+}
+
+// keyRequest returns a request signed with the named key credentials
+func keyRequest(creds *KeyCredentials) *http.Request {
+	privkey, _ := base64.StdEncoding.DecodeString(creds.PrivateKey)
+
+	r, _ := http.NewRequest("GET", "https://something.com/", nil)
+	passcode, _ := totp.GenerateCode(creds.TOTPSecret, time.Now())
+
+	hash := sha512.New()
+	hash.Write([]byte(strings.Join([]string{creds.UserID, passcode, r.Method, r.Host, r.URL.Path, "", ""}, "\r\n")))
+
+	r.Header.Set("Authorization", "DEVICEIO-HUB-AUTH "+creds.UserID+":"+creds.KeyID+":"+base64.StdEncoding.EncodeToString(ed25519.Sign(privkey, hash.Sum(nil))))
+
+	return r
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_with_named_keys() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	user, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+	_, laptop, err := t.service.AddUserKey(nil, "ops", "laptop", 0)
+	assert.Nil(t.T(), err)
+
+	_, ci, err := t.service.AddUserKey(nil, "ops", "ci", time.Hour)
+	assert.Nil(t.T(), err)
+
+	stored, _ := t.service.store.Users.Get(user.ID)
+	t.service.users.Replace(stored)
+
+	authenticated, err := t.service.AuthenticateAPIUser(keyRequest(laptop))
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), laptop.KeyID, authenticated.KeyID)
+	assert.Equal(t.T(), "DEVICEIO-HUB-AUTH", authenticated.Scheme)
+	assert.Equal(t.T(), "", stored.KeyID)
+
+	unknown := *laptop
+	unknown.KeyID = "nope"
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(&unknown))
+	assert.Equal(t.T(), "no such key", err.Error())
+
+	// another key's secrets do not sign for the key
+	mixed := *ci
+	mixed.KeyID = laptop.KeyID
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(&mixed))
+	assert.Equal(t.T(), "signature mismatch", err.Error())
+
+	_, replacement, err := t.service.RotateUserKey(nil, "ops", laptop.KeyID, 0)
+	assert.Nil(t.T(), err)
+
+	stored, _ = t.service.store.Users.Get(user.ID)
+	t.service.users.Replace(stored)
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(laptop))
+	assert.Equal(t.T(), "key revoked", err.Error())
+	assert.True(t.T(), t.service.sessionRevoked(user.ID, laptop.KeyID, stored.SessionEpoch))
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(replacement))
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), t.service.sessionRevoked(user.ID, replacement.KeyID, stored.SessionEpoch))
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(ci))
+	assert.Nil(t.T(), err)
+
+	stored.key(ci.KeyID).Expires = time.Now().Add(-time.Second)
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(ci))
+	assert.Equal(t.T(), "key expired", err.Error())
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_counts_failures_by_code() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	user, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+	_, laptop, _ := t.service.AddUserKey(nil, "ops", "laptop", 0)
+	_, ci, _ := t.service.AddUserKey(nil, "ops", "ci", 0)
+
+	stored, _ := t.service.store.Users.Get(user.ID)
+	t.service.users.Replace(stored)
+
+	empty, _ := http.NewRequest("GET", "https://something.com/", nil)
+
+	unknown := *laptop
+	unknown.KeyID = "nope"
+
+	mixed := *ci
+	mixed.KeyID = laptop.KeyID
+
+	tests := []struct {
+		request *http.Request
+		code    string
+		change  func()
+	}{
+		{empty, FailureMalformed, nil},
+		{keyRequest(&unknown), FailureUnknownUser, nil},
+		{keyRequest(&mixed), FailureBadSignature, nil},
+		{keyRequest(ci), FailureExpired, func() { stored.key(ci.KeyID).Expires = time.Now().Add(-time.Second) }},
+		{keyRequest(laptop), FailureDisabled, func() { stored.Disabled = true }},
+	}
+
+	for _, test := range tests {
+		if test.change != nil {
+			test.change()
+		}
+
+		counted := testutil.ToFloat64(authFailures.WithLabelValues(test.code))
+
+		_, err := t.service.AuthenticateAPIUser(test.request)
+		assert.IsType(t.T(), &AuthenticationFailed{}, err, test.code)
+		assert.Equal(t.T(), test.code, err.(*AuthenticationFailed).Code)
+		assert.Equal(t.T(), counted+1, testutil.ToFloat64(authFailures.WithLabelValues(test.code)), test.code)
+	}
+}
+
+func (t *ServiceTestSuite) Test_RotateUserKey_keeps_the_old_key_for_the_grace_period() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	t.service.AddUser("ops", "ops@localhost", false)
+	old, _, _ := t.service.AddUserKey(nil, "ops", "ci", 30*24*time.Hour)
+
+	key, _, err := t.service.RotateUserKey(nil, "ops", old.ID, time.Hour)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "ci", key.Label)
+	assert.Equal(t.T(), 30*24*time.Hour, key.Expires.Sub(key.Created))
+
+	keys, _ := t.service.UserKeys("ops")
+	assert.Equal(t.T(), 2, len(keys))
+	assert.False(t.T(), keys[0].Revoked)
+	assert.True(t.T(), keys[0].Active(time.Now()))
+	assert.False(t.T(), keys[0].Active(time.Now().Add(61*time.Minute)))
+
+	assert.Nil(t.T(), t.service.RevokeUserKey(nil, "ops", key.ID))
+
+	_, _, err = t.service.RotateUserKey(nil, "ops", key.ID, 0)
+	assert.NotNil(t.T(), err)
+}
+
+func (t *ServiceTestSuite) Test_key_use_does_not_publish_user_updated() {
+	used := &User{ID: "ops", Keys: []*Key{{ID: "k", LastUsed: time.Now()}}}
+	unused := &User{ID: "ops", Keys: []*Key{{ID: "k"}}}
+
+	assert.True(t.T(), used.onlyKeysUsed(unused))
+
+	unused.Keys[0].Revoked = true
+	assert.False(t.T(), used.onlyKeysUsed(unused))
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_with_service_account_tokens() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	account, err := t.service.AddServiceAccount(nil, "ci", "deploy pipeline")
+	assert.Nil(t.T(), err)
+
+	_, _, err = t.service.AddServiceAccountToken(nil, "ci", "deploy", &TokenScope{}, time.Hour)
+	assert.IsType(t.T(), &Invalid{}, err)
+
+	token, value, err := t.service.AddServiceAccountToken(nil, "ci", "deploy", &TokenScope{
+		Devices: []string{"web*", "tag:canary"},
+		Paths:   []string{"/filesystem"},
+		Methods: []string{"GET"},
+	}, time.Hour)
+	assert.Nil(t.T(), err)
+
+	stored, _ := t.service.ServiceAccount(account.ID)
+	assert.Equal(t.T(), hashToken(value[strings.LastIndex(value, "_")+1:]), stored.Tokens[0].Hash)
+
+	t.service.serviceAccounts.Replace(stored)
+	t.service.devices.Replace(
+		&Device{ID: "d1", Hostname: "web01"},
+		&Device{ID: "d2", Hostname: "db01"},
+		&Device{ID: "d3", Hostname: "db02", Tags: []string{"canary"}},
+	)
+
+	bearer := func(method string, path string, value string) *http.Request {
+		r, _ := http.NewRequest(method, "https://something.com"+path, nil)
+		r.Header.Set("Authorization", "Bearer "+value)
+		return r
+	}
+
+	principal, err := t.service.AuthenticateAPIUser(bearer("GET", "/device/web01/filesystem/etc", value))
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), account.ID, principal.ID)
+	assert.Equal(t.T(), token.ID, principal.TokenID)
+	assert.False(t.T(), principal.Admin)
+
+	for _, allowed := range []string{"/device/d3/filesystem", "/v1/devices/web01", "/v1/device/db02/events"} {
+		_, err = t.service.AuthenticateAPIUser(bearer("GET", allowed, value))
+		assert.Nil(t.T(), err, allowed)
+	}
+
+	for _, denied := range []string{
+		"/device/db01/filesystem",
+		"/device/web01/process",
+		"/device/web01/filesystemx",
+		"/device/web01/filesystem/../process",
+		"/device/unknown/filesystem",
+		"/v1/devices",
+		"/v1/users/me",
+	} {
+		_, err = t.service.AuthenticateAPIUser(bearer("GET", denied, value))
+		assert.Equal(t.T(), "token scope does not permit the request", err.Error(), denied)
+	}
+
+	_, err = t.service.AuthenticateAPIUser(bearer("POST", "/device/web01/filesystem", value))
+	assert.Equal(t.T(), "token scope does not permit the request", err.Error())
+
+	_, err = t.service.AuthenticateAPIUser(bearer("GET", "/device/web01/filesystem", value[:strings.LastIndex(value, "_")+1]+"00"))
+	assert.Equal(t.T(), "token mismatch", err.Error())
+
+	_, err = t.service.AuthenticateAPIUser(bearer("GET", "/device/web01/filesystem", TokenPrefix+"nope_secret"))
+	assert.Equal(t.T(), "no such token", err.Error())
+
+	stored.Tokens[0].Expires = time.Now().Add(-time.Second)
+
+	_, err = t.service.AuthenticateAPIUser(bearer("GET", "/device/web01/filesystem", value))
+	assert.Equal(t.T(), "token expired", err.Error())
+	assert.True(t.T(), t.service.tokenRevoked(account.ID, token.ID))
+
+	assert.Nil(t.T(), t.service.RevokeServiceAccountToken(nil, "ci", token.ID))
+
+	stored, _ = t.service.ServiceAccount("ci")
+	t.service.serviceAccounts.Replace(stored)
+
+	_, err = t.service.AuthenticateAPIUser(bearer("GET", "/device/web01/filesystem", value))
+	assert.Equal(t.T(), "token revoked", err.Error())
+}
+
+// staleUsers lists the users as they were when it was created, as a member
+// reading before another member's change would
+type staleUsers struct {
+	UserRepository
+	snapshot []byte
+}
+
+func (t *staleUsers) List() ([]*User, error) {
+	users := []*User{}
+	err := json.Unmarshal(t.snapshot, &users)
+
+	return users, err
+}
+
+func (t *ServiceTestSuite) Test_key_changes_do_not_overwrite_concurrent_changes() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	user, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+
+	first, _, _ := t.service.AddUserKey(nil, "ops", "first", 0)
+	second, _, _ := t.service.AddUserKey(nil, "ops", "second", 0)
+
+	users, _ := t.service.store.Users.List()
+	snapshot, _ := json.Marshal(users)
+	repository := t.service.store.Users
+
+	// another member adds a key after this member read the user
+	third, _, _ := t.service.AddUserKey(nil, "ops", "third", 0)
+
+	t.service.store.Users = &staleUsers{
+		UserRepository: repository,
+		snapshot:       snapshot,
+	}
+
+	assert.Nil(t.T(), t.service.RevokeUserKey(nil, "ops", second.ID))
+
+	rotated, _, err := t.service.RotateUserKey(nil, "ops", first.ID, 0)
+	assert.Nil(t.T(), err)
+
+	t.service.store.Users = repository
+
+	stored, _ := t.service.store.Users.Get(user.ID)
+	assert.Equal(t.T(), 4, len(stored.Keys))
+	assert.True(t.T(), stored.key(first.ID).Revoked)
+	assert.True(t.T(), stored.key(second.ID).Revoked)
+	assert.False(t.T(), stored.key(third.ID).Revoked)
+	assert.NotNil(t.T(), stored.key(rotated.ID))
+}
+
+func (t *ServiceTestSuite) Test_admin_changes_do_not_overwrite_concurrent_changes() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.AddUser("admin", "admin@localhost", true)
+	user, _, _ := t.service.AddUser("ops", "ops@localhost", true)
+
+	users, _ := t.service.store.Users.List()
+	snapshot, _ := json.Marshal(users)
+	repository := t.service.store.Users
+
+	// another member adds a key and links the user after this member read it
+	key, _, _ := t.service.AddUserKey(nil, "ops", "laptop", 0)
+	repository.LinkSSO(user.ID, "https://idp.example.com", "00u1")
+
+	t.service.store.Users = &staleUsers{
+		UserRepository: repository,
+		snapshot:       snapshot,
+	}
+
+	assert.Nil(t.T(), t.service.SetUserDisabled("ops", true))
+
+	stored, _ := repository.Get(user.ID)
+	assert.True(t.T(), stored.Disabled)
+	assert.NotNil(t.T(), stored.key(key.ID))
+	assert.Equal(t.T(), "00u1", stored.OIDCSubject)
+
+	_, err := t.service.RotateUserKeys("ops")
+	assert.Nil(t.T(), err)
+
+	stored, _ = repository.Get(user.ID)
+	assert.Equal(t.T(), int64(1), stored.SessionEpoch)
+	assert.False(t.T(), stored.key(key.ID).Revoked)
+	assert.Equal(t.T(), "00u1", stored.OIDCSubject)
+
+	recovered, _, err := t.service.RecoverAdmin("ops", "operator")
+	assert.Nil(t.T(), err)
+	assert.False(t.T(), recovered.Disabled)
+	assert.Equal(t.T(), int64(2), recovered.SessionEpoch)
+
+	stored, _ = repository.Get(user.ID)
+	assert.False(t.T(), stored.Disabled)
+	assert.True(t.T(), stored.key(key.ID).Revoked)
+	assert.Equal(t.T(), "00u1", stored.OIDCSubject)
+	assert.False(t.T(), stored.RecoveredAt.IsZero())
+}
+
+// staleServiceAccounts lists the service accounts as they were when it was
+// created, as a member reading before another member's change would
+type staleServiceAccounts struct {
+	ServiceAccountRepository
+	snapshot []byte
+}
+
+func (t *staleServiceAccounts) List() ([]*ServiceAccount, error) {
+	accounts := []*ServiceAccount{}
+	err := json.Unmarshal(t.snapshot, &accounts)
+
+	return accounts, err
+}
+
+func (t *ServiceTestSuite) Test_token_changes_do_not_overwrite_concurrent_changes() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.AddServiceAccount(nil, "ci", "deploy pipeline")
+
+	first, _, _ := t.service.AddServiceAccountToken(nil, "ci", "first", &TokenScope{Devices: []string{"*"}}, time.Hour)
+
+	accounts, _ := t.service.store.ServiceAccounts.List()
+	snapshot, _ := json.Marshal(accounts)
+	repository := t.service.store.ServiceAccounts
+
+	// another member adds a token after this member read the account
+	second, _, _ := t.service.AddServiceAccountToken(nil, "ci", "second", &TokenScope{Devices: []string{"*"}}, time.Hour)
+
+	t.service.store.ServiceAccounts = &staleServiceAccounts{
+		ServiceAccountRepository: repository,
+		snapshot:                 snapshot,
+	}
+
+	third, _, err := t.service.AddServiceAccountToken(nil, "ci", "third", &TokenScope{Devices: []string{"*"}}, time.Hour)
+	assert.Nil(t.T(), err)
+	assert.Nil(t.T(), t.service.RevokeServiceAccountToken(nil, "ci", first.ID))
+
+	t.service.store.ServiceAccounts = repository
+
+	stored, _ := t.service.ServiceAccount("ci")
+	assert.Equal(t.T(), 3, len(stored.Tokens))
+	assert.True(t.T(), stored.token(first.ID).Revoked)
+	assert.False(t.T(), stored.token(second.ID).Revoked)
+	assert.NotNil(t.T(), stored.token(third.ID))
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_with_hmac_keys() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	signed := func(hmacKey string, hmacSecret string) *http.Request {
+		r, _ := http.NewRequest("GET", "https://something.com/v1/users/me", nil)
+		r.RemoteAddr = "10.0.0.5:40000"
+		user.Sign(r, hmacKey, hmacSecret, time.Now())
+		return r
+	}
+
+	_, err := t.service.AuthenticateAPIUser(signed("key", "secret"))
+	assert.Equal(t.T(), "hmac authentication is not enabled", err.Error())
+
+	t.service.config.HMAC = &user.Service{
+		Repository: &user.EmbeddedRepository{DB: edb},
+	}
+
+	entity, hmacSecret, err := t.service.config.HMAC.Add(nil, "ops", []string{"10.0.0.0/24"})
+	assert.Nil(t.T(), err)
+
+	t.service.users.Replace()
+
+	_, err = t.service.AuthenticateAPIUser(signed(entity.HmacKey, hmacSecret))
+	assert.Equal(t.T(), "no such user", err.Error())
+
+	ops := &User{ID: "1", Login: "ops"}
+	t.service.users.Replace(ops)
+
+	principal, err := t.service.AuthenticateAPIUser(signed(entity.HmacKey, hmacSecret))
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "1", principal.ID)
+	assert.Equal(t.T(), user.AuthScheme, principal.Scheme)
+	assert.Equal(t.T(), "", ops.Scheme)
+
+	r := signed(entity.HmacKey, hmacSecret)
+	r.RemoteAddr = "10.0.1.5:40000"
+
+	_, err = t.service.AuthenticateAPIUser(r)
+	assert.IsType(t.T(), &AuthenticationFailed{}, err)
+	assert.Equal(t.T(), "source address not permitted", err.Error())
+	assert.Equal(t.T(), FailureScope, err.(*AuthenticationFailed).Code)
+
+	ops.Disabled = true
+
+	_, err = t.service.AuthenticateAPIUser(signed(entity.HmacKey, hmacSecret))
+	assert.Equal(t.T(), "user disabled", err.Error())
+}
+
+func (t *ServiceTestSuite) Test_SignIn_provisions_and_links_users() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	admin, _, _ := t.service.AddUser("admin", "admin@example.com", true)
+
+	identity := &oidc.Identity{
+		Issuer:      "https://idp.example.com",
+		Subject:     "00u1",
+		Login:       "jdoe",
+		Email:       "jdoe@example.com",
+		Admin:       true,
+		RoleManaged: true,
+	}
+
+	user, key, creds, err := t.service.SignIn(identity, time.Hour)
+	assert.Nil(t.T(), err)
+	assert.NotEmpty(t.T(), user.ID)
+	assert.True(t.T(), user.Admin)
+	assert.True(t.T(), key.SSO)
+	assert.Equal(t.T(), key.ID, creds.KeyID)
+	assert.WithinDuration(t.T(), time.Now().Add(time.Hour), key.Expires, time.Minute)
+
+	// the same subject signs in as the same user, losing the admin role with its
+	// group, and expired session keys are removed
+	stored, _ := t.service.User(user.ID)
+	stored.Keys[0].Expires = time.Now().Add(-time.Minute)
+	t.service.store.Users.Update(stored)
+
+	identity.Admin = false
+
+	again, _, _, err := t.service.SignIn(identity, time.Hour)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), user.ID, again.ID)
+	assert.False(t.T(), again.Admin)
+	assert.Len(t.T(), again.Keys, 1)
+
+	// a local user is linked by verified email only
+	ops, _, _ := t.service.AddUser("ops", "ops@example.com", false)
+
+	other := &oidc.Identity{
+		Issuer:  "https://idp.example.com",
+		Subject: "00u2",
+		Login:   "ops",
+		Email:   "ops@example.com",
+	}
+
+	_, _, _, err = t.service.SignIn(other, time.Hour)
+	assert.Equal(t.T(), "login 'ops' belongs to another user", err.Error())
+
+	other.EmailVerified = true
+
+	linked, _, _, err := t.service.SignIn(other, time.Hour)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), ops.ID, linked.ID)
+	assert.Equal(t.T(), "00u2", linked.OIDCSubject)
+
+	// admins are never linked by email, only explicitly
+	adminIdentity := &oidc.Identity{
+		Issuer:        "https://idp.example.com",
+		Subject:       "00u3",
+		Login:         "root",
+		Email:         "admin@example.com",
+		EmailVerified: true,
+	}
+
+	_, _, _, err = t.service.SignIn(adminIdentity, time.Hour)
+	assert.Equal(t.T(), "admin 'admin' must be linked to the identity with user link-sso", err.Error())
+
+	_, err = t.service.LinkUserSSO("admin", "https://idp.example.com", "00u2")
+	assert.IsType(t.T(), &Invalid{}, err)
+
+	_, err = t.service.LinkUserSSO("admin", "https://idp.example.com", "00u3")
+	assert.Nil(t.T(), err)
+
+	linked, _, _, err = t.service.SignIn(adminIdentity, time.Hour)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), admin.ID, linked.ID)
+	assert.True(t.T(), linked.Admin)
+
+	t.service.SetUserDisabled(user.ID, true)
+
+	_, _, _, err = t.service.SignIn(identity, time.Hour)
+	assert.Equal(t.T(), "user disabled", err.Error())
+}
+
+func (t *ServiceTestSuite) Test_keys_issued_through_sso_sessions_expire_with_the_session() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	identity := &oidc.Identity{
+		Issuer:  "https://idp.example.com",
+		Subject: "00u1",
+		Login:   "jdoe",
+		Email:   "jdoe@example.com",
+	}
+
+	user, session, creds, err := t.service.SignIn(identity, time.Hour)
+	assert.Nil(t.T(), err)
+
+	stored, _ := t.service.store.Users.Get(user.ID)
+	t.service.users.Replace(stored)
+
+	actor, err := t.service.AuthenticateAPIUser(keyRequest(creds))
+	assert.Nil(t.T(), err)
+
+	forever, _, err := t.service.AddUserKey(actor, user.ID, "laptop", 0)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), session.Expires, forever.Expires)
+
+	long, _, err := t.service.AddUserKey(actor, user.ID, "ci", 24*time.Hour)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), session.Expires, long.Expires)
+
+	short, _, err := t.service.AddUserKey(actor, user.ID, "job", time.Minute)
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), short.Expires.Before(session.Expires))
+
+	rotated, _, err := t.service.RotateUserKey(actor, user.ID, forever.ID, 0)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), session.Expires, rotated.Expires)
+
+	// keys issued without a session keep their lifetime
+	local, _, err := t.service.AddUserKey(nil, user.ID, "local", 0)
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), local.Expires.IsZero())
+}
+
+func (t *ServiceTestSuite) Test_SignIn_does_not_overwrite_concurrent_changes() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.AddUser("admin", "admin@example.com", true)
+
+	identity := &oidc.Identity{
+		Issuer:  "https://idp.example.com",
+		Subject: "00u1",
+		Login:   "jdoe",
+		Email:   "jdoe@example.com",
+	}
+
+	user, session, _, _ := t.service.SignIn(identity, time.Hour)
+	laptop, _, _ := t.service.AddUserKey(nil, user.ID, "laptop", 0)
+
+	users, _ := t.service.store.Users.List()
+	snapshot, _ := json.Marshal(users)
+	repository := t.service.store.Users
+
+	// another member revokes a key after this member read the user
+	assert.Nil(t.T(), t.service.RevokeUserKey(nil, user.ID, laptop.ID))
+	assert.Nil(t.T(), repository.ExpireKey(user.ID, session.ID, time.Now().Add(-time.Minute)))
+
+	t.service.store.Users = &staleUsers{
+		UserRepository: repository,
+		snapshot:       snapshot,
+	}
+
+	_, again, _, err := t.service.SignIn(identity, time.Hour)
+	assert.Nil(t.T(), err)
+
+	stored, _ := repository.Get(user.ID)
+	assert.True(t.T(), stored.key(laptop.ID).Revoked)
+	assert.Nil(t.T(), stored.key(session.ID))
+	assert.NotNil(t.T(), stored.key(again.ID))
+
+	// and disables the user
+	stored.Disabled = true
+	repository.Update(stored)
+
+	_, _, _, err = t.service.SignIn(identity, time.Hour)
+	assert.Equal(t.T(), "user disabled", err.Error())
+
+	stored, _ = repository.Get(user.ID)
+	assert.Len(t.T(), stored.Keys, 2)
+}
+
+func (t *ServiceTestSuite) Test_LinkUserSSO_checks_links_made_after_the_users_were_read() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	admin, _, _ := t.service.AddUser("admin", "admin@example.com", true)
+	ops, _, _ := t.service.AddUser("ops", "ops@example.com", true)
+
+	users, _ := t.service.store.Users.List()
+	snapshot, _ := json.Marshal(users)
+	repository := t.service.store.Users
+
+	// another member links the identity after this member read the users
+	_, err := t.service.LinkUserSSO(ops.ID, "https://idp.example.com", "00u1")
+	assert.Nil(t.T(), err)
+
+	t.service.store.Users = &staleUsers{
+		UserRepository: repository,
+		snapshot:       snapshot,
+	}
+
+	_, err = t.service.LinkUserSSO(admin.ID, "https://idp.example.com", "00u1")
+	assert.IsType(t.T(), &Invalid{}, err)
+
+	stored, _ := repository.Get(admin.ID)
+	assert.Empty(t.T(), stored.OIDCSubject)
+}
+
 func TestServiceTestSuite(t *testing.T) {
 	suite.Run(t, new(ServiceTestSuite))
 }
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_with_ssh_keys() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	keyring := agent.NewKeyring()
+	assert.Nil(t.T(), keyring.Add(agent.AddedKey{PrivateKey: &edKey}))
+
+	signers, _ := keyring.Signers()
+	authorizedKey := string(ssh.MarshalAuthorizedKey(signers[0].PublicKey()))
+
+	owner, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+	dev, _, _ := t.service.AddUser("dev", "dev@localhost", false)
+	_, laptop, _ := t.service.AddUserKey(nil, "ops", "laptop", 0)
+
+	key, err := t.service.AddUserSSHKey(nil, "ops", "yubikey", authorizedKey, 0)
+	assert.Nil(t.T(), err)
+
+	_, err = t.service.AddUserSSHKey(nil, "dev", "laptop", authorizedKey, 0)
+	assert.IsType(t.T(), &Invalid{}, err)
+
+	_, err = t.service.AddUserSSHKey(nil, "ops", "rsa", "ssh-rsa AAAAB3NzaC1yc2EAAAADAQABAAAAgQDPMXULAHuLUhwsVNWr9h06uLX5yuGQBfbRpT5g8Hu6qybCxVu6fM3iaeKvu7rnZzlDrHbgJmYsiYVtwVaHmvL8AD40XzUtY+gvcXDuBC6D3MzhxBsf59EVB0W7YSUsjtcFgbMtMvcXHtm9ZyKSRNGRYH5omgIcT4IYFwTmsGHa1Q== rsa", 0)
+	assert.IsType(t.T(), &Invalid{}, err)
+
+	_, _, err = t.service.RotateUserKey(nil, "ops", key.ID, 0)
+	assert.IsType(t.T(), &Invalid{}, err)
+
+	stored, _ := t.service.store.Users.Get(owner.ID)
+	storedDev, _ := t.service.store.Users.Get(dev.ID)
+	t.service.users.Replace(stored, storedDev)
+
+	signed := func(userID string, at time.Time) *http.Request {
+		r, _ := http.NewRequest("GET", "https://something.com/v1/devices", nil)
+		assert.Nil(t.T(), client.SignSSH(r, &client.SSHCredentials{UserID: userID, Signer: signers[0]}, at))
+		return r
+	}
+
+	authenticated, err := t.service.AuthenticateAPIUser(signed(owner.ID, time.Now()))
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), key.ID, authenticated.KeyID)
+
+	_, err = t.service.AuthenticateAPIUser(signed("ops", time.Now()))
+	assert.Nil(t.T(), err)
+
+	_, err = t.service.AuthenticateAPIUser(signed("dev", time.Now()))
+	assert.Equal(t.T(), "no such key", err.Error())
+
+	_, err = t.service.AuthenticateAPIUser(signed(owner.ID, time.Now().Add(-10*time.Minute)))
+	assert.Equal(t.T(), "request timestamp outside the allowed clock skew", err.Error())
+
+	tampered := signed(owner.ID, time.Now())
+	tampered.URL.Path = "/v1/users"
+
+	_, err = t.service.AuthenticateAPIUser(tampered)
+	assert.Equal(t.T(), "signature mismatch", err.Error())
+
+	// ssh keys have no totp secret to sign with the DEVICEIO-HUB-AUTH scheme
+	laptop.KeyID = key.ID
+
+	_, err = t.service.AuthenticateAPIUser(keyRequest(laptop))
+	assert.Equal(t.T(), "ssh keys sign with the DEVICEIO-HUB-SSH scheme", err.Error())
+
+	assert.Nil(t.T(), t.service.RevokeUserKey(nil, "ops", key.ID))
+
+	stored, _ = t.service.store.Users.Get(owner.ID)
+	t.service.users.Replace(stored, storedDev)
+
+	_, err = t.service.AuthenticateAPIUser(signed(owner.ID, time.Now()))
+	assert.Equal(t.T(), "key revoked", err.Error())
+	assert.True(t.T(), t.service.sessionRevoked(owner.ID, key.ID, stored.SessionEpoch))
+
+	// a revoked key may be registered again
+	_, err = t.service.AddUserSSHKey(nil, "dev", "laptop", authorizedKey, 0)
+	assert.Nil(t.T(), err)
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_throttles_and_locks_out_repeated_failures() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.config.Lockout = &LockoutPolicy{
+		Window:        time.Hour,
+		FreeAttempts:  1,
+		Delay:         time.Hour,
+		MaxDelay:      time.Hour,
+		UserThreshold: 3,
+		Duration:      time.Hour,
+	}
+
+	user, _, _ := t.service.AddUser("ops", "ops@localhost", false)
+	_, laptop, _ := t.service.AddUserKey(nil, "ops", "laptop", 0)
+	_, ci, _ := t.service.AddUserKey(nil, "ops", "ci", 0)
+
+	stored, _ := t.service.store.Users.Get(user.ID)
+	t.service.users.Replace(stored)
+	t.service.lockouts.Replace()
+
+	refresh := func() {
+		lockouts, _ := t.service.store.Lockouts.List()
+		items := []interface{}{}
+
+		for _, lockout := range lockouts {
+			items = append(items, lockout)
+		}
+
+		t.service.lockouts.Replace(items...)
+	}
+
+	attempt := func(creds *KeyCredentials, addr string) error {
+		r := keyRequest(creds)
+		r.RemoteAddr = addr + ":5000"
+
+		_, err := t.service.AuthenticateAPIUser(r)
+		refresh()
+
+		return err
+	}
+
+	wrong := *ci
+	wrong.KeyID = laptop.KeyID
+
+	assert.Equal(t.T(), "signature mismatch", attempt(&wrong, "10.0.0.1").Error())
+	assert.Equal(t.T(), "signature mismatch", attempt(&wrong, "10.0.0.1").Error())
+
+	// past the free attempts even valid credentials wait out the delay
+	assert.Equal(t.T(), "addr throttled after repeated failures", attempt(laptop, "10.0.0.1").Error())
+	assert.Equal(t.T(), "user throttled after repeated failures", attempt(laptop, "10.0.0.2").Error())
+
+	// a third failure, from an address not yet throttled, reaches the threshold
+	r := keyRequest(&wrong)
+	r.RemoteAddr = "10.0.0.3:5000"
+
+	t.service.recordFailure(t.service.requestLockouts(r), time.Now())
+	refresh()
+
+	err := attempt(laptop, "10.0.0.3")
+	assert.Equal(t.T(), "user locked out after repeated failures", err.Error())
+	assert.Equal(t.T(), FailureLocked, err.(*AuthenticationFailed).Code)
+
+	lockouts, err := t.service.Lockouts()
+	assert.Nil(t.T(), err)
+
+	for _, lockout := range lockouts {
+		if lockout.ID == "user:"+user.ID {
+			assert.Equal(t.T(), 3, lockout.Failures)
+			assert.True(t.T(), lockout.Locked(time.Now()))
+		}
+	}
+
+	assert.Nil(t.T(), t.service.ClearLockout(nil, "user:"+user.ID))
+	assert.IsType(t.T(), &NotFound{}, t.service.ClearLockout(nil, "user:"+user.ID))
+	refresh()
+
+	// a success forgets the failures of the user but not of its address
+	assert.Equal(t.T(), "signature mismatch", attempt(&wrong, "10.0.0.4").Error())
+	assert.Nil(t.T(), attempt(laptop, "10.0.0.5"))
+
+	lockouts, _ = t.service.store.Lockouts.List()
+	ids := []string{}
+
+	for _, lockout := range lockouts {
+		ids = append(ids, lockout.ID)
+	}
+
+	assert.NotContains(t.T(), ids, "user:"+user.ID)
+	assert.Contains(t.T(), ids, "addr:10.0.0.4")
+}
+
+func (t *ServiceTestSuite) Test_AuthenticateAPIUser_locks_out_hmac_keys_and_tokens() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+	t.service.config.Lockout = &LockoutPolicy{
+		Window:        time.Hour,
+		FreeAttempts:  1,
+		Delay:         time.Hour,
+		MaxDelay:      time.Hour,
+		UserThreshold: 2,
+		Duration:      time.Hour,
+	}
+	t.service.config.HMAC = &user.Service{
+		Repository: &user.EmbeddedRepository{DB: edb},
+	}
+
+	defer func(timeout time.Duration) {
+		cacheReadyTimeout = timeout
+	}(cacheReadyTimeout)
+
+	cacheReadyTimeout = 10 * time.Millisecond
+
+	// attempts are refused until the lockouts are loaded
+	r, _ := http.NewRequest("GET", "https://something.com/", nil)
+	r.RemoteAddr = "10.0.0.1:5000"
+
+	_, err := t.service.AuthenticateAPIUser(r)
+	assert.IsType(t.T(), &ServiceUnavailable{}, err)
+
+	entity, _, _ := t.service.config.HMAC.Add(nil, "ops", nil)
+
+	t.service.AddServiceAccount(nil, "ci", "")
+	token, _, _ := t.service.AddServiceAccountToken(nil, "ci", "deploy", &TokenScope{Devices: []string{"*"}}, time.Hour)
+	account, _ := t.service.ServiceAccount("ci")
+
+	t.service.users.Replace(&User{ID: "1", Login: "ops"})
+	t.service.serviceAccounts.Replace(account)
+	t.service.lockouts.Replace()
+
+	hmacKey := func(addr string) *http.Request {
+		r, _ := http.NewRequest("GET", "https://something.com/", nil)
+		r.RemoteAddr = addr + ":5000"
+		user.Sign(r, entity.HmacKey, "wrong", time.Now())
+		return r
+	}
+
+	bearer := func(addr string) *http.Request {
+		r, _ := http.NewRequest("GET", "https://something.com/", nil)
+		r.RemoteAddr = addr + ":5000"
+		r.Header.Set("Authorization", "Bearer "+TokenPrefix+token.ID+"_wrong")
+		return r
+	}
+
+	// rotating source addresses does not escape the lockout of the credential
+	for i, request := range []func(addr string) *http.Request{hmacKey, bearer} {
+		for _, addr := range []string{"10.0.1.1", "10.0.1.2"} {
+			_, err = t.service.AuthenticateAPIUser(request(fmt.Sprintf("%v%v", addr, i)))
+			assert.IsType(t.T(), &AuthenticationFailed{}, err)
+
+			lockouts, _ := t.service.store.Lockouts.List()
+			items := []interface{}{}
+
+			for _, lockout := range lockouts {
+				items = append(items, lockout)
+			}
+
+			t.service.lockouts.Replace(items...)
+		}
+	}
+
+	_, err = t.service.AuthenticateAPIUser(hmacKey("10.0.2.1"))
+	assert.Equal(t.T(), "hmac_key locked out after repeated failures", err.Error())
+
+	_, err = t.service.AuthenticateAPIUser(bearer("10.0.2.2"))
+	assert.Equal(t.T(), "token locked out after repeated failures", err.Error())
+}
+
+func (t *ServiceTestSuite) Test_failed_audit_writes_fail_the_change_without_exiting() {
+	edb, _ := embedded.Open("")
+	defer edb.Close()
+
+	t.service.store = NewEmbeddedStore(edb)
+
+	user, _, err := t.service.AddUser("ops", "ops@localhost", false)
+	assert.Nil(t.T(), err)
+
+	auditDB, _ := embedded.Open("")
+	auditDB.Close()
+
+	t.service.config.Audit = &audit.Log{
+		Store:  &audit.EmbeddedStore{DB: auditDB},
+		Member: "member",
+	}
+
+	err = t.service.SetUserDisabled(user.ID, true)
+	assert.IsType(t.T(), &ServiceUnavailable{}, err)
+
+	_, _, err = t.service.AddUserKey(nil, "ops", "laptop", 0)
+	assert.IsType(t.T(), &ServiceUnavailable{}, err)
+}
@@ -0,0 +1,607 @@
+package cluster
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/http"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/audit"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+)
+
+// TokenPrefix starts every service account token. Tokens are sent as
+// "Authorization: Bearer <token>".
+const TokenPrefix = "dhsa_"
+
+// serviceAccountLoginPrefix distinguishes service accounts from users in the
+// audit log
+const serviceAccountLoginPrefix = "service-account:"
+
+var tokenMethodPattern = regexp.MustCompile(`^[A-Z]+$`)
+
+// ServiceAccount is a non-interactive principal such as a ci pipeline or a
+// monitoring system. Service accounts are not users: they have no password, totp
+// secret or signing key and authenticate with scoped bearer tokens only.
+type ServiceAccount struct {
+	ID          string    `gorethink:"id,omitempty"`
+	Name        string    `gorethink:"name,omitempty"`
+	Description string    `gorethink:"description,omitempty"`
+	Created     time.Time `gorethink:"created"`
+
+	// Disabled service accounts fail authentication with every token
+	Disabled bool `gorethink:"disabled,omitempty"`
+
+	Tokens []*Token `gorethink:"tokens,omitempty"`
+}
+
+// Token is a bearer credential of a service account. Only the sha256 hash of
+// its secret is stored.
+type Token struct {
+	ID      string      `gorethink:"id"`
+	Label   string      `gorethink:"label,omitempty"`
+	Hash    []byte      `gorethink:"hash"`
+	Scope   *TokenScope `gorethink:"scope"`
+	Created time.Time   `gorethink:"created"`
+	Expires time.Time   `gorethink:"expires"`
+
+	// LastUsed is updated at most once a minute
+	LastUsed time.Time `gorethink:"last_used,omitempty"`
+
+	Revoked bool `gorethink:"revoked,omitempty"`
+}
+
+// TokenScope limits the requests a token authenticates. Tokens only reach
+// devices: requests proxied through /device/{device}, GET /v1/devices/{device}
+// and GET /v1/device/{device}/events.
+type TokenScope struct {
+	// Devices are selectors of the devices the token reaches. A selector is *
+	// for every device, tag:<tag> for devices with the tag, or a glob such as
+	// web-* matched against the device id and hostname.
+	Devices []string `gorethink:"devices"`
+
+	// Paths are prefixes of the agent paths of proxied requests, such as
+	// /filesystem. A prefix matches whole path segments. Every path if empty.
+	Paths []string `gorethink:"paths,omitempty"`
+
+	// Methods are the http methods allowed, every method if empty
+	Methods []string `gorethink:"methods,omitempty"`
+}
+
+// ServiceAccountAdmin manages service accounts and their tokens. actor is the
+// admin making the change through the api, or nil for the command line.
+type ServiceAccountAdmin interface {
+	ServiceAccounts() ([]*ServiceAccount, error)
+
+	// ServiceAccount returns the service account with the id or name
+	ServiceAccount(idOrName string) (*ServiceAccount, error)
+
+	AddServiceAccount(actor *User, name string, description string) (*ServiceAccount, error)
+
+	// SetServiceAccountDisabled disables or enables every token of the account
+	SetServiceAccountDisabled(actor *User, idOrName string, disabled bool) error
+
+	DeleteServiceAccount(actor *User, idOrName string) error
+
+	// AddServiceAccountToken issues a token limited to the scope that expires
+	// after ttl. The token is returned only here.
+	AddServiceAccountToken(actor *User, idOrName string, label string, scope *TokenScope, ttl time.Duration) (*Token, string, error)
+
+	// RevokeServiceAccountToken revokes the token, ending the requests and
+	// event streams it opened
+	RevokeServiceAccountToken(actor *User, idOrName string, tokenID string) error
+}
+
+// Active reports if the token authenticates requests at the time
+func (t *Token) Active(at time.Time) bool {
+	return !t.Revoked && at.Before(t.Expires)
+}
+
+// token returns the token with the id or nil
+func (t *ServiceAccount) token(id string) *Token {
+	for _, token := range t.Tokens {
+		if token.ID == id {
+			return token
+		}
+	}
+
+	return nil
+}
+
+// principal returns the user the requests authenticated by the token of the
+// service account are made as. It is never an admin.
+func (t *ServiceAccount) principal(token *Token) *User {
+	return &User{
+		ID:      t.ID,
+		Login:   serviceAccountLoginPrefix + t.Name,
+		TokenID: token.ID,
+	}
+}
+
+// hashToken returns the stored hash of the secret part of a token
+func hashToken(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+// validate fails with Invalid if the scope cannot be issued
+func (t *TokenScope) validate() error {
+	if t == nil || len(t.Devices) == 0 {
+		return &Invalid{
+			Reason: "a token needs at least one device selector",
+		}
+	}
+
+	for _, selector := range t.Devices {
+		if _, err := path.Match(strings.TrimPrefix(selector, "tag:"), ""); err != nil || selector == "" || selector == "tag:" {
+			return &Invalid{
+				Reason: "device selector '" + selector + "' is not valid",
+			}
+		}
+	}
+
+	for _, prefix := range t.Paths {
+		if !strings.HasPrefix(prefix, "/") {
+			return &Invalid{
+				Reason: "path prefix '" + prefix + "' must start with /",
+			}
+		}
+	}
+
+	for _, method := range t.Methods {
+		if !tokenMethodPattern.MatchString(method) {
+			return &Invalid{
+				Reason: "method '" + method + "' must be an uppercase http method",
+			}
+		}
+	}
+
+	return nil
+}
+
+// permits reports if the scope allows the request to the device with the agent
+// path. agentPath is empty for requests to the device routes of the api, which only
+// the device selectors and methods apply to.
+func (t *TokenScope) permits(method string, device *Device, agentPath string) bool {
+	if len(t.Methods) > 0 && !containsString(t.Methods, method) {
+		return false
+	}
+
+	matched := false
+
+	for _, selector := range t.Devices {
+		if matchDevice(selector, device) {
+			matched = true
+			break
+		}
+	}
+
+	if !matched {
+		return false
+	}
+
+	if agentPath == "" || len(t.Paths) == 0 {
+		return true
+	}
+
+	for _, prefix := range t.Paths {
+		prefix = strings.TrimSuffix(prefix, "/")
+
+		if agentPath == prefix || strings.HasPrefix(agentPath, prefix+"/") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchDevice reports if the device matches the selector
+func matchDevice(selector string, device *Device) bool {
+	if selector == "*" {
+		return true
+	}
+
+	if strings.HasPrefix(selector, "tag:") {
+		return containsString(device.Tags, strings.TrimPrefix(selector, "tag:"))
+	}
+
+	selector = strings.ToLower(selector)
+
+	for _, name := range []string{device.ID, device.Hostname} {
+		if ok, _ := path.Match(selector, strings.ToLower(name)); ok && name != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tokenTarget returns the device a request authenticated by a token targets and
+// its agent path, which is empty for the device routes of the api. ok is false
+// for routes tokens cannot reach.
+func tokenTarget(r *http.Request) (deviceID string, agentPath string, ok bool) {
+	p := r.URL.Path
+
+	switch {
+	case strings.HasPrefix(p, "/device/"):
+		parts := strings.SplitN(strings.TrimPrefix(p, "/device/"), "/", 2)
+
+		if len(parts) == 1 {
+			parts = append(parts, "")
+		}
+
+		return parts[0], path.Clean("/" + parts[1]), parts[0] != ""
+	case strings.HasPrefix(p, "/v1/devices/"):
+		id := strings.TrimPrefix(p, "/v1/devices/")
+		return id, "", id != "" && !strings.Contains(id, "/")
+	case strings.HasPrefix(p, "/v1/device/") && strings.HasSuffix(p, "/events"):
+		id := strings.TrimSuffix(strings.TrimPrefix(p, "/v1/device/"), "/events")
+		return id, "", id != "" && !strings.Contains(id, "/")
+	}
+
+	return "", "", false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+// authenticateToken authenticates a request bearing a service account token
+func (t *service) authenticateToken(r *http.Request, value string) (*User, error) {
+	parts := strings.Split(strings.TrimPrefix(value, TokenPrefix), "_")
+
+	if !strings.HasPrefix(value, TokenPrefix) || len(parts) != 2 {
+		return nil, &AuthenticationFailed{
+			Reason: "bearer token does not have required format " + TokenPrefix + "<token_id>_<secret>",
+			Code:   FailureMalformed,
+		}
+	}
+
+	if err := t.serviceAccounts.WaitReady(cacheReadyTimeout); err != nil {
+		return nil, &ServiceUnavailable{
+			Reason: err.Error(),
+		}
+	}
+
+	var account *ServiceAccount
+
+	for _, item := range t.serviceAccounts.Lookup("token", parts[0]) {
+		account = item.(*ServiceAccount)
+	}
+
+	if account == nil {
+		return nil, &AuthenticationFailed{
+			Reason: "no such token",
+			Code:   FailureUnknownUser,
+		}
+	}
+
+	token := account.token(parts[0])
+
+	if subtle.ConstantTimeCompare(hashToken(parts[1]), token.Hash) != 1 {
+		return nil, &AuthenticationFailed{
+			Reason: "token mismatch",
+			Code:   FailureBadSignature,
+		}
+	}
+
+	if account.Disabled {
+		return nil, &AuthenticationFailed{
+			Reason: "service account disabled",
+			Code:   FailureDisabled,
+		}
+	}
+
+	now := time.Now()
+
+	if token.Revoked {
+		return nil, &AuthenticationFailed{
+			Reason: "token revoked",
+			Code:   FailureExpired,
+		}
+	}
+
+	if !token.Active(now) {
+		return nil, &AuthenticationFailed{
+			Reason: "token expired",
+			Code:   FailureExpired,
+		}
+	}
+
+	deviceID, agentPath, ok := tokenTarget(r)
+	device := t.LookupDevice(deviceID)
+
+	if !ok || device == nil || !token.Scope.permits(r.Method, device, agentPath) {
+		return nil, &AuthenticationFailed{
+			Reason: "token scope does not permit the request",
+			Code:   FailureScope,
+		}
+	}
+
+	t.touchToken(account.ID, token, now)
+
+	return account.principal(token), nil
+}
+
+// touchToken records the use of the token, at most once per keyTouchInterval
+func (t *service) touchToken(accountID string, token *Token, at time.Time) {
+	if !t.touchDue(token.ID, token.LastUsed, at) {
+		return
+	}
+
+	go func() {
+		if err := t.store.ServiceAccounts.TouchToken(accountID, token.ID, at.UTC()); err != nil {
+			logger.WithFields(logrus.Fields{
+				"serviceAccountId": accountID,
+				"tokenId":          token.ID,
+				"error":            err.Error(),
+			}).Error("failed to record token use")
+		}
+	}()
+}
+
+// tokenRevoked reports if requests authenticated by the token of the service
+// account must end
+func (t *service) tokenRevoked(accountID string, tokenID string) bool {
+	if !t.serviceAccounts.Ready() {
+		return false
+	}
+
+	account, ok := t.serviceAccounts.Get(accountID).(*ServiceAccount)
+
+	if !ok || account.Disabled {
+		return true
+	}
+
+	token := account.token(tokenID)
+
+	return token == nil || !token.Active(time.Now())
+}
+
+func (t *service) ServiceAccounts() ([]*ServiceAccount, error) {
+	accounts, err := t.store.ServiceAccounts.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(accounts, func(i, j int) bool {
+		return accounts[i].Name < accounts[j].Name
+	})
+
+	return accounts, nil
+}
+
+func (t *service) ServiceAccount(idOrName string) (*ServiceAccount, error) {
+	accounts, err := t.store.ServiceAccounts.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, account := range accounts {
+		if account.ID == idOrName || account.Name == idOrName {
+			return account, nil
+		}
+	}
+
+	return nil, &NotFound{
+		Reason: "no service account with id or name '" + idOrName + "'",
+	}
+}
+
+func (t *service) AddServiceAccount(actor *User, name string, description string) (*ServiceAccount, error) {
+	if name == "" {
+		return nil, &Invalid{
+			Reason: "service account name is required",
+		}
+	}
+
+	accounts, err := t.store.ServiceAccounts.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, existing := range accounts {
+		if strings.EqualFold(existing.Name, name) {
+			return nil, &Invalid{
+				Reason: "service account '" + existing.ID + "' already has name '" + name + "'",
+			}
+		}
+	}
+
+	account := &ServiceAccount{
+		Name:        name,
+		Description: description,
+		Created:     time.Now().UTC(),
+	}
+
+	if _, err = t.store.ServiceAccounts.Insert(account); err != nil {
+		return nil, err
+	}
+
+	if err = t.auditServiceAccount(actor, audit.ServiceAccountCreate, account, nil); err != nil {
+		return nil, err
+	}
+
+	return account, nil
+}
+
+func (t *service) SetServiceAccountDisabled(actor *User, idOrName string, disabled bool) error {
+	account, err := t.ServiceAccount(idOrName)
+
+	if err != nil {
+		return err
+	}
+
+	account.Disabled = disabled
+
+	if err = t.store.ServiceAccounts.Update(account); err != nil {
+		return err
+	}
+
+	kind := audit.ServiceAccountEnable
+
+	if disabled {
+		kind = audit.ServiceAccountDisable
+	}
+
+	if err = t.auditServiceAccount(actor, kind, account, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *service) DeleteServiceAccount(actor *User, idOrName string) error {
+	account, err := t.ServiceAccount(idOrName)
+
+	if err != nil {
+		return err
+	}
+
+	if err = t.store.ServiceAccounts.Delete(account.ID); err != nil {
+		return err
+	}
+
+	if err = t.auditServiceAccount(actor, audit.ServiceAccountDelete, account, nil); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (t *service) AddServiceAccountToken(actor *User, idOrName string, label string, scope *TokenScope, ttl time.Duration) (*Token, string, error) {
+	if label == "" {
+		return nil, "", &Invalid{
+			Reason: "token label is required",
+		}
+	}
+
+	if ttl <= 0 {
+		return nil, "", &Invalid{
+			Reason: "token lifetime must be positive",
+		}
+	}
+
+	if err := scope.validate(); err != nil {
+		return nil, "", err
+	}
+
+	account, err := t.ServiceAccount(idOrName)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	id, err := uuid.NewRandom()
+
+	if err != nil {
+		return nil, "", stacktrace.Propagate(err, "error generating token id")
+	}
+
+	secret := make([]byte, 32)
+
+	if _, err = rand.Read(secret); err != nil {
+		return nil, "", stacktrace.Propagate(err, "error generating token secret")
+	}
+
+	token := &Token{
+		ID:      id.String(),
+		Label:   label,
+		Hash:    hashToken(hex.EncodeToString(secret)),
+		Scope:   scope,
+		Created: time.Now().UTC(),
+	}
+
+	token.Expires = token.Created.Add(ttl)
+
+	if err = t.store.ServiceAccounts.AddToken(account.ID, token); err != nil {
+		return nil, "", err
+	}
+
+	if err = t.auditServiceAccount(actor, audit.ServiceAccountTokenAdd, account, map[string]string{
+		"tokenId": token.ID,
+		"label":   token.Label,
+		"devices": strings.Join(scope.Devices, ","),
+		"paths":   strings.Join(scope.Paths, ","),
+		"methods": strings.Join(scope.Methods, ","),
+		"expires": token.Expires.Format(time.RFC3339),
+	}); err != nil {
+		return nil, "", err
+	}
+
+	return token, TokenPrefix + token.ID + "_" + hex.EncodeToString(secret), nil
+}
+
+func (t *service) RevokeServiceAccountToken(actor *User, idOrName string, tokenID string) error {
+	account, err := t.ServiceAccount(idOrName)
+
+	if err != nil {
+		return err
+	}
+
+	token := account.token(tokenID)
+
+	if token == nil {
+		return &NotFound{
+			Reason: "service account '" + account.Name + "' has no token '" + tokenID + "'",
+		}
+	}
+
+	if token.Revoked {
+		return nil
+	}
+
+	if err = t.store.ServiceAccounts.RevokeToken(account.ID, token.ID); err != nil {
+		return err
+	}
+
+	if err = t.auditServiceAccount(actor, audit.ServiceAccountTokenRevoke, account, map[string]string{
+		"tokenId": token.ID,
+		"label":   token.Label,
+	}); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// auditServiceAccount writes the audit record of a change to a service account
+func (t *service) auditServiceAccount(actor *User, kind string, account *ServiceAccount, detail map[string]string) error {
+	if detail == nil {
+		detail = map[string]string{}
+	}
+
+	detail["name"] = account.Name
+	detail["source"] = "cli"
+
+	rec := &audit.Record{
+		Kind:   kind,
+		Target: account.ID,
+		Detail: detail,
+	}
+
+	if actor != nil {
+		detail["source"] = "api"
+		rec.UserID = actor.ID
+		rec.UserLogin = actor.Login
+	}
+
+	return t.audit(rec)
+}
@@ -0,0 +1,78 @@
+package cluster
+
+import (
+	"context"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// sessionCheckInterval is how often open sessions check the sessions of their
+// user have not been revoked
+const sessionCheckInterval = 5 * time.Second
+
+// SessionContext returns a context derived from ctx that is cancelled when the
+// sessions of the user are revoked, the user is disabled or deleted, or the
+// named key or service account token that authenticated it is revoked or
+// expires. Event streams and proxied requests authenticated as the user run
+// under it.
+func (t *service) SessionContext(ctx context.Context, user *User) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+	epoch := user.SessionEpoch
+
+	go func() {
+		ticker := time.NewTicker(sessionCheckInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if t.revoked(user, epoch) {
+					logger.WithFields(logrus.Fields{
+						"userId": user.ID,
+						"login":  user.Login,
+					}).Warn("session revoked")
+
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// revoked reports if the session of the user opened at the session epoch must
+// end
+func (t *service) revoked(user *User, epoch int64) bool {
+	if user.TokenID != "" {
+		return t.tokenRevoked(user.ID, user.TokenID)
+	}
+
+	return t.sessionRevoked(user.ID, user.KeyID, epoch)
+}
+
+// sessionRevoked reports if sessions of the user opened at the session epoch
+// with the named key, or the primary key if keyID is empty, must end
+func (t *service) sessionRevoked(id string, keyID string, epoch int64) bool {
+	if !t.users.Ready() {
+		return false
+	}
+
+	current, ok := t.users.Get(id).(*User)
+
+	if !ok || current.Disabled || current.SessionEpoch != epoch {
+		return true
+	}
+
+	if keyID == "" {
+		return false
+	}
+
+	key := current.key(keyID)
+
+	return key == nil || !key.Active(time.Now())
+}
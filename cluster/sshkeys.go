@@ -0,0 +1,269 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/sshsig"
+	"github.com/deviceio/hub/user"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ssh"
+)
+
+// SSHAuthScheme is the Authorization header scheme of requests signed with an
+// ssh key of the user
+const SSHAuthScheme = "DEVICEIO-HUB-SSH"
+
+// sshKeyTypes are the OpenSSH key types that may be registered. RSA keys are
+// refused as only their SHA-1 signatures can be verified.
+var sshKeyTypes = []string{
+	ssh.KeyAlgoED25519,
+	ssh.KeyAlgoECDSA256,
+	ssh.KeyAlgoECDSA384,
+	ssh.KeyAlgoECDSA521,
+}
+
+func (t *service) AddUserSSHKey(actor *User, idLoginOrEmail string, label string, authorizedKey string, ttl time.Duration) (*Key, error) {
+	if label == "" {
+		return nil, &Invalid{
+			Reason: "key label is required",
+		}
+	}
+
+	if ttl < 0 {
+		return nil, &Invalid{
+			Reason: "key lifetime cannot be negative",
+		}
+	}
+
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(authorizedKey))
+
+	if err != nil {
+		return nil, &Invalid{
+			Reason: "public key is not in authorized_keys format",
+		}
+	}
+
+	if !containsString(sshKeyTypes, publicKey.Type()) {
+		return nil, &Invalid{
+			Reason: "ssh key type '" + publicKey.Type() + "' is not supported, use " + strings.Join(sshKeyTypes, ", "),
+		}
+	}
+
+	owner, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return nil, err
+	}
+
+	users, err := t.store.Users.List()
+
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+
+	for _, u := range users {
+		if key := u.sshKey(publicKey); key != nil && key.Active(now) {
+			return nil, &Invalid{
+				Reason: "ssh key " + ssh.FingerprintSHA256(publicKey) + " is already registered",
+			}
+		}
+	}
+
+	id, err := uuid.NewRandom()
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "error generating key id")
+	}
+
+	key := &Key{
+		ID:           id.String(),
+		Label:        label,
+		SSHPublicKey: publicKey.Marshal(),
+		Created:      now,
+	}
+
+	if ttl > 0 {
+		key.Expires = key.Created.Add(ttl)
+	}
+
+	capToSession(actor, key)
+
+	if err = t.store.Users.AddKey(owner.ID, key); err != nil {
+		return nil, err
+	}
+
+	if err = t.auditKey(actor, audit.UserKeyAdd, owner, key, map[string]string{
+		"sshKey": publicKey.Type() + " " + ssh.FingerprintSHA256(publicKey),
+	}); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// authenticateSSH returns the user whose ssh key made the SSHSIG signature in
+// the authorization value <user_id>:<sshsig_base64>. The signature covers the
+// request message with the X-Deviceio-Timestamp value in place of a passcode.
+func (t *service) authenticateSSH(r *http.Request, value string) (*User, error) {
+	values := strings.Split(value, ":")
+
+	if len(values) != 2 {
+		return nil, &AuthenticationFailed{
+			Reason: "authorization value does not have required format <user_id>:<sshsig_base64>",
+			Code:   FailureMalformed,
+		}
+	}
+
+	blob, err := base64.StdEncoding.DecodeString(values[1])
+
+	if err != nil {
+		return nil, &AuthenticationFailed{
+			Reason: err.Error(),
+			Code:   FailureMalformed,
+		}
+	}
+
+	sig, err := sshsig.Parse(blob)
+
+	if err != nil {
+		return nil, &AuthenticationFailed{
+			Reason: "malformed sshsig signature",
+			Code:   FailureMalformed,
+		}
+	}
+
+	owner, err := t.lookupUser(values[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if owner == nil {
+		return nil, &AuthenticationFailed{
+			Reason: "no such user",
+			Code:   FailureUnknownUser,
+		}
+	}
+
+	key := owner.sshKey(sig.PublicKey)
+
+	if key == nil {
+		return nil, &AuthenticationFailed{
+			Reason: "no such key",
+			Code:   FailureUnknownUser,
+		}
+	}
+
+	timestamp := r.Header.Get(user.TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return nil, &AuthenticationFailed{
+			Reason: user.TimestampHeader + " header must be the unix time the request was signed at",
+			Code:   FailureMalformed,
+		}
+	}
+
+	if skew := time.Since(time.Unix(seconds, 0)); skew > user.MaxClockSkew || skew < -user.MaxClockSkew {
+		return nil, &AuthenticationFailed{
+			Reason: "request timestamp outside the allowed clock skew",
+			Code:   FailureExpired,
+		}
+	}
+
+	message := strings.Join(
+		[]string{
+			values[0],
+			timestamp,
+			r.Method,
+			r.Host,
+			r.URL.Path,
+			r.URL.RawQuery,
+			r.Header.Get("Content-Type"),
+		},
+		"\r\n",
+	)
+
+	if err = sig.Verify(sshsig.Namespace, []byte(message)); err != nil {
+		return nil, &AuthenticationFailed{
+			Reason: "signature mismatch",
+			Code:   FailureBadSignature,
+		}
+	}
+
+	if owner.Disabled {
+		return nil, &AuthenticationFailed{
+			Reason: "user disabled",
+			Code:   FailureDisabled,
+		}
+	}
+
+	now := time.Now()
+
+	if key.Revoked {
+		return nil, &AuthenticationFailed{
+			Reason: "key revoked",
+			Code:   FailureExpired,
+		}
+	}
+
+	if !key.Active(now) {
+		return nil, &AuthenticationFailed{
+			Reason: "key expired",
+			Code:   FailureExpired,
+		}
+	}
+
+	t.touchKey(owner.ID, key, now)
+
+	authenticated := *owner
+	authenticated.KeyID = key.ID
+
+	return &authenticated, nil
+}
+
+// sshKey returns the ssh key of the user with the public key, preferring an
+// active one, or nil
+func (t *User) sshKey(publicKey ssh.PublicKey) *Key {
+	var found *Key
+	marshaled := publicKey.Marshal()
+
+	for _, key := range t.Keys {
+		if key.SSHPublicKey == nil || !bytes.Equal(key.SSHPublicKey, marshaled) {
+			continue
+		}
+
+		if key.Active(time.Now()) {
+			return key
+		}
+
+		found = key
+	}
+
+	return found
+}
+
+// SSHAuthorizedKey returns the public key of an ssh key in authorized_keys
+// format and its SHA256 fingerprint, or empty strings for other keys
+func (t *Key) SSHAuthorizedKey() (authorizedKey string, fingerprint string) {
+	if t.SSHPublicKey == nil {
+		return "", ""
+	}
+
+	publicKey, err := ssh.ParsePublicKey(t.SSHPublicKey)
+
+	if err != nil {
+		return "", ""
+	}
+
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(publicKey))), ssh.FingerprintSHA256(publicKey)
+}
@@ -0,0 +1,288 @@
+package cluster
+
+import (
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/oidc"
+)
+
+// SSO signs in users authenticated by the identity provider
+type SSO interface {
+	// SignIn returns the user of the identity, issuing it a session key that
+	// expires after lifetime. Users are matched by their subject at the provider,
+	// then by verified email. Unknown users are created.
+	SignIn(identity *oidc.Identity, lifetime time.Duration) (*User, *Key, *KeyCredentials, error)
+}
+
+func (t *service) SignIn(identity *oidc.Identity, lifetime time.Duration) (*User, *Key, *KeyCredentials, error) {
+	if lifetime <= 0 {
+		return nil, nil, nil, &Invalid{
+			Reason: "session lifetime must be positive",
+		}
+	}
+
+	users, err := t.store.Users.List()
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	user, linked := matchIdentity(users, identity)
+
+	for _, other := range users {
+		if other == user {
+			continue
+		}
+
+		if strings.EqualFold(other.Login, identity.Login) {
+			return nil, nil, nil, &AuthenticationFailed{
+				Reason: "login '" + identity.Login + "' belongs to another user",
+			}
+		}
+
+		if user == nil && strings.EqualFold(other.Email, identity.Email) {
+			if other.Admin && identity.EmailVerified && other.OIDCSubject == "" {
+				return nil, nil, nil, &AuthenticationFailed{
+					Reason: "admin '" + other.Login + "' must be linked to the identity with user link-sso",
+				}
+			}
+
+			return nil, nil, nil, &AuthenticationFailed{
+				Reason: "email '" + identity.Email + "' belongs to another user",
+			}
+		}
+	}
+
+	if user == nil {
+		if user, err = t.provision(identity); err != nil {
+			return nil, nil, nil, err
+		}
+	} else if user.Disabled {
+		return nil, nil, nil, &AuthenticationFailed{
+			Reason: "user disabled",
+		}
+	}
+
+	if linked {
+		ok, err := t.store.Users.LinkSSO(user.ID, identity.Issuer, identity.Subject)
+
+		if err != nil {
+			return nil, nil, nil, err
+		}
+
+		if !ok {
+			return nil, nil, nil, &AuthenticationFailed{
+				Reason: "identity '" + identity.Subject + "' is linked to another user",
+			}
+		}
+
+		user.OIDCIssuer = identity.Issuer
+		user.OIDCSubject = identity.Subject
+
+		if err = t.auditSSO(audit.UserSSOLink, user, identity); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	if identity.RoleManaged && user.Admin != identity.Admin {
+		if err = t.syncAdmin(user, identity); err != nil {
+			return nil, nil, nil, err
+		}
+	}
+
+	key, creds, err := issueKey(user, "sso", lifetime)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	key.SSO = true
+
+	// the user may have been disabled since it was listed
+	now := time.Now()
+	ok, err := t.store.Users.AddSessionKey(user.ID, key, now)
+
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	if !ok {
+		return nil, nil, nil, &AuthenticationFailed{
+			Reason: "user disabled",
+		}
+	}
+
+	keys := []*Key{}
+
+	for _, existing := range user.Keys {
+		if !existing.SSO || existing.Active(now) {
+			keys = append(keys, existing)
+		}
+	}
+
+	user.Keys = append(keys, key)
+
+	if err = t.auditKey(user, audit.UserKeyAdd, user, key, map[string]string{
+		"issuer": identity.Issuer,
+		"source": "oidc",
+	}); err != nil {
+		return nil, nil, nil, err
+	}
+
+	return user, key, creds, nil
+}
+
+// matchIdentity returns the user of the identity. linked is set if the user was
+// matched by its verified email and is not yet linked to the identity. Admins
+// are never linked by email as control of the address at the provider would
+// grant their role; they are linked explicitly with LinkUserSSO.
+func matchIdentity(users []*User, identity *oidc.Identity) (user *User, linked bool) {
+	for _, user := range users {
+		if user.OIDCIssuer == identity.Issuer && user.OIDCSubject == identity.Subject {
+			return user, false
+		}
+	}
+
+	if !identity.EmailVerified {
+		return nil, false
+	}
+
+	for _, user := range users {
+		if user.OIDCSubject == "" && !user.Admin && strings.EqualFold(user.Email, identity.Email) {
+			return user, true
+		}
+	}
+
+	return nil, false
+}
+
+func (t *service) LinkUserSSO(idLoginOrEmail string, issuer string, subject string) (*User, error) {
+	if issuer == "" || subject == "" {
+		return nil, &Invalid{
+			Reason: "issuer and subject are required",
+		}
+	}
+
+	user, err := t.User(idLoginOrEmail)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := t.store.Users.LinkSSO(user.ID, issuer, subject)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !ok {
+		return nil, &Invalid{
+			Reason: "identity '" + subject + "' is linked to another user",
+		}
+	}
+
+	user.OIDCIssuer = issuer
+	user.OIDCSubject = subject
+
+	if err = t.audit(&audit.Record{
+		Kind:   audit.UserSSOLink,
+		Target: user.ID,
+		Detail: map[string]string{
+			"login":   user.Login,
+			"source":  "cli",
+			"issuer":  issuer,
+			"subject": subject,
+		},
+	}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// provision creates the user of an identity signing in for the first time. Its
+// primary credentials are generated but never shown.
+func (t *service) provision(identity *oidc.Identity) (*User, error) {
+	user := &User{
+		Login:       identity.Login,
+		Email:       identity.Email,
+		Admin:       identity.RoleManaged && identity.Admin,
+		OIDCIssuer:  identity.Issuer,
+		OIDCSubject: identity.Subject,
+	}
+
+	if _, err := issueCredentials(user); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.store.Users.Insert(user); err != nil {
+		return nil, err
+	}
+
+	detail := map[string]string{
+		"login":   user.Login,
+		"source":  "oidc",
+		"issuer":  identity.Issuer,
+		"subject": identity.Subject,
+	}
+
+	if user.Admin {
+		detail["admin"] = "true"
+	}
+
+	if err := t.audit(&audit.Record{
+		Kind:   audit.UserCreate,
+		Target: user.ID,
+		Detail: detail,
+	}); err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// syncAdmin sets the admin role of the user to follow its groups. The last
+// enabled admin keeps its role.
+func (t *service) syncAdmin(user *User, identity *oidc.Identity) error {
+	if !identity.Admin {
+		if err := t.keepAdmin(user); err != nil {
+			logger.WithFields(logrus.Fields{
+				"userId": user.ID,
+				"error":  err.Error(),
+			}).Warn("admin role not revoked at sign in")
+
+			return nil
+		}
+	}
+
+	if err := t.store.Users.SetAdmin(user.ID, identity.Admin); err != nil {
+		return err
+	}
+
+	user.Admin = identity.Admin
+
+	kind := audit.UserAdminRevoke
+
+	if user.Admin {
+		kind = audit.UserAdminGrant
+	}
+
+	return t.auditSSO(kind, user, identity)
+}
+
+func (t *service) auditSSO(kind string, user *User, identity *oidc.Identity) error {
+	return t.audit(&audit.Record{
+		Kind:   kind,
+		Target: user.ID,
+		Detail: map[string]string{
+			"login":   user.Login,
+			"source":  "oidc",
+			"issuer":  identity.Issuer,
+			"subject": identity.Subject,
+			"groups":  strings.Join(identity.Groups, ","),
+		},
+	})
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+)
+
+// Store groups the repositories the cluster persists its state in
+type Store struct {
+	Users           UserRepository
+	Members         MemberRepository
+	Devices         DeviceRepository
+	Events          EventRepository
+	DeviceEvents    DeviceEventRepository
+	ServiceAccounts ServiceAccountRepository
+	Lockouts        LockoutRepository
+}
+
+// UserRepository persists hub users
+type UserRepository interface {
+	// Source is the changefeed the user cache follows
+	Source() cache.Source
+
+	List() ([]*User, error)
+
+	// Get returns the user or nil if there is no such user
+	Get(id string) (*User, error)
+
+	// Insert stores a new user generating its ID if empty
+	Insert(user *User) (id string, err error)
+
+	Update(user *User) error
+
+	// TouchKey sets the LastUsed time of the user's named key
+	TouchKey(userID string, keyID string, at time.Time) error
+
+	// AddKey appends the named key to the user's keys
+	AddKey(userID string, key *Key) error
+
+	// RevokeKey marks the user's named key revoked
+	RevokeKey(userID string, keyID string) error
+
+	// ExpireKey sets when the user's named key expires
+	ExpireKey(userID string, keyID string, at time.Time) error
+
+	// SetAdmin sets whether the user is an admin
+	SetAdmin(userID string, admin bool) error
+
+	// SetDisabled sets whether the user is disabled
+	SetDisabled(userID string, disabled bool) error
+
+	// ReplaceCredentials stores the password, totp secret and public key of
+	// creds as the user's and increments its session epoch
+	ReplaceCredentials(userID string, creds *User) error
+
+	// RecoverCredentials replaces the user's credentials as ReplaceCredentials
+	// does, enables the user, revokes its named keys and records at as the time
+	// it was recovered
+	RecoverCredentials(userID string, creds *User, at time.Time) error
+
+	// LinkSSO links the user to the identity at the provider. ok is false if
+	// another user is linked to the identity.
+	LinkSSO(userID string, issuer string, subject string) (ok bool, err error)
+
+	// AddSessionKey appends the sso session key, dropping the user's sso keys
+	// no longer active at now. ok is false if the user is disabled or missing.
+	AddSessionKey(userID string, key *Key, now time.Time) (ok bool, err error)
+
+	// RewrapTOTPSecret replaces the totp secret of the user, or of its named key
+	// if keyID is not empty, with envelope if it is still sealed by the master key
+	// prevKeyID. ok is false if the secret was changed in the meantime.
+	RewrapTOTPSecret(userID string, keyID string, prevKeyID string, envelope *secret.Envelope) (ok bool, err error)
+
+	Delete(id string) error
+}
+
+// ServiceAccountRepository persists service accounts and their tokens
+type ServiceAccountRepository interface {
+	// Source is the changefeed the service account cache follows
+	Source() cache.Source
+
+	List() ([]*ServiceAccount, error)
+
+	// Insert stores a new service account generating its ID if empty
+	Insert(account *ServiceAccount) (id string, err error)
+
+	Update(account *ServiceAccount) error
+
+	// TouchToken sets the LastUsed time of the service account's token
+	TouchToken(accountID string, tokenID string, at time.Time) error
+
+	// AddToken appends the token to the service account's tokens
+	AddToken(accountID string, token *Token) error
+
+	// RevokeToken marks the service account's token revoked
+	RevokeToken(accountID string, tokenID string) error
+
+	Delete(id string) error
+}
+
+// LockoutRepository persists the authentication failures counted against users
+// and source addresses
+type LockoutRepository interface {
+	// Source is the changefeed the lockout cache follows
+	Source() cache.Source
+
+	List() ([]*Lockout, error)
+
+	// RecordFailure counts a failure of the lockout at the time, starting the
+	// count again if its last failure was before since, and returns the lockout
+	RecordFailure(lockout *Lockout, at time.Time, since time.Time) (*Lockout, error)
+
+	// Lock sets when the lockout ends
+	Lock(id string, until time.Time) error
+
+	// DeleteExpired removes lockouts whose last failure and lock are before the
+	// time
+	DeleteExpired(before time.Time) error
+
+	Delete(id string) error
+}
+
+// MemberRepository persists the members of the hub cluster
+type MemberRepository interface {
+	// Source is the changefeed the member cache follows
+	Source() cache.Source
+
+	List() ([]*Member, error)
+
+	// Upsert stores the member replacing any existing record
+	Upsert(member *Member) error
+
+	// Touch sets the member's LastSeen time
+	Touch(id string, at time.Time) error
+
+	// DeleteExpired removes members last seen before the time
+	DeleteExpired(before time.Time) error
+
+	Delete(id string) error
+}
+
+// DeviceRepository persists the devices known to the cluster
+type DeviceRepository interface {
+	// Source is the changefeed the device cache follows
+	Source() cache.Source
+
+	List() ([]*Device, error)
+
+	// Upsert stores the device merging it into any existing record
+	Upsert(device *Device) error
+
+	// SetBlocked sets whether the device is refused connections and requests
+	SetBlocked(id string, blocked bool) error
+
+	Delete(id string) error
+}
+
+// EventRepository persists cluster wide events for relay and stream resumption
+type EventRepository interface {
+	// Source is the changefeed of newly inserted events
+	Source() cache.Source
+
+	Insert(e *event.Event) error
+
+	// After calls fn for events with an ID greater than id in ID order until fn
+	// returns false
+	After(id string, fn func(e *event.Event) bool) error
+
+	// DeleteBefore removes events with an ID less than id
+	DeleteBefore(id string) error
+}
+
+// DeviceEventRepository persists the bounded event history of each device
+type DeviceEventRepository interface {
+	Insert(e *event.Event) error
+
+	// Recent calls fn for the events of the device with the id or hostname, newest
+	// first, until fn returns false
+	Recent(idOrHostname string, fn func(e *event.Event) bool) error
+
+	// Trim removes all but the newest keep events of the device
+	Trim(deviceID string, keep int) error
+}
@@ -0,0 +1,156 @@
+package cluster
+
+import (
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/event"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	// defaultEventRetention is used when the config does not specify a retention
+	defaultEventRetention = 24 * time.Hour
+
+	// maxEventBacklog is the maximum number of events replayed when resuming a stream
+	maxEventBacklog = 10000
+)
+
+func (t *service) SubscribeEvents(lastEventID string, types []string) ([]*event.Event, *event.Subscription, error) {
+	sub := t.stream.Subscribe(1024, types...)
+
+	if lastEventID == "" {
+		return []*event.Event{}, sub, nil
+	}
+
+	backlog := []*event.Event{}
+
+	err := t.store.Events.After(lastEventID, func(e *event.Event) bool {
+		if event.MatchAny(types, e.Type) {
+			backlog = append(backlog, e)
+		}
+
+		return len(backlog) < maxEventBacklog
+	})
+
+	if err != nil {
+		sub.Close()
+		return nil, nil, stacktrace.Propagate(err, "failed to read event backlog")
+	}
+
+	return backlog, sub, nil
+}
+
+// relayEvents writes events published on this member's bus to the event table so
+// every member of the cluster observes them
+func (t *service) relayEvents() {
+	sub := t.config.Events.Subscribe(1024)
+	defer sub.Close()
+
+	for e := range sub.C {
+		relayed := *e
+
+		if relayed.Member == "" {
+			relayed.Member = t.memberID
+		}
+
+		if err := t.store.Events.Insert(&relayed); err != nil {
+			logger.WithFields(logrus.Fields{
+				"type":  e.Type,
+				"error": err.Error(),
+			}).Error("failed to relay event to cluster")
+		}
+	}
+}
+
+// hydrateEventStream publishes every event written to the event table by any member
+// onto this member's cluster wide stream. Events written while the changefeed is
+// reconnecting are not replayed; stream clients resume from the table with
+// Last-Event-ID.
+func (t *service) hydrateEventStream() {
+	cache.Follow("event", t.store.Events.Source(), false, nil, func(change *cache.Change) {
+		if e, ok := change.New.(*event.Event); ok {
+			t.stream.Publish(e)
+		}
+	})
+}
+
+// recordDevices keeps the device table in step with device connections on this
+// member's gateway.
+func (t *service) recordDevices() {
+	sub := t.config.Events.Subscribe(1024, event.DeviceConnected, event.DeviceDisconnected)
+	defer sub.Close()
+
+	for e := range sub.C {
+		device := &Device{
+			ID:           e.DeviceID,
+			Hostname:     e.Hostname,
+			Platform:     stringValue(e.Data["platform"]),
+			Architecture: stringValue(e.Data["architecture"]),
+			Tags:         stringSliceValue(e.Data["tags"]),
+			Connected:    e.Type == event.DeviceConnected,
+			Member:       t.memberID,
+			LastSeen:     e.Time,
+		}
+
+		if err := t.store.Devices.Upsert(device); err != nil {
+			logger.WithFields(logrus.Fields{
+				"deviceId": e.DeviceID,
+				"error":    err.Error(),
+			}).Error("failed to record device")
+		}
+	}
+}
+
+// publish places the event on this member's bus
+func (t *service) publish(e *event.Event) {
+	if t.config == nil {
+		return
+	}
+
+	t.config.Events.Publish(e)
+}
+
+// publishDerived places an event derived from a changefeed on this member's bus.
+// Every member observes the change, so only the leader publishes it and the
+// event is relayed and delivered to webhooks once per cluster.
+func (t *service) publishDerived(e *event.Event) {
+	if !t.isLeader() {
+		return
+	}
+
+	t.publish(e)
+}
+
+func (t *service) eventRetention() time.Duration {
+	if t.config.EventRetention <= 0 {
+		return defaultEventRetention
+	}
+
+	return t.config.EventRetention
+}
+
+func stringValue(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
+
+func stringSliceValue(v interface{}) []string {
+	switch vv := v.(type) {
+	case []string:
+		return vv
+	case []interface{}:
+		s := []string{}
+
+		for _, item := range vv {
+			if str, ok := item.(string); ok {
+				s = append(s, str)
+			}
+		}
+
+		return s
+	}
+
+	return nil
+}
@@ -1,12 +1,126 @@
 package cluster
 
+import (
+	"reflect"
+	"time"
+
+	"github.com/deviceio/hub/secret"
+)
+
 type User struct {
-	ID               string `gorethink:"id,omitempty"`
-	Admin            bool   `gorethink:"admin,omitempty"`
-	Login            string `gorethink:"login,omitempty"`
-	Email            string `gorethink:"email,omitempty"`
-	PasswordHash     []byte `gorethink:"password_hash,omitempty"`
-	PasswordSalt     string `gorethink:"password_salt,omitempty"`
-	TOTPSecret       []byte `gorethink:"totp_secret,omitempty"`
-	ED25519PublicKey []byte `gorethink:"ed22519_public_key,omitempty"`
+	ID               string           `gorethink:"id,omitempty"`
+	Admin            bool             `gorethink:"admin,omitempty"`
+	Login            string           `gorethink:"login,omitempty"`
+	Email            string           `gorethink:"email,omitempty"`
+	PasswordHash     []byte           `gorethink:"password_hash,omitempty"`
+	PasswordSalt     string           `gorethink:"password_salt,omitempty"`
+	TOTPSecret       *secret.Envelope `gorethink:"totp_secret,omitempty"`
+	ED25519PublicKey []byte           `gorethink:"ed22519_public_key,omitempty"`
+
+	// Disabled users fail authentication
+	Disabled bool `gorethink:"disabled,omitempty"`
+
+	// SessionEpoch is incremented to end the user's open event streams and
+	// proxied requests
+	SessionEpoch int64 `gorethink:"session_epoch,omitempty"`
+
+	// RecoveredAt is when the user's credentials were last reset with
+	// recover-admin
+	RecoveredAt time.Time `gorethink:"recovered_at,omitempty"`
+
+	// OIDCIssuer and OIDCSubject identify the user at the identity provider it
+	// signs in with. They are set when the user first signs in.
+	OIDCIssuer  string `gorethink:"oidc_issuer,omitempty"`
+	OIDCSubject string `gorethink:"oidc_subject,omitempty"`
+
+	// Keys are the user's named keys, usable alongside the primary
+	// ED25519PublicKey and TOTPSecret
+	Keys []*Key `gorethink:"keys,omitempty"`
+
+	// KeyID is the named key that authenticated the request the user was
+	// returned for, empty for the primary key. It is not stored.
+	KeyID string `gorethink:"-" json:"-"`
+
+	// TokenID is the service account token that authenticated the request the
+	// user was returned for. The user then stands for the service account and
+	// is not stored.
+	TokenID string `gorethink:"-" json:"-"`
+
+	// Scheme is the authorization scheme of the request the user was returned
+	// for. It is not stored.
+	Scheme string `gorethink:"-" json:"-"`
+}
+
+// Key is a named credential of a user. Each key has its own totp secret so it
+// can be rotated or revoked without affecting the user's other keys.
+type Key struct {
+	ID         string           `gorethink:"id"`
+	Label      string           `gorethink:"label,omitempty"`
+	TOTPSecret *secret.Envelope `gorethink:"totp_secret,omitempty"`
+	PublicKey  []byte           `gorethink:"public_key,omitempty"`
+	Created    time.Time        `gorethink:"created"`
+
+	// SSHPublicKey is the wire format OpenSSH public key of keys registered by
+	// the user, which sign requests with the DEVICEIO-HUB-SSH scheme. They have
+	// no totp secret or ed25519 key.
+	SSHPublicKey []byte `gorethink:"ssh_public_key,omitempty"`
+
+	// Expires is when the key stops authenticating, never if zero
+	Expires time.Time `gorethink:"expires,omitempty"`
+
+	// LastUsed is updated at most once a minute
+	LastUsed time.Time `gorethink:"last_used,omitempty"`
+
+	Revoked bool `gorethink:"revoked,omitempty"`
+
+	// SSO keys are the session credentials issued at single sign-on. Expired
+	// ones are removed when the user next signs in.
+	SSO bool `gorethink:"sso,omitempty"`
+}
+
+// Active reports if the key authenticates requests at the time
+func (t *Key) Active(at time.Time) bool {
+	return !t.Revoked && (t.Expires.IsZero() || at.Before(t.Expires))
+}
+
+// key returns the named key with the id or nil
+func (t *User) key(id string) *Key {
+	for _, key := range t.Keys {
+		if key.ID == id {
+			return key
+		}
+	}
+
+	return nil
+}
+
+// onlyKeysUsed reports if the only difference between the users is the
+// LastUsed time of keys
+func (t *User) onlyKeysUsed(old *User) bool {
+	strip := func(user *User) User {
+		stripped := *user
+		stripped.Keys = nil
+
+		for _, key := range user.Keys {
+			k := *key
+			k.LastUsed = time.Time{}
+			stripped.Keys = append(stripped.Keys, &k)
+		}
+
+		return stripped
+	}
+
+	return reflect.DeepEqual(strip(t), strip(old))
+}
+
+// eventData describes the user for inclusion in events. Credential material is
+// never included.
+func (t *User) eventData() map[string]interface{} {
+	return map[string]interface{}{
+		"id":       t.ID,
+		"login":    t.Login,
+		"email":    t.Email,
+		"admin":    t.Admin,
+		"disabled": t.Disabled,
+	}
 }
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/user"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// userView is a user as printed by the cli. Credential material is never shown.
+type userView struct {
+	ID        string `json:"id"`
+	Login     string `json:"login"`
+	Email     string `json:"email"`
+	Admin     bool   `json:"admin"`
+	Disabled  bool   `json:"disabled"`
+	PublicKey string `json:"publicKey"`
+}
+
+func newUserView(user *cluster.User) *userView {
+	return &userView{
+		ID:        user.ID,
+		Login:     user.Login,
+		Email:     user.Email,
+		Admin:     user.Admin,
+		Disabled:  user.Disabled,
+		PublicKey: base64.StdEncoding.EncodeToString(user.ED25519PublicKey),
+	}
+}
+
+func newUserCmd() *cobra.Command {
+	userCmd := &cobra.Command{
+		Use:   "user",
+		Short: "user administration",
+		Long:  `adds, lists and manages hub users directly in the configured database`,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add",
+		Short: "adds a user and prints its credentials",
+		Run: func(cmd *cobra.Command, args []string) {
+			admin, auditLog := openAdmin(cmd)
+
+			login, _ := cmd.Flags().GetString("login")
+			email, _ := cmd.Flags().GetString("email")
+			isAdmin, _ := cmd.Flags().GetBool("admin")
+
+			user, creds, err := admin.AddUser(login, email, isAdmin)
+
+			if err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "failed to add user"))
+			}
+
+			checkpoint(auditLog)
+			printCredentials(cmd, user, creds)
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "lists users",
+		Run: func(cmd *cobra.Command, args []string) {
+			admin, _ := openAdmin(cmd)
+
+			users, err := admin.Users()
+
+			if err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "failed to list users"))
+			}
+
+			views := []*userView{}
+
+			for _, user := range users {
+				views = append(views, newUserView(user))
+			}
+
+			printOutput(cmd, views, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tLOGIN\tEMAIL\tADMIN\tDISABLED")
+
+				for _, user := range views {
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", user.ID, user.Login, user.Email, user.Admin, user.Disabled)
+				}
+			})
+		},
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show <id|login|email>",
+		Short: "shows a user",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, _ := openAdmin(cmd)
+
+			user, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printUser(cmd, newUserView(user))
+		},
+	}
+
+	disableCmd := &cobra.Command{
+		Use:   "disable <id|login|email>",
+		Short: "disables a user so it fails authentication",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			enable, _ := cmd.Flags().GetBool("enable")
+
+			if err := admin.SetUserDisabled(args[0], !enable); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			user, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printUser(cmd, newUserView(user))
+		},
+	}
+
+	rotateCmd := &cobra.Command{
+		Use:   "rotate-keys <id|login|email>",
+		Short: "issues new credentials to a user",
+		Long: `replaces the password, totp secret and ed25519 key of the user, deletes its hmac
+keys and prints the new credentials. The previous credentials stop working once
+hubs observe the change`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			creds, err := admin.RotateUserKeys(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			user, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printCredentials(cmd, user, creds)
+		},
+	}
+
+	linkSSOCmd := &cobra.Command{
+		Use:   "link-sso <id|login|email>",
+		Short: "links a user to its single sign-on identity",
+		Long: `links the user to the identity with the subject at the oidc issuer, so signing in
+with that identity signs in as the user. Admins are never linked by email at
+sign in and must be linked this way`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			issuer, _ := cmd.Flags().GetString("issuer")
+			subject, _ := cmd.Flags().GetString("subject")
+
+			user, err := admin.LinkUserSSO(args[0], issuer, subject)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			printUser(cmd, newUserView(user))
+		},
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <id|login|email>",
+		Short: "deletes a user",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			if err := admin.DeleteUser(args[0]); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("user %v deleted\n", args[0])
+		},
+	}
+
+	addCmd.Flags().String("login", "", "login of the new user")
+	addCmd.Flags().String("email", "", "email address of the new user")
+	addCmd.Flags().Bool("admin", false, "make the user an administrator")
+	disableCmd.Flags().Bool("enable", false, "enable a disabled user instead")
+	linkSSOCmd.Flags().String("issuer", "", "issuer url of the identity provider")
+	linkSSOCmd.Flags().String("subject", "", "subject of the user's identity at the provider")
+
+	for _, cmd := range []*cobra.Command{addCmd, listCmd, showCmd, disableCmd, rotateCmd, linkSSOCmd, deleteCmd} {
+		addAdminFlags(cmd)
+		userCmd.AddCommand(cmd)
+	}
+
+	userCmd.AddCommand(newUserKeyCmd())
+	userCmd.AddCommand(newUserHmacKeyCmd())
+
+	return userCmd
+}
+
+func newDeviceCmd() *cobra.Command {
+	deviceCmd := &cobra.Command{
+		Use:   "device",
+		Short: "device administration",
+		Long:  `lists and manages the devices known to the hub directly in the configured database`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "lists devices",
+		Run: func(cmd *cobra.Command, args []string) {
+			admin, _ := openAdmin(cmd)
+
+			devices, err := admin.Devices()
+
+			if err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "failed to list devices"))
+			}
+
+			printOutput(cmd, devices, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tHOSTNAME\tPLATFORM\tCONNECTED\tBLOCKED\tMEMBER\tLAST SEEN")
+
+				for _, device := range devices {
+					fmt.Fprintf(
+						w,
+						"%v\t%v\t%v\t%v\t%v\t%v\t%v\n",
+						device.ID,
+						device.Hostname,
+						device.Platform,
+						device.Connected,
+						device.Blocked,
+						device.Member,
+						formatTime(device.LastSeen),
+					)
+				}
+			})
+		},
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show <id|hostname>",
+		Short: "shows a device",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, _ := openAdmin(cmd)
+
+			device, err := admin.Device(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printDevice(cmd, device)
+		},
+	}
+
+	blockCmd := &cobra.Command{
+		Use:   "block <id|hostname>",
+		Short: "blocks a device",
+		Long: `refuses the device's gateway connections and requests proxied to it. A device
+connected when it is blocked stays connected but receives no requests`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			unblock, _ := cmd.Flags().GetBool("unblock")
+
+			if err := admin.SetDeviceBlocked(args[0], !unblock); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			device, err := admin.Device(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printDevice(cmd, device)
+		},
+	}
+
+	blockCmd.Flags().Bool("unblock", false, "unblock a blocked device instead")
+
+	for _, cmd := range []*cobra.Command{listCmd, showCmd, blockCmd} {
+		addAdminFlags(cmd)
+		deviceCmd.AddCommand(cmd)
+	}
+
+	return deviceCmd
+}
+
+func newMemberCmd() *cobra.Command {
+	memberCmd := &cobra.Command{
+		Use:   "member",
+		Short: "cluster member administration",
+		Long:  `lists and evicts the hub instances registered as cluster members`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "lists cluster members",
+		Run: func(cmd *cobra.Command, args []string) {
+			admin, _ := openAdmin(cmd)
+
+			members, err := admin.Members()
+
+			if err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "failed to list cluster members"))
+			}
+
+			printOutput(cmd, members, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tHOSTNAME\tADDRESS\tSTARTED\tLAST SEEN")
+
+				for _, member := range members {
+					fmt.Fprintf(
+						w,
+						"%v\t%v\t%v:%v\t%v\t%v\n",
+						member.ID,
+						member.Hostname,
+						strings.Join(member.BindAddr, ","),
+						member.BindPort,
+						formatTime(member.StartedAt),
+						formatTime(member.LastSeen),
+					)
+				}
+			})
+		},
+	}
+
+	evictCmd := &cobra.Command{
+		Use:   "evict <id>",
+		Short: "removes a member from the cluster",
+		Long: `removes a member that stopped without leaving the cluster, and marks the devices
+it recorded as connected disconnected. The leader removes members a minute after
+their last heartbeat; evict does so immediately. Members seen within the last
+minute are only evicted with --force`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			force, _ := cmd.Flags().GetBool("force")
+
+			devices, err := admin.EvictMember(args[0], force)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("member %v evicted, %v devices marked disconnected\n", args[0], devices)
+		},
+	}
+
+	evictCmd.Flags().Bool("force", false, "evict a member that may still be running")
+
+	for _, cmd := range []*cobra.Command{listCmd, evictCmd} {
+		addAdminFlags(cmd)
+		memberCmd.AddCommand(cmd)
+	}
+
+	return memberCmd
+}
+
+// addAdminFlags adds the flags shared by the administration commands
+func addAdminFlags(cmd *cobra.Command) {
+	addDBFlags(cmd, true)
+	cmd.Flags().StringP("output", "o", "table", "output format: table or json")
+	cmd.Flags().String("master-key-path", "", "path of the key file encrypting credentials at rest. Defaults to ~/.deviceio/hub/master.key. Ignored if DEVICEIO_HUB_MASTER_KEY is set")
+	cmd.Flags().String("audit-key-path", "", "path to the ed25519 key signing audit checkpoints. Defaults to ~/.deviceio/hub/audit.key")
+}
+
+// openAdmin connects to the configured database. Changes are recorded to the
+// cli audit chain.
+func openAdmin(cmd *cobra.Command) (cluster.Admin, *audit.Log) {
+	admin, _, auditLog := openHMAC(cmd)
+	return admin, auditLog
+}
+
+// openHMAC connects to the configured database for managing the hmac keys of
+// users. Changes are recorded to the cli audit chain.
+func openHMAC(cmd *cobra.Command) (cluster.Admin, *user.Service, *audit.Log) {
+	stores, auditLog := openBackend(cmd)
+
+	hmac := &user.Service{
+		Repository: stores.HMAC,
+		Audit:      auditLog,
+	}
+
+	admin := cluster.NewAdmin(&cluster.Config{
+		Audit: auditLog,
+		Store: stores.Cluster,
+		HMAC:  hmac,
+	})
+
+	return admin, hmac, auditLog
+}
+
+// openBackend configures the command and opens the configured storage backend
+// and the cli audit chain
+func openBackend(cmd *cobra.Command) (*backend, *audit.Log) {
+	configure(cmd)
+
+	if output, _ := cmd.Flags().GetString("output"); output != "table" && output != "json" {
+		logger.Fatal(stacktrace.NewError("unknown output format '%v', expected table or json", output))
+	}
+
+	loadMasterKey(false)
+	stores := connect()
+
+	auditKey, err := audit.LoadOrCreateKey(viper.GetString("audit.key_path"))
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to load audit signing key"))
+	}
+
+	return stores, &audit.Log{
+		Store: stores.Audit,
+		Chain: "cli",
+		Key:   auditKey,
+	}
+}
+
+// checkpoint signs the audit records written by the command
+func checkpoint(auditLog *audit.Log) {
+	if err := auditLog.Checkpoint(); err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to checkpoint audit chain"))
+	}
+}
+
+// requireArgs exits with the usage unless exactly n arguments are given
+func requireArgs(cmd *cobra.Command, args []string, n int) {
+	if len(args) != n {
+		cmd.Usage()
+		os.Exit(1)
+	}
+}
+
+// printOutput prints v as json, or calls table to print it as a table
+func printOutput(cmd *cobra.Command, v interface{}, table func(w *tabwriter.Writer)) {
+	if output, _ := cmd.Flags().GetString("output"); output == "json" {
+		encoded, err := json.MarshalIndent(v, "", "  ")
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to encode output"))
+		}
+
+		fmt.Println(string(encoded))
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	table(w)
+	w.Flush()
+}
+
+func printUser(cmd *cobra.Command, user *userView) {
+	printOutput(cmd, user, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "ID\t%v\n", user.ID)
+		fmt.Fprintf(w, "Login\t%v\n", user.Login)
+		fmt.Fprintf(w, "Email\t%v\n", user.Email)
+		fmt.Fprintf(w, "Admin\t%v\n", user.Admin)
+		fmt.Fprintf(w, "Disabled\t%v\n", user.Disabled)
+		fmt.Fprintf(w, "Public Key\t%v\n", user.PublicKey)
+	})
+}
+
+func printCredentials(cmd *cobra.Command, user *cluster.User, creds *cluster.Credentials) {
+	view := newUserView(user)
+
+	printOutput(cmd, map[string]interface{}{
+		"user":        view,
+		"credentials": creds,
+	}, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "please save these credentials securely, they cannot be retrieved later")
+		fmt.Fprintf(w, "ID\t%v\n", view.ID)
+		fmt.Fprintf(w, "Login\t%v\n", view.Login)
+		fmt.Fprintf(w, "Password\t%v\n", creds.Password)
+		fmt.Fprintf(w, "TOTP Secret\t%v\n", creds.TOTPSecret)
+		fmt.Fprintf(w, "Private Key\t%v\n", creds.PrivateKey)
+	})
+}
+
+func printDevice(cmd *cobra.Command, device *cluster.Device) {
+	printOutput(cmd, device, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "ID\t%v\n", device.ID)
+		fmt.Fprintf(w, "Hostname\t%v\n", device.Hostname)
+		fmt.Fprintf(w, "Platform\t%v\n", device.Platform)
+		fmt.Fprintf(w, "Architecture\t%v\n", device.Architecture)
+		fmt.Fprintf(w, "Tags\t%v\n", strings.Join(device.Tags, ","))
+		fmt.Fprintf(w, "Connected\t%v\n", device.Connected)
+		fmt.Fprintf(w, "Blocked\t%v\n", device.Blocked)
+		fmt.Fprintf(w, "Member\t%v\n", device.Member)
+		fmt.Fprintf(w, "Last Seen\t%v\n", formatTime(device.LastSeen))
+	})
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+
+	return t.Format("2006-01-02 15:04:05Z07:00")
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
+)
+
+func newAuditCmd() *cobra.Command {
+	auditCmd := &cobra.Command{
+		Use:   "audit",
+		Short: "audit log tooling",
+		Long:  `inspects the tamper-evident audit log of the hub`,
+	}
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "verifies the audit log hash chains",
+		Long: `walks every audit hash chain reporting modified records, gaps and checkpoints that
+are missing, unsigned or signed by an untrusted key. Exits non-zero if any problem is found`,
+		Run: func(cmd *cobra.Command, args []string) {
+			configure(cmd)
+			auditVerify(cmd, connect())
+		},
+	}
+
+	addDBFlags(verifyCmd, true)
+	verifyCmd.Flags().String("audit-key-path", "", "path to the ed25519 key signing audit checkpoints. Defaults to ~/.deviceio/hub/audit.key")
+	verifyCmd.Flags().StringSlice("public-key", []string{}, "base64 ed25519 public key trusted to sign checkpoints. May be repeated. When supplied the audit key is not read")
+
+	auditCmd.AddCommand(verifyCmd)
+
+	return auditCmd
+}
+
+func auditVerify(cmd *cobra.Command, stores *backend) {
+	trusted := []ed25519.PublicKey{}
+
+	publicKeys, _ := cmd.Flags().GetStringSlice("public-key")
+
+	for _, encoded := range publicKeys {
+		key, err := audit.ParsePublicKey(encoded)
+
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		trusted = append(trusted, key)
+	}
+
+	if len(trusted) == 0 {
+		key, err := audit.LoadKey(viper.GetString("audit.key_path"))
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to load audit signing key"))
+		}
+
+		trusted = append(trusted, key.Public().(ed25519.PublicKey))
+	}
+
+	report, err := audit.Verify(stores.Audit, trusted)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "audit verification failed"))
+	}
+
+	for _, chain := range report.Chains {
+		fmt.Printf(
+			"chain %v: %v records, head seq %v, %v valid checkpoints, checkpointed through seq %v\n",
+			chain.Chain,
+			chain.Records,
+			chain.HeadSeq,
+			chain.Checkpoints,
+			chain.CheckpointedSeq,
+		)
+	}
+
+	if report.OK() {
+		fmt.Println("audit log OK")
+		return
+	}
+
+	for _, problem := range report.Problems {
+		fmt.Println("PROBLEM", problem.String())
+	}
+
+	fmt.Printf("audit log FAILED verification with %v problems\n", len(report.Problems))
+	os.Exit(1)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/deviceio/hub/backup"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// passphraseEnvVar holds the backup passphrase in place of --passphrase-file
+const passphraseEnvVar = "DEVICEIO_HUB_BACKUP_PASSPHRASE"
+
+func newBackupCmd() *cobra.Command {
+	backupCmd := &cobra.Command{
+		Use:   "backup <file>",
+		Short: "backs up the hub to an archive",
+		Long: `writes every hub table, users, devices, members, events, webhooks and the audit
+log, to a versioned archive. The archive is encrypted when a passphrase is given with
+--passphrase-file or DEVICEIO_HUB_BACKUP_PASSPHRASE. Stop the hub first when using the
+embedded driver`,
+		Run: func(cmd *cobra.Command, args []string) {
+			configure(cmd)
+			requireArgs(cmd, args, 1)
+			backupRun(args[0], readPassphrase(cmd), openTables())
+		},
+	}
+
+	addDBFlags(backupCmd, true)
+	backupCmd.Flags().String("passphrase-file", "", "path of a file holding the passphrase to encrypt the archive with")
+
+	return backupCmd
+}
+
+func newRestoreCmd() *cobra.Command {
+	restoreCmd := &cobra.Command{
+		Use:   "restore <file>",
+		Short: "restores the hub from an archive",
+		Long: `validates the archive then loads it into the database. Rethinkdb databases are
+migrated to the schema of the archive before loading and to the latest schema after.
+Restoring into tables that hold documents requires --replace, which deletes them
+first. A replace that fails part way through leaves the tables half loaded, so
+--replace also requires --safety-backup, where the database is backed up before
+anything is deleted; restore that archive to undo a failed or unwanted replace.
+Stop every hub before restoring`,
+		Run: func(cmd *cobra.Command, args []string) {
+			configure(cmd)
+			requireArgs(cmd, args, 1)
+
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			replace, _ := cmd.Flags().GetBool("replace")
+			safetyBackup, _ := cmd.Flags().GetString("safety-backup")
+
+			if replace && !dryRun && safetyBackup == "" {
+				logger.Fatal("--replace requires --safety-backup <file> to back up the database to first")
+			}
+
+			if !dryRun {
+				loadMasterKey(false)
+			}
+
+			passphrase := readPassphrase(cmd)
+			tables := openTables()
+
+			opts := &backup.RestoreOptions{
+				Passphrase: passphrase,
+				Replace:    replace,
+				DryRun:     dryRun,
+			}
+
+			if replace {
+				opts.Safeguard = func() error {
+					_, err := writeArchive(safetyBackup, passphrase, tables)
+					return err
+				}
+			}
+
+			restoreRun(args[0], tables, opts)
+		},
+	}
+
+	addDBFlags(restoreCmd, true)
+	restoreCmd.Flags().String("passphrase-file", "", "path of a file holding the passphrase the archive is encrypted with")
+	restoreCmd.Flags().String("master-key-path", "", "path of the key file encrypting credentials at rest. Must hold the keys of the backed up hub. Defaults to ~/.deviceio/hub/master.key")
+	restoreCmd.Flags().Bool("dry-run", false, "validate the archive against the database and report what would be restored without writing")
+	restoreCmd.Flags().Bool("replace", false, "delete the documents of every hub table before restoring")
+	restoreCmd.Flags().String("safety-backup", "", "path of an archive to back up the database to before --replace deletes it, encrypted with the restore passphrase")
+
+	return restoreCmd
+}
+
+// readPassphrase returns the archive passphrase from the environment or the
+// passphrase file, or nil if neither is set
+func readPassphrase(cmd *cobra.Command) []byte {
+	if passphrase := os.Getenv(passphraseEnvVar); passphrase != "" {
+		return []byte(passphrase)
+	}
+
+	path, _ := cmd.Flags().GetString("passphrase-file")
+
+	if path == "" {
+		return nil
+	}
+
+	raw, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to read passphrase file '%v'", path))
+	}
+
+	passphrase := strings.TrimRight(string(raw), "\r\n")
+
+	if passphrase == "" {
+		logger.Fatal(stacktrace.NewError("passphrase file '%v' is empty", path))
+	}
+
+	return []byte(passphrase)
+}
+
+func backupRun(path string, passphrase []byte, tables backup.Tables) {
+	trailer, err := writeArchive(path, passphrase, tables)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "backup failed"))
+	}
+
+	total := 0
+
+	for _, n := range trailer.Counts {
+		total += n
+	}
+
+	encrypted := "unencrypted"
+
+	if len(passphrase) > 0 {
+		encrypted = "encrypted"
+	}
+
+	fmt.Printf("backed up %v documents of %v tables to %v (%v)\n", total, len(trailer.Counts), path, encrypted)
+}
+
+// writeArchive backs tables up to path, which only appears once the archive is
+// complete and synced
+func writeArchive(path string, passphrase []byte, tables backup.Tables) (*backup.Trailer, error) {
+	tmp := path + ".tmp"
+
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create archive '%v'", path)
+	}
+
+	trailer, err := backup.Backup(file, tables, passphrase)
+
+	if err == nil {
+		err = file.Sync()
+	}
+
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	if err != nil {
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	return trailer, nil
+}
+
+func restoreRun(path string, tables backup.Tables, opts *backup.RestoreOptions) {
+	open := func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+
+	report, err := backup.Restore(open, tables, opts)
+
+	if report != nil {
+		printRestoreReport(report, opts)
+	}
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "restore failed"))
+	}
+
+	if opts.DryRun {
+		fmt.Println("archive OK, nothing was restored (dry run)")
+		return
+	}
+
+	fmt.Printf("restored %v, run 'deviceio-hub keys verify' to check credentials decrypt with the loaded master keys\n", path)
+}
+
+func printRestoreReport(report *backup.Report, opts *backup.RestoreOptions) {
+	fmt.Printf(
+		"archive: version %v, %v database schema %v, created %v\n",
+		report.Header.Version,
+		report.Header.Driver,
+		report.Header.Schema,
+		report.Header.Created.Format("2006-01-02 15:04:05Z07:00"),
+	)
+
+	if viper.GetString("db.driver") == "rethinkdb" {
+		fmt.Printf("database: schema %v\n", report.Schema)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TABLE\tARCHIVED\tEXISTING\tAFTER RESTORE")
+
+	for _, table := range report.Tables {
+		after := table.Archived
+
+		if !opts.Replace {
+			after += table.Existing
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", table.Table, table.Archived, table.Existing, after)
+	}
+
+	w.Flush()
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/deviceio/hub/client"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+)
+
+// profileEnvVar selects the call profile when --profile is not given
+const profileEnvVar = "DEVICEIO_HUB_PROFILE"
+
+// callProfile is the part of a profile file read by the call command. A profile
+// is the json printed by user add, user rotate-keys, user key add, user key
+// add-ssh, service-account token add or recover-admin with -o json with the hub
+// url and optionally its certificate fingerprint added.
+type callProfile struct {
+	URL         string `json:"url"`
+	Fingerprint string `json:"fingerprint"`
+
+	// Token is the service account token of profiles of service accounts
+	Token string `json:"token"`
+
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+
+	// Key.SSHPublicKey is set in profiles of ssh keys, which sign through the
+	// ssh-agent of SSH_AUTH_SOCK
+	Key struct {
+		SSHPublicKey string `json:"sshPublicKey"`
+	} `json:"key"`
+}
+
+func newCallCmd() *cobra.Command {
+	callCmd := &cobra.Command{
+		Use:   "call <path>",
+		Short: "sends a signed request to the hub api",
+		Long: `sends a request signed with the credentials of a profile to an api route such as
+/v1/devices, or to a device with --device. Profiles are read from
+~/.deviceio/hub/profiles/<name>.json. Profiles of ssh keys sign through the
+ssh-agent of SSH_AUTH_SOCK. JSON responses are pretty printed. Exits non-zero
+when the hub responds with a 4xx or 5xx status`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			callRun(cmd, args[0])
+		},
+	}
+
+	callCmd.Flags().String("profile", "", "name of the profile in ~/.deviceio/hub/profiles. Defaults to DEVICEIO_HUB_PROFILE or default")
+	callCmd.Flags().String("profile-path", "", "path of the profile file, instead of --profile")
+	callCmd.Flags().String("url", "", "url of the hub api, overriding the profile url")
+	callCmd.Flags().String("fingerprint", "", "SHA-256 fingerprint the hub certificate must have, overriding the profile fingerprint")
+	callCmd.Flags().Bool("insecure", false, "accept any hub certificate")
+	callCmd.Flags().String("device", "", "id or hostname of the device to send the request to. <path> is then the device path")
+	callCmd.Flags().StringP("method", "X", "", "request method. Defaults to GET, or POST when a body is given")
+	callCmd.Flags().StringArrayP("header", "H", nil, "request header as 'Name: value'. May be repeated")
+	callCmd.Flags().StringP("data", "d", "", "request body")
+	callCmd.Flags().String("data-file", "", "path of a file to send as the request body, - for stdin")
+	callCmd.Flags().BoolP("include", "i", false, "print the response status and headers")
+	callCmd.Flags().Bool("raw", false, "print JSON responses as sent instead of pretty printed")
+	callCmd.Flags().Duration("timeout", 0, "request timeout. Unlimited if zero, which suits event streams")
+
+	return callCmd
+}
+
+func callRun(cmd *cobra.Command, path string) {
+	c := newCallClient(cmd)
+
+	if device, _ := cmd.Flags().GetString("device"); device != "" {
+		path = "/device/" + device + "/" + strings.TrimPrefix(path, "/")
+	} else if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+
+	body, hasBody := callBody(cmd)
+	method, _ := cmd.Flags().GetString("method")
+
+	if method == "" && hasBody {
+		method = "POST"
+	} else if method == "" {
+		method = "GET"
+	}
+
+	ctx := context.Background()
+
+	if timeout, _ := cmd.Flags().GetDuration("timeout"); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	req, err := c.NewRequest(ctx, strings.ToUpper(method), path, body)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "invalid request"))
+	}
+
+	headers, _ := cmd.Flags().GetStringArray("header")
+
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+
+		if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+			logger.Fatal(stacktrace.NewError("header '%v' must be 'Name: value'", header))
+		}
+
+		if strings.EqualFold(strings.TrimSpace(parts[0]), "Host") {
+			req.Host = strings.TrimSpace(parts[1])
+			continue
+		}
+
+		req.Header.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+
+	if hasBody && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.Do(req)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "%v %v failed", req.Method, path))
+	}
+
+	defer resp.Body.Close()
+
+	if include, _ := cmd.Flags().GetBool("include"); include {
+		printResponseHeader(resp)
+	}
+
+	raw, _ := cmd.Flags().GetBool("raw")
+
+	if !raw && strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		printJSON(resp.Body)
+	} else if _, err := io.Copy(os.Stdout, resp.Body); err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to read response"))
+	}
+
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		os.Exit(1)
+	}
+}
+
+// newCallClient returns a client of the hub signing with the selected profile
+func newCallClient(cmd *cobra.Command) *client.Client {
+	path := profilePath(cmd)
+
+	data, err := ioutil.ReadFile(path)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to read profile '%v'", path))
+	}
+
+	profile := &callProfile{}
+
+	if err := json.Unmarshal(data, profile); err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "profile '%v' is not valid json", path))
+	}
+
+	var creds *client.Credentials
+	var sshCreds *client.SSHCredentials
+
+	if profile.Key.SSHPublicKey != "" {
+		// the agent connection is left open until the command exits
+		signer, _, err := client.AgentSigner(profile.Key.SSHPublicKey)
+
+		if err != nil {
+			logger.Fatal(err)
+		}
+
+		sshCreds = &client.SSHCredentials{
+			UserID: profile.User.ID,
+			Signer: signer,
+		}
+	} else if profile.Token == "" {
+		if creds, err = client.LoadCredentials(path); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	if url, _ := cmd.Flags().GetString("url"); url != "" {
+		profile.URL = url
+	}
+
+	if fingerprint, _ := cmd.Flags().GetString("fingerprint"); fingerprint != "" {
+		profile.Fingerprint = fingerprint
+	}
+
+	if profile.URL == "" {
+		logger.Fatal(stacktrace.NewError("profile '%v' has no url, add one or pass --url", path))
+	}
+
+	var tlsConfig *tls.Config
+
+	if insecure, _ := cmd.Flags().GetBool("insecure"); insecure {
+		tlsConfig = &tls.Config{InsecureSkipVerify: true}
+	} else if profile.Fingerprint != "" {
+		if tlsConfig, err = client.PinnedTLSConfig(profile.Fingerprint); err != nil {
+			logger.Fatal(err)
+		}
+	}
+
+	c, err := client.New(&client.Config{
+		URL:            profile.URL,
+		Credentials:    creds,
+		Token:          profile.Token,
+		SSHCredentials: sshCreds,
+		TLSConfig:      tlsConfig,
+	})
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	return c
+}
+
+// profilePath returns the path of the profile file selected by the flags
+func profilePath(cmd *cobra.Command) string {
+	if path, _ := cmd.Flags().GetString("profile-path"); path != "" {
+		return path
+	}
+
+	name, _ := cmd.Flags().GetString("profile")
+
+	if name == "" {
+		name = os.Getenv(profileEnvVar)
+	}
+
+	if name == "" {
+		name = "default"
+	}
+
+	home, err := homedir.Dir()
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to locate home directory"))
+	}
+
+	return filepath.Join(home, ".deviceio", "hub", "profiles", name+".json")
+}
+
+// callBody returns the request body given by --data or --data-file
+func callBody(cmd *cobra.Command) (io.Reader, bool) {
+	data, _ := cmd.Flags().GetString("data")
+	path, _ := cmd.Flags().GetString("data-file")
+
+	switch {
+	case data != "" && path != "":
+		logger.Fatal(stacktrace.NewError("--data and --data-file cannot be combined"))
+	case data != "":
+		return strings.NewReader(data), true
+	case path == "-":
+		return os.Stdin, true
+	case path != "":
+		file, err := os.Open(path)
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to open '%v'", path))
+		}
+
+		return file, true
+	}
+
+	return nil, false
+}
+
+func printResponseHeader(resp *http.Response) {
+	fmt.Printf("%v %v\n", resp.Proto, resp.Status)
+
+	names := []string{}
+
+	for name := range resp.Header {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		for _, value := range resp.Header[name] {
+			fmt.Printf("%v: %v\n", name, value)
+		}
+	}
+
+	fmt.Println()
+}
+
+// printJSON pretty prints a json body, or prints it as sent if it is not valid json
+func printJSON(body io.Reader) {
+	data, err := ioutil.ReadAll(body)
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to read response"))
+	}
+
+	indented := &bytes.Buffer{}
+
+	if err := json.Indent(indented, bytes.TrimSpace(data), "", "  "); err != nil {
+		os.Stdout.Write(data)
+		return
+	}
+
+	indented.WriteTo(os.Stdout)
+	fmt.Println()
+}
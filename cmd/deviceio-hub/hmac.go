@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deviceio/hub/user"
+	"github.com/spf13/cobra"
+)
+
+// hmacKeyView is an hmac credential as printed by the cli. Its secret is never
+// shown.
+type hmacKeyView struct {
+	ID         string    `json:"id"`
+	Login      string    `json:"login"`
+	HmacKey    string    `json:"hmacKey"`
+	PermitAddr []string  `json:"permitAddr"`
+	Created    time.Time `json:"created"`
+}
+
+func newHmacKeyView(entity *user.Entity) *hmacKeyView {
+	view := &hmacKeyView{
+		ID:         entity.ID,
+		Login:      entity.Username,
+		HmacKey:    entity.HmacKey,
+		PermitAddr: entity.PermitAddr,
+		Created:    entity.Created,
+	}
+
+	if view.PermitAddr == nil {
+		view.PermitAddr = []string{}
+	}
+
+	return view
+}
+
+func newUserHmacKeyCmd() *cobra.Command {
+	hmacCmd := &cobra.Command{
+		Use:   "hmac-key",
+		Short: "hmac key administration",
+		Long: `adds and deletes the hmac credentials of a user. Requests signed with an hmac
+credential act as the user and may be limited to source addresses with --permit-addr`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list <id|login|email>",
+		Short: "lists the hmac keys of a user",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, hmacService, _ := openHMAC(cmd)
+
+			owner, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			entities, err := hmacService.List(owner.Login)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			views := []*hmacKeyView{}
+
+			for _, entity := range entities {
+				views = append(views, newHmacKeyView(entity))
+			}
+
+			printOutput(cmd, views, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "HMAC KEY\tCREATED\tPERMITTED ADDRESSES")
+
+				for _, view := range views {
+					fmt.Fprintf(w, "%v\t%v\t%v\n", view.HmacKey, formatTime(view.Created), strings.Join(view.PermitAddr, ","))
+				}
+			})
+		},
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <id|login|email>",
+		Short: "issues an hmac key to a user and prints its secret",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, hmacService, auditLog := openHMAC(cmd)
+
+			permitAddr, _ := cmd.Flags().GetStringArray("permit-addr")
+
+			owner, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			entity, hmacSecret, err := hmacService.Add(nil, owner.Login, permitAddr)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			printOutput(cmd, map[string]interface{}{
+				"hmacKey":    newHmacKeyView(entity),
+				"hmacSecret": hmacSecret,
+			}, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "please save this secret securely, it cannot be retrieved later")
+				fmt.Fprintf(w, "Login\t%v\n", entity.Username)
+				fmt.Fprintf(w, "HMAC Key\t%v\n", entity.HmacKey)
+				fmt.Fprintf(w, "HMAC Secret\t%v\n", hmacSecret)
+				fmt.Fprintf(w, "Permitted Addresses\t%v\n", strings.Join(entity.PermitAddr, ","))
+			})
+		},
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <id|login|email> <hmac key>",
+		Short: "deletes an hmac key of a user",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 2)
+			admin, hmacService, auditLog := openHMAC(cmd)
+
+			owner, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			if err := hmacService.Delete(nil, owner.Login, args[1]); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("hmac key %v deleted\n", args[1])
+		},
+	}
+
+	addCmd.Flags().StringArray("permit-addr", nil, "ip address or CIDR range the key may be used from, such as 10.0.0.0/8. May be repeated. Every address if omitted")
+
+	for _, cmd := range []*cobra.Command{listCmd, addCmd, deleteCmd} {
+		addAdminFlags(cmd)
+		hmacCmd.AddCommand(cmd)
+	}
+
+	return hmacCmd
+}
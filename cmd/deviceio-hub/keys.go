@@ -0,0 +1,214 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/secret"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func newKeysCmd() *cobra.Command {
+	keysCmd := &cobra.Command{
+		Use:   "keys",
+		Short: "master key tooling",
+		Long: `manages the master keys that encrypt credentials at rest. Every hub of a cluster
+must load the same key file, or the same DEVICEIO_HUB_MASTER_KEY value`,
+	}
+
+	generateCmd := &cobra.Command{
+		Use:   "generate",
+		Short: "creates the master key file",
+		Run: func(cmd *cobra.Command, args []string) {
+			configure(cmd)
+
+			path := viper.GetString("master_key.path")
+
+			if _, err := os.Stat(path); err == nil {
+				logger.Fatal(stacktrace.NewError("master key file '%v' already exists, use 'keys rotate' to add a key", path))
+			}
+
+			id, err := secret.AppendKey(path)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			fmt.Printf("master key %v written to %v\n", id, path)
+		},
+	}
+
+	rotateCmd := &cobra.Command{
+		Use:   "rotate",
+		Short: "adds a new active master key",
+		Long: `appends a new master key to the key file. The new key seals new credentials and
+the cluster leader re-wraps existing credentials with it in the background. Copy the
+key file to every hub and restart them. Once 'keys verify' reports no credentials
+under the retired key its line may be removed from the key file`,
+		Run: func(cmd *cobra.Command, args []string) {
+			configure(cmd)
+
+			path := viper.GetString("master_key.path")
+
+			if _, err := secret.LoadKeyring(path); err != nil {
+				logger.Fatal(err)
+			}
+
+			id, err := secret.AppendKey(path)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			fmt.Printf("master key %v added to %v and is now active\n", id, path)
+		},
+	}
+
+	verifyCmd := &cobra.Command{
+		Use:   "verify",
+		Short: "verifies every stored credential decrypts",
+		Long: `decrypts the credentials and hmac secrets of every user with the loaded master
+keys, reporting how many are sealed by each key. Exits non-zero if any credential
+fails to decrypt`,
+		Run: func(cmd *cobra.Command, args []string) {
+			configure(cmd)
+			loadMasterKey(false)
+			keysVerify(connect())
+		},
+	}
+
+	addDBFlags(verifyCmd, true)
+
+	for _, cmd := range []*cobra.Command{generateCmd, rotateCmd, verifyCmd} {
+		cmd.Flags().String("master-key-path", "", "path of the master key file. Defaults to ~/.deviceio/hub/master.key")
+		keysCmd.AddCommand(cmd)
+	}
+
+	return keysCmd
+}
+
+// loadMasterKey loads the master keyring used to seal credentials. When create is
+// set a missing key file is generated.
+func loadMasterKey(create bool) {
+	path := viper.GetString("master_key.path")
+
+	if _, err := os.Stat(path); create && os.IsNotExist(err) && os.Getenv(secret.EnvVar) == "" {
+		id, err := secret.AppendKey(path)
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to create master key"))
+		}
+
+		logger.WithFields(logrus.Fields{
+			"path":  path,
+			"keyId": id,
+		}).Info("master key generated. Copy it to every hub of the cluster and back it up, credentials cannot be recovered without it")
+	}
+
+	keyring, err := secret.LoadKeyring(path)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	secret.SetKeyring(keyring)
+}
+
+func keysVerify(stores *backend) {
+	keyring := secret.Default()
+
+	users, err := stores.Cluster.Users.List()
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to list users"))
+	}
+
+	counts := map[string]int{}
+	failures := 0
+
+	for _, user := range users {
+		if user.TOTPSecret == nil {
+			continue
+		}
+
+		counts[user.TOTPSecret.KeyID]++
+
+		if _, err := keyring.Open(user.TOTPSecret); err != nil {
+			failures++
+			fmt.Printf("PROBLEM user %v (%v): %v\n", user.ID, user.Login, err.Error())
+		}
+	}
+
+	hmacKeys, err := stores.HMAC.List("")
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to list hmac keys"))
+	}
+
+	for _, hmacKey := range hmacKeys {
+		if hmacKey.HmacSecret == nil {
+			continue
+		}
+
+		counts[hmacKey.HmacSecret.KeyID]++
+
+		if _, err := keyring.Open(hmacKey.HmacSecret); err != nil {
+			failures++
+			fmt.Printf("PROBLEM hmac key %v (%v): %v\n", hmacKey.HmacKey, hmacKey.Username, err.Error())
+		}
+	}
+
+	subs, err := stores.Webhook.Subscriptions()
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to list webhook subscriptions"))
+	}
+
+	for _, sub := range subs {
+		if sub.SealedSecret == nil {
+			continue
+		}
+
+		counts[sub.SealedSecret.KeyID]++
+
+		if _, err := keyring.Open(sub.SealedSecret); err != nil {
+			failures++
+			fmt.Printf("PROBLEM webhook subscription %v (%v): %v\n", sub.ID, sub.URL, err.Error())
+		}
+	}
+
+	ids := []string{}
+
+	for id := range counts {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		state := "not loaded"
+
+		for _, loaded := range keyring.KeyIDs() {
+			if id == loaded {
+				state = "retired"
+			}
+		}
+
+		if id == keyring.Active() {
+			state = "active"
+		}
+
+		fmt.Printf("key %v (%v): %v credentials\n", id, state, counts[id])
+	}
+
+	if failures > 0 {
+		fmt.Printf("credential verification FAILED for %v of %v users, hmac keys and webhook subscriptions\n", failures, len(users)+len(hmacKeys)+len(subs))
+		os.Exit(1)
+	}
+
+	fmt.Println("credentials OK")
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"text/tabwriter"
+	"time"
+
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+)
+
+func newLockoutCmd() *cobra.Command {
+	lockoutCmd := &cobra.Command{
+		Use:   "lockout",
+		Short: "authentication lockout administration",
+		Long: `lists and clears the users and source addresses throttled or locked out after
+repeated failed api authentication attempts`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "lists users and source addresses with recent authentication failures",
+		Run: func(cmd *cobra.Command, args []string) {
+			admin, _ := openAdmin(cmd)
+
+			lockouts, err := admin.Lockouts()
+
+			if err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "failed to list lockouts"))
+			}
+
+			printOutput(cmd, lockouts, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tFAILURES\tFIRST FAILURE\tLAST FAILURE\tLOCKED UNTIL")
+
+				now := time.Now()
+
+				for _, lockout := range lockouts {
+					lockedUntil := ""
+
+					if lockout.Locked(now) {
+						lockedUntil = formatTime(lockout.LockedUntil)
+					}
+
+					fmt.Fprintf(
+						w,
+						"%v\t%v\t%v\t%v\t%v\n",
+						lockout.ID,
+						lockout.Failures,
+						formatTime(lockout.FirstFailure),
+						formatTime(lockout.LastFailure),
+						lockedUntil,
+					)
+				}
+			})
+		},
+	}
+
+	clearCmd := &cobra.Command{
+		Use:   "clear <id>",
+		Short: "forgets the failures of a user or source address, ending its lockout",
+		Long: `forgets the failed attempts of a lockout listed by lockout list, such as
+user:<user_id>, hmac_key:<hmac_key>, token:<token_id> or addr:<ip>, so its next
+attempt is accepted at once`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			if err := admin.ClearLockout(nil, args[0]); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("lockout %v cleared\n", args[0])
+		},
+	}
+
+	for _, cmd := range []*cobra.Command{listCmd, clearCmd} {
+		addAdminFlags(cmd)
+		lockoutCmd.AddCommand(cmd)
+	}
+
+	return lockoutCmd
+}
@@ -2,22 +2,31 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math/rand"
 	"net/http"
 	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/deviceio/hub/api"
+	"github.com/deviceio/hub/audit"
 	"github.com/deviceio/hub/cluster"
-	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/event"
 	"github.com/deviceio/hub/gateway"
+	"github.com/deviceio/hub/health"
+	"github.com/deviceio/hub/logging"
+	"github.com/deviceio/hub/oidc"
+	"github.com/deviceio/hub/trace"
+	"github.com/deviceio/hub/user"
+	"github.com/deviceio/hub/webhook"
 	homedir "github.com/mitchellh/go-homedir"
 	"github.com/palantir/stacktrace"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"golang.org/x/crypto/ed25519"
 )
 
+var logger = logging.Component("hub")
+
 var (
 	startCmd *cobra.Command
 	initCmd  *cobra.Command
@@ -36,10 +45,7 @@ func main() {
 		},
 	}
 
-	startCmd.Flags().String("db-host", "127.0.0.1", "Rethinkdb host to connect to")
-	startCmd.Flags().String("db-name", "DeviceioHub", "Rethinkdb database name to use")
-	startCmd.Flags().String("db-user", "", "Rethinkdb user to authenticate as")
-	startCmd.Flags().String("db-pass", "", "Rethinkdb password to authenticate with")
+	addDBFlags(startCmd, true)
 	startCmd.Flags().String("api-bind-addr", "", "ip or hostname to bind the api to. Defaults to 0.0.0.0")
 	startCmd.Flags().String("api-bind-port", "4431", "port to bind the api to")
 	startCmd.Flags().String("api-tls-cert-path", "", "path to the api tls certificate to use. If blank an auto-generated cert will be used")
@@ -52,6 +58,22 @@ func main() {
 	startCmd.Flags().String("gateway-bind-port", "8975", "port to bind the gateway to")
 	startCmd.Flags().String("gateway-tls-cert-path", "", "path to the gateway tls certificate to use. If blank an auto-generated cert will be used")
 	startCmd.Flags().String("gateway-tls-key-path", "", "path to the gateway tls key to use. If blank an auto-generated cert will be used")
+	startCmd.Flags().String("metrics-bind-addr", "", "ip:port to serve /metrics on over plain http. If blank metrics are served on the api listener")
+	startCmd.Flags().String("trace-file", "", "path of a file to append request spans to as OTLP/JSON. Spans are not recorded if blank")
+	startCmd.Flags().Int("device-event-limit", 500, "maximum number of events retained per device")
+	startCmd.Flags().Duration("event-retention", 24*time.Hour, "how long cluster events are retained for stream resumption")
+	startCmd.Flags().String("master-key-path", "", "path of the key file encrypting credentials at rest. Defaults to ~/.deviceio/hub/master.key. Ignored if DEVICEIO_HUB_MASTER_KEY is set")
+	startCmd.Flags().String("audit-key-path", "", "path to the ed25519 key signing audit checkpoints. Generated if missing. Defaults to ~/.deviceio/hub/audit.key")
+	startCmd.Flags().String("oidc-issuer", "", "issuer url of the OpenID Connect provider users sign in with. Single sign-on is disabled if blank")
+	startCmd.Flags().String("oidc-client-id", "", "client id of the hub registered with the OpenID Connect provider")
+	startCmd.Flags().String("oidc-client-secret", "", "client secret of the hub registered with the OpenID Connect provider")
+	startCmd.Flags().String("oidc-redirect-url", "", "callback url registered with the OpenID Connect provider, https://<hub>:4431/v1/auth/oidc/callback")
+	startCmd.Flags().Duration("oidc-session-lifetime", 12*time.Hour, "how long the session keys issued at single sign-on are valid")
+	startCmd.Flags().Bool("lockout-disabled", false, "apply no limits to failed api authentication attempts")
+	startCmd.Flags().Int("lockout-user-threshold", 10, "failed api authentication attempts within the lockout window locking out a user, hmac key or service account token. 0 never locks out")
+	startCmd.Flags().Int("lockout-addr-threshold", 50, "failed api authentication attempts within the lockout window locking out a source address. 0 never locks out")
+	startCmd.Flags().Duration("lockout-window", 15*time.Minute, "how long a failed api authentication attempt counts towards the lockout thresholds")
+	startCmd.Flags().Duration("lockout-duration", 15*time.Minute, "how long a user or source address is locked out for")
 
 	initCmd = &cobra.Command{
 		Use:   "init",
@@ -62,31 +84,90 @@ func main() {
 		},
 	}
 
-	initCmd.Flags().String("db-host", "127.0.0.1", "Rethinkdb host to connect to")
-	initCmd.Flags().String("db-name", "DeviceioHub", "Rethinkdb database name to use")
-	initCmd.Flags().String("db-user", "", "Rethinkdb user to authenticate as")
-	initCmd.Flags().String("db-pass", "", "Rethinkdb password to authenticate with")
+	addDBFlags(initCmd, true)
+	initCmd.Flags().String("master-key-path", "", "path of the key file encrypting credentials at rest. Generated if missing. Defaults to ~/.deviceio/hub/master.key. Ignored if DEVICEIO_HUB_MASTER_KEY is set")
+	initCmd.Flags().String("audit-key-path", "", "path to the ed25519 key signing audit checkpoints. Generated if missing. Defaults to ~/.deviceio/hub/audit.key")
 
 	rootCmd = &cobra.Command{}
+	rootCmd.PersistentFlags().String("log-level", "info", "minimum level logged: debug, info, warn, error or fatal")
+	rootCmd.PersistentFlags().String("log-format", "text", "log output format: text or json")
+	rootCmd.PersistentFlags().String("log-file", "", "path of a log file to write to instead of stderr")
+	rootCmd.PersistentFlags().Int("log-max-size", 100, "size in megabytes at which the log file is rotated")
+	rootCmd.PersistentFlags().Int("log-max-backups", 5, "number of rotated log files retained")
 	rootCmd.AddCommand(startCmd)
 	rootCmd.AddCommand(initCmd)
+	rootCmd.AddCommand(newAuditCmd())
+	rootCmd.AddCommand(newMigrateCmd())
+	rootCmd.AddCommand(newKeysCmd())
+	rootCmd.AddCommand(newBackupCmd())
+	rootCmd.AddCommand(newRestoreCmd())
+	rootCmd.AddCommand(newUserCmd())
+	rootCmd.AddCommand(newServiceAccountCmd())
+	rootCmd.AddCommand(newDeviceCmd())
+	rootCmd.AddCommand(newMemberCmd())
+	rootCmd.AddCommand(newLockoutCmd())
+	rootCmd.AddCommand(newRecoverAdminCmd())
+	rootCmd.AddCommand(newCallCmd())
 
 	if err := rootCmd.Execute(); err != nil {
-		log.Fatal(stacktrace.Propagate(err, "Error executing cli"))
+		logger.Fatal(stacktrace.Propagate(err, "Error executing cli"))
 	}
 }
 
 func start(cmd *cobra.Command, init bool) {
+	configure(cmd)
+	loadMasterKey(init)
+	stores := connect()
+
+	auditKey, err := audit.LoadOrCreateKey(viper.GetString("audit.key_path"))
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to load audit signing key"))
+	}
+
+	if init {
+		initAudit := &audit.Log{
+			Store: stores.Audit,
+			Chain: "cli",
+			Key:   auditKey,
+		}
+
+		cluster.NewService(&cluster.Config{
+			Audit: initAudit,
+			Store: stores.Cluster,
+		}).Initialize()
+
+		if err = initAudit.Checkpoint(); err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to checkpoint audit chain"))
+		}
+
+		return
+	}
+
+	serve(stores, auditKey)
+}
+
+// configure binds the command's flags and loads the hub configuration file
+func configure(cmd *cobra.Command) {
 	homedir, err := homedir.Dir()
 
 	if err != nil {
-		log.Fatal(stacktrace.Propagate(err, "failed to locate home directory"))
+		logger.Fatal(stacktrace.Propagate(err, "failed to locate home directory"))
 	}
 
+	viper.BindPFlag("db.driver", cmd.Flags().Lookup("db-driver"))
+	viper.BindPFlag("db.path", cmd.Flags().Lookup("db-path"))
 	viper.BindPFlag("db.host", cmd.Flags().Lookup("db-host"))
 	viper.BindPFlag("db.name", cmd.Flags().Lookup("db-name"))
 	viper.BindPFlag("db.user", cmd.Flags().Lookup("db-user"))
 	viper.BindPFlag("db.pass", cmd.Flags().Lookup("db-pass"))
+	viper.BindPFlag("db.tls", cmd.Flags().Lookup("db-tls"))
+	viper.BindPFlag("db.tls_ca_path", cmd.Flags().Lookup("db-tls-ca-path"))
+	viper.BindPFlag("db.tls_cert_path", cmd.Flags().Lookup("db-tls-cert-path"))
+	viper.BindPFlag("db.tls_key_path", cmd.Flags().Lookup("db-tls-key-path"))
+	viper.BindPFlag("db.discover_hosts", cmd.Flags().Lookup("db-discover-hosts"))
+	viper.BindPFlag("db.pool_size", cmd.Flags().Lookup("db-pool-size"))
+	viper.BindPFlag("db.connect_timeout", cmd.Flags().Lookup("db-connect-timeout"))
 	viper.BindPFlag("api.bind_addr", cmd.Flags().Lookup("api-bind-addr"))
 	viper.BindPFlag("api.bind_port", cmd.Flags().Lookup("api-bind-port"))
 	viper.BindPFlag("api.tls_cert_path", cmd.Flags().Lookup("api-tls-cert-path"))
@@ -99,6 +180,27 @@ func start(cmd *cobra.Command, init bool) {
 	viper.BindPFlag("gateway.bind_port", cmd.Flags().Lookup("gateway-bind-port"))
 	viper.BindPFlag("gateway.tls_cert_path", cmd.Flags().Lookup("gateway-tls-cert-path"))
 	viper.BindPFlag("gateway.tls_key_path", cmd.Flags().Lookup("gateway-tls-key-path"))
+	viper.BindPFlag("metrics.bind_addr", cmd.Flags().Lookup("metrics-bind-addr"))
+	viper.BindPFlag("trace.file", cmd.Flags().Lookup("trace-file"))
+	viper.BindPFlag("device.event_limit", cmd.Flags().Lookup("device-event-limit"))
+	viper.BindPFlag("event.retention", cmd.Flags().Lookup("event-retention"))
+	viper.BindPFlag("audit.key_path", cmd.Flags().Lookup("audit-key-path"))
+	viper.BindPFlag("master_key.path", cmd.Flags().Lookup("master-key-path"))
+	viper.BindPFlag("oidc.issuer", cmd.Flags().Lookup("oidc-issuer"))
+	viper.BindPFlag("oidc.client_id", cmd.Flags().Lookup("oidc-client-id"))
+	viper.BindPFlag("oidc.client_secret", cmd.Flags().Lookup("oidc-client-secret"))
+	viper.BindPFlag("oidc.redirect_url", cmd.Flags().Lookup("oidc-redirect-url"))
+	viper.BindPFlag("oidc.session_lifetime", cmd.Flags().Lookup("oidc-session-lifetime"))
+	viper.BindPFlag("lockout.disabled", cmd.Flags().Lookup("lockout-disabled"))
+	viper.BindPFlag("lockout.user_threshold", cmd.Flags().Lookup("lockout-user-threshold"))
+	viper.BindPFlag("lockout.addr_threshold", cmd.Flags().Lookup("lockout-addr-threshold"))
+	viper.BindPFlag("lockout.window", cmd.Flags().Lookup("lockout-window"))
+	viper.BindPFlag("lockout.duration", cmd.Flags().Lookup("lockout-duration"))
+	viper.BindPFlag("log.level", cmd.Flags().Lookup("log-level"))
+	viper.BindPFlag("log.format", cmd.Flags().Lookup("log-format"))
+	viper.BindPFlag("log.file", cmd.Flags().Lookup("log-file"))
+	viper.BindPFlag("log.max_size", cmd.Flags().Lookup("log-max-size"))
+	viper.BindPFlag("log.max_backups", cmd.Flags().Lookup("log-max-backups"))
 
 	viper.SetEnvPrefix("DEVICEIO_HUB_")
 	viper.SetConfigName("config")
@@ -110,10 +212,19 @@ func start(cmd *cobra.Command, init bool) {
 	viper.AddConfigPath("c:/ProgramData/deviceio/hub/")
 	viper.AddConfigPath(".")
 
+	viper.SetDefault("db.driver", "rethinkdb")
+	viper.SetDefault("db.path", fmt.Sprintf("%v/.deviceio/hub/hub.db", homedir))
 	viper.SetDefault("db.host", "127.0.0.1")
 	viper.SetDefault("db.name", "DeviceioHub")
 	viper.SetDefault("db.user", "")
 	viper.SetDefault("db.pass", "")
+	viper.SetDefault("db.tls", false)
+	viper.SetDefault("db.tls_ca_path", "")
+	viper.SetDefault("db.tls_cert_path", "")
+	viper.SetDefault("db.tls_key_path", "")
+	viper.SetDefault("db.discover_hosts", false)
+	viper.SetDefault("db.pool_size", 10)
+	viper.SetDefault("db.connect_timeout", time.Minute)
 	viper.SetDefault("api.bind_addr", "")
 	viper.SetDefault("api.bind_port", "4431")
 	viper.SetDefault("api.tls_cert_path", "")
@@ -126,24 +237,59 @@ func start(cmd *cobra.Command, init bool) {
 	viper.SetDefault("gateway.bind_port", "8975")
 	viper.SetDefault("gateway.tls_cert_path", "")
 	viper.SetDefault("gateway.tls_key_path", "")
+	viper.SetDefault("metrics.bind_addr", "")
+	viper.SetDefault("trace.file", "")
+	viper.SetDefault("device.event_limit", 500)
+	viper.SetDefault("event.retention", 24*time.Hour)
+	viper.SetDefault("audit.key_path", fmt.Sprintf("%v/.deviceio/hub/audit.key", homedir))
+	viper.SetDefault("master_key.path", fmt.Sprintf("%v/.deviceio/hub/master.key", homedir))
+	viper.SetDefault("oidc.issuer", "")
+	viper.SetDefault("oidc.client_id", "")
+	viper.SetDefault("oidc.client_secret", "")
+	viper.SetDefault("oidc.redirect_url", "")
+	viper.SetDefault("oidc.scopes", []string{"profile", "email"})
+	viper.SetDefault("oidc.login_claim", "preferred_username")
+	viper.SetDefault("oidc.email_claim", "email")
+	viper.SetDefault("oidc.groups_claim", "groups")
+	viper.SetDefault("oidc.allowed_groups", []string{})
+	viper.SetDefault("oidc.admin_groups", []string{})
+	viper.SetDefault("oidc.session_lifetime", 12*time.Hour)
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.format", "text")
+	viper.SetDefault("log.file", "")
+	viper.SetDefault("log.max_size", 100)
+	viper.SetDefault("log.max_backups", 5)
 
 	if err := viper.ReadInConfig(); err != nil {
-		panic(fmt.Errorf("Fatal error config file: %s \n", err))
+		logger.Fatal(stacktrace.Propagate(err, "failed to read configuration file"))
 	}
 
-	logrus.WithField("config", viper.ConfigFileUsed()).Println("configuration loaded")
-
-	db.Connect(&db.Options{
-		DBName: viper.GetString("db.name"),
-		DBHost: viper.GetString("db.host"),
-		DBUser: viper.GetString("db.user"),
-		DBPass: viper.GetString("db.pass"),
+	err = logging.Configure(&logging.Options{
+		Level:      viper.GetString("log.level"),
+		Format:     viper.GetString("log.format"),
+		File:       viper.GetString("log.file"),
+		MaxSize:    viper.GetInt("log.max_size"),
+		MaxBackups: viper.GetInt("log.max_backups"),
 	})
-	db.Migrate()
 
-	if init {
-		cluster.NewService(&cluster.Config{}).Initialize()
-		return
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to configure logging"))
+	}
+
+	logger.WithField("config", viper.ConfigFileUsed()).Info("configuration loaded")
+}
+
+func serve(stores *backend, auditKey ed25519.PrivateKey) {
+	events := event.NewBus()
+
+	if path := viper.GetString("trace.file"); path != "" {
+		exporter, err := trace.NewFileExporter(path, "deviceio-hub")
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to open trace file"))
+		}
+
+		trace.SetExporter(exporter)
 	}
 
 	gatewayService := &gateway.Service{
@@ -154,16 +300,24 @@ func start(cmd *cobra.Command, init bool) {
 		),
 		TLSCertPath: viper.GetString("gateway.tls_cert_path"),
 		TLSKeyPath:  viper.GetString("gateway.tls_key_path"),
+		Events:      events,
 	}
 
-	clusterService := cluster.NewService(&cluster.Config{
+	clusterConfig := &cluster.Config{
 		BindAddr: fmt.Sprintf(
 			"%v:%v",
 			viper.GetString("cluster.bind_addr"),
 			viper.GetString("cluster.bind_port"),
 		),
-		TLSCertPath: viper.GetString("cluster.tls_cert_path"),
-		TLSKeyPath:  viper.GetString("cluster.tls_key_path"),
+		TLSCertPath:      viper.GetString("cluster.tls_cert_path"),
+		TLSKeyPath:       viper.GetString("cluster.tls_key_path"),
+		Events:           events,
+		DeviceEventLimit: viper.GetInt("device.event_limit"),
+		EventRetention:   viper.GetDuration("event.retention"),
+		Store:            stores.Cluster,
+		HMAC: &user.Service{
+			Repository: stores.HMAC,
+		},
 		LocalDeviceProxyFunc: func(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error {
 			if deviceid == "" {
 				return stacktrace.NewError("deviceid is empty")
@@ -185,7 +339,46 @@ func start(cmd *cobra.Command, init bool) {
 
 			return nil
 		},
-	})
+	}
+
+	if !viper.GetBool("lockout.disabled") {
+		clusterConfig.Lockout = cluster.DefaultLockoutPolicy()
+		clusterConfig.Lockout.UserThreshold = viper.GetInt("lockout.user_threshold")
+		clusterConfig.Lockout.AddrThreshold = viper.GetInt("lockout.addr_threshold")
+		clusterConfig.Lockout.Window = viper.GetDuration("lockout.window")
+		clusterConfig.Lockout.Duration = viper.GetDuration("lockout.duration")
+	}
+
+	clusterService := cluster.NewService(clusterConfig)
+
+	gatewayService.Admit = func(id string, hostname string) bool {
+		for _, idOrHostname := range []string{id, hostname} {
+			if device := clusterService.LookupDevice(idOrHostname); device != nil && device.Blocked {
+				return false
+			}
+		}
+
+		return true
+	}
+
+	webhookService := &webhook.Service{
+		Events: events,
+		Store:  stores.Webhook,
+	}
+
+	clusterConfig.Webhooks = webhookService
+
+	auditLog := &audit.Log{
+		Store:  stores.Audit,
+		Member: clusterService.MemberID(),
+		Key:    auditKey,
+	}
+
+	// changes to user keys and hmac keys made through the api are audited
+	clusterConfig.Audit = auditLog
+	clusterConfig.HMAC.Audit = auditLog
+
+	statusController := &api.StatusController{}
 
 	apiService := &api.Service{
 		BindAddr: fmt.Sprintf(
@@ -196,17 +389,88 @@ func start(cmd *cobra.Command, init bool) {
 		TLSCertPath: viper.GetString("api.tls_cert_path"),
 		TLSKeyPath:  viper.GetString("api.tls_key_path"),
 		Controllers: []api.Controller{
-			&api.UserController{},
-			&api.StatusController{},
+			&api.UserController{
+				UserService:    clusterConfig.HMAC,
+				ClusterService: clusterService,
+			},
+			statusController,
+			&api.EventController{
+				ClusterService: clusterService,
+			},
+			&api.WebhookController{
+				ClusterService: clusterService,
+				WebhookService: webhookService,
+			},
 			&api.DeviceController{
 				ClusterService: clusterService,
+				Audit:          auditLog,
+			},
+			&api.AuditController{
+				ClusterService: clusterService,
+				Audit:          auditLog,
+			},
+			&api.ServiceAccountController{
+				ClusterService: clusterService,
+			},
+			&api.LockoutController{
+				ClusterService: clusterService,
 			},
 		},
 	}
 
+	statusController.Reporters = []health.Reporter{
+		stores.Health,
+		apiService,
+		clusterService,
+		gatewayService,
+	}
+
+	if issuer := viper.GetString("oidc.issuer"); issuer != "" {
+		apiService.Controllers = append(apiService.Controllers, &api.OIDCController{
+			ClusterService: clusterService,
+			Provider: oidc.NewProvider(&oidc.Config{
+				Issuer:       issuer,
+				ClientID:     viper.GetString("oidc.client_id"),
+				ClientSecret: viper.GetString("oidc.client_secret"),
+				RedirectURL:  viper.GetString("oidc.redirect_url"),
+				Scopes:       viper.GetStringSlice("oidc.scopes"),
+			}),
+			Mapping: &oidc.Mapping{
+				LoginClaim:    viper.GetString("oidc.login_claim"),
+				EmailClaim:    viper.GetString("oidc.email_claim"),
+				GroupsClaim:   viper.GetString("oidc.groups_claim"),
+				AllowedGroups: viper.GetStringSlice("oidc.allowed_groups"),
+				AdminGroups:   viper.GetStringSlice("oidc.admin_groups"),
+			},
+			SessionLifetime: viper.GetDuration("oidc.session_lifetime"),
+		})
+
+		logger.WithField("issuer", issuer).Info("oidc single sign-on enabled")
+	}
+
+	if metricsAddr := viper.GetString("metrics.bind_addr"); metricsAddr != "" {
+		go serveMetrics(metricsAddr)
+	} else {
+		apiService.Controllers = append(apiService.Controllers, &api.MetricsController{})
+	}
+
 	go apiService.Start()
 	go clusterService.Start()
 	go gatewayService.Start()
+	go webhookService.Start()
+	go auditLog.Start()
 
 	<-make(chan bool)
 }
+
+// serveMetrics serves the metrics endpoint on its own plain http listener
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	logger.WithField("bindAddr", addr).Info("metrics starting")
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "metrics listener failed"))
+	}
+}
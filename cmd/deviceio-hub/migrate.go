@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/deviceio/hub/db"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+func newMigrateCmd() *cobra.Command {
+	migrateCmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "rethinkdb schema migrations",
+		Long: `lists, applies and reverts the versioned rethinkdb schema migrations. start applies
+pending migrations automatically. Migrations run under a cluster wide lock so hubs
+starting together do not race`,
+	}
+
+	statusCmd := &cobra.Command{
+		Use:   "status",
+		Short: "lists migrations and whether they are applied",
+		Run: func(cmd *cobra.Command, args []string) {
+			openMigrations(cmd)
+			migrateStatus()
+		},
+	}
+
+	upCmd := &cobra.Command{
+		Use:   "up",
+		Short: "applies pending migrations",
+		Run: func(cmd *cobra.Command, args []string) {
+			openMigrations(cmd)
+			loadMasterKey(false)
+
+			to, _ := cmd.Flags().GetInt("to")
+
+			if err := db.MigrateUp(to); err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "migration failed"))
+			}
+
+			migrateStatus()
+		},
+	}
+
+	downCmd := &cobra.Command{
+		Use:   "down",
+		Short: "reverts the latest applied migration",
+		Run: func(cmd *cobra.Command, args []string) {
+			openMigrations(cmd)
+			loadMasterKey(false)
+
+			to, _ := cmd.Flags().GetInt("to")
+
+			if !cmd.Flags().Changed("to") {
+				to = previousMigration()
+			}
+
+			if err := db.MigrateDown(to); err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "reverting migrations failed"))
+			}
+
+			migrateStatus()
+		},
+	}
+
+	upCmd.Flags().Int("to", 0, "version to migrate up to. Defaults to the latest")
+	downCmd.Flags().Int("to", 0, "version to revert down to; later migrations are reverted. Defaults to reverting only the latest applied migration")
+
+	for _, cmd := range []*cobra.Command{upCmd, downCmd} {
+		cmd.Flags().String("master-key-path", "", "path of the key file encrypting credentials at rest. Defaults to ~/.deviceio/hub/master.key. Ignored if DEVICEIO_HUB_MASTER_KEY is set")
+	}
+
+	for _, cmd := range []*cobra.Command{statusCmd, upCmd, downCmd} {
+		addDBFlags(cmd, false)
+
+		migrateCmd.AddCommand(cmd)
+	}
+
+	return migrateCmd
+}
+
+// openMigrations connects to rethinkdb without applying migrations
+func openMigrations(cmd *cobra.Command) {
+	configure(cmd)
+
+	if driver := viper.GetString("db.driver"); driver != "rethinkdb" {
+		logger.Fatal(stacktrace.NewError("migrations apply to the rethinkdb driver only, the configured driver is '%v'", driver))
+	}
+
+	connectRethink()
+}
+
+func migrateStatus() {
+	states, err := db.MigrationStatus()
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to read migration status"))
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "VERSION\tSTATUS\tAPPLIED AT\tDESCRIPTION")
+
+	for _, state := range states {
+		status := "pending"
+		appliedAt := ""
+
+		if state.Applied {
+			status = "applied"
+			appliedAt = state.AppliedAt.Format("2006-01-02 15:04:05Z07:00")
+		}
+
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\n", state.Version, status, appliedAt, state.Description)
+	}
+
+	w.Flush()
+}
+
+// previousMigration returns the version of the applied migration preceding the
+// latest applied one, or 0
+func previousMigration() int {
+	states, err := db.MigrationStatus()
+
+	if err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "failed to read migration status"))
+	}
+
+	applied := []int{0}
+
+	for _, state := range states {
+		if state.Applied {
+			applied = append(applied, state.Version)
+		}
+	}
+
+	if len(applied) < 2 {
+		return 0
+	}
+
+	return applied[len(applied)-2]
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	osuser "os/user"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+)
+
+func newRecoverAdminCmd() *cobra.Command {
+	recoverCmd := &cobra.Command{
+		Use:   "recover-admin",
+		Short: "break-glass reset of lost admin credentials",
+		Long: `issues a new password, totp secret and ed25519 key to an admin whose credentials
+were lost, deletes its hmac keys, enables it if disabled and ends its open event
+streams and proxied requests. Requires direct access to the hub database and --confirm. The recovery is
+written to the audit log and published as a user.recovered event`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if confirm, _ := cmd.Flags().GetBool("confirm"); !confirm {
+				fmt.Fprintln(os.Stderr, "recover-admin replaces the admin's credentials and ends its sessions. Re-run with --confirm to proceed")
+				os.Exit(1)
+			}
+
+			admin, auditLog := openAdmin(cmd)
+			login, _ := cmd.Flags().GetString("login")
+			operator := recoveryOperator()
+
+			logger.WithFields(logrus.Fields{
+				"login":    login,
+				"operator": operator,
+			}).Warn("BREAK-GLASS: recovering admin credentials")
+
+			user, creds, err := admin.RecoverAdmin(login, operator)
+
+			if err != nil {
+				logger.Fatal(stacktrace.Propagate(err, "admin recovery failed"))
+			}
+
+			checkpoint(auditLog)
+			printCredentials(cmd, user, creds)
+		},
+	}
+
+	addAdminFlags(recoverCmd)
+	recoverCmd.Flags().String("login", "admin", "id, login or email of the admin to recover")
+	recoverCmd.Flags().Bool("confirm", false, "confirm replacing the admin's credentials")
+
+	return recoverCmd
+}
+
+// recoveryOperator identifies the local account running the recovery
+func recoveryOperator() string {
+	name := "unknown"
+
+	if u, err := osuser.Current(); err == nil {
+		name = u.Username
+	}
+
+	hostname, _ := os.Hostname()
+
+	return name + "@" + hostname
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/spf13/cobra"
+)
+
+// serviceAccountView is a service account as printed by the cli
+type serviceAccountView struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description,omitempty"`
+	Created     time.Time    `json:"created"`
+	Disabled    bool         `json:"disabled"`
+	Tokens      []*tokenView `json:"tokens"`
+}
+
+func newServiceAccountView(account *cluster.ServiceAccount) *serviceAccountView {
+	view := &serviceAccountView{
+		ID:          account.ID,
+		Name:        account.Name,
+		Description: account.Description,
+		Created:     account.Created,
+		Disabled:    account.Disabled,
+		Tokens:      []*tokenView{},
+	}
+
+	for _, token := range account.Tokens {
+		view.Tokens = append(view.Tokens, newTokenView(token))
+	}
+
+	return view
+}
+
+// tokenView is a service account token as printed by the cli. Its hash is never
+// shown.
+type tokenView struct {
+	ID       string     `json:"id"`
+	Label    string     `json:"label"`
+	Devices  []string   `json:"devices"`
+	Paths    []string   `json:"paths,omitempty"`
+	Methods  []string   `json:"methods,omitempty"`
+	Created  time.Time  `json:"created"`
+	Expires  time.Time  `json:"expires"`
+	LastUsed *time.Time `json:"lastUsed,omitempty"`
+	Revoked  bool       `json:"revoked"`
+}
+
+func newTokenView(token *cluster.Token) *tokenView {
+	view := &tokenView{
+		ID:      token.ID,
+		Label:   token.Label,
+		Created: token.Created,
+		Expires: token.Expires,
+		Revoked: token.Revoked,
+	}
+
+	if token.Scope != nil {
+		view.Devices = token.Scope.Devices
+		view.Paths = token.Scope.Paths
+		view.Methods = token.Scope.Methods
+	}
+
+	if !token.LastUsed.IsZero() {
+		view.LastUsed = &token.LastUsed
+	}
+
+	return view
+}
+
+func newServiceAccountCmd() *cobra.Command {
+	accountCmd := &cobra.Command{
+		Use:   "service-account",
+		Short: "service account administration",
+		Long: `adds and manages service accounts directly in the configured database. Service
+accounts are non-interactive principals, such as ci pipelines, that reach devices
+with scoped bearer tokens`,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <name>",
+		Short: "adds a service account",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			description, _ := cmd.Flags().GetString("description")
+
+			account, err := admin.AddServiceAccount(nil, args[0], description)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			printServiceAccount(cmd, newServiceAccountView(account))
+		},
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list",
+		Short: "lists service accounts",
+		Run: func(cmd *cobra.Command, args []string) {
+			admin, _ := openAdmin(cmd)
+
+			accounts, err := admin.ServiceAccounts()
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			views := []*serviceAccountView{}
+
+			for _, account := range accounts {
+				views = append(views, newServiceAccountView(account))
+			}
+
+			printOutput(cmd, views, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tNAME\tDISABLED\tTOKENS\tDESCRIPTION")
+
+				for _, account := range views {
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", account.ID, account.Name, account.Disabled, len(account.Tokens), account.Description)
+				}
+			})
+		},
+	}
+
+	showCmd := &cobra.Command{
+		Use:   "show <id|name>",
+		Short: "shows a service account and its tokens",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, _ := openAdmin(cmd)
+
+			account, err := admin.ServiceAccount(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printServiceAccount(cmd, newServiceAccountView(account))
+		},
+	}
+
+	disableCmd := &cobra.Command{
+		Use:   "disable <id|name>",
+		Short: "disables a service account so its tokens fail authentication",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			enable, _ := cmd.Flags().GetBool("enable")
+
+			if err := admin.SetServiceAccountDisabled(nil, args[0], !enable); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			account, err := admin.ServiceAccount(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printServiceAccount(cmd, newServiceAccountView(account))
+		},
+	}
+
+	deleteCmd := &cobra.Command{
+		Use:   "delete <id|name>",
+		Short: "deletes a service account and its tokens",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			if err := admin.DeleteServiceAccount(nil, args[0]); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("service account %v deleted\n", args[0])
+		},
+	}
+
+	addCmd.Flags().String("description", "", "what the service account is used for")
+	disableCmd.Flags().Bool("enable", false, "enable a disabled service account instead")
+
+	for _, cmd := range []*cobra.Command{addCmd, listCmd, showCmd, disableCmd, deleteCmd} {
+		addAdminFlags(cmd)
+		accountCmd.AddCommand(cmd)
+	}
+
+	accountCmd.AddCommand(newServiceAccountTokenCmd())
+
+	return accountCmd
+}
+
+func newServiceAccountTokenCmd() *cobra.Command {
+	tokenCmd := &cobra.Command{
+		Use:   "token",
+		Short: "service account token administration",
+		Long: `issues and revokes the bearer tokens of a service account. Each token is limited
+to the devices, agent paths and methods of its scope and expires`,
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <id|name>",
+		Short: "issues a token to a service account and prints it",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			label, _ := cmd.Flags().GetString("label")
+			devices, _ := cmd.Flags().GetStringArray("device")
+			paths, _ := cmd.Flags().GetStringArray("path")
+			methods, _ := cmd.Flags().GetStringArray("method")
+			ttl, _ := cmd.Flags().GetDuration("expires-in")
+
+			for i, method := range methods {
+				methods[i] = strings.ToUpper(method)
+			}
+
+			token, value, err := admin.AddServiceAccountToken(nil, args[0], label, &cluster.TokenScope{
+				Devices: devices,
+				Paths:   paths,
+				Methods: methods,
+			}, ttl)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			account, err := admin.ServiceAccount(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			printOutput(cmd, map[string]interface{}{
+				"serviceAccount": newServiceAccountView(account),
+				"issued":         newTokenView(token),
+				"token":          value,
+			}, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "please save this token securely, it cannot be retrieved later")
+				fmt.Fprintf(w, "Service Account\t%v\n", account.Name)
+				fmt.Fprintf(w, "Token ID\t%v\n", token.ID)
+				fmt.Fprintf(w, "Label\t%v\n", token.Label)
+				fmt.Fprintf(w, "Expires\t%v\n", formatTime(token.Expires))
+				fmt.Fprintf(w, "Token\t%v\n", value)
+			})
+		},
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <id|name> <token id>",
+		Short: "revokes a service account token",
+		Long: `revokes the token. Hubs refuse requests bearing it, and end the proxied requests
+it opened, once they observe the change`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 2)
+			admin, auditLog := openAdmin(cmd)
+
+			if err := admin.RevokeServiceAccountToken(nil, args[0], args[1]); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("token %v revoked\n", args[1])
+		},
+	}
+
+	addCmd.Flags().String("label", "", "label describing where the token is used, such as a pipeline")
+	addCmd.Flags().StringArray("device", nil, "device selector: *, tag:<tag>, or a glob matched against device ids and hostnames. May be repeated")
+	addCmd.Flags().StringArray("path", nil, "agent path prefix the token may request, such as /filesystem. May be repeated. Every path if omitted")
+	addCmd.Flags().StringArray("method", nil, "http method the token may use. May be repeated. Every method if omitted")
+	addCmd.Flags().Duration("expires-in", 30*24*time.Hour, "lifetime of the token")
+
+	for _, cmd := range []*cobra.Command{addCmd, revokeCmd} {
+		addAdminFlags(cmd)
+		tokenCmd.AddCommand(cmd)
+	}
+
+	return tokenCmd
+}
+
+func printServiceAccount(cmd *cobra.Command, account *serviceAccountView) {
+	printOutput(cmd, account, func(w *tabwriter.Writer) {
+		fmt.Fprintf(w, "ID\t%v\n", account.ID)
+		fmt.Fprintf(w, "Name\t%v\n", account.Name)
+		fmt.Fprintf(w, "Description\t%v\n", account.Description)
+		fmt.Fprintf(w, "Created\t%v\n", formatTime(account.Created))
+		fmt.Fprintf(w, "Disabled\t%v\n", account.Disabled)
+
+		if len(account.Tokens) == 0 {
+			return
+		}
+
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "TOKEN\tLABEL\tDEVICES\tPATHS\tMETHODS\tEXPIRES\tLAST USED\tREVOKED")
+
+		for _, token := range account.Tokens {
+			lastUsed := ""
+
+			if token.LastUsed != nil {
+				lastUsed = formatTime(*token.LastUsed)
+			}
+
+			fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\t%v\t%v\n", token.ID, token.Label, strings.Join(token.Devices, ","), strings.Join(token.Paths, ","), strings.Join(token.Methods, ","), formatTime(token.Expires), lastUsed, token.Revoked)
+		}
+	})
+}
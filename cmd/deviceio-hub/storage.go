@@ -0,0 +1,134 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/backup"
+	"github.com/deviceio/hub/cluster"
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/embedded"
+	"github.com/deviceio/hub/health"
+	"github.com/deviceio/hub/user"
+	"github.com/deviceio/hub/webhook"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// backend holds the stores of the configured storage driver
+type backend struct {
+	Cluster *cluster.Store
+	Webhook webhook.Store
+	Audit   audit.Store
+	HMAC    user.Repository
+	Health  health.Reporter
+}
+
+// connect opens the configured storage backend. For rethinkdb the database
+// session is established and any required migrations applied.
+func connect() *backend {
+	switch driver := viper.GetString("db.driver"); driver {
+	case "rethinkdb":
+		connectRethink()
+		db.Migrate()
+
+		return &backend{
+			Cluster: cluster.NewRethinkStore(),
+			Webhook: &webhook.RethinkStore{},
+			Audit:   &audit.RethinkStore{},
+			HMAC:    &user.RethinkRepository{},
+			Health:  health.ReporterFunc(db.Health),
+		}
+
+	case "embedded":
+		edb, err := embedded.Open(viper.GetString("db.path"))
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to open embedded database"))
+		}
+
+		logger.WithField("path", edb.Path()).Info("embedded database opened")
+
+		return &backend{
+			Cluster: cluster.NewEmbeddedStore(edb),
+			Webhook: &webhook.EmbeddedStore{DB: edb},
+			Audit:   &audit.EmbeddedStore{DB: edb},
+			HMAC:    &user.EmbeddedRepository{DB: edb},
+			Health:  edb,
+		}
+
+	default:
+		logger.Fatal(stacktrace.NewError("unknown db driver '%v', expected rethinkdb or embedded", driver))
+	}
+
+	return nil
+}
+
+// connectRethink establishes the rethinkdb session without applying migrations
+func connectRethink() {
+	err := db.Connect(&db.Options{
+		DBName:         viper.GetString("db.name"),
+		DBHosts:        strings.Split(viper.GetString("db.host"), ","),
+		DBUser:         viper.GetString("db.user"),
+		DBPass:         viper.GetString("db.pass"),
+		TLS:            viper.GetBool("db.tls"),
+		TLSCAPath:      viper.GetString("db.tls_ca_path"),
+		TLSCertPath:    viper.GetString("db.tls_cert_path"),
+		TLSKeyPath:     viper.GetString("db.tls_key_path"),
+		DiscoverHosts:  viper.GetBool("db.discover_hosts"),
+		PoolSize:       viper.GetInt("db.pool_size"),
+		ConnectTimeout: viper.GetDuration("db.connect_timeout"),
+	})
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+}
+
+// addDBFlags adds the database connection flags to the command. drivers adds
+// the storage backend selection flags.
+func addDBFlags(cmd *cobra.Command, drivers bool) {
+	if drivers {
+		cmd.Flags().String("db-driver", "rethinkdb", "storage backend to use: rethinkdb, or embedded for a single node hub")
+		cmd.Flags().String("db-path", "", "path of the embedded database file. Defaults to ~/.deviceio/hub/hub.db")
+	}
+
+	cmd.Flags().String("db-host", "127.0.0.1", "Rethinkdb host to connect to. Separate several cluster seed hosts with commas, e.g. db1:28015,db2:28015")
+	cmd.Flags().String("db-name", "DeviceioHub", "Rethinkdb database name to use")
+	cmd.Flags().String("db-user", "", "Rethinkdb user to authenticate as")
+	cmd.Flags().String("db-pass", "", "Rethinkdb password to authenticate with")
+	cmd.Flags().Bool("db-tls", false, "connect to rethinkdb over tls. Implied by --db-tls-ca-path")
+	cmd.Flags().String("db-tls-ca-path", "", "path of a PEM bundle of CAs trusted to sign the rethinkdb certificate. The system roots are used if blank")
+	cmd.Flags().String("db-tls-cert-path", "", "path of a client certificate presented to rethinkdb")
+	cmd.Flags().String("db-tls-key-path", "", "path of the key of the client certificate presented to rethinkdb")
+	cmd.Flags().Bool("db-discover-hosts", false, "discover and use every server of the rethinkdb cluster, not only the seed hosts")
+	cmd.Flags().Int("db-pool-size", 10, "maximum number of connections held open to each rethinkdb host")
+	cmd.Flags().Duration("db-connect-timeout", time.Minute, "how long to retry an unreachable rethinkdb before giving up")
+}
+
+// openTables opens the configured storage backend for reading and writing its
+// raw documents. No migrations are applied.
+func openTables() backup.Tables {
+	switch driver := viper.GetString("db.driver"); driver {
+	case "rethinkdb":
+		connectRethink()
+
+		return &backup.RethinkTables{}
+
+	case "embedded":
+		edb, err := embedded.Open(viper.GetString("db.path"))
+
+		if err != nil {
+			logger.Fatal(stacktrace.Propagate(err, "failed to open embedded database"))
+		}
+
+		return &backup.EmbeddedTables{DB: edb}
+
+	default:
+		logger.Fatal(stacktrace.NewError("unknown db driver '%v', expected rethinkdb or embedded", driver))
+	}
+
+	return nil
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"text/tabwriter"
+	"time"
+
+	"github.com/deviceio/hub/cluster"
+	"github.com/palantir/stacktrace"
+	"github.com/spf13/cobra"
+)
+
+// keyView is a named key as printed by the cli. Its totp secret is never shown.
+type keyView struct {
+	ID        string     `json:"id"`
+	Label     string     `json:"label"`
+	PublicKey string     `json:"publicKey"`
+	Created   time.Time  `json:"created"`
+	Expires   *time.Time `json:"expires,omitempty"`
+	LastUsed  *time.Time `json:"lastUsed,omitempty"`
+	Revoked   bool       `json:"revoked"`
+
+	// SSHPublicKey and Fingerprint are set for ssh keys
+	SSHPublicKey string `json:"sshPublicKey,omitempty"`
+	Fingerprint  string `json:"fingerprint,omitempty"`
+}
+
+func newKeyView(key *cluster.Key) *keyView {
+	view := &keyView{
+		ID:        key.ID,
+		Label:     key.Label,
+		PublicKey: base64.StdEncoding.EncodeToString(key.PublicKey),
+		Created:   key.Created,
+		Revoked:   key.Revoked,
+	}
+
+	view.SSHPublicKey, view.Fingerprint = key.SSHAuthorizedKey()
+
+	if !key.Expires.IsZero() {
+		view.Expires = &key.Expires
+	}
+
+	if !key.LastUsed.IsZero() {
+		view.LastUsed = &key.LastUsed
+	}
+
+	return view
+}
+
+func newUserKeyCmd() *cobra.Command {
+	keyCmd := &cobra.Command{
+		Use:   "key",
+		Short: "named key administration",
+		Long: `adds, rotates and revokes the named keys of a user. Each key has its own totp
+secret and ed25519 key and signs requests alongside the user's other keys.
+OpenSSH public keys registered with add-ssh are listed and revoked alongside
+them`,
+	}
+
+	listCmd := &cobra.Command{
+		Use:   "list <id|login|email>",
+		Short: "lists the named keys of a user",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, _ := openAdmin(cmd)
+
+			keys, err := admin.UserKeys(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			views := []*keyView{}
+
+			for _, key := range keys {
+				views = append(views, newKeyView(key))
+			}
+
+			printOutput(cmd, views, func(w *tabwriter.Writer) {
+				fmt.Fprintln(w, "ID\tLABEL\tCREATED\tEXPIRES\tLAST USED\tREVOKED")
+
+				for _, key := range keys {
+					fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\t%v\n", key.ID, key.Label, formatTime(key.Created), formatTime(key.Expires), formatTime(key.LastUsed), key.Revoked)
+				}
+			})
+		},
+	}
+
+	addCmd := &cobra.Command{
+		Use:   "add <id|login|email>",
+		Short: "issues a named key to a user and prints its credentials",
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+			admin, auditLog := openAdmin(cmd)
+
+			label, _ := cmd.Flags().GetString("label")
+			ttl, _ := cmd.Flags().GetDuration("expires-in")
+
+			key, creds, err := admin.AddUserKey(nil, args[0], label, ttl)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			printKeyCredentials(cmd, admin, key, creds)
+		},
+	}
+
+	addSSHCmd := &cobra.Command{
+		Use:   "add-ssh <id|login|email>",
+		Short: "registers an OpenSSH public key of a user",
+		Long: `registers an ed25519 or ecdsa public key, in authorized_keys format, as a named
+key of the user. Requests are then signed through ssh-agent with the
+DEVICEIO-HUB-SSH scheme, so the private key never leaves the agent or hardware
+token holding it. The json output, with the hub url added, may be saved as a
+call profile`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 1)
+
+			label, _ := cmd.Flags().GetString("label")
+			ttl, _ := cmd.Flags().GetDuration("expires-in")
+			publicKey, _ := cmd.Flags().GetString("public-key")
+
+			if path, _ := cmd.Flags().GetString("public-key-file"); path != "" {
+				data, err := ioutil.ReadFile(path)
+
+				if err != nil {
+					logger.Fatal(stacktrace.Propagate(err, "failed to read public key file %v", path))
+				}
+
+				publicKey = string(data)
+			}
+
+			if publicKey == "" {
+				logger.Fatal(stacktrace.NewError("--public-key or --public-key-file is required"))
+			}
+
+			admin, auditLog := openAdmin(cmd)
+
+			key, err := admin.AddUserSSHKey(nil, args[0], label, publicKey, ttl)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+
+			user, err := admin.User(args[0])
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			view := newKeyView(key)
+
+			printOutput(cmd, map[string]interface{}{
+				"user": newUserView(user),
+				"key":  view,
+			}, func(w *tabwriter.Writer) {
+				fmt.Fprintf(w, "User ID\t%v\n", user.ID)
+				fmt.Fprintf(w, "Login\t%v\n", user.Login)
+				fmt.Fprintf(w, "Key ID\t%v\n", key.ID)
+				fmt.Fprintf(w, "Label\t%v\n", key.Label)
+				fmt.Fprintf(w, "Expires\t%v\n", formatTime(key.Expires))
+				fmt.Fprintf(w, "Fingerprint\t%v\n", view.Fingerprint)
+			})
+		},
+	}
+
+	rotateCmd := &cobra.Command{
+		Use:   "rotate <id|login|email> <key id>",
+		Short: "replaces a named key and prints the new key's credentials",
+		Long: `issues a new key with the label and lifetime of the old one. The old key keeps
+working for --grace so scripts can be moved to the new key, or is revoked at once
+if --grace is zero`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 2)
+			admin, auditLog := openAdmin(cmd)
+
+			grace, _ := cmd.Flags().GetDuration("grace")
+
+			key, creds, err := admin.RotateUserKey(nil, args[0], args[1], grace)
+
+			if err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			printKeyCredentials(cmd, admin, key, creds)
+		},
+	}
+
+	revokeCmd := &cobra.Command{
+		Use:   "revoke <id|login|email> <key id>",
+		Short: "revokes a named key",
+		Long: `revokes the key. Hubs refuse requests signed with it, and end the event streams
+and proxied requests it opened, once they observe the change`,
+		Run: func(cmd *cobra.Command, args []string) {
+			requireArgs(cmd, args, 2)
+			admin, auditLog := openAdmin(cmd)
+
+			if err := admin.RevokeUserKey(nil, args[0], args[1]); err != nil {
+				logger.Fatal(err)
+			}
+
+			checkpoint(auditLog)
+			fmt.Printf("key %v revoked\n", args[1])
+		},
+	}
+
+	addCmd.Flags().String("label", "", "label describing where the key is used, such as a host or script")
+	addCmd.Flags().Duration("expires-in", 0, "lifetime of the key. The key does not expire if zero")
+	addSSHCmd.Flags().String("label", "", "label describing where the key is used, such as a host or token")
+	addSSHCmd.Flags().String("public-key", "", "public key in authorized_keys format")
+	addSSHCmd.Flags().String("public-key-file", "", "path of the public key file, such as ~/.ssh/id_ed25519.pub")
+	addSSHCmd.Flags().Duration("expires-in", 0, "lifetime of the key. The key does not expire if zero")
+	rotateCmd.Flags().Duration("grace", time.Hour, "how long the old key keeps working")
+
+	for _, cmd := range []*cobra.Command{listCmd, addCmd, addSSHCmd, rotateCmd, revokeCmd} {
+		addAdminFlags(cmd)
+		keyCmd.AddCommand(cmd)
+	}
+
+	return keyCmd
+}
+
+// printKeyCredentials prints a newly issued key. The json output may be saved
+// as a call profile.
+func printKeyCredentials(cmd *cobra.Command, admin cluster.Admin, key *cluster.Key, creds *cluster.KeyCredentials) {
+	user, err := admin.User(creds.UserID)
+
+	if err != nil {
+		logger.Fatal(err)
+	}
+
+	printOutput(cmd, map[string]interface{}{
+		"user":        newUserView(user),
+		"key":         newKeyView(key),
+		"credentials": creds,
+	}, func(w *tabwriter.Writer) {
+		fmt.Fprintln(w, "please save these credentials securely, they cannot be retrieved later")
+		fmt.Fprintf(w, "User ID\t%v\n", user.ID)
+		fmt.Fprintf(w, "Login\t%v\n", user.Login)
+		fmt.Fprintf(w, "Key ID\t%v\n", key.ID)
+		fmt.Fprintf(w, "Label\t%v\n", key.Label)
+		fmt.Fprintf(w, "Expires\t%v\n", formatTime(key.Expires))
+		fmt.Fprintf(w, "TOTP Secret\t%v\n", creds.TOTPSecret)
+		fmt.Fprintf(w, "Private Key\t%v\n", creds.PrivateKey)
+	})
+}
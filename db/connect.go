@@ -1,25 +1,162 @@
 package db
 
 import (
-	"log"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
+	"github.com/cenk/backoff"
+	"github.com/palantir/stacktrace"
 	r "gopkg.in/gorethink/gorethink.v2"
 )
 
-// Connect establishes our connection to rethinkdb
-func Connect(opts *Options) {
-	s, err := r.Connect(r.ConnectOpts{
-		Address:  opts.DBHost,
-		Database: opts.DBName,
-		Timeout:  1 * time.Minute,
+const (
+	// defaultPoolSize is used when the options do not specify a pool size
+	defaultPoolSize = 10
+
+	// defaultConnectTimeout is used when the options do not specify a timeout
+	defaultConnectTimeout = 1 * time.Minute
+
+	// queryRetries is how many times a query is retried on a broken connection
+	// before failing. Each retry reconnects.
+	queryRetries = 3
+)
+
+// ConnectError is returned when the rethinkdb cluster cannot be reached
+type ConnectError struct {
+	Hosts []string
+	Err   error
+}
+
+func (t *ConnectError) Error() string {
+	return "failed to connect to rethinkdb at " + strings.Join(t.Hosts, ", ") + ": " + t.Err.Error()
+}
+
+// Connect establishes our connection to rethinkdb, retrying with backoff until
+// the connect timeout expires. Configuration errors fail immediately.
+func Connect(opts *Options) error {
+	connectOpts, err := connectOpts(opts)
+
+	if err != nil {
+		return err
+	}
+
+	timeout := opts.ConnectTimeout
+
+	if timeout <= 0 {
+		timeout = defaultConnectTimeout
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = timeout
+
+	var s *r.Session
+
+	err = backoff.RetryNotify(func() error {
+		var err error
+		s, err = r.Connect(connectOpts)
+		return err
+	}, b, func(err error, wait time.Duration) {
+		logger.WithFields(logrus.Fields{
+			"hosts": connectOpts.Addresses,
+			"retry": wait.String(),
+			"error": err.Error(),
+		}).Warn("rethinkdb connection failed")
 	})
 
 	if err != nil {
-		log.Fatalln(err)
+		return &ConnectError{
+			Hosts: connectOpts.Addresses,
+			Err:   err,
+		}
 	}
 
 	Session = s
-
 	Database = opts.DBName
+
+	logger.WithFields(logrus.Fields{
+		"hosts":    connectOpts.Addresses,
+		"database": opts.DBName,
+		"tls":      connectOpts.TLSConfig != nil,
+	}).Info("connected to rethinkdb")
+
+	return nil
+}
+
+// connectOpts translates the options to gorethink connection options
+func connectOpts(opts *Options) (r.ConnectOpts, error) {
+	hosts := []string{}
+
+	for _, host := range opts.DBHosts {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+
+	if len(hosts) == 0 {
+		return r.ConnectOpts{}, stacktrace.NewError("no rethinkdb hosts configured")
+	}
+
+	poolSize := opts.PoolSize
+
+	if poolSize <= 0 {
+		poolSize = defaultPoolSize
+	}
+
+	connectOpts := r.ConnectOpts{
+		Addresses:     hosts,
+		Database:      opts.DBName,
+		Username:      opts.DBUser,
+		Password:      opts.DBPass,
+		Timeout:       10 * time.Second,
+		InitialCap:    1,
+		MaxOpen:       poolSize,
+		NumRetries:    queryRetries,
+		DiscoverHosts: opts.DiscoverHosts,
+	}
+
+	if opts.TLS || opts.TLSCAPath != "" || opts.TLSCertPath != "" {
+		tlsConfig, err := tlsConfig(opts)
+
+		if err != nil {
+			return r.ConnectOpts{}, err
+		}
+
+		connectOpts.TLSConfig = tlsConfig
+	}
+
+	return connectOpts, nil
+}
+
+func tlsConfig(opts *Options) (*tls.Config, error) {
+	config := &tls.Config{}
+
+	if opts.TLSCAPath != "" {
+		pem, err := ioutil.ReadFile(opts.TLSCAPath)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to read rethinkdb ca bundle '%v'", opts.TLSCAPath)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, stacktrace.NewError("rethinkdb ca bundle '%v' contains no certificates", opts.TLSCAPath)
+		}
+	}
+
+	if opts.TLSCertPath != "" || opts.TLSKeyPath != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertPath, opts.TLSKeyPath)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "failed to load rethinkdb client certificate")
+		}
+
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
 }
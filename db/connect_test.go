@@ -0,0 +1,51 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ConnectTestSuite struct {
+	suite.Suite
+}
+
+func (t *ConnectTestSuite) Test_connectOpts_passes_credentials_hosts_and_pool_size() {
+	opts, err := connectOpts(&Options{
+		DBName:  "DeviceioHub",
+		DBHosts: []string{"db1:28015", " db2 ", ""},
+		DBUser:  "hub",
+		DBPass:  "secret",
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"db1:28015", "db2"}, opts.Addresses)
+	assert.Equal(t.T(), "hub", opts.Username)
+	assert.Equal(t.T(), "secret", opts.Password)
+	assert.Equal(t.T(), defaultPoolSize, opts.MaxOpen)
+	assert.Nil(t.T(), opts.TLSConfig)
+}
+
+func (t *ConnectTestSuite) Test_connectOpts_requires_a_host() {
+	_, err := connectOpts(&Options{DBHosts: []string{" "}})
+
+	assert.NotNil(t.T(), err)
+}
+
+func (t *ConnectTestSuite) Test_connectOpts_enables_tls() {
+	opts, err := connectOpts(&Options{DBHosts: []string{"db1"}, TLS: true})
+
+	assert.Nil(t.T(), err)
+	assert.NotNil(t.T(), opts.TLSConfig)
+}
+
+func (t *ConnectTestSuite) Test_connectOpts_fails_on_unreadable_ca_bundle() {
+	_, err := connectOpts(&Options{DBHosts: []string{"db1"}, TLSCAPath: "/nonexistent/ca.pem"})
+
+	assert.NotNil(t.T(), err)
+}
+
+func TestConnectTestSuite(t *testing.T) {
+	suite.Run(t, new(ConnectTestSuite))
+}
@@ -0,0 +1,63 @@
+package db
+
+import (
+	"time"
+
+	"github.com/deviceio/hub/health"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// pingTimeout bounds how long Health waits for rethinkdb to answer
+const pingTimeout = 2 * time.Second
+
+// Health reports whether the session is connected and rethinkdb answers queries
+func Health() *health.Component {
+	c := &health.Component{
+		Name:    "rethinkdb",
+		Details: map[string]interface{}{},
+	}
+
+	start := time.Now()
+
+	if err := Ping(pingTimeout); err != nil {
+		c.Error = err.Error()
+		return c
+	}
+
+	c.Ready = true
+	c.Details["latencyMs"] = float64(time.Since(start)) / float64(time.Millisecond)
+
+	return c
+}
+
+// Ping runs a trivial query against rethinkdb failing if it does not complete
+// within timeout
+func Ping(timeout time.Duration) error {
+	if Session == nil || !Session.IsConnected() {
+		return stacktrace.NewError("rethinkdb session is not connected")
+	}
+
+	result := make(chan error, 1)
+
+	go func() {
+		cursor, err := r.Expr(1).Run(Session)
+
+		if err == nil {
+			cursor.Close()
+		}
+
+		result <- err
+	}()
+
+	select {
+	case err := <-result:
+		if err != nil {
+			return stacktrace.Propagate(err, "rethinkdb ping failed")
+		}
+
+		return nil
+	case <-time.After(timeout):
+		return stacktrace.NewError("rethinkdb did not answer within %v", timeout)
+	}
+}
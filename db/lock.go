@@ -0,0 +1,169 @@
+package db
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+const (
+	// migrationLockID identifies the migration lock in the lock table
+	migrationLockID = "migrate"
+
+	// migrationLockTTL is how long a lock survives without being refreshed. A hub
+	// that dies while migrating releases the lock once it expires.
+	migrationLockTTL = 1 * time.Minute
+
+	// migrationLockWait is how long to wait for another hub to finish migrating
+	migrationLockWait = 10 * time.Minute
+)
+
+// lock is a cluster wide lock held in the lock table. It is refreshed in the
+// background until released, and lost is closed if it can no longer be held.
+type lock struct {
+	id     string
+	holder string
+	stop   chan struct{}
+	done   chan struct{}
+	lost   chan struct{}
+}
+
+// acquireMigrationLock waits up to timeout to take the migration lock
+func acquireMigrationLock(timeout time.Duration) (*lock, error) {
+	hostname, _ := os.Hostname()
+
+	l := &lock{
+		id:     migrationLockID,
+		holder: fmt.Sprintf("%v:%v:%v", hostname, os.Getpid(), uuid.New().String()),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		lost:   make(chan struct{}),
+	}
+
+	deadline := time.Now().Add(timeout)
+	waiting := false
+
+	for {
+		ok, err := l.take()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			go l.refresh()
+			return l, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, stacktrace.NewError("timed out waiting for the %v lock", l.id)
+		}
+
+		if !waiting {
+			logger.WithField("lock", l.id).Info("waiting for another hub to release the lock")
+			waiting = true
+		}
+
+		time.Sleep(time.Second)
+	}
+}
+
+// take atomically claims the lock if it is free, expired or already ours
+func (t *lock) take() (bool, error) {
+	resp, err := Table(LockTable).Get(t.id).Replace(func(row r.Term) interface{} {
+		return r.Branch(
+			row.Eq(nil).Or(row.Field("expires_at").Lt(r.Now())).Or(row.Field("holder").Eq(t.holder)),
+			map[string]interface{}{
+				"id":         t.id,
+				"holder":     t.holder,
+				"expires_at": r.Now().Add(migrationLockTTL.Seconds()),
+			},
+			row,
+		)
+	}).RunWrite(Session)
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to take the %v lock", t.id)
+	}
+
+	return resp.Inserted+resp.Replaced > 0, nil
+}
+
+// refresh extends the lock until it is released. If another hub takes the lock,
+// or it goes unrefreshed long enough to expire, lost is closed and refreshing
+// stops.
+func (t *lock) refresh() {
+	defer close(t.done)
+
+	refreshed := time.Now()
+
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(migrationLockTTL / 3):
+		}
+
+		ok, err := t.take()
+
+		if err == nil && ok {
+			refreshed = time.Now()
+			continue
+		}
+
+		if err != nil {
+			logger.WithFields(logrus.Fields{
+				"lock":  t.id,
+				"error": err.Error(),
+			}).Error("failed to refresh lock")
+		}
+
+		if refreshLost(ok, err, refreshed, time.Now()) {
+			logger.WithField("lock", t.id).Error("lock lost")
+			close(t.lost)
+			return
+		}
+	}
+}
+
+// refreshLost reports if a refresh attempt shows the lock lost: another holder
+// has it, or it was not refreshed for its whole ttl and may have expired
+func refreshLost(ok bool, err error, refreshed time.Time, now time.Time) bool {
+	if err == nil {
+		return !ok
+	}
+
+	return now.Sub(refreshed) >= migrationLockTTL
+}
+
+// held fails once the lock has been lost
+func (t *lock) held() error {
+	select {
+	case <-t.lost:
+		return stacktrace.NewError("the %v lock was lost", t.id)
+	default:
+		return nil
+	}
+}
+
+// release frees the lock if it is still ours
+func (t *lock) release() {
+	close(t.stop)
+	<-t.done
+
+	_, err := Table(LockTable).Get(t.id).Replace(func(row r.Term) interface{} {
+		return r.Branch(row.Ne(nil).And(row.Field("holder").Eq(t.holder)), nil, row)
+	}).RunWrite(Session)
+
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"lock":  t.id,
+			"error": err.Error(),
+		}).Error("failed to release lock")
+	}
+}
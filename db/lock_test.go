@@ -0,0 +1,43 @@
+package db
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LockTestSuite struct {
+	suite.Suite
+}
+
+func (t *LockTestSuite) Test_refreshLost() {
+	now := time.Now()
+	unreachable := errors.New("connection refused")
+
+	assert.False(t.T(), refreshLost(true, nil, now, now))
+	assert.True(t.T(), refreshLost(false, nil, now, now))
+
+	// the lock survives failed refreshes until it may have expired
+	assert.False(t.T(), refreshLost(false, unreachable, now.Add(-migrationLockTTL/2), now))
+	assert.True(t.T(), refreshLost(false, unreachable, now.Add(-migrationLockTTL), now))
+}
+
+func (t *LockTestSuite) Test_held_fails_once_the_lock_is_lost() {
+	l := &lock{
+		id:   migrationLockID,
+		lost: make(chan struct{}),
+	}
+
+	assert.Nil(t.T(), l.held())
+
+	close(l.lost)
+
+	assert.Contains(t.T(), l.held().Error(), "the migrate lock was lost")
+}
+
+func TestLockTestSuite(t *testing.T) {
+	suite.Run(t, new(LockTestSuite))
+}
@@ -0,0 +1,5 @@
+package db
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("db")
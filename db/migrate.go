@@ -1,66 +1,314 @@
 package db
 
 import (
-	"github.com/Sirupsen/logrus"
-	"github.com/deviceio/shared/try"
-	"github.com/deviceio/shared/types"
+	"sort"
+	"strings"
+	"time"
 
+	"github.com/palantir/stacktrace"
 	r "gopkg.in/gorethink/gorethink.v2"
 )
 
-// Migrate conducts any required data migrations
+// Migration is a versioned change to the schema or data of the database.
+// Migrations are applied in Version order and each is recorded in the migration
+// table once applied.
+type Migration struct {
+	Version     int
+	Description string
+	Up          func() error
+
+	// Down reverts Up. Migrations without a Down cannot be rolled back.
+	Down func() error
+}
+
+// MigrationState describes a known migration and whether it has been applied
+type MigrationState struct {
+	Version     int
+	Description string
+	Applied     bool
+	AppliedAt   time.Time
+}
+
+// appliedMigration is the record of an applied migration in the migration table
+type appliedMigration struct {
+	Version     int       `gorethink:"id"`
+	Description string    `gorethink:"description"`
+	AppliedAt   time.Time `gorethink:"applied_at"`
+}
+
+// Migrate applies every pending migration, exiting if any fails
 func Migrate() {
-	try.Call(func() error {
-		c, err := r.DBList().Run(Session)
+	if err := MigrateUp(0); err != nil {
+		logger.Fatal(stacktrace.Propagate(err, "database migration failed"))
+	}
+}
+
+// MigrateUp applies pending migrations up to and including version target. A
+// target of 0 applies every pending migration.
+func MigrateUp(target int) error {
+	return withMigrationLock(func(applied map[int]bool, held func() error) error {
+		for _, m := range planUp(migrations, applied, target) {
+			if err := held(); err != nil {
+				return stacktrace.Propagate(err, "migration %v not applied", m.Version)
+			}
+
+			logger.WithField("version", m.Version).Info("applying migration: " + m.Description)
+
+			if err := m.Up(); err != nil {
+				return stacktrace.Propagate(err, "migration %v failed", m.Version)
+			}
+
+			_, err := Table(MigrationTable).Insert(&appliedMigration{
+				Version:     m.Version,
+				Description: m.Description,
+				AppliedAt:   time.Now().UTC(),
+			}).RunWrite(Session)
+
+			if err != nil {
+				return stacktrace.Propagate(err, "failed to record migration %v", m.Version)
+			}
+		}
+
+		return nil
+	})
+}
+
+// MigrateDown reverts applied migrations newer than version target, newest first.
+// Nothing is reverted if any of them cannot be rolled back.
+func MigrateDown(target int) error {
+	return withMigrationLock(func(applied map[int]bool, held func() error) error {
+		plan, err := planDown(migrations, applied, target)
 
 		if err != nil {
 			return err
 		}
 
-		var dblist types.StringSlice
+		for _, m := range plan {
+			if err := held(); err != nil {
+				return stacktrace.Propagate(err, "migration %v not reverted", m.Version)
+			}
 
-		c.All(&dblist)
+			logger.WithField("version", m.Version).Info("reverting migration: " + m.Description)
 
-		logrus.Println("Available Databases", dblist)
+			if err := m.Down(); err != nil {
+				return stacktrace.Propagate(err, "reverting migration %v failed", m.Version)
+			}
 
-		if !dblist.Contains(Database) {
-			logrus.Println("Creating Database", Database)
-			r.DBCreate(Database).RunWrite(Session)
+			if _, err := Table(MigrationTable).Get(m.Version).Delete().RunWrite(Session); err != nil {
+				return stacktrace.Propagate(err, "failed to record reverting migration %v", m.Version)
+			}
 		}
 
 		return nil
-	}, func(e error, stack string) {
-		logrus.Fatal(e, stack)
 	})
+}
+
+// MigrationStatus lists every known migration and whether it has been applied
+func MigrationStatus() ([]*MigrationState, error) {
+	if err := ensureMigrationTables(); err != nil {
+		return nil, err
+	}
+
+	records, err := appliedMigrations()
+
+	if err != nil {
+		return nil, err
+	}
 
-	try.Call(func() error {
-		tables := &types.StringSlice{
-			string(DeviceTable),
-			string(UserTable),
-			string(MemberTable),
+	states := []*MigrationState{}
+
+	for _, m := range migrations {
+		state := &MigrationState{
+			Version:     m.Version,
+			Description: m.Description,
 		}
 
-		c, err := r.TableList().Run(Session)
+		if rec, ok := records[m.Version]; ok {
+			state.Applied = true
+			state.AppliedAt = rec.AppliedAt
+		}
 
-		if err != nil {
+		states = append(states, state)
+	}
+
+	return states, nil
+}
+
+// SchemaVersion returns the newest applied migration version, or 0 for a database
+// without migrations
+func SchemaVersion() (int, error) {
+	if err := ensureMigrationTables(); err != nil {
+		return 0, err
+	}
+
+	records, err := appliedMigrations()
+
+	if err != nil {
+		return 0, err
+	}
+
+	version := 0
+
+	for v := range records {
+		if v > version {
+			version = v
+		}
+	}
+
+	return version, nil
+}
+
+// LatestVersion returns the version of the newest known migration
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// withMigrationLock runs fn with the versions already applied while holding the
+// cluster wide migration lock. fn checks held before each step and stops if the
+// lock was lost, as another hub may then be migrating.
+func withMigrationLock(fn func(applied map[int]bool, held func() error) error) error {
+	if err := validateMigrations(migrations); err != nil {
+		return err
+	}
+
+	if err := ensureMigrationTables(); err != nil {
+		return err
+	}
+
+	lock, err := acquireMigrationLock(migrationLockWait)
+
+	if err != nil {
+		return err
+	}
+
+	defer lock.release()
+
+	records, err := appliedMigrations()
+
+	if err != nil {
+		return err
+	}
+
+	applied := map[int]bool{}
+
+	for version := range records {
+		applied[version] = true
+	}
+
+	return fn(applied, lock.held)
+}
+
+func appliedMigrations() (map[int]*appliedMigration, error) {
+	cursor, err := Table(MigrationTable).Run(Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query applied migrations")
+	}
+
+	records := []*appliedMigration{}
+
+	if err = cursor.All(&records); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read applied migrations")
+	}
+
+	applied := map[int]*appliedMigration{}
+
+	for _, rec := range records {
+		applied[rec.Version] = rec
+	}
+
+	return applied, nil
+}
+
+// ensureMigrationTables creates the database and the tables the migration
+// framework itself relies on. Concurrent hubs may race to create them so
+// existing objects are not an error.
+func ensureMigrationTables() error {
+	if _, err := r.DBCreate(Database).RunWrite(Session); err != nil && !alreadyExists(err) {
+		return stacktrace.Propagate(err, "failed to create database '%v'", Database)
+	}
+
+	for _, table := range []tableName{MigrationTable, LockTable} {
+		if err := createTable(table); err != nil {
 			return err
 		}
+	}
 
-		var tablelist types.StringSlice
+	return nil
+}
 
-		c.All(&tablelist)
+// validateMigrations checks migrations are ordered by unique, positive versions
+func validateMigrations(list []*Migration) error {
+	for i, m := range list {
+		if m.Version <= 0 || m.Up == nil {
+			return stacktrace.NewError("migration %v is invalid", m.Version)
+		}
 
-		logrus.Println("Available Tables", tablelist)
+		if i > 0 && list[i-1].Version >= m.Version {
+			return stacktrace.NewError("migration %v is out of order", m.Version)
+		}
+	}
 
-		for _, table := range tables.ToSlice() {
-			if !tablelist.Contains(table) {
-				logrus.Println("Creating Table", table)
-				r.TableCreate(table).RunWrite(Session)
-			}
+	return nil
+}
+
+// planUp returns the unapplied migrations up to target in the order to apply them
+func planUp(list []*Migration, applied map[int]bool, target int) []*Migration {
+	plan := []*Migration{}
+
+	for _, m := range list {
+		if target > 0 && m.Version > target {
+			break
 		}
 
-		return nil
-	}, func(e error, stack string) {
-		logrus.Fatal(e, stack)
+		if !applied[m.Version] {
+			plan = append(plan, m)
+		}
+	}
+
+	return plan
+}
+
+// planDown returns the applied migrations newer than target in the order to
+// revert them
+func planDown(list []*Migration, applied map[int]bool, target int) ([]*Migration, error) {
+	plan := []*Migration{}
+
+	for _, m := range list {
+		if m.Version <= target || !applied[m.Version] {
+			continue
+		}
+
+		if m.Down == nil {
+			return nil, stacktrace.NewError("migration %v (%v) cannot be reverted", m.Version, m.Description)
+		}
+
+		plan = append(plan, m)
+	}
+
+	sort.Slice(plan, func(i, j int) bool {
+		return plan[i].Version > plan[j].Version
 	})
+
+	return plan, nil
+}
+
+func createTable(table tableName) error {
+	if _, err := r.DB(Database).TableCreate(string(table)).RunWrite(Session); err != nil && !alreadyExists(err) {
+		return stacktrace.Propagate(err, "failed to create table '%v'", table)
+	}
+
+	return nil
+}
+
+func dropTable(table tableName) error {
+	if _, err := r.DB(Database).TableDrop(string(table)).RunWrite(Session); err != nil && !strings.Contains(err.Error(), "does not exist") {
+		return stacktrace.Propagate(err, "failed to drop table '%v'", table)
+	}
+
+	return nil
+}
+
+func alreadyExists(err error) bool {
+	return strings.Contains(err.Error(), "already exists")
 }
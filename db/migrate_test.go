@@ -0,0 +1,73 @@
+package db
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type MigrateTestSuite struct {
+	suite.Suite
+	list []*Migration
+}
+
+func (t *MigrateTestSuite) SetupTest() {
+	noop := func() error { return nil }
+
+	t.list = []*Migration{
+		{Version: 1, Up: noop},
+		{Version: 2, Up: noop, Down: noop},
+		{Version: 3, Up: noop, Down: noop},
+		{Version: 4, Up: noop, Down: noop},
+	}
+}
+
+func versions(list []*Migration) []int {
+	v := []int{}
+
+	for _, m := range list {
+		v = append(v, m.Version)
+	}
+
+	return v
+}
+
+func (t *MigrateTestSuite) Test_planUp_applies_pending_in_order() {
+	plan := planUp(t.list, map[int]bool{1: true, 3: true}, 0)
+
+	assert.Equal(t.T(), []int{2, 4}, versions(plan))
+}
+
+func (t *MigrateTestSuite) Test_planUp_stops_at_target() {
+	plan := planUp(t.list, map[int]bool{}, 2)
+
+	assert.Equal(t.T(), []int{1, 2}, versions(plan))
+}
+
+func (t *MigrateTestSuite) Test_planDown_reverts_newest_first() {
+	plan, err := planDown(t.list, map[int]bool{1: true, 2: true, 3: true, 4: true}, 2)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []int{4, 3}, versions(plan))
+}
+
+func (t *MigrateTestSuite) Test_planDown_refuses_irreversible_migrations() {
+	_, err := planDown(t.list, map[int]bool{1: true, 2: true}, 0)
+
+	assert.NotNil(t.T(), err)
+}
+
+func (t *MigrateTestSuite) Test_validateMigrations_rejects_out_of_order_versions() {
+	t.list[1], t.list[2] = t.list[2], t.list[1]
+
+	assert.NotNil(t.T(), validateMigrations(t.list))
+}
+
+func (t *MigrateTestSuite) Test_registered_migrations_are_valid() {
+	assert.Nil(t.T(), validateMigrations(migrations))
+}
+
+func TestMigrateTestSuite(t *testing.T) {
+	suite.Run(t, new(MigrateTestSuite))
+}
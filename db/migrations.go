@@ -0,0 +1,363 @@
+package db
+
+import (
+	"strings"
+
+	"github.com/deviceio/hub/secret"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// migrations is every migration in version order. Released migrations must not
+// be changed; add a new version instead. Each Up must tolerate being re-run after
+// it was interrupted part way.
+var migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "create tables",
+		Up: func() error {
+			for _, table := range []tableName{
+				DeviceTable,
+				UserTable,
+				MemberTable,
+				DeviceEventTable,
+				EventTable,
+				WebhookTable,
+				WebhookDeliveryTable,
+				WebhookDeadLetterTable,
+				AuditTable,
+				AuditChainTable,
+				AuditCheckpointTable,
+			} {
+				if err := createTable(table); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     2,
+		Description: "index users by login, email and public key",
+		Up: func() error {
+			return createIndexes(UserTable, false, "login", "email", "ed22519_public_key")
+		},
+		Down: func() error {
+			return dropIndexes(UserTable, "login", "email", "ed22519_public_key")
+		},
+	},
+	{
+		Version:     3,
+		Description: "lowercase device hostnames",
+		Up: func() error {
+			_, err := Table(DeviceTable).Filter(func(row r.Term) r.Term {
+				return row.HasFields("hostname")
+			}).Update(func(row r.Term) interface{} {
+				return map[string]interface{}{
+					"hostname": row.Field("hostname").Downcase(),
+				}
+			}).RunWrite(Session)
+
+			if err != nil {
+				return stacktrace.Propagate(err, "failed to lowercase device hostnames")
+			}
+
+			return nil
+		},
+		Down: func() error {
+			// the original case is not recoverable and lowercase hostnames are
+			// valid for earlier versions
+			return nil
+		},
+	},
+	{
+		Version:     4,
+		Description: "index devices by hostname and tags",
+		Up: func() error {
+			if err := createIndexes(DeviceTable, false, "hostname"); err != nil {
+				return err
+			}
+
+			return createIndexes(DeviceTable, true, "tags")
+		},
+		Down: func() error {
+			return dropIndexes(DeviceTable, "hostname", "tags")
+		},
+	},
+	{
+		Version:     5,
+		Description: "index device events by device, webhook history by subscription and audit records by chain",
+		Up: func() error {
+			if err := createIndexes(DeviceEventTable, false, "device_id"); err != nil {
+				return err
+			}
+
+			if err := createIndexes(WebhookDeliveryTable, false, "subscription_id"); err != nil {
+				return err
+			}
+
+			if err := createIndexes(WebhookDeadLetterTable, false, "subscription_id"); err != nil {
+				return err
+			}
+
+			return createIndexes(AuditTable, false, "chain")
+		},
+		Down: func() error {
+			for table, index := range map[tableName]string{
+				DeviceEventTable:       "device_id",
+				WebhookDeliveryTable:   "subscription_id",
+				WebhookDeadLetterTable: "subscription_id",
+				AuditTable:             "chain",
+			} {
+				if err := dropIndexes(table, index); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		},
+	},
+	{
+		Version:     6,
+		Description: "encrypt user totp secrets with the master key",
+		Up:          sealTOTPSecrets,
+		Down:        openTOTPSecrets,
+	},
+	{
+		Version:     7,
+		Description: "create the service account table",
+		Up: func() error {
+			return createTable(ServiceAccountTable)
+		},
+		Down: func() error {
+			return dropTable(ServiceAccountTable)
+		},
+	},
+	{
+		Version:     8,
+		Description: "create the hmac key table indexed by key",
+		Up: func() error {
+			if err := createTable(HmacKeyTable); err != nil {
+				return err
+			}
+
+			return createIndexes(HmacKeyTable, false, "hmac_key")
+		},
+		Down: func() error {
+			return dropTable(HmacKeyTable)
+		},
+	},
+	{
+		Version:     9,
+		Description: "create the authentication lockout table",
+		Up: func() error {
+			return createTable(LockoutTable)
+		},
+		Down: func() error {
+			return dropTable(LockoutTable)
+		},
+	},
+	{
+		Version:     10,
+		Description: "encrypt webhook secrets with the master key",
+		Up:          sealWebhookSecrets,
+		Down:        openWebhookSecrets,
+	},
+}
+
+// plainTOTPUser is a user whose totp secret is stored unencrypted
+type plainTOTPUser struct {
+	ID         string `gorethink:"id"`
+	TOTPSecret []byte `gorethink:"totp_secret"`
+}
+
+// sealedTOTPUser is a user whose totp secret is sealed by a master key
+type sealedTOTPUser struct {
+	ID         string           `gorethink:"id"`
+	TOTPSecret *secret.Envelope `gorethink:"totp_secret"`
+}
+
+func sealTOTPSecrets() error {
+	cursor, err := Table(UserTable).Filter(func(row r.Term) r.Term {
+		return row.HasFields("totp_secret").And(row.Field("totp_secret").TypeOf().Eq("PTYPE<BINARY>"))
+	}).Run(Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query users")
+	}
+
+	users := []*plainTOTPUser{}
+
+	if err = cursor.All(&users); err != nil {
+		return stacktrace.Propagate(err, "failed to read users")
+	}
+
+	for _, user := range users {
+		sealed, err := secret.Seal(user.TOTPSecret)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to encrypt totp secret of user '%v'", user.ID)
+		}
+
+		_, err = Table(UserTable).Get(user.ID).Update(&sealedTOTPUser{
+			ID:         user.ID,
+			TOTPSecret: sealed,
+		}).RunWrite(Session)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to store encrypted totp secret of user '%v'", user.ID)
+		}
+	}
+
+	return nil
+}
+
+func openTOTPSecrets() error {
+	cursor, err := Table(UserTable).Filter(func(row r.Term) r.Term {
+		return row.HasFields("totp_secret").And(row.Field("totp_secret").TypeOf().Eq("OBJECT"))
+	}).Run(Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query users")
+	}
+
+	users := []*sealedTOTPUser{}
+
+	if err = cursor.All(&users); err != nil {
+		return stacktrace.Propagate(err, "failed to read users")
+	}
+
+	for _, user := range users {
+		plain, err := secret.Open(user.TOTPSecret)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to decrypt totp secret of user '%v'", user.ID)
+		}
+
+		_, err = Table(UserTable).Get(user.ID).Update(map[string]interface{}{
+			"totp_secret": r.Literal(r.Binary(plain)),
+		}).RunWrite(Session)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to store decrypted totp secret of user '%v'", user.ID)
+		}
+	}
+
+	return nil
+}
+
+// plainSecretWebhook is a webhook subscription whose secret is stored
+// unencrypted
+type plainSecretWebhook struct {
+	ID     string `gorethink:"id"`
+	Secret string `gorethink:"secret"`
+}
+
+// sealedSecretWebhook is a webhook subscription whose secret is sealed by a
+// master key
+type sealedSecretWebhook struct {
+	ID     string           `gorethink:"id"`
+	Secret *secret.Envelope `gorethink:"secret"`
+}
+
+func sealWebhookSecrets() error {
+	cursor, err := Table(WebhookTable).Filter(func(row r.Term) r.Term {
+		return row.HasFields("secret").And(row.Field("secret").TypeOf().Eq("STRING"))
+	}).Run(Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query webhook subscriptions")
+	}
+
+	subs := []*plainSecretWebhook{}
+
+	if err = cursor.All(&subs); err != nil {
+		return stacktrace.Propagate(err, "failed to read webhook subscriptions")
+	}
+
+	for _, sub := range subs {
+		sealed, err := secret.Seal([]byte(sub.Secret))
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to encrypt secret of webhook subscription '%v'", sub.ID)
+		}
+
+		_, err = Table(WebhookTable).Get(sub.ID).Update(&sealedSecretWebhook{
+			ID:     sub.ID,
+			Secret: sealed,
+		}).RunWrite(Session)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to store encrypted secret of webhook subscription '%v'", sub.ID)
+		}
+	}
+
+	return nil
+}
+
+func openWebhookSecrets() error {
+	cursor, err := Table(WebhookTable).Filter(func(row r.Term) r.Term {
+		return row.HasFields("secret").And(row.Field("secret").TypeOf().Eq("OBJECT"))
+	}).Run(Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to query webhook subscriptions")
+	}
+
+	subs := []*sealedSecretWebhook{}
+
+	if err = cursor.All(&subs); err != nil {
+		return stacktrace.Propagate(err, "failed to read webhook subscriptions")
+	}
+
+	for _, sub := range subs {
+		plain, err := secret.Open(sub.Secret)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to decrypt secret of webhook subscription '%v'", sub.ID)
+		}
+
+		_, err = Table(WebhookTable).Get(sub.ID).Update(map[string]interface{}{
+			"secret": r.Literal(string(plain)),
+		}).RunWrite(Session)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to store decrypted secret of webhook subscription '%v'", sub.ID)
+		}
+	}
+
+	return nil
+}
+
+// createIndexes creates the secondary indexes over the fields of the same name
+// and waits for them to be built
+func createIndexes(table tableName, multi bool, fields ...string) error {
+	for _, field := range fields {
+		opts := r.IndexCreateOpts{}
+
+		if multi {
+			opts.Multi = true
+		}
+
+		if _, err := Table(table).IndexCreate(field, opts).RunWrite(Session); err != nil && !alreadyExists(err) {
+			return stacktrace.Propagate(err, "failed to create index '%v' on table '%v'", field, table)
+		}
+	}
+
+	if _, err := Table(table).IndexWait().Run(Session); err != nil {
+		return stacktrace.Propagate(err, "failed waiting for indexes of table '%v'", table)
+	}
+
+	return nil
+}
+
+func dropIndexes(table tableName, names ...string) error {
+	for _, name := range names {
+		if _, err := Table(table).IndexDrop(name).RunWrite(Session); err != nil && !strings.Contains(err.Error(), "does not exist") {
+			return stacktrace.Propagate(err, "failed to drop index '%v' on table '%v'", name, table)
+		}
+	}
+
+	return nil
+}
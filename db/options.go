@@ -1,8 +1,35 @@
 package db
 
+import "time"
+
 type Options struct {
 	DBName string
-	DBHost string
+
+	// DBHosts are the host[:port] seed addresses of the rethinkdb cluster
+	DBHosts []string
+
 	DBUser string
 	DBPass string
+
+	// TLS encrypts connections to rethinkdb. It is implied when TLSCAPath is set.
+	TLS bool
+
+	// TLSCAPath is a PEM bundle of the certificate authorities trusted to sign the
+	// rethinkdb server certificate. The system roots are used if empty.
+	TLSCAPath string
+
+	// TLSCertPath and TLSKeyPath are an optional client certificate
+	TLSCertPath string
+	TLSKeyPath  string
+
+	// DiscoverHosts finds and uses every server of the rethinkdb cluster rather
+	// than only the seed hosts
+	DiscoverHosts bool
+
+	// PoolSize is the maximum number of connections held open per host
+	PoolSize int
+
+	// ConnectTimeout is how long Connect retries an unreachable cluster before
+	// failing
+	ConnectTimeout time.Duration
 }
@@ -10,8 +10,52 @@ const (
 	UserTable   tableName = tableName("User")
 	DeviceTable tableName = tableName("Device")
 	MemberTable tableName = tableName("Member")
+
+	ServiceAccountTable tableName = tableName("ServiceAccount")
+	HmacKeyTable        tableName = tableName("HmacKey")
+	LockoutTable        tableName = tableName("Lockout")
+
+	DeviceEventTable tableName = tableName("DeviceEvent")
+	EventTable       tableName = tableName("Event")
+
+	WebhookTable           tableName = tableName("Webhook")
+	WebhookDeliveryTable   tableName = tableName("WebhookDelivery")
+	WebhookDeadLetterTable tableName = tableName("WebhookDeadLetter")
+
+	AuditTable           tableName = tableName("Audit")
+	AuditChainTable      tableName = tableName("AuditChain")
+	AuditCheckpointTable tableName = tableName("AuditCheckpoint")
+
+	MigrationTable tableName = tableName("Migration")
+	LockTable      tableName = tableName("Lock")
 )
 
+// DataTables returns the names of the tables holding hub state, excluding the
+// migration bookkeeping tables and the short lived authentication lockouts
+func DataTables() []string {
+	names := []string{}
+
+	for _, table := range []tableName{
+		UserTable,
+		DeviceTable,
+		MemberTable,
+		ServiceAccountTable,
+		HmacKeyTable,
+		DeviceEventTable,
+		EventTable,
+		WebhookTable,
+		WebhookDeliveryTable,
+		WebhookDeadLetterTable,
+		AuditTable,
+		AuditChainTable,
+		AuditCheckpointTable,
+	} {
+		names = append(names, string(table))
+	}
+
+	return names
+}
+
 // Table returns a rethink term to a table by name
 func Table(name tableName) r.Term {
 	return r.DB(Database).Table(string(name))
@@ -0,0 +1,525 @@
+package embedded
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/deviceio/hub/health"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	opPut    = "put"
+	opDelete = "delete"
+
+	// compactThreshold is the number of superseded log entries tolerated before
+	// the log is rewritten
+	compactThreshold = 1000
+)
+
+// ErrConflict is returned when inserting a document whose id already exists
+type ErrConflict struct {
+	Table string
+	ID    string
+}
+
+func (t *ErrConflict) Error() string {
+	return "document '" + t.ID + "' already exists in table '" + t.Table + "'"
+}
+
+// ErrNotFound is returned when updating a document that does not exist
+type ErrNotFound struct {
+	Table string
+	ID    string
+}
+
+func (t *ErrNotFound) Error() string {
+	return "document '" + t.ID + "' not found in table '" + t.Table + "'"
+}
+
+// ErrInUse is returned when opening a database another process has open
+type ErrInUse struct {
+	Path string
+}
+
+func (t *ErrInUse) Error() string {
+	return "database '" + t.Path + "' is in use by another process"
+}
+
+// entry is a single line of the log file
+type entry struct {
+	Op    string          `json:"op"`
+	Table string          `json:"table"`
+	ID    string          `json:"id"`
+	Doc   json.RawMessage `json:"doc,omitempty"`
+}
+
+// DB is an embedded json document store for single node hubs. Documents are
+// kept in memory and every write is appended to a log file which is replayed on
+// open. A DB opened without a path is memory only.
+type DB struct {
+	path string
+
+	mu     sync.RWMutex
+	tables map[string]map[string]json.RawMessage
+	file   *os.File
+	lock   *os.File
+	stale  int
+	subs   map[string]map[*feed]bool
+	closed bool
+}
+
+// Open loads the database at path, creating it if missing. An empty path opens a
+// memory only database. A database is opened by one process at a time, guarded
+// by a lock file beside it, and Open fails with ErrInUse while another has it.
+func Open(path string) (*DB, error) {
+	t := &DB{
+		path:   path,
+		tables: map[string]map[string]json.RawMessage{},
+		subs:   map[string]map[*feed]bool{},
+	}
+
+	if path == "" {
+		return t, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create database directory")
+	}
+
+	lock, err := lockDB(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock = lock
+
+	if err = t.replay(); err == nil {
+		err = t.compact()
+	}
+
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// Close closes the log file and ends every open changefeed
+func (t *DB) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.closed {
+		return nil
+	}
+
+	t.closed = true
+
+	for _, feeds := range t.subs {
+		for f := range feeds {
+			f.end(nil)
+		}
+	}
+
+	t.subs = map[string]map[*feed]bool{}
+
+	var err error
+
+	if t.file != nil {
+		err = t.file.Close()
+	}
+
+	if t.lock != nil {
+		t.lock.Close()
+	}
+
+	return err
+}
+
+// Path returns the log file path, or an empty string for memory only databases
+func (t *DB) Path() string {
+	return t.path
+}
+
+// Get decodes the document into dst. found is false if there is no such document.
+func (t *DB) Get(table string, id string, dst interface{}) (found bool, err error) {
+	t.mu.RLock()
+	raw, ok := t.tables[table][id]
+	t.mu.RUnlock()
+
+	if !ok {
+		return false, nil
+	}
+
+	if err := json.Unmarshal(raw, dst); err != nil {
+		return false, stacktrace.Propagate(err, "failed to decode document '%v' of table '%v'", id, table)
+	}
+
+	return true, nil
+}
+
+// Insert stores a new document failing with ErrConflict if the id exists
+func (t *DB) Insert(table string, id string, doc interface{}) error {
+	raw, err := json.Marshal(doc)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode document")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tables[table][id]; ok {
+		return &ErrConflict{Table: table, ID: id}
+	}
+
+	return t.put(table, id, raw)
+}
+
+// Put stores the document replacing any existing document with the id
+func (t *DB) Put(table string, id string, doc interface{}) error {
+	raw, err := json.Marshal(doc)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode document")
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.put(table, id, raw)
+}
+
+// Update atomically replaces a document with the result of fn. current is nil if
+// the document does not exist. Returning a nil document deletes it, returning an
+// error leaves it unchanged.
+func (t *DB) Update(table string, id string, fn func(current []byte) (interface{}, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.update(table, id, fn)
+}
+
+// UpdateUnless atomically applies Update unless another document of the table
+// matches conflict, failing with ErrConflict naming that document
+func (t *DB) UpdateUnless(table string, id string, conflict func(id string, doc []byte) bool, fn func(current []byte) (interface{}, error)) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for other, raw := range t.tables[table] {
+		if other != id && conflict(other, raw) {
+			return &ErrConflict{Table: table, ID: other}
+		}
+	}
+
+	return t.update(table, id, fn)
+}
+
+func (t *DB) update(table string, id string, fn func(current []byte) (interface{}, error)) error {
+	current, ok := t.tables[table][id]
+
+	if !ok {
+		current = nil
+	}
+
+	next, err := fn(current)
+
+	if err != nil {
+		return err
+	}
+
+	if next == nil {
+		if ok {
+			return t.delete(table, id)
+		}
+
+		return nil
+	}
+
+	raw, err := json.Marshal(next)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode document")
+	}
+
+	return t.put(table, id, raw)
+}
+
+// Delete removes the document. found is false if there was no such document.
+func (t *DB) Delete(table string, id string) (found bool, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.tables[table][id]; !ok {
+		return false, nil
+	}
+
+	return true, t.delete(table, id)
+}
+
+// DeleteWhere removes every document of the table for which match returns true
+func (t *DB) DeleteWhere(table string, match func(id string, doc []byte) bool) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	deleted := 0
+
+	for id, raw := range t.tables[table] {
+		if !match(id, raw) {
+			continue
+		}
+
+		if err := t.delete(table, id); err != nil {
+			return deleted, err
+		}
+
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// Scan calls fn for every document of the table in id order, descending when
+// reverse is set, until fn returns false or an error
+func (t *DB) Scan(table string, reverse bool, fn func(id string, doc []byte) (bool, error)) error {
+	t.mu.RLock()
+	ids := make([]string, 0, len(t.tables[table]))
+	docs := make(map[string]json.RawMessage, len(t.tables[table]))
+
+	for id, raw := range t.tables[table] {
+		ids = append(ids, id)
+		docs[id] = raw
+	}
+	t.mu.RUnlock()
+
+	if reverse {
+		sort.Sort(sort.Reverse(sort.StringSlice(ids)))
+	} else {
+		sort.Strings(ids)
+	}
+
+	for _, id := range ids {
+		more, err := fn(id, docs[id])
+
+		if err != nil {
+			return err
+		}
+
+		if !more {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Count returns the number of documents in the table
+func (t *DB) Count(table string) int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return len(t.tables[table])
+}
+
+func (t *DB) put(table string, id string, raw json.RawMessage) error {
+	if t.closed {
+		return stacktrace.NewError("database is closed")
+	}
+
+	if t.tables[table] == nil {
+		t.tables[table] = map[string]json.RawMessage{}
+	}
+
+	old, existed := t.tables[table][id]
+
+	if err := t.append(&entry{Op: opPut, Table: table, ID: id, Doc: raw}); err != nil {
+		return err
+	}
+
+	if existed {
+		t.stale++
+	}
+
+	t.tables[table][id] = raw
+
+	t.notify(table, old, raw)
+
+	return t.compactIfStale()
+}
+
+func (t *DB) delete(table string, id string) error {
+	if t.closed {
+		return stacktrace.NewError("database is closed")
+	}
+
+	old := t.tables[table][id]
+
+	if err := t.append(&entry{Op: opDelete, Table: table, ID: id}); err != nil {
+		return err
+	}
+
+	delete(t.tables[table], id)
+	t.stale += 2
+
+	t.notify(table, old, nil)
+
+	return t.compactIfStale()
+}
+
+// append writes the entry to the log file and syncs it to disk
+func (t *DB) append(e *entry) error {
+	if t.file == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(e)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode log entry")
+	}
+
+	if _, err = t.file.Write(append(line, '\n')); err != nil {
+		return stacktrace.Propagate(err, "failed to write database log")
+	}
+
+	if err = t.file.Sync(); err != nil {
+		return stacktrace.Propagate(err, "failed to sync database log")
+	}
+
+	return nil
+}
+
+// replay loads the log file into memory
+func (t *DB) replay() error {
+	f, err := os.Open(t.path)
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to open database '%v'", t.path)
+	}
+
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+
+	for {
+		line, err := reader.ReadBytes('\n')
+
+		if err == io.EOF {
+			// a trailing line without a newline is a write interrupted by a crash
+			return nil
+		}
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to read database '%v'", t.path)
+		}
+
+		e := &entry{}
+
+		if err = json.Unmarshal(line, e); err != nil {
+			return stacktrace.Propagate(err, "corrupt entry in database '%v'", t.path)
+		}
+
+		if t.tables[e.Table] == nil {
+			t.tables[e.Table] = map[string]json.RawMessage{}
+		}
+
+		switch e.Op {
+		case opPut:
+			t.tables[e.Table][e.ID] = e.Doc
+		case opDelete:
+			delete(t.tables[e.Table], e.ID)
+		}
+	}
+}
+
+func (t *DB) compactIfStale() error {
+	if t.file == nil || t.stale < compactThreshold {
+		return nil
+	}
+
+	return t.compact()
+}
+
+// compact rewrites the log with only the current documents
+func (t *DB) compact() error {
+	tmp := t.path + ".tmp"
+
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to create compacted database")
+	}
+
+	writer := bufio.NewWriter(f)
+
+	for table, docs := range t.tables {
+		for id, raw := range docs {
+			line, err := json.Marshal(&entry{Op: opPut, Table: table, ID: id, Doc: raw})
+
+			if err != nil {
+				f.Close()
+				return stacktrace.Propagate(err, "failed to encode log entry")
+			}
+
+			writer.Write(append(line, '\n'))
+		}
+	}
+
+	if err = writer.Flush(); err == nil {
+		err = f.Sync()
+	}
+
+	f.Close()
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to write compacted database")
+	}
+
+	if t.file != nil {
+		t.file.Close()
+	}
+
+	if err = os.Rename(tmp, t.path); err != nil {
+		return stacktrace.Propagate(err, "failed to replace database with compacted copy")
+	}
+
+	if t.file, err = os.OpenFile(t.path, os.O_WRONLY|os.O_APPEND, 0600); err != nil {
+		return stacktrace.Propagate(err, "failed to open database '%v'", t.path)
+	}
+
+	t.stale = 0
+
+	return nil
+}
+
+// Health reports the database as a hub component
+func (t *DB) Health() *health.Component {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	c := &health.Component{
+		Name:  "embedded",
+		Ready: !t.closed,
+		Details: map[string]interface{}{
+			"path": t.path,
+		},
+	}
+
+	if t.closed {
+		c.Error = "database is closed"
+	}
+
+	return c
+}
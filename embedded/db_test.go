@@ -0,0 +1,188 @@
+package embedded
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type doc struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+type DBTestSuite struct {
+	suite.Suite
+	dir string
+}
+
+func (t *DBTestSuite) SetupTest() {
+	t.dir, _ = ioutil.TempDir("", "deviceio-hub-embedded")
+}
+
+func (t *DBTestSuite) TearDownTest() {
+	os.RemoveAll(t.dir)
+}
+
+func (t *DBTestSuite) Test_writes_survive_reopen() {
+	path := filepath.Join(t.dir, "hub.db")
+
+	edb, err := Open(path)
+	assert.Nil(t.T(), err)
+
+	assert.Nil(t.T(), edb.Put("users", "1", &doc{ID: "1", Name: "admin"}))
+	assert.Nil(t.T(), edb.Put("users", "2", &doc{ID: "2", Name: "ops"}))
+	assert.Nil(t.T(), edb.Put("users", "1", &doc{ID: "1", Name: "root"}))
+	_, err = edb.Delete("users", "2")
+	assert.Nil(t.T(), err)
+	assert.Nil(t.T(), edb.Close())
+
+	edb, err = Open(path)
+	assert.Nil(t.T(), err)
+	defer edb.Close()
+
+	d := &doc{}
+	found, err := edb.Get("users", "1", d)
+
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), found)
+	assert.Equal(t.T(), "root", d.Name)
+	assert.Equal(t.T(), 1, edb.Count("users"))
+}
+
+func (t *DBTestSuite) Test_Open_refuses_a_database_already_open() {
+	path := filepath.Join(t.dir, "hub.db")
+
+	edb, err := Open(path)
+	assert.Nil(t.T(), err)
+
+	_, err = Open(path)
+	assert.IsType(t.T(), &ErrInUse{}, err)
+	assert.Equal(t.T(), "database '"+path+"' is in use by another process", err.Error())
+
+	assert.Nil(t.T(), edb.Close())
+
+	edb, err = Open(path)
+	assert.Nil(t.T(), err)
+	assert.Nil(t.T(), edb.Close())
+}
+
+func (t *DBTestSuite) Test_Insert_conflicts_on_existing_id() {
+	edb, _ := Open("")
+
+	assert.Nil(t.T(), edb.Insert("users", "1", &doc{ID: "1"}))
+	assert.IsType(t.T(), &ErrConflict{}, edb.Insert("users", "1", &doc{ID: "1"}))
+}
+
+func (t *DBTestSuite) Test_Update_error_leaves_document_unchanged() {
+	edb, _ := Open("")
+	edb.Put("users", "1", &doc{ID: "1", Name: "admin"})
+
+	err := edb.Update("users", "1", func(current []byte) (interface{}, error) {
+		return nil, errors.New("stale")
+	})
+
+	d := &doc{}
+	edb.Get("users", "1", d)
+
+	assert.EqualError(t.T(), err, "stale")
+	assert.Equal(t.T(), "admin", d.Name)
+}
+
+func (t *DBTestSuite) Test_UpdateUnless_conflicts_on_other_matching_documents() {
+	edb, _ := Open("")
+	edb.Put("users", "1", &doc{ID: "1", Name: "admin"})
+	edb.Put("users", "2", &doc{ID: "2", Name: "ops"})
+
+	named := func(name string) func(id string, raw []byte) bool {
+		return func(id string, raw []byte) bool {
+			d := &doc{}
+			json.Unmarshal(raw, d)
+			return d.Name == name
+		}
+	}
+
+	rename := func(name string) func(current []byte) (interface{}, error) {
+		return func(current []byte) (interface{}, error) {
+			return &doc{ID: "2", Name: name}, nil
+		}
+	}
+
+	err := edb.UpdateUnless("users", "2", named("admin"), rename("admin"))
+	assert.Equal(t.T(), &ErrConflict{Table: "users", ID: "1"}, err)
+
+	assert.Nil(t.T(), edb.UpdateUnless("users", "2", named("ops"), rename("ops")))
+	assert.Nil(t.T(), edb.UpdateUnless("users", "2", named("root"), rename("root")))
+
+	d := &doc{}
+	edb.Get("users", "2", d)
+	assert.Equal(t.T(), "root", d.Name)
+}
+
+func (t *DBTestSuite) Test_Scan_orders_by_id() {
+	edb, _ := Open("")
+
+	for _, id := range []string{"b", "c", "a"} {
+		edb.Put("events", id, &doc{ID: id})
+	}
+
+	ids := []string{}
+
+	edb.Scan("events", true, func(id string, raw []byte) (bool, error) {
+		ids = append(ids, id)
+		return true, nil
+	})
+
+	assert.Equal(t.T(), []string{"c", "b", "a"}, ids)
+}
+
+func (t *DBTestSuite) Test_feed_reports_initial_documents_then_changes() {
+	edb, _ := Open("")
+	edb.Put("users", "1", &doc{ID: "1", Name: "admin"})
+
+	feed, err := edb.Source("users", func() interface{} { return &doc{} }).Changes(true)
+	assert.Nil(t.T(), err)
+
+	edb.Put("users", "1", &doc{ID: "1", Name: "root"})
+	edb.Delete("users", "1")
+	edb.Close()
+
+	changes := []*cache.Change{}
+
+	for change, ok := feed.Next(); ok; change, ok = feed.Next() {
+		changes = append(changes, change)
+	}
+
+	assert.Equal(t.T(), 5, len(changes))
+	assert.Equal(t.T(), cache.StateInitializing, changes[0].State)
+	assert.Equal(t.T(), "admin", changes[1].New.(*doc).Name)
+	assert.Equal(t.T(), cache.StateReady, changes[2].State)
+	assert.Equal(t.T(), "admin", changes[3].Old.(*doc).Name)
+	assert.Equal(t.T(), "root", changes[3].New.(*doc).Name)
+	assert.Equal(t.T(), "root", changes[4].Old.(*doc).Name)
+	assert.Nil(t.T(), changes[4].New)
+}
+
+func (t *DBTestSuite) Test_interrupted_trailing_write_is_ignored() {
+	path := filepath.Join(t.dir, "hub.db")
+
+	line, _ := json.Marshal(&entry{Op: opPut, Table: "users", ID: "1", Doc: json.RawMessage(`{"id":"1"}`)})
+	ioutil.WriteFile(path, append(append(line, '\n'), []byte(`{"op":"put","tab`)...), 0600)
+
+	edb, err := Open(path)
+	assert.Nil(t.T(), err)
+	defer edb.Close()
+
+	assert.Equal(t.T(), 1, edb.Count("users"))
+}
+
+func TestDBTestSuite(t *testing.T) {
+	suite.Run(t, new(DBTestSuite))
+}
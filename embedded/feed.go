@@ -0,0 +1,174 @@
+package embedded
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/palantir/stacktrace"
+)
+
+// Source returns a changefeed source over the table. new returns a pointer to
+// decode documents into.
+func (t *DB) Source(table string, new func() interface{}) cache.Source {
+	return &source{
+		db:    t,
+		table: table,
+		new:   new,
+	}
+}
+
+type source struct {
+	db    *DB
+	table string
+	new   func() interface{}
+}
+
+func (t *source) Changes(includeInitial bool) (cache.Feed, error) {
+	t.db.mu.Lock()
+	defer t.db.mu.Unlock()
+
+	if t.db.closed {
+		return nil, stacktrace.NewError("database is closed")
+	}
+
+	f := &feed{
+		db:    t.db,
+		table: t.table,
+		new:   t.new,
+		cond:  sync.NewCond(&sync.Mutex{}),
+	}
+
+	if includeInitial {
+		f.queue = append(f.queue, &rawChange{state: cache.StateInitializing})
+
+		ids := []string{}
+
+		for id := range t.db.tables[t.table] {
+			ids = append(ids, id)
+		}
+
+		sort.Strings(ids)
+
+		for _, id := range ids {
+			f.queue = append(f.queue, &rawChange{new: t.db.tables[t.table][id]})
+		}
+
+		f.queue = append(f.queue, &rawChange{state: cache.StateReady})
+	}
+
+	if t.db.subs[t.table] == nil {
+		t.db.subs[t.table] = map[*feed]bool{}
+	}
+
+	t.db.subs[t.table][f] = true
+
+	return f, nil
+}
+
+type rawChange struct {
+	old   json.RawMessage
+	new   json.RawMessage
+	state string
+}
+
+// feed queues changes without bounds so writers never block on slow readers
+type feed struct {
+	db    *DB
+	table string
+	new   func() interface{}
+
+	cond  *sync.Cond
+	queue []*rawChange
+	ended bool
+	err   error
+}
+
+// notify queues a change to every feed of the table. The caller holds the db lock.
+func (t *DB) notify(table string, old json.RawMessage, new json.RawMessage) {
+	for f := range t.subs[table] {
+		f.push(&rawChange{old: old, new: new})
+	}
+}
+
+func (t *feed) push(change *rawChange) {
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
+
+	if t.ended {
+		return
+	}
+
+	t.queue = append(t.queue, change)
+	t.cond.Signal()
+}
+
+func (t *feed) end(err error) {
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
+
+	if t.ended {
+		return
+	}
+
+	t.ended = true
+	t.err = err
+	t.cond.Broadcast()
+}
+
+func (t *feed) Next() (*cache.Change, bool) {
+	t.cond.L.Lock()
+
+	for len(t.queue) == 0 && !t.ended {
+		t.cond.Wait()
+	}
+
+	if len(t.queue) == 0 {
+		t.cond.L.Unlock()
+		return nil, false
+	}
+
+	raw := t.queue[0]
+	t.queue = t.queue[1:]
+	t.cond.L.Unlock()
+
+	change := &cache.Change{State: raw.state}
+
+	if raw.old != nil {
+		change.Old = t.new()
+
+		if err := json.Unmarshal(raw.old, change.Old); err != nil {
+			t.end(stacktrace.Propagate(err, "failed to decode document of table '%v'", t.table))
+			return nil, false
+		}
+	}
+
+	if raw.new != nil {
+		change.New = t.new()
+
+		if err := json.Unmarshal(raw.new, change.New); err != nil {
+			t.end(stacktrace.Propagate(err, "failed to decode document of table '%v'", t.table))
+			return nil, false
+		}
+	}
+
+	return change, true
+}
+
+func (t *feed) Err() error {
+	t.cond.L.Lock()
+	defer t.cond.L.Unlock()
+
+	return t.err
+}
+
+func (t *feed) Close() error {
+	t.db.mu.Lock()
+	delete(t.db.subs[t.table], t)
+	t.db.mu.Unlock()
+
+	t.end(nil)
+
+	return nil
+}
@@ -0,0 +1,34 @@
+//go:build !windows
+// +build !windows
+
+package embedded
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/palantir/stacktrace"
+)
+
+// lockDB takes an exclusive lock on the lock file of the database at path,
+// failing at once if another process holds it. Closing the returned file
+// releases the lock.
+func lockDB(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open database lock file")
+	}
+
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+
+		if err == syscall.EWOULDBLOCK {
+			return nil, &ErrInUse{Path: path}
+		}
+
+		return nil, stacktrace.Propagate(err, "failed to lock database")
+	}
+
+	return f, nil
+}
@@ -0,0 +1,35 @@
+package embedded
+
+import (
+	"os"
+	"syscall"
+
+	"github.com/palantir/stacktrace"
+)
+
+// errSharingViolation is returned opening a file another process has open
+// without sharing it
+const errSharingViolation = syscall.Errno(32)
+
+// lockDB opens the lock file of the database at path without sharing it,
+// failing at once if another process has it open. Closing the returned file
+// releases the lock.
+func lockDB(path string) (*os.File, error) {
+	name, err := syscall.UTF16PtrFromString(path + ".lock")
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open database lock file")
+	}
+
+	handle, err := syscall.CreateFile(name, syscall.GENERIC_READ|syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_ALWAYS, syscall.FILE_ATTRIBUTE_NORMAL, 0)
+
+	if err == errSharingViolation {
+		return nil, &ErrInUse{Path: path}
+	}
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to lock database")
+	}
+
+	return os.NewFile(uintptr(handle), path+".lock"), nil
+}
@@ -0,0 +1,84 @@
+package event
+
+import (
+	"sync"
+)
+
+// Bus is an in-process publish/subscribe fan-out of events. Publishing never
+// blocks; subscribers that do not keep up have events dropped.
+type Bus struct {
+	subs map[*Subscription]bool
+	mu   *sync.RWMutex
+}
+
+// Subscription receives published events matching its type patterns on C until
+// closed.
+type Subscription struct {
+	C <-chan *Event
+
+	c        chan *Event
+	patterns []string
+	bus      *Bus
+	once     *sync.Once
+}
+
+// NewBus instantiates a new empty event bus
+func NewBus() *Bus {
+	return &Bus{
+		subs: map[*Subscription]bool{},
+		mu:   &sync.RWMutex{},
+	}
+}
+
+// Publish delivers the event to every subscription whose patterns match the event
+// type.
+func (t *Bus) Publish(e *Event) {
+	if t == nil || e == nil {
+		return
+	}
+
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	for sub := range t.subs {
+		if !MatchAny(sub.patterns, e.Type) {
+			continue
+		}
+
+		select {
+		case sub.c <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe registers a new subscription buffering up to buffer events. Supplying
+// no patterns subscribes to every event type.
+func (t *Bus) Subscribe(buffer int, patterns ...string) *Subscription {
+	c := make(chan *Event, buffer)
+
+	sub := &Subscription{
+		C:        c,
+		c:        c,
+		patterns: patterns,
+		bus:      t,
+		once:     &sync.Once{},
+	}
+
+	t.mu.Lock()
+	t.subs[sub] = true
+	t.mu.Unlock()
+
+	return sub
+}
+
+// Close removes the subscription from its bus and closes C
+func (t *Subscription) Close() {
+	t.once.Do(func() {
+		t.bus.mu.Lock()
+		delete(t.bus.subs, t)
+		t.bus.mu.Unlock()
+
+		close(t.c)
+	})
+}
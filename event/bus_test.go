@@ -0,0 +1,66 @@
+package event
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type BusTestSuite struct {
+	suite.Suite
+	bus *Bus
+}
+
+func (t *BusTestSuite) SetupTest() {
+	t.bus = NewBus()
+}
+
+func (t *BusTestSuite) Test_Publish_delivers_only_matching_types() {
+	devices := t.bus.Subscribe(10, "device.*")
+	defer devices.Close()
+
+	alerts := t.bus.Subscribe(10, DeviceAlert)
+	defer alerts.Close()
+
+	t.bus.Publish(New(DeviceLog, nil))
+	t.bus.Publish(New(DeviceAlert, nil))
+	t.bus.Publish(New("member.joined", nil))
+
+	assert.Equal(t.T(), 2, len(devices.C))
+	assert.Equal(t.T(), 1, len(alerts.C))
+	assert.Equal(t.T(), DeviceAlert, (<-alerts.C).Type)
+}
+
+func (t *BusTestSuite) Test_Publish_does_not_block_on_full_subscription() {
+	sub := t.bus.Subscribe(1)
+	defer sub.Close()
+
+	t.bus.Publish(New(DeviceLog, nil))
+	t.bus.Publish(New(DeviceLog, nil))
+
+	assert.Equal(t.T(), 1, len(sub.C))
+}
+
+func (t *BusTestSuite) Test_Close_stops_delivery() {
+	sub := t.bus.Subscribe(10)
+	sub.Close()
+	sub.Close()
+
+	t.bus.Publish(New(DeviceLog, nil))
+
+	_, ok := <-sub.C
+	assert.False(t.T(), ok)
+}
+
+func (t *BusTestSuite) Test_NewID_sorts_by_time() {
+	now := time.Now()
+
+	assert.True(t.T(), NewID(now) < NewID(now.Add(time.Nanosecond)))
+	assert.True(t.T(), NewID(now) < NewID(now.Add(time.Hour)))
+}
+
+func TestBusTestSuite(t *testing.T) {
+	suite.Run(t, new(BusTestSuite))
+}
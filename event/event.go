@@ -0,0 +1,124 @@
+package event
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	// DeviceAlert is published when a device raises an alert over its event stream
+	DeviceAlert = "device.alert"
+
+	// DeviceState is published when a device reports a change in its state
+	DeviceState = "device.state"
+
+	// DeviceLog is published when a device forwards a log line
+	DeviceLog = "device.log"
+
+	// DeviceConnected is published when a device connects to a gateway
+	DeviceConnected = "device.connected"
+
+	// DeviceDisconnected is published when a device's gateway session closes
+	DeviceDisconnected = "device.disconnected"
+
+	// MemberJoined is published when a hub instance joins the cluster
+	MemberJoined = "member.joined"
+
+	// MemberLeft is published when a hub instance leaves the cluster
+	MemberLeft = "member.left"
+
+	// UserCreated is published when a user is added
+	UserCreated = "user.created"
+
+	// UserUpdated is published when a user is changed
+	UserUpdated = "user.updated"
+
+	// UserDeleted is published when a user is removed
+	UserDeleted = "user.deleted"
+
+	// UserRecovered is published when an admin's credentials are reset with the
+	// break-glass recover-admin command
+	UserRecovered = "user.recovered"
+
+	// AuthFailed is published when an api request fails authentication
+	AuthFailed = "auth.failed"
+)
+
+// Event is a single typed occurrence published on the hub event bus.
+type Event struct {
+	// ID is a time ordered identifier. Lexical order of ID's matches the order
+	// in which the events were created.
+	ID string `gorethink:"id,omitempty" json:"id"`
+
+	// Type of the event such as device.alert or device.log
+	Type string `gorethink:"type" json:"type"`
+
+	// Time the event occurred
+	Time time.Time `gorethink:"time" json:"time"`
+
+	// DeviceID of the device the event relates to, if any. Always lowercase.
+	DeviceID string `gorethink:"device_id,omitempty" json:"deviceId,omitempty"`
+
+	// Hostname of the device the event relates to, if any. Always lowercase.
+	Hostname string `gorethink:"hostname,omitempty" json:"hostname,omitempty"`
+
+	// Member is the ID of the hub cluster member the event originated on
+	Member string `gorethink:"member,omitempty" json:"member,omitempty"`
+
+	// Data is the type specific payload of the event
+	Data map[string]interface{} `gorethink:"data,omitempty" json:"data,omitempty"`
+}
+
+// New instantiates a new event of the given type stamped with a fresh ID and the
+// current time.
+func New(typ string, data map[string]interface{}) *Event {
+	now := time.Now().UTC()
+
+	return &Event{
+		ID:   NewID(now),
+		Type: typ,
+		Time: now,
+		Data: data,
+	}
+}
+
+// NewID generates a lexically sortable event id for the supplied time.
+func NewID(at time.Time) string {
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+
+	return fmt.Sprintf("%016x%v", at.UnixNano(), hex.EncodeToString(suffix))
+}
+
+// Match reports if the event type typ is matched by pattern. A pattern is either
+// an exact type, a prefix ending in ".*" (device.*) or "*" to match everything.
+func Match(pattern string, typ string) bool {
+	if pattern == "*" || pattern == typ {
+		return true
+	}
+
+	if strings.HasSuffix(pattern, ".*") {
+		return strings.HasPrefix(typ, strings.TrimSuffix(pattern, "*"))
+	}
+
+	return false
+}
+
+// MatchAny reports if typ is matched by any of the supplied patterns. An empty
+// pattern list matches every type.
+func MatchAny(patterns []string, typ string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if Match(pattern, typ) {
+			return true
+		}
+	}
+
+	return false
+}
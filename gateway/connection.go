@@ -7,7 +7,10 @@ import (
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"time"
 
+	"github.com/deviceio/hub/event"
 	"github.com/deviceio/shared/types"
 	"github.com/google/uuid"
 	"github.com/hashicorp/yamux"
@@ -132,3 +135,28 @@ func (t *connection) proxyRequest(w http.ResponseWriter, r *http.Request, path s
 
 	return nil
 }
+
+// newEvent instantiates a bus event of the given type attributed to this
+// connection's device. Device supplied times that are missing or in the future
+// are replaced with the hub's current time.
+func (t *connection) newEvent(typ string, at time.Time, data map[string]interface{}) *event.Event {
+	e := event.New(typ, data)
+	e.DeviceID = strings.ToLower(t.info.ID)
+	e.Hostname = strings.ToLower(t.info.Hostname)
+
+	if !at.IsZero() && at.Before(e.Time) {
+		e.Time = at.UTC()
+	}
+
+	return e
+}
+
+// eventData describes the connection for inclusion in lifecycle events
+func (t *connection) eventData() map[string]interface{} {
+	return map[string]interface{}{
+		"remoteAddr":   t.conn.RemoteAddr().String(),
+		"platform":     t.info.Platform,
+		"architecture": t.info.Architecture,
+		"tags":         t.info.Tags,
+	}
+}
@@ -0,0 +1,199 @@
+package gateway
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/event"
+)
+
+const (
+	// maxAgentEventSize is the largest single newline delimited event a device
+	// may write to an event stream.
+	maxAgentEventSize = 16 * 1024
+
+	// maxAgentEventFields is the most top level data fields an event may carry
+	maxAgentEventFields = 64
+
+	// maxAgentEventStreams is the most event streams a device may hold open at
+	// once. Further streams are closed as soon as they are accepted.
+	maxAgentEventStreams = 4
+
+	// agentEventRate and agentEventBurst limit the events accepted per second on
+	// each stream. Events beyond the limit are discarded.
+	agentEventRate  = 20
+	agentEventBurst = 100
+)
+
+// agentEventTypes maps the event types a device may push to their bus type
+var agentEventTypes = map[string]string{
+	"alert": event.DeviceAlert,
+	"state": event.DeviceState,
+	"log":   event.DeviceLog,
+}
+
+// agentEvent is the wire format of an event pushed by a device. Devices open a
+// stream on the session and write one JSON encoded agentEvent per line.
+type agentEvent struct {
+	Type string                 `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data"`
+}
+
+// validate ensures the event is well formed before it is accepted onto the bus
+func (t *agentEvent) validate() error {
+	if _, ok := agentEventTypes[t.Type]; !ok {
+		return fmt.Errorf("unsupported event type '%v'", t.Type)
+	}
+
+	switch t.Type {
+	case "alert", "log":
+		if message, ok := t.Data["message"].(string); !ok || message == "" {
+			return fmt.Errorf("%v event requires a non-empty data.message", t.Type)
+		}
+	case "state":
+		if len(t.Data) == 0 {
+			return fmt.Errorf("state event requires data")
+		}
+	}
+
+	if len(t.Data) > maxAgentEventFields {
+		return fmt.Errorf("event data may hold at most %v fields", maxAgentEventFields)
+	}
+
+	if severity, ok := t.Data["severity"]; ok && t.Type == "alert" {
+		switch severity {
+		case "info", "warning", "critical":
+		default:
+			return fmt.Errorf("alert severity must be one of info, warning or critical")
+		}
+	}
+
+	return nil
+}
+
+// eventLimiter is a token bucket limiting the events accepted on a stream
+type eventLimiter struct {
+	tokens float64
+	last   time.Time
+}
+
+func newEventLimiter(now time.Time) *eventLimiter {
+	return &eventLimiter{
+		tokens: agentEventBurst,
+		last:   now,
+	}
+}
+
+// allow reports whether an event arriving at now is within the limit
+func (t *eventLimiter) allow(now time.Time) bool {
+	t.tokens += now.Sub(t.last).Seconds() * agentEventRate
+	t.last = now
+
+	if t.tokens > agentEventBurst {
+		t.tokens = agentEventBurst
+	}
+
+	if t.tokens < 1 {
+		return false
+	}
+
+	t.tokens--
+
+	return true
+}
+
+// eventloop accepts streams opened by the device on its session until the session
+// closes. Each accepted stream is treated as an event stream.
+func (t *Service) eventloop(c *connection) {
+	slots := make(chan struct{}, maxAgentEventStreams)
+
+	for {
+		stream, err := c.session.Accept()
+
+		if err != nil {
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			logger.WithField("id", c.info.ID).Warn("device event stream refused: too many open streams")
+			discardedEvents.WithLabelValues("streams").Inc()
+			stream.Close()
+			continue
+		}
+
+		go func() {
+			defer func() { <-slots }()
+			t.handleEventStream(c, stream)
+		}()
+	}
+}
+
+// handleEventStream reads newline delimited events from a device opened stream,
+// publishing each valid event on the bus. Invalid events are logged and skipped,
+// events beyond the stream's rate limit are discarded.
+func (t *Service) handleEventStream(c *connection, stream net.Conn) {
+	defer stream.Close()
+
+	scanner := bufio.NewScanner(stream)
+	scanner.Buffer(make([]byte, 4096), maxAgentEventSize)
+
+	limiter := newEventLimiter(time.Now())
+	throttled := false
+
+	for scanner.Scan() {
+		line := scanner.Bytes()
+
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+
+		if !limiter.allow(time.Now()) {
+			if !throttled {
+				logger.WithField("id", c.info.ID).Warn("device events discarded: stream exceeds its rate limit")
+				throttled = true
+			}
+
+			discardedEvents.WithLabelValues("throttled").Inc()
+			continue
+		}
+
+		throttled = false
+
+		ae := &agentEvent{}
+
+		if err := json.Unmarshal(line, ae); err != nil {
+			logger.WithFields(logrus.Fields{
+				"id":    c.info.ID,
+				"error": err.Error(),
+			}).Warn("device event discarded: malformed json")
+			discardedEvents.WithLabelValues("malformed").Inc()
+			continue
+		}
+
+		if err := ae.validate(); err != nil {
+			logger.WithFields(logrus.Fields{
+				"id":    c.info.ID,
+				"error": err.Error(),
+			}).Warn("device event discarded: invalid event")
+			discardedEvents.WithLabelValues("invalid").Inc()
+			continue
+		}
+
+		t.Events.Publish(c.newEvent(agentEventTypes[ae.Type], ae.Time, ae.Data))
+	}
+
+	if err := scanner.Err(); err != nil {
+		logger.WithFields(logrus.Fields{
+			"id":    c.info.ID,
+			"error": err.Error(),
+		}).Warn("device event stream closed")
+	}
+}
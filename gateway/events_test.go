@@ -0,0 +1,112 @@
+package gateway
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/deviceio/hub/event"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type EventsTestSuite struct {
+	suite.Suite
+}
+
+func (t *EventsTestSuite) Test_validate() {
+	fields := map[string]interface{}{}
+
+	for i := 0; i <= maxAgentEventFields; i++ {
+		fields[fmt.Sprintf("f%v", i)] = i
+	}
+
+	tests := []struct {
+		name  string
+		event *agentEvent
+		valid bool
+	}{
+		{"alert", &agentEvent{Type: "alert", Data: map[string]interface{}{"message": "disk full"}}, true},
+		{"alert with severity", &agentEvent{Type: "alert", Data: map[string]interface{}{"message": "disk full", "severity": "critical"}}, true},
+		{"alert with unknown severity", &agentEvent{Type: "alert", Data: map[string]interface{}{"message": "disk full", "severity": "fatal"}}, false},
+		{"alert with non-string severity", &agentEvent{Type: "alert", Data: map[string]interface{}{"message": "disk full", "severity": 3.0}}, false},
+		{"alert without message", &agentEvent{Type: "alert", Data: map[string]interface{}{"severity": "info"}}, false},
+		{"alert with empty message", &agentEvent{Type: "alert", Data: map[string]interface{}{"message": ""}}, false},
+		{"alert with non-string message", &agentEvent{Type: "alert", Data: map[string]interface{}{"message": 1.0}}, false},
+		{"log", &agentEvent{Type: "log", Data: map[string]interface{}{"message": "nginx exited"}}, true},
+		{"log with severity", &agentEvent{Type: "log", Data: map[string]interface{}{"message": "nginx exited", "severity": "fatal"}}, true},
+		{"log without data", &agentEvent{Type: "log"}, false},
+		{"state", &agentEvent{Type: "state", Data: map[string]interface{}{"running": false}}, true},
+		{"state without data", &agentEvent{Type: "state", Data: map[string]interface{}{}}, false},
+		{"state with too many fields", &agentEvent{Type: "state", Data: fields}, false},
+		{"missing type", &agentEvent{Data: map[string]interface{}{"message": "disk full"}}, false},
+		{"unknown type", &agentEvent{Type: "device.alert", Data: map[string]interface{}{"message": "disk full"}}, false},
+	}
+
+	for _, test := range tests {
+		err := test.event.validate()
+		assert.Equal(t.T(), test.valid, err == nil, test.name)
+	}
+}
+
+func (t *EventsTestSuite) Test_eventLimiter_allows_a_burst_then_the_rate() {
+	now := time.Now()
+	limiter := newEventLimiter(now)
+
+	for i := 0; i < agentEventBurst; i++ {
+		assert.True(t.T(), limiter.allow(now), "event %v", i)
+	}
+
+	assert.False(t.T(), limiter.allow(now))
+
+	now = now.Add(time.Second)
+
+	for i := 0; i < agentEventRate; i++ {
+		assert.True(t.T(), limiter.allow(now), "event %v", i)
+	}
+
+	assert.False(t.T(), limiter.allow(now))
+
+	now = now.Add(time.Hour)
+
+	for i := 0; i < agentEventBurst; i++ {
+		assert.True(t.T(), limiter.allow(now), "event %v", i)
+	}
+
+	assert.False(t.T(), limiter.allow(now))
+}
+
+func (t *EventsTestSuite) Test_handleEventStream_discards_events_beyond_the_rate_limit() {
+	bus := event.NewBus()
+	sub := bus.Subscribe(10*agentEventBurst, "device.*")
+	defer sub.Close()
+
+	service := &Service{Events: bus}
+	conn := &connection{info: &connectionInfo{ID: "D1", Hostname: "web01"}}
+
+	device, hub := net.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		service.handleEventStream(conn, hub)
+		close(done)
+	}()
+
+	line := `{"type":"log","data":{"message":"nginx exited"}}` + "\n"
+	device.Write([]byte(strings.Repeat(line, 2*agentEventBurst)))
+	device.Close()
+	<-done
+
+	// the stream is read within a few milliseconds, refilling at most a token
+	assert.InDelta(t.T(), agentEventBurst, len(sub.C), 1)
+
+	e := <-sub.C
+	assert.Equal(t.T(), event.DeviceLog, e.Type)
+	assert.Equal(t.T(), "d1", e.DeviceID)
+}
+
+func TestEventsTestSuite(t *testing.T) {
+	suite.Run(t, new(EventsTestSuite))
+}
@@ -0,0 +1,5 @@
+package gateway
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("gateway")
@@ -0,0 +1,46 @@
+package gateway
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	connectedDevices = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "deviceio_hub_gateway_connected_devices",
+		Help: "Number of devices currently connected to this gateway",
+	})
+
+	deviceConnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "deviceio_hub_gateway_connects_total",
+		Help: "Number of device connections accepted by the gateway",
+	})
+
+	deviceDisconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "deviceio_hub_gateway_disconnects_total",
+		Help: "Number of device connections closed",
+	})
+
+	handshakeFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deviceio_hub_gateway_handshake_failures_total",
+		Help: "Number of device connections rejected during the handshake by reason",
+	}, []string{"reason"})
+
+	discardedEvents = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deviceio_hub_gateway_discarded_events_total",
+		Help: "Number of device events and event streams discarded by reason",
+	}, []string{"reason"})
+
+	activeStreams = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "deviceio_hub_gateway_active_streams",
+		Help: "Number of open yamux streams across all device connections",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		connectedDevices,
+		deviceConnects,
+		deviceDisconnects,
+		handshakeFailures,
+		discardedEvents,
+		activeStreams,
+	)
+}
@@ -11,6 +11,9 @@ import (
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/health"
+	"github.com/deviceio/hub/trace"
 	"github.com/deviceio/shared/types"
 
 	"strings"
@@ -29,13 +32,21 @@ type Service struct {
 	BindAddr    string
 	TLSCertPath string
 	TLSKeyPath  string
-	conns       *serviceConnections
+
+	// Events receives events pushed by connected devices
+	Events *event.Bus
+
+	// Admit decides if a device may connect. Every device is admitted if nil.
+	Admit func(id string, hostname string) bool
+
+	conns    *serviceConnections
+	listener health.Listener
 }
 
 func (t *Service) Start() {
 	t.init()
 
-	logrus.WithFields(logrus.Fields{
+	logger.WithFields(logrus.Fields{
 		"bindAddr": t.BindAddr,
 	}).Info("gateway starting")
 
@@ -45,14 +56,15 @@ func (t *Service) Start() {
 	if t.TLSCertPath == "" && t.TLSKeyPath == "" {
 		certpath, keypath = t.makeTempCertificates()
 
-		logrus.WithField("cert", certpath).Info("gateway temporary certificate")
-		logrus.WithField("key", keypath).Info("gateway temporary key")
+		logger.WithField("cert", certpath).Info("gateway temporary certificate")
+		logger.WithField("key", keypath).Info("gateway temporary key")
 	}
 
 	cer, err := tls.LoadX509KeyPair(certpath, keypath)
 
 	if err != nil {
-		logrus.Fatal("error loading gateway certificates", err.Error())
+		t.listener.Failed(t.BindAddr, err)
+		logger.WithField("error", err.Error()).Error("error loading gateway certificates")
 		return
 	}
 
@@ -61,10 +73,13 @@ func (t *Service) Start() {
 	})
 
 	if err != nil {
-		logrus.Fatal("error starting gateway tls listener", err.Error())
+		t.listener.Failed(t.BindAddr, err)
+		logger.WithField("error", err.Error()).Error("error starting gateway tls listener")
 		return
 	}
 
+	t.listener.Bound(t.BindAddr, cer)
+
 	defer ln.Close()
 	defer os.Remove(certpath)
 	defer os.Remove(keypath)
@@ -72,7 +87,7 @@ func (t *Service) Start() {
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
-			logrus.Info("error accepting gateway connection", err.Error())
+			logger.Info("error accepting gateway connection", err.Error())
 			continue
 		}
 
@@ -80,6 +95,32 @@ func (t *Service) Start() {
 	}
 }
 
+// Health reports the gateway listener and the number of connected devices
+func (t *Service) Health() *health.Component {
+	c := t.listener.Component("gateway")
+	c.Details["connectedDevices"] = t.connectedDevices()
+
+	return c
+}
+
+// connectedDevices counts the connections indexed by both device id and hostname
+func (t *Service) connectedDevices() int {
+	if t.conns == nil {
+		return 0
+	}
+
+	t.conns.RLock()
+	defer t.conns.RUnlock()
+
+	conns := map[*connection]bool{}
+
+	for _, c := range t.conns.items {
+		conns[c] = true
+	}
+
+	return len(conns)
+}
+
 func (t *Service) ProxyHTTPRequest(deviceid string, path string, rw http.ResponseWriter, r *http.Request) error {
 	if deviceid == "" {
 		return stacktrace.NewError("deviceid is empty")
@@ -93,15 +134,28 @@ func (t *Service) ProxyHTTPRequest(deviceid string, path string, rw http.Respons
 		return stacktrace.NewError("http.Request is nil")
 	}
 
+	ctx, span := trace.StartSpan(r.Context(), "gateway.ProxyHTTPRequest", trace.SpanKindClient)
+	defer span.Finish()
+
+	span.SetAttribute("device.id", deviceid)
+	span.SetAttribute("device.path", "/"+path)
+
 	c, err := t.findConnectionForDevice(deviceid)
 
 	if err != nil {
+		span.SetError(err)
 		return stacktrace.Propagate(err, "gateway failed to locate device")
 	}
 
+	// the device receives X-Request-ID as sent by the api and the traceparent of
+	// this span
+	r = r.WithContext(ctx)
+	trace.Inject(r)
+
 	err = c.proxyRequest(rw, r, path)
 
 	if err != nil {
+		span.SetError(err)
 		return stacktrace.Propagate(err, "gateway failed to proxy on connection")
 	}
 
@@ -120,7 +174,8 @@ func (t *Service) handleConnection(conn net.Conn) {
 	var err error
 
 	if gwconn, err = newConnection(conn); err != nil {
-		logrus.Error("Failed to create gateway connection:", err.Error())
+		handshakeFailures.WithLabelValues("handshake").Inc()
+		logger.Error("Failed to create gateway connection:", err.Error())
 		return
 	}
 
@@ -130,23 +185,36 @@ func (t *Service) handleConnection(conn net.Conn) {
 	id := strings.ToLower(gwconn.info.ID)
 	hostname := strings.ToLower(gwconn.info.Hostname)
 
+	if t.Admit != nil && !t.Admit(id, hostname) {
+		logger.WithFields(logrus.Fields{
+			"id":         id,
+			"hostname":   hostname,
+			"remoteAddr": gwconn.conn.RemoteAddr().String(),
+		}).Warn("device connection refused")
+		handshakeFailures.WithLabelValues("refused").Inc()
+		gwconn.conn.Close()
+		return
+	}
+
 	if c, cok := t.conns.items[id]; cok {
-		logrus.WithFields(logrus.Fields{
-			"id": id,
+		logger.WithFields(logrus.Fields{
+			"id":                   id,
 			"connectedDeviceAddr":  c.conn.RemoteAddr().String(),
 			"connectingDeviceAddr": gwconn.conn.RemoteAddr().String(),
 		}).Error("device connections closed due to duplicate id")
+		handshakeFailures.WithLabelValues("duplicate_id").Inc()
 		c.conn.Close()
 		gwconn.conn.Close()
 		return
 	}
 
 	if c, hok := t.conns.items[hostname]; hok {
-		logrus.WithFields(logrus.Fields{
+		logger.WithFields(logrus.Fields{
 			"hostname":             hostname,
 			"connectedDeviceAddr":  c.conn.RemoteAddr().String(),
 			"connectingDeviceAddr": gwconn.conn.RemoteAddr().String(),
 		}).Error("device connections closed due to duplicate hostname")
+		handshakeFailures.WithLabelValues("duplicate_hostname").Inc()
 		c.conn.Close()
 		gwconn.conn.Close()
 		return
@@ -155,7 +223,10 @@ func (t *Service) handleConnection(conn net.Conn) {
 	t.conns.items[id] = gwconn
 	t.conns.items[hostname] = gwconn
 
-	logrus.WithFields(logrus.Fields{
+	connectedDevices.Inc()
+	deviceConnects.Inc()
+
+	logger.WithFields(logrus.Fields{
 		"localAddr":    conn.LocalAddr(),
 		"remoteAddr":   conn.RemoteAddr(),
 		"id":           gwconn.info.ID,
@@ -165,7 +236,10 @@ func (t *Service) handleConnection(conn net.Conn) {
 		"tags":         gwconn.info.Tags,
 	}).Info("device connected")
 
+	t.Events.Publish(gwconn.newEvent(event.DeviceConnected, time.Time{}, gwconn.eventData()))
+
 	go t.closeloop(gwconn)
+	go t.eventloop(gwconn)
 }
 
 func (t *Service) makeTempCertificates() (string, string) {
@@ -186,12 +260,12 @@ func (t *Service) makeTempCertificates() (string, string) {
 	certBytes, keyBytes = certgen.Generate()
 
 	if certTemp, err = ioutil.TempFile("", "deviceio-hub"); err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	defer certTemp.Close()
 
 	if keyTemp, err = ioutil.TempFile("", "deviceio-hub"); err != nil {
-		logrus.Fatal(err.Error())
+		logger.Fatal(err.Error())
 	}
 	defer keyTemp.Close()
 
@@ -221,9 +295,15 @@ func (t *Service) findConnectionForDevice(deviceid string) (*connection, error)
 }
 
 func (t *Service) closeloop(c *connection) {
+	streams := 0
+
 	for {
 		if c.session.IsClosed() {
-			logrus.WithFields(logrus.Fields{
+			connectedDevices.Dec()
+			deviceDisconnects.Inc()
+			activeStreams.Add(float64(-streams))
+
+			logger.WithFields(logrus.Fields{
 				"localAddr":    c.conn.LocalAddr(),
 				"remoteAddr":   c.conn.RemoteAddr(),
 				"id":           c.info.ID,
@@ -233,6 +313,8 @@ func (t *Service) closeloop(c *connection) {
 				"tags":         c.info.Tags,
 			}).Info("device disconnected")
 
+			t.Events.Publish(c.newEvent(event.DeviceDisconnected, time.Time{}, c.eventData()))
+
 			t.conns.Lock()
 			defer t.conns.Unlock()
 
@@ -249,6 +331,11 @@ func (t *Service) closeloop(c *connection) {
 
 			return
 		}
+
+		n := c.session.NumStreams()
+		activeStreams.Add(float64(n - streams))
+		streams = n
+
 		time.Sleep(1 * time.Second)
 	}
 }
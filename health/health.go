@@ -0,0 +1,171 @@
+package health
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+)
+
+// certExpiryWarning is how close to expiry a certificate is reported as expiring
+const certExpiryWarning = 14 * 24 * time.Hour
+
+// Component is the health of a single hub component
+type Component struct {
+	Name string `json:"name"`
+
+	// Ready is false when the hub should not receive traffic because of this component
+	Ready bool `json:"ready"`
+
+	// Error describes why the component is not ready
+	Error string `json:"error,omitempty"`
+
+	// Details carries component specific information such as cache load state
+	Details map[string]interface{} `json:"details,omitempty"`
+}
+
+// Reporter is implemented by components reporting their health
+type Reporter interface {
+	Health() *Component
+}
+
+// ReporterFunc adapts a function to a Reporter
+type ReporterFunc func() *Component
+
+// Health calls the function
+func (t ReporterFunc) Health() *Component {
+	return t()
+}
+
+// Report is the readiness of the hub as a whole
+type Report struct {
+	Ready      bool         `json:"ready"`
+	Time       time.Time    `json:"time"`
+	Components []*Component `json:"components"`
+}
+
+// Check collects the health of every reporter. The hub is ready when every
+// component is ready.
+func Check(reporters []Reporter) *Report {
+	report := &Report{
+		Ready:      true,
+		Time:       time.Now().UTC(),
+		Components: []*Component{},
+	}
+
+	for _, reporter := range reporters {
+		component := reporter.Health()
+
+		if !component.Ready {
+			report.Ready = false
+		}
+
+		report.Components = append(report.Components, component)
+	}
+
+	return report
+}
+
+// Certificate describes the validity of a tls certificate
+type Certificate struct {
+	Subject  string    `json:"subject"`
+	NotAfter time.Time `json:"notAfter"`
+	Expiring bool      `json:"expiring"`
+	Expired  bool      `json:"expired"`
+}
+
+// DescribeCertificate returns the validity of the leaf of a tls certificate, or
+// nil if it cannot be parsed
+func DescribeCertificate(cert tls.Certificate) *Certificate {
+	if len(cert.Certificate) == 0 {
+		return nil
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+
+	if err != nil {
+		return nil
+	}
+
+	now := time.Now()
+
+	return &Certificate{
+		Subject:  leaf.Subject.CommonName,
+		NotAfter: leaf.NotAfter.UTC(),
+		Expiring: now.Add(certExpiryWarning).After(leaf.NotAfter),
+		Expired:  now.After(leaf.NotAfter),
+	}
+}
+
+// Listener tracks the state of a network listener. The zero value is a listener
+// that has not started.
+type Listener struct {
+	mu        sync.Mutex
+	addr      string
+	listening bool
+	err       string
+	cert      *tls.Certificate
+}
+
+// Bound records that the listener is accepting connections with the certificate
+func (t *Listener) Bound(addr string, cert tls.Certificate) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.addr = addr
+	t.listening = true
+	t.err = ""
+	t.cert = &cert
+}
+
+// Failed records that the listener could not be started or stopped serving
+func (t *Listener) Failed(addr string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.addr = addr
+	t.listening = false
+	t.err = err.Error()
+}
+
+// Listening reports if the listener is accepting connections
+func (t *Listener) Listening() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.listening
+}
+
+// Component reports the listener as a component with the given name. Listeners
+// that are not bound or whose certificate has expired are not ready.
+func (t *Listener) Component(name string) *Component {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	c := &Component{
+		Name:  name,
+		Ready: t.listening,
+		Error: t.err,
+		Details: map[string]interface{}{
+			"bindAddr":  t.addr,
+			"listening": t.listening,
+		},
+	}
+
+	if !t.listening && c.Error == "" {
+		c.Error = "listener not started"
+	}
+
+	if t.cert != nil {
+		if cert := DescribeCertificate(*t.cert); cert != nil {
+			c.Details["certificate"] = cert
+
+			if cert.Expired {
+				c.Ready = false
+				c.Error = "tls certificate expired"
+			}
+		}
+	}
+
+	return c
+}
@@ -0,0 +1,56 @@
+package health
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type HealthTestSuite struct {
+	suite.Suite
+}
+
+func component(name string, ready bool) Reporter {
+	return ReporterFunc(func() *Component {
+		return &Component{Name: name, Ready: ready}
+	})
+}
+
+func (t *HealthTestSuite) Test_Check_is_ready_when_every_component_is_ready() {
+	report := Check([]Reporter{component("a", true), component("b", true)})
+
+	assert.True(t.T(), report.Ready)
+	assert.Equal(t.T(), 2, len(report.Components))
+}
+
+func (t *HealthTestSuite) Test_Check_is_not_ready_when_any_component_is_not_ready() {
+	report := Check([]Reporter{component("a", true), component("b", false)})
+
+	assert.False(t.T(), report.Ready)
+}
+
+func (t *HealthTestSuite) Test_Listener_is_not_ready_until_bound() {
+	listener := &Listener{}
+
+	c := listener.Component("gateway")
+
+	assert.False(t.T(), c.Ready)
+	assert.Equal(t.T(), "listener not started", c.Error)
+}
+
+func (t *HealthTestSuite) Test_Listener_reports_bind_failure() {
+	listener := &Listener{}
+	listener.Failed(":8975", errors.New("address already in use"))
+
+	c := listener.Component("gateway")
+
+	assert.False(t.T(), c.Ready)
+	assert.Equal(t.T(), "address already in use", c.Error)
+	assert.Equal(t.T(), ":8975", c.Details["bindAddr"])
+}
+
+func TestHealthTestSuite(t *testing.T) {
+	suite.Run(t, new(HealthTestSuite))
+}
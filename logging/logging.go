@@ -0,0 +1,92 @@
+package logging
+
+import (
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/palantir/stacktrace"
+)
+
+// Options configures the hub logging subsystem
+type Options struct {
+	// Level is the minimum level logged: debug, info, warn, error, fatal or panic
+	Level string
+
+	// Format is text or json
+	Format string
+
+	// File is the path of a log file. Logs are written to stderr when empty.
+	File string
+
+	// MaxSize is the size in megabytes at which File is rotated. Defaults to 100.
+	MaxSize int
+
+	// MaxBackups is the number of rotated files retained. Defaults to 5.
+	MaxBackups int
+}
+
+// Configure applies the options to the standard logrus logger. Every formatter is
+// wrapped to redact credentials. Output from the standard library log package is
+// routed through logrus so it is redacted as well.
+func Configure(opts *Options) error {
+	level, err := logrus.ParseLevel(defaultString(opts.Level, "info"))
+
+	if err != nil {
+		return stacktrace.Propagate(err, "invalid log level '%v'", opts.Level)
+	}
+
+	var formatter logrus.Formatter
+
+	switch strings.ToLower(defaultString(opts.Format, "text")) {
+	case "text":
+		formatter = &logrus.TextFormatter{
+			FullTimestamp: true,
+		}
+	case "json":
+		formatter = &logrus.JSONFormatter{}
+	default:
+		return stacktrace.NewError("invalid log format '%v'. must be text or json", opts.Format)
+	}
+
+	var out io.Writer = os.Stderr
+
+	if opts.File != "" {
+		file, err := NewRotatingFile(opts.File, opts.MaxSize, opts.MaxBackups)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to open log file")
+		}
+
+		out = file
+	}
+
+	logrus.SetLevel(level)
+	logrus.SetFormatter(&RedactingFormatter{Formatter: formatter})
+	logrus.SetOutput(out)
+
+	log.SetFlags(0)
+	log.SetOutput(logrus.StandardLogger().Writer())
+
+	return nil
+}
+
+// Component returns a log entry tagged with the named hub component such as api,
+// cluster or gateway
+func Component(name string) *logrus.Entry {
+	return logrus.WithField("component", name)
+}
+
+func defaultString(value string, def string) string {
+	if value == "" {
+		return def
+	}
+
+	return value
+}
+
+func init() {
+	logrus.SetFormatter(&RedactingFormatter{Formatter: &logrus.TextFormatter{}})
+}
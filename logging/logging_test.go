@@ -0,0 +1,133 @@
+package logging
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type LoggingTestSuite struct {
+	suite.Suite
+	out    *bytes.Buffer
+	logger *logrus.Logger
+}
+
+func (t *LoggingTestSuite) SetupTest() {
+	t.out = &bytes.Buffer{}
+	t.logger = logrus.New()
+	t.logger.Out = t.out
+	t.logger.Formatter = &RedactingFormatter{Formatter: &logrus.JSONFormatter{}}
+}
+
+func (t *LoggingTestSuite) Test_sensitive_fields_are_redacted() {
+	t.logger.WithFields(logrus.Fields{
+		"authorization": "DEVICEIO-HUB-AUTH admin:c2lnbmF0dXJl",
+		"db_pass":       "hunter2",
+		"totpSecret":    "JBSWY3DPEHPK3PXP",
+		"remoteAddr":    "10.0.0.1:5000",
+	}).Error("authentication failed")
+
+	assert.NotContains(t.T(), t.out.String(), "c2lnbmF0dXJl")
+	assert.NotContains(t.T(), t.out.String(), "hunter2")
+	assert.NotContains(t.T(), t.out.String(), "JBSWY3DPEHPK3PXP")
+	assert.Contains(t.T(), t.out.String(), "10.0.0.1:5000")
+}
+
+func (t *LoggingTestSuite) Test_IsSensitive_matches_field_names_exactly() {
+	tests := []struct {
+		name      string
+		sensitive bool
+	}{
+		{"token", true},
+		{"Token", true},
+		{"private_key", true},
+		{"api-key", true},
+		{"Set-Cookie", true},
+		{"hmacSecret", true},
+		{"tokenId", false},
+		{"tokens", false},
+		{"hmacKey", false},
+		{"keyId", false},
+		{"passes", false},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t.T(), test.sensitive, IsSensitive(test.name), test.name)
+	}
+}
+
+func (t *LoggingTestSuite) Test_embedded_credentials_are_redacted() {
+	t.logger.WithField("error", errors.New("bad header 'Bearer abc.def.ghi'")).
+		Error("rejected DEVICEIO-HUB-AUTH admin:c2lnbmF0dXJl")
+
+	assert.NotContains(t.T(), t.out.String(), "abc.def.ghi")
+	assert.NotContains(t.T(), t.out.String(), "c2lnbmF0dXJl")
+	assert.Contains(t.T(), t.out.String(), "Bearer "+Redacted)
+	assert.Contains(t.T(), t.out.String(), "DEVICEIO-HUB-AUTH "+Redacted)
+}
+
+func (t *LoggingTestSuite) Test_hmac_and_ssh_credentials_are_redacted() {
+	t.logger.WithField("header", "DEVICEIO-HUB-SSH admin:laptop:c3NoLXNpZw==").
+		Error("rejected DEVICEIO-HUB-HMAC 0a1b2c3d:aG1hYy1zaWc=")
+
+	assert.NotContains(t.T(), t.out.String(), "c3NoLXNpZw==")
+	assert.NotContains(t.T(), t.out.String(), "aG1hYy1zaWc=")
+	assert.Contains(t.T(), t.out.String(), "DEVICEIO-HUB-SSH "+Redacted)
+	assert.Contains(t.T(), t.out.String(), "DEVICEIO-HUB-HMAC "+Redacted)
+}
+
+func (t *LoggingTestSuite) Test_entry_data_is_not_mutated() {
+	entry := t.logger.WithField("password", "hunter2")
+	entry.Info("first")
+
+	assert.Equal(t.T(), "hunter2", entry.Data["password"])
+}
+
+func (t *LoggingTestSuite) Test_RotatingFile_rotates_at_max_size() {
+	dir, err := ioutil.TempDir("", "deviceio-hub-logging")
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "hub.log")
+	file, err := NewRotatingFile(path, 1, 2)
+
+	if err != nil {
+		t.T().Fatal(err)
+	}
+
+	defer file.Close()
+
+	line := []byte(strings.Repeat("x", 400*1024) + "\n")
+
+	for i := 0; i < 8; i++ {
+		file.Write(line)
+	}
+
+	_, err = os.Stat(path + ".1")
+	assert.Nil(t.T(), err)
+
+	_, err = os.Stat(path + ".2")
+	assert.Nil(t.T(), err)
+
+	_, err = os.Stat(path + ".3")
+	assert.True(t.T(), os.IsNotExist(err))
+
+	info, _ := os.Stat(path)
+	assert.True(t.T(), info.Size() <= 1024*1024)
+}
+
+func TestLoggingTestSuite(t *testing.T) {
+	suite.Run(t, new(LoggingTestSuite))
+}
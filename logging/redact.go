@@ -0,0 +1,89 @@
+package logging
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// Redacted replaces sensitive values in log output
+const Redacted = "[REDACTED]"
+
+// sensitiveFields are the field names whose values are always redacted, in
+// lowercase without underscores or dashes. Names are matched exactly so fields
+// identifying a credential, such as tokenId or hmacKey, are still logged.
+var sensitiveFields = map[string]bool{
+	"authorization": true,
+	"pass":          true,
+	"password":      true,
+	"passwd":        true,
+	"dbpass":        true,
+	"secret":        true,
+	"clientsecret":  true,
+	"hmacsecret":    true,
+	"totp":          true,
+	"totpsecret":    true,
+	"token":         true,
+	"accesstoken":   true,
+	"refreshtoken":  true,
+	"idtoken":       true,
+	"signature":     true,
+	"privatekey":    true,
+	"cookie":        true,
+	"setcookie":     true,
+	"apikey":        true,
+}
+
+// credentialPattern matches credentials embedded in free text such as an
+// Authorization header value quoted in an error message
+var credentialPattern = regexp.MustCompile(`(?i)\b(DEVICEIO-HUB-AUTH|DEVICEIO-HUB-HMAC|DEVICEIO-HUB-SSH|Bearer|Basic|HMAC-SHA256)\s+[^\s"',]+`)
+
+// RedactingFormatter removes credentials from entries before delegating to the
+// wrapped formatter
+type RedactingFormatter struct {
+	Formatter logrus.Formatter
+}
+
+func (t *RedactingFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	redacted := *entry
+	redacted.Message = RedactString(entry.Message)
+	redacted.Data = make(logrus.Fields, len(entry.Data))
+
+	for key, value := range entry.Data {
+		redacted.Data[key] = redactField(key, value)
+	}
+
+	return t.Formatter.Format(&redacted)
+}
+
+// RedactString replaces credentials embedded in s
+func RedactString(s string) string {
+	return credentialPattern.ReplaceAllString(s, "$1 "+Redacted)
+}
+
+// IsSensitive reports if values of the named field must never be logged
+func IsSensitive(name string) bool {
+	name = strings.ToLower(name)
+	name = strings.NewReplacer("_", "", "-", "").Replace(name)
+
+	return sensitiveFields[name]
+}
+
+func redactField(key string, value interface{}) interface{} {
+	if IsSensitive(key) {
+		return Redacted
+	}
+
+	switch v := value.(type) {
+	case string:
+		return RedactString(v)
+	case error:
+		return RedactString(v.Error())
+	case fmt.Stringer:
+		return RedactString(v.String())
+	}
+
+	return value
+}
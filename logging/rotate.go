@@ -0,0 +1,115 @@
+package logging
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// RotatingFile is an io.Writer appending to a file that is rotated once it reaches
+// a maximum size. Rotated files are renamed <path>.1 through <path>.<MaxBackups>
+// with .1 the most recent.
+type RotatingFile struct {
+	path       string
+	maxBytes   int64
+	maxBackups int
+	file       *os.File
+	size       int64
+	mu         *sync.Mutex
+}
+
+// NewRotatingFile opens or creates the file at path for appending
+func NewRotatingFile(path string, maxSizeMB int, maxBackups int) (*RotatingFile, error) {
+	if maxSizeMB <= 0 {
+		maxSizeMB = 100
+	}
+
+	if maxBackups <= 0 {
+		maxBackups = 5
+	}
+
+	t := &RotatingFile{
+		path:       path,
+		maxBytes:   int64(maxSizeMB) * 1024 * 1024,
+		maxBackups: maxBackups,
+		mu:         &sync.Mutex{},
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create log directory")
+	}
+
+	if err := t.open(); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *RotatingFile) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.size+int64(len(p)) > t.maxBytes && t.size > 0 {
+		if err := t.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := t.file.Write(p)
+	t.size += int64(n)
+
+	return n, err
+}
+
+func (t *RotatingFile) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.file.Close()
+}
+
+func (t *RotatingFile) open() error {
+	file, err := os.OpenFile(t.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to open log file '%v'", t.path)
+	}
+
+	info, err := file.Stat()
+
+	if err != nil {
+		file.Close()
+		return stacktrace.Propagate(err, "failed to stat log file '%v'", t.path)
+	}
+
+	t.file = file
+	t.size = info.Size()
+
+	return nil
+}
+
+func (t *RotatingFile) rotate() error {
+	if err := t.file.Close(); err != nil {
+		return stacktrace.Propagate(err, "failed to close log file for rotation")
+	}
+
+	os.Remove(t.backup(t.maxBackups))
+
+	for i := t.maxBackups - 1; i >= 1; i-- {
+		os.Rename(t.backup(i), t.backup(i+1))
+	}
+
+	if err := os.Rename(t.path, t.backup(1)); err != nil {
+		return stacktrace.Propagate(err, "failed to rotate log file")
+	}
+
+	return t.open()
+}
+
+func (t *RotatingFile) backup(n int) string {
+	return fmt.Sprintf("%v.%v", t.path, n)
+}
@@ -0,0 +1,91 @@
+package oidc
+
+// Mapping maps the claims of id tokens onto hub users and roles
+type Mapping struct {
+	// LoginClaim is the claim used as the hub login, preferred_username if empty
+	LoginClaim string
+
+	// EmailClaim is the claim used as the email of the hub user, email if empty
+	EmailClaim string
+
+	// GroupsClaim lists the groups of the user, groups if empty
+	GroupsClaim string
+
+	// AllowedGroups, if not empty, are the groups permitted to log in
+	AllowedGroups []string
+
+	// AdminGroups, if not empty, are the groups whose members are hub admins. The
+	// admin role of users logging in is then kept in step with their groups. If
+	// empty, the admin role is managed on the hub only.
+	AdminGroups []string
+}
+
+// Identity is a user as asserted by the identity provider
+type Identity struct {
+	Issuer        string
+	Subject       string
+	Login         string
+	Email         string
+	EmailVerified bool
+	Groups        []string
+
+	// Admin is set if the user is a member of one of the admin groups
+	Admin bool
+
+	// RoleManaged is set if the admin groups decide Admin
+	RoleManaged bool
+}
+
+// Identity returns the identity the token asserts, failing if its groups are not
+// permitted to log in
+func (t *Mapping) Identity(token *IDToken) (*Identity, error) {
+	identity := &Identity{
+		Issuer:        token.Issuer,
+		Subject:       token.Subject,
+		Login:         stringClaim(token.Claims, orDefault(t.LoginClaim, "preferred_username")),
+		Email:         stringClaim(token.Claims, orDefault(t.EmailClaim, "email")),
+		EmailVerified: boolClaim(token.Claims, "email_verified"),
+		Groups:        stringsClaim(token.Claims, orDefault(t.GroupsClaim, "groups")),
+		RoleManaged:   len(t.AdminGroups) > 0,
+	}
+
+	if identity.Login == "" {
+		return nil, &Rejected{
+			Reason: "id token has no '" + orDefault(t.LoginClaim, "preferred_username") + "' claim to use as the login",
+		}
+	}
+
+	if identity.Email == "" {
+		return nil, &Rejected{
+			Reason: "id token has no '" + orDefault(t.EmailClaim, "email") + "' claim to use as the email",
+		}
+	}
+
+	if len(t.AllowedGroups) > 0 && !memberOf(identity.Groups, t.AllowedGroups) {
+		return nil, &Rejected{
+			Reason: "user '" + identity.Login + "' is not in a group permitted to log in",
+		}
+	}
+
+	identity.Admin = memberOf(identity.Groups, t.AdminGroups)
+
+	return identity, nil
+}
+
+func memberOf(groups []string, of []string) bool {
+	for _, group := range groups {
+		if containsString(of, group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func orDefault(value string, fallback string) string {
+	if value == "" {
+		return fallback
+	}
+
+	return value
+}
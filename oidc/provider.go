@@ -0,0 +1,272 @@
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Config identifies the identity provider and the hub's registration with it
+type Config struct {
+	// Issuer is the provider's issuer url. Its discovery document is fetched from
+	// <Issuer>/.well-known/openid-configuration.
+	Issuer string
+
+	ClientID     string
+	ClientSecret string
+
+	// RedirectURL is the hub's callback url registered with the provider
+	RedirectURL string
+
+	// Scopes are requested in addition to openid
+	Scopes []string
+
+	// HTTPClient makes the requests to the provider. http.DefaultClient is used
+	// if nil.
+	HTTPClient *http.Client
+}
+
+// discovery is the subset of the provider's discovery document the hub uses
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Provider runs the authorization code flow with PKCE against an OpenID
+// Connect provider and verifies the id tokens it issues
+type Provider struct {
+	config *Config
+
+	mu          sync.Mutex
+	discovery   *discovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+// AuthRequest holds the values binding an authorization request to its
+// callback. They must be kept by the client, never sent to the provider as is.
+type AuthRequest struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+}
+
+// Rejected is returned when a login is not accepted: the provider reported an
+// error, the id token failed verification, or the identity is not permitted
+type Rejected struct {
+	Reason string
+}
+
+func (t *Rejected) Error() string {
+	return t.Reason
+}
+
+// NewProvider returns the provider of the config. Discovery happens on first use.
+func NewProvider(config *Config) *Provider {
+	return &Provider{
+		config: config,
+	}
+}
+
+// NewAuthRequest generates a random state, nonce and PKCE verifier
+func NewAuthRequest() (*AuthRequest, error) {
+	values := make([]string, 3)
+
+	for i := range values {
+		b := make([]byte, 32)
+
+		if _, err := rand.Read(b); err != nil {
+			return nil, stacktrace.Propagate(err, "error generating auth request")
+		}
+
+		values[i] = base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	return &AuthRequest{
+		State:    values[0],
+		Nonce:    values[1],
+		Verifier: values[2],
+	}, nil
+}
+
+// Challenge returns the S256 PKCE code challenge of the verifier
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// AuthCodeURL returns the provider url the user is sent to to log in
+func (t *Provider) AuthCodeURL(req *AuthRequest) (string, error) {
+	d, err := t.discover()
+
+	if err != nil {
+		return "", err
+	}
+
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {t.config.ClientID},
+		"redirect_uri":          {t.config.RedirectURL},
+		"scope":                 {strings.Join(append([]string{"openid"}, t.config.Scopes...), " ")},
+		"state":                 {req.State},
+		"nonce":                 {req.Nonce},
+		"code_challenge":        {Challenge(req.Verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+
+	return d.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code of the callback for the request and
+// returns the verified id token
+func (t *Provider) Exchange(code string, req *AuthRequest) (*IDToken, error) {
+	d, err := t.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {t.config.RedirectURL},
+		"client_id":     {t.config.ClientID},
+		"code_verifier": {req.Verifier},
+	}
+
+	r, err := http.NewRequest("POST", d.TokenEndpoint, strings.NewReader(form.Encode()))
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create token request")
+	}
+
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.Header.Set("Accept", "application/json")
+
+	if t.config.ClientSecret != "" {
+		r.SetBasicAuth(url.QueryEscape(t.config.ClientID), url.QueryEscape(t.config.ClientSecret))
+	}
+
+	resp, err := t.client().Do(r)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "token request failed")
+	}
+
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read token response")
+	}
+
+	tokens := struct {
+		IDToken          string `json:"id_token"`
+		Error            string `json:"error"`
+		ErrorDescription string `json:"error_description"`
+	}{}
+
+	if err = json.Unmarshal(body, &tokens); err != nil && resp.StatusCode == http.StatusOK {
+		return nil, stacktrace.Propagate(err, "failed to decode token response")
+	}
+
+	if tokens.Error != "" {
+		return nil, &Rejected{
+			Reason: "token request refused: " + strings.TrimSpace(tokens.Error+" "+tokens.ErrorDescription),
+		}
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, stacktrace.NewError("token request failed with status %v", resp.StatusCode)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, &Rejected{
+			Reason: "token response has no id_token",
+		}
+	}
+
+	return t.Verify(tokens.IDToken, req.Nonce)
+}
+
+// discover fetches and caches the provider's discovery document
+func (t *Provider) discover() (*discovery, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.discovery != nil {
+		return t.discovery, nil
+	}
+
+	d := &discovery{}
+
+	if err := t.getJSON(strings.TrimSuffix(t.config.Issuer, "/")+"/.well-known/openid-configuration", d); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to discover openid provider '%v'", t.config.Issuer)
+	}
+
+	if d.Issuer != t.config.Issuer {
+		return nil, stacktrace.NewError("openid provider reports issuer '%v', expected '%v'", d.Issuer, t.config.Issuer)
+	}
+
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JWKSURI == "" {
+		return nil, stacktrace.NewError("openid provider '%v' discovery document is missing endpoints", t.config.Issuer)
+	}
+
+	t.discovery = d
+
+	return d, nil
+}
+
+func (t *Provider) getJSON(u string, v interface{}) error {
+	r, err := http.NewRequest("GET", u, nil)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to create request")
+	}
+
+	r.Header.Set("Accept", "application/json")
+
+	resp, err := t.client().Do(r)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "request to '%v' failed", u)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return stacktrace.NewError("request to '%v' failed with status %v", u, resp.StatusCode)
+	}
+
+	if err = json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return stacktrace.Propagate(err, "failed to decode response of '%v'", u)
+	}
+
+	return nil
+}
+
+func (t *Provider) client() *http.Client {
+	if t.config.HTTPClient != nil {
+		return t.config.HTTPClient
+	}
+
+	return http.DefaultClient
+}
@@ -0,0 +1,348 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+// stubIdP is a local OpenID Connect provider issuing id tokens for the claims
+// of the test
+type stubIdP struct {
+	server *httptest.Server
+	rsaKey *rsa.PrivateKey
+	ecKey  *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	codes  map[string]url.Values
+	claims map[string]interface{}
+}
+
+func newStubIdP() *stubIdP {
+	t := &stubIdP{
+		codes: map[string]url.Values{},
+	}
+
+	t.rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	t.ecKey, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", t.httpDiscovery)
+	mux.HandleFunc("/authorize", t.httpAuthorize)
+	mux.HandleFunc("/token", t.httpToken)
+	mux.HandleFunc("/jwks", t.httpJWKS)
+
+	t.server = httptest.NewServer(mux)
+
+	return t
+}
+
+func (t *stubIdP) httpDiscovery(rw http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(rw).Encode(map[string]string{
+		"issuer":                 t.server.URL,
+		"authorization_endpoint": t.server.URL + "/authorize",
+		"token_endpoint":         t.server.URL + "/token",
+		"jwks_uri":               t.server.URL + "/jwks",
+	})
+}
+
+// httpAuthorize logs the user in at once, redirecting back with a code
+func (t *stubIdP) httpAuthorize(rw http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	if query.Get("code_challenge_method") != "S256" || query.Get("response_type") != "code" {
+		http.Error(rw, "pkce required", http.StatusBadRequest)
+		return
+	}
+
+	code := randomString()
+
+	t.mu.Lock()
+	t.codes[code] = query
+	t.mu.Unlock()
+
+	http.Redirect(rw, r, query.Get("redirect_uri")+"?code="+code+"&state="+url.QueryEscape(query.Get("state")), http.StatusFound)
+}
+
+func (t *stubIdP) httpToken(rw http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+
+	t.mu.Lock()
+	authorized, ok := t.codes[r.PostForm.Get("code")]
+	delete(t.codes, r.PostForm.Get("code"))
+	t.mu.Unlock()
+
+	clientID, clientSecret, _ := r.BasicAuth()
+
+	switch {
+	case !ok:
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	case clientID != "hub" || clientSecret != "s3cret":
+		rw.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_client"})
+		return
+	case Challenge(r.PostForm.Get("code_verifier")) != authorized.Get("code_challenge"):
+		rw.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(rw).Encode(map[string]string{"error": "invalid_grant", "error_description": "pkce verification failed"})
+		return
+	}
+
+	claims := t.baseClaims()
+	claims["nonce"] = authorized.Get("nonce")
+
+	json.NewEncoder(rw).Encode(map[string]string{
+		"access_token": randomString(),
+		"token_type":   "Bearer",
+		"id_token":     t.sign("RS256", "rsa", claims),
+	})
+}
+
+func (t *stubIdP) httpJWKS(rw http.ResponseWriter, r *http.Request) {
+	encode := func(b []byte) string {
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+
+	json.NewEncoder(rw).Encode(map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA",
+				"kid": "rsa",
+				"use": "sig",
+				"n":   encode(t.rsaKey.N.Bytes()),
+				"e":   encode(big.NewInt(int64(t.rsaKey.E)).Bytes()),
+			},
+			{
+				"kty": "EC",
+				"kid": "ec",
+				"crv": "P-256",
+				"x":   encode(t.ecKey.X.Bytes()),
+				"y":   encode(t.ecKey.Y.Bytes()),
+			},
+		},
+	})
+}
+
+func (t *stubIdP) baseClaims() map[string]interface{} {
+	claims := map[string]interface{}{
+		"iss":                t.server.URL,
+		"sub":                "00u1",
+		"aud":                "hub",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": "jdoe",
+		"email":              "jdoe@example.com",
+		"email_verified":     true,
+		"groups":             []string{"engineering", "hub-admins"},
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for name, value := range t.claims {
+		claims[name] = value
+	}
+
+	return claims
+}
+
+func (t *stubIdP) sign(alg string, kid string, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	input := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(input))
+
+	var signature []byte
+
+	switch alg {
+	case "RS256":
+		signature, _ = rsa.SignPKCS1v15(rand.Reader, t.rsaKey, crypto.SHA256, digest[:])
+	case "ES256":
+		r, s, _ := ecdsa.Sign(rand.Reader, t.ecKey, digest[:])
+		signature = make([]byte, 64)
+		copy(signature[32-len(r.Bytes()):32], r.Bytes())
+		copy(signature[64-len(s.Bytes()):], s.Bytes())
+	}
+
+	return input + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func randomString() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+type ProviderTestSuite struct {
+	suite.Suite
+	idp      *stubIdP
+	provider *Provider
+}
+
+func (t *ProviderTestSuite) SetupTest() {
+	t.idp = newStubIdP()
+	t.provider = NewProvider(&Config{
+		Issuer:       t.idp.server.URL,
+		ClientID:     "hub",
+		ClientSecret: "s3cret",
+		RedirectURL:  "https://hub.example.com/v1/auth/oidc/callback",
+		Scopes:       []string{"profile", "email"},
+	})
+}
+
+func (t *ProviderTestSuite) TearDownTest() {
+	t.idp.server.Close()
+}
+
+// login follows the redirect to the stub provider and returns the code and
+// state of its callback
+func (t *ProviderTestSuite) login(req *AuthRequest) (string, string) {
+	authURL, err := t.provider.AuthCodeURL(req)
+	assert.Nil(t.T(), err)
+
+	client := &http.Client{
+		CheckRedirect: func(r *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	resp, err := client.Get(authURL)
+	assert.Nil(t.T(), err)
+	resp.Body.Close()
+
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	return callback.Query().Get("code"), callback.Query().Get("state")
+}
+
+func (t *ProviderTestSuite) Test_authorization_code_flow_with_pkce() {
+	req, err := NewAuthRequest()
+	assert.Nil(t.T(), err)
+
+	authURL, _ := t.provider.AuthCodeURL(req)
+	query, _ := url.ParseQuery(authURL[strings.Index(authURL, "?")+1:])
+
+	assert.Equal(t.T(), "openid profile email", query.Get("scope"))
+	assert.Equal(t.T(), Challenge(req.Verifier), query.Get("code_challenge"))
+	assert.NotContains(t.T(), authURL, req.Verifier)
+
+	code, state := t.login(req)
+	assert.Equal(t.T(), req.State, state)
+
+	token, err := t.provider.Exchange(code, req)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "00u1", token.Subject)
+	assert.Equal(t.T(), req.Nonce, token.Nonce)
+
+	// codes are single use
+	_, err = t.provider.Exchange(code, req)
+	assert.IsType(t.T(), &Rejected{}, err)
+}
+
+func (t *ProviderTestSuite) Test_Exchange_requires_the_pkce_verifier() {
+	req, _ := NewAuthRequest()
+	code, _ := t.login(req)
+
+	other, _ := NewAuthRequest()
+	req.Verifier = other.Verifier
+
+	_, err := t.provider.Exchange(code, req)
+	assert.Equal(t.T(), "token request refused: invalid_grant pkce verification failed", err.Error())
+}
+
+func (t *ProviderTestSuite) Test_Verify() {
+	claims := t.idp.baseClaims()
+	claims["nonce"] = "n"
+
+	token, err := t.provider.Verify(t.idp.sign("ES256", "ec", claims), "n")
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), []string{"hub"}, token.Audience)
+
+	reason := func(raw string, nonce string) string {
+		_, err := t.provider.Verify(raw, nonce)
+
+		if rejected, ok := err.(*Rejected); ok {
+			return rejected.Reason
+		}
+
+		return ""
+	}
+
+	assert.Equal(t.T(), "id token nonce mismatch", reason(t.idp.sign("RS256", "rsa", claims), "other"))
+
+	forged := t.idp.sign("RS256", "rsa", claims)
+	forged = forged[:strings.LastIndex(forged, ".")] + "." + base64.RawURLEncoding.EncodeToString([]byte("forged"))
+	assert.Equal(t.T(), "id token signature mismatch", reason(forged, "n"))
+
+	// the ec key cannot verify an rsa signature
+	assert.Equal(t.T(), "id token signature mismatch", reason(t.idp.sign("RS256", "ec", claims), "n"))
+
+	unsigned := t.idp.sign("RS256", "rsa", claims)
+	unsigned = strings.Replace(unsigned, unsigned[:strings.Index(unsigned, ".")], base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)), 1)
+	assert.Equal(t.T(), "id token signature algorithm 'none' is not accepted", reason(unsigned, "n"))
+
+	assert.Equal(t.T(), "id token signing key 'rotated' is unknown", reason(t.idp.sign("RS256", "rotated", claims), "n"))
+
+	expired := t.idp.baseClaims()
+	expired["nonce"] = "n"
+	expired["exp"] = time.Now().Add(-time.Hour).Unix()
+	assert.Equal(t.T(), "id token expired", reason(t.idp.sign("RS256", "rsa", expired), "n"))
+
+	audience := t.idp.baseClaims()
+	audience["nonce"] = "n"
+	audience["aud"] = []string{"other"}
+	assert.Equal(t.T(), "id token was not issued to this client", reason(t.idp.sign("RS256", "rsa", audience), "n"))
+
+	issuer := t.idp.baseClaims()
+	issuer["nonce"] = "n"
+	issuer["iss"] = "https://attacker.example.com"
+	assert.Equal(t.T(), "id token issuer 'https://attacker.example.com' is not the configured issuer", reason(t.idp.sign("RS256", "rsa", issuer), "n"))
+}
+
+func (t *ProviderTestSuite) Test_Mapping() {
+	claims := t.idp.baseClaims()
+	claims["nonce"] = "n"
+
+	token, _ := t.provider.Verify(t.idp.sign("RS256", "rsa", claims), "n")
+
+	identity, err := (&Mapping{}).Identity(token)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "jdoe", identity.Login)
+	assert.Equal(t.T(), "jdoe@example.com", identity.Email)
+	assert.True(t.T(), identity.EmailVerified)
+	assert.False(t.T(), identity.RoleManaged)
+	assert.False(t.T(), identity.Admin)
+
+	identity, err = (&Mapping{AllowedGroups: []string{"engineering"}, AdminGroups: []string{"hub-admins"}}).Identity(token)
+	assert.Nil(t.T(), err)
+	assert.True(t.T(), identity.RoleManaged)
+	assert.True(t.T(), identity.Admin)
+
+	_, err = (&Mapping{AllowedGroups: []string{"finance"}}).Identity(token)
+	assert.Equal(t.T(), "user 'jdoe' is not in a group permitted to log in", err.Error())
+
+	_, err = (&Mapping{LoginClaim: "upn"}).Identity(token)
+	assert.Equal(t.T(), "id token has no 'upn' claim to use as the login", err.Error())
+}
+
+func TestProviderTestSuite(t *testing.T) {
+	suite.Run(t, new(ProviderTestSuite))
+}
@@ -0,0 +1,377 @@
+package oidc
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+// clockSkew is the leeway allowed when checking the times of an id token
+const clockSkew = 1 * time.Minute
+
+// keyRefreshInterval is the least time between fetches of the provider's keys
+// when a token names an unknown key
+const keyRefreshInterval = 1 * time.Minute
+
+// IDToken is a verified id token
+type IDToken struct {
+	Issuer   string
+	Subject  string
+	Audience []string
+	Expiry   time.Time
+	IssuedAt time.Time
+	Nonce    string
+
+	// Claims are every claim of the token
+	Claims map[string]interface{}
+}
+
+// header is the JOSE header of an id token
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// jwk is a public key of the provider's JWKS
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// algorithms are the signature algorithms accepted, by JOSE name
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+}
+
+// Verify checks the signature of the raw id token against the provider's JWKS,
+// that it was issued by the provider to the hub and has not expired, and that
+// it carries the nonce
+func (t *Provider) Verify(raw string, nonce string) (*IDToken, error) {
+	parts := strings.Split(raw, ".")
+
+	if len(parts) != 3 {
+		return nil, &Rejected{
+			Reason: "id token is not a signed jwt",
+		}
+	}
+
+	h := &header{}
+
+	if err := decodeSegment(parts[0], h); err != nil {
+		return nil, &Rejected{
+			Reason: "id token header is malformed",
+		}
+	}
+
+	hash, ok := algorithms[h.Alg]
+
+	if !ok {
+		return nil, &Rejected{
+			Reason: "id token signature algorithm '" + h.Alg + "' is not accepted",
+		}
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+
+	if err != nil {
+		return nil, &Rejected{
+			Reason: "id token signature is malformed",
+		}
+	}
+
+	key, err := t.key(h.Kid)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifySignature(h.Alg, hash, key, []byte(parts[0]+"."+parts[1]), signature) {
+		return nil, &Rejected{
+			Reason: "id token signature mismatch",
+		}
+	}
+
+	claims := map[string]interface{}{}
+
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return nil, &Rejected{
+			Reason: "id token claims are malformed",
+		}
+	}
+
+	token := &IDToken{
+		Issuer:   stringClaim(claims, "iss"),
+		Subject:  stringClaim(claims, "sub"),
+		Audience: stringsClaim(claims, "aud"),
+		Expiry:   timeClaim(claims, "exp"),
+		IssuedAt: timeClaim(claims, "iat"),
+		Nonce:    stringClaim(claims, "nonce"),
+		Claims:   claims,
+	}
+
+	now := time.Now()
+
+	switch {
+	case token.Issuer != t.config.Issuer:
+		return nil, &Rejected{Reason: "id token issuer '" + token.Issuer + "' is not the configured issuer"}
+	case !containsString(token.Audience, t.config.ClientID):
+		return nil, &Rejected{Reason: "id token was not issued to this client"}
+	case len(token.Audience) > 1 && stringClaim(claims, "azp") != t.config.ClientID:
+		return nil, &Rejected{Reason: "id token authorized party is not this client"}
+	case token.Subject == "":
+		return nil, &Rejected{Reason: "id token has no subject"}
+	case token.Expiry.IsZero() || now.After(token.Expiry.Add(clockSkew)):
+		return nil, &Rejected{Reason: "id token expired"}
+	case token.IssuedAt.After(now.Add(clockSkew)):
+		return nil, &Rejected{Reason: "id token issued in the future"}
+	case token.Nonce != nonce:
+		return nil, &Rejected{Reason: "id token nonce mismatch"}
+	}
+
+	return token, nil
+}
+
+// key returns the provider's public key with the id, fetching the JWKS again if
+// the key is unknown
+func (t *Provider) key(kid string) (interface{}, error) {
+	d, err := t.discover()
+
+	if err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if key := t.lookupKey(kid); key != nil {
+		return key, nil
+	}
+
+	if time.Since(t.keysFetched) < keyRefreshInterval {
+		return nil, &Rejected{
+			Reason: "id token signing key '" + kid + "' is unknown",
+		}
+	}
+
+	set := struct {
+		Keys []*jwk `json:"keys"`
+	}{}
+
+	if err = t.getJSON(d.JWKSURI, &set); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to fetch openid provider keys")
+	}
+
+	t.keys = map[string]interface{}{}
+	t.keysFetched = time.Now()
+
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		if key, err := k.publicKey(); err == nil {
+			t.keys[k.Kid] = key
+		}
+	}
+
+	if key := t.lookupKey(kid); key != nil {
+		return key, nil
+	}
+
+	return nil, &Rejected{
+		Reason: "id token signing key '" + kid + "' is unknown",
+	}
+}
+
+// lookupKey returns the cached key with the id. A token naming no key may use the
+// provider's only key.
+func (t *Provider) lookupKey(kid string) interface{} {
+	if key, ok := t.keys[kid]; ok {
+		return key
+	}
+
+	if kid == "" && len(t.keys) == 1 {
+		for _, key := range t.keys {
+			return key
+		}
+	}
+
+	return nil
+}
+
+func (t *jwk) publicKey() (interface{}, error) {
+	switch t.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(t.N)
+
+		if err != nil {
+			return nil, err
+		}
+
+		e, err := base64.RawURLEncoding.DecodeString(t.E)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		curves := map[string]elliptic.Curve{
+			"P-256": elliptic.P256(),
+			"P-384": elliptic.P384(),
+			"P-521": elliptic.P521(),
+		}
+
+		curve, ok := curves[t.Crv]
+
+		if !ok {
+			return nil, stacktrace.NewError("unsupported curve '%v'", t.Crv)
+		}
+
+		x, err := base64.RawURLEncoding.DecodeString(t.X)
+
+		if err != nil {
+			return nil, err
+		}
+
+		y, err := base64.RawURLEncoding.DecodeString(t.Y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PublicKey{
+			Curve: curve,
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, stacktrace.NewError("unsupported key type '%v'", t.Kty)
+}
+
+// verifySignature checks the JOSE signature of the signing input with the key
+func verifySignature(alg string, hash crypto.Hash, key interface{}, input []byte, signature []byte) bool {
+	hasher := hash.New()
+	hasher.Write(input)
+	digest := hasher.Sum(nil)
+
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		return strings.HasPrefix(alg, "RS") && rsa.VerifyPKCS1v15(k, hash, digest, signature) == nil
+
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+
+		if !strings.HasPrefix(alg, "ES") || len(signature) != 2*size {
+			return false
+		}
+
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+
+		return ecdsa.Verify(k, digest, r, s)
+	}
+
+	return false
+}
+
+func decodeSegment(segment string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(segment)
+
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(decoded))
+	decoder.UseNumber()
+
+	return decoder.Decode(v)
+}
+
+func stringClaim(claims map[string]interface{}, name string) string {
+	value, _ := claims[name].(string)
+	return value
+}
+
+// stringsClaim returns a claim that is a string or an array of strings
+func stringsClaim(claims map[string]interface{}, name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return []string{value}
+
+	case []interface{}:
+		values := []string{}
+
+		for _, item := range value {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+
+		return values
+	}
+
+	return nil
+}
+
+func timeClaim(claims map[string]interface{}, name string) time.Time {
+	number, ok := claims[name].(json.Number)
+
+	if !ok {
+		return time.Time{}
+	}
+
+	seconds, err := number.Float64()
+
+	if err != nil {
+		return time.Time{}
+	}
+
+	return time.Unix(int64(seconds), 0)
+}
+
+func boolClaim(claims map[string]interface{}, name string) bool {
+	switch value := claims[name].(type) {
+	case bool:
+		return value
+	case string:
+		return value == "true"
+	}
+
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,197 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+
+	"github.com/palantir/stacktrace"
+)
+
+// Envelope is a value sealed with a random data key. The data key is stored
+// wrapped by a master key so values can be re-wrapped on rotation and the
+// master key never leaves the hub.
+type Envelope struct {
+	// KeyID identifies the master key that wrapped the data key
+	KeyID string `gorethink:"kid" json:"kid"`
+
+	// WrappedKey is the data key sealed by the master key, nonce first
+	WrappedKey []byte `gorethink:"dek" json:"dek"`
+
+	Nonce      []byte `gorethink:"nonce" json:"nonce"`
+	Ciphertext []byte `gorethink:"data" json:"data"`
+}
+
+// ErrUnknownKey is returned when opening an envelope whose master key is not in
+// the keyring
+type ErrUnknownKey struct {
+	KeyID string
+}
+
+func (t *ErrUnknownKey) Error() string {
+	return "master key '" + t.KeyID + "' is not in the keyring"
+}
+
+// Seal encrypts plain under a new data key wrapped by the active master key
+func (t *Keyring) Seal(plain []byte) (*Envelope, error) {
+	dek := make([]byte, KeySize)
+
+	if _, err := rand.Read(dek); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to generate data key")
+	}
+
+	nonce, ciphertext, err := seal(dek, plain, nil)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wrapNonce, wrapped, err := seal(t.keys[t.active], dek, []byte(t.active))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		KeyID:      t.active,
+		WrappedKey: append(wrapNonce, wrapped...),
+		Nonce:      nonce,
+		Ciphertext: ciphertext,
+	}, nil
+}
+
+// Open decrypts the envelope
+func (t *Keyring) Open(e *Envelope) ([]byte, error) {
+	if e == nil {
+		return nil, nil
+	}
+
+	dek, err := t.unwrap(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	gcm, err := newGCM(dek)
+
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := gcm.Open(nil, e.Nonce, e.Ciphertext, nil)
+
+	if err != nil {
+		return nil, stacktrace.NewError("failed to decrypt sealed value")
+	}
+
+	return plain, nil
+}
+
+// Rewrap returns the envelope with its data key wrapped by the active master
+// key. The ciphertext is unchanged. Envelopes already under the active key are
+// returned as is.
+func (t *Keyring) Rewrap(e *Envelope) (*Envelope, error) {
+	if e == nil || e.KeyID == t.active {
+		return e, nil
+	}
+
+	dek, err := t.unwrap(e)
+
+	if err != nil {
+		return nil, err
+	}
+
+	wrapNonce, wrapped, err := seal(t.keys[t.active], dek, []byte(t.active))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Envelope{
+		KeyID:      t.active,
+		WrappedKey: append(wrapNonce, wrapped...),
+		Nonce:      e.Nonce,
+		Ciphertext: e.Ciphertext,
+	}, nil
+}
+
+// unwrap returns the data key of the envelope
+func (t *Keyring) unwrap(e *Envelope) ([]byte, error) {
+	kek, ok := t.keys[e.KeyID]
+
+	if !ok {
+		return nil, &ErrUnknownKey{KeyID: e.KeyID}
+	}
+
+	gcm, err := newGCM(kek)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(e.WrappedKey) < gcm.NonceSize() {
+		return nil, stacktrace.NewError("wrapped data key is truncated")
+	}
+
+	dek, err := gcm.Open(nil, e.WrappedKey[:gcm.NonceSize()], e.WrappedKey[gcm.NonceSize():], []byte(e.KeyID))
+
+	if err != nil {
+		return nil, stacktrace.NewError("failed to unwrap data key with master key '%v'", e.KeyID)
+	}
+
+	return dek, nil
+}
+
+// Seal seals plain with the keyring set with SetKeyring
+func Seal(plain []byte) (*Envelope, error) {
+	k := Default()
+
+	if k == nil {
+		return nil, stacktrace.NewError("no master key loaded")
+	}
+
+	return k.Seal(plain)
+}
+
+// Open opens the envelope with the keyring set with SetKeyring
+func Open(e *Envelope) ([]byte, error) {
+	k := Default()
+
+	if k == nil {
+		return nil, stacktrace.NewError("no master key loaded")
+	}
+
+	return k.Open(e)
+}
+
+func seal(key []byte, plain []byte, data []byte) (nonce []byte, ciphertext []byte, err error) {
+	gcm, err := newGCM(key)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nonce = make([]byte, gcm.NonceSize())
+
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, nil, stacktrace.Propagate(err, "failed to generate nonce")
+	}
+
+	return nonce, gcm.Seal(nil, nonce, plain, data), nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid key")
+	}
+
+	gcm, err := cipher.NewGCM(block)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to create cipher")
+	}
+
+	return gcm, nil
+}
@@ -0,0 +1,195 @@
+package secret
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/palantir/stacktrace"
+)
+
+// KeySize is the length of a master key in bytes. Master keys are AES-256 keys.
+const KeySize = 32
+
+// EnvVar is the environment variable that may hold the master keys in place of
+// a key file
+const EnvVar = "DEVICEIO_HUB_MASTER_KEY"
+
+// Keyring holds the master keys that seal credential material. The last key is
+// active and seals new values; earlier keys are retired and only open values
+// sealed before a rotation.
+type Keyring struct {
+	keys   map[string][]byte
+	active string
+}
+
+// NewKeyring returns a keyring of the keys in rotation order. The last key is
+// active.
+func NewKeyring(keys ...[]byte) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, stacktrace.NewError("a keyring requires at least one master key")
+	}
+
+	t := &Keyring{
+		keys: map[string][]byte{},
+	}
+
+	for _, key := range keys {
+		if len(key) != KeySize {
+			return nil, stacktrace.NewError("master keys must be %v bytes", KeySize)
+		}
+
+		t.active = KeyID(key)
+		t.keys[t.active] = key
+	}
+
+	return t, nil
+}
+
+// Active returns the id of the key that seals new values
+func (t *Keyring) Active() string {
+	return t.active
+}
+
+// KeyIDs returns the id of every key of the keyring
+func (t *Keyring) KeyIDs() []string {
+	ids := []string{}
+
+	for id := range t.keys {
+		ids = append(ids, id)
+	}
+
+	return ids
+}
+
+// KeyID returns a short stable identifier of a master key
+func KeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
+
+// GenerateKey returns a new random master key
+func GenerateKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to generate master key")
+	}
+
+	return key, nil
+}
+
+// ParseKeyring decodes a keyring from one base64 master key per line, oldest
+// first. Blank lines and lines starting with # are ignored.
+func ParseKeyring(encoded string) (*Keyring, error) {
+	keys := [][]byte{}
+
+	for _, line := range strings.FieldsFunc(encoded, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, err := base64.StdEncoding.DecodeString(line)
+
+		if err != nil || len(key) != KeySize {
+			return nil, stacktrace.NewError("master keys must be base64 encoded %v byte keys", KeySize)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return NewKeyring(keys...)
+}
+
+// LoadKeyring reads the keyring from the EnvVar environment variable if it is
+// set, otherwise from the key file at path
+func LoadKeyring(path string) (*Keyring, error) {
+	if encoded := os.Getenv(EnvVar); encoded != "" {
+		keyring, err := ParseKeyring(encoded)
+
+		if err != nil {
+			return nil, stacktrace.Propagate(err, "invalid master key in %v", EnvVar)
+		}
+
+		return keyring, nil
+	}
+
+	encoded, err := ioutil.ReadFile(path)
+
+	if os.IsNotExist(err) {
+		return nil, stacktrace.NewError(
+			"master key file '%v' not found. Copy it from another hub of the cluster, set %v or create it with 'deviceio-hub keys generate'",
+			path,
+			EnvVar,
+		)
+	}
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read master key file")
+	}
+
+	keyring, err := ParseKeyring(string(encoded))
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "invalid master key file '%v'", path)
+	}
+
+	return keyring, nil
+}
+
+// AppendKey adds a new master key to the key file at path, creating the file if
+// missing. The new key becomes the active key.
+func AppendKey(path string) (string, error) {
+	key, err := GenerateKey()
+
+	if err != nil {
+		return "", err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", stacktrace.Propagate(err, "failed to create master key directory")
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to open master key file")
+	}
+
+	defer f.Close()
+
+	if _, err = f.WriteString(base64.StdEncoding.EncodeToString(key) + "\n"); err != nil {
+		return "", stacktrace.Propagate(err, "failed to write master key file")
+	}
+
+	return KeyID(key), nil
+}
+
+var (
+	mu      sync.RWMutex
+	keyring *Keyring
+)
+
+// SetKeyring sets the keyring used by Seal and Open
+func SetKeyring(k *Keyring) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	keyring = k
+}
+
+// Default returns the keyring set with SetKeyring, or nil
+func Default() *Keyring {
+	mu.RLock()
+	defer mu.RUnlock()
+
+	return keyring
+}
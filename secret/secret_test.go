@@ -0,0 +1,104 @@
+package secret
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type SecretTestSuite struct {
+	suite.Suite
+	old []byte
+	new []byte
+}
+
+func (t *SecretTestSuite) SetupTest() {
+	t.old, _ = GenerateKey()
+	t.new, _ = GenerateKey()
+}
+
+func (t *SecretTestSuite) Test_Seal_and_Open_round_trip() {
+	k, _ := NewKeyring(t.old)
+
+	e, err := k.Seal([]byte("JBSWY3DPEHPK3PXP"))
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), KeyID(t.old), e.KeyID)
+	assert.NotContains(t.T(), string(e.Ciphertext), "JBSWY3DPEHPK3PXP")
+
+	plain, err := k.Open(e)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "JBSWY3DPEHPK3PXP", string(plain))
+}
+
+func (t *SecretTestSuite) Test_Open_detects_tampering() {
+	k, _ := NewKeyring(t.old)
+	e, _ := k.Seal([]byte("secret"))
+
+	e.Ciphertext[0] ^= 0xff
+
+	_, err := k.Open(e)
+	assert.NotNil(t.T(), err)
+}
+
+func (t *SecretTestSuite) Test_Open_fails_without_the_master_key() {
+	old, _ := NewKeyring(t.old)
+	e, _ := old.Seal([]byte("secret"))
+
+	k, _ := NewKeyring(t.new)
+
+	_, err := k.Open(e)
+	assert.IsType(t.T(), &ErrUnknownKey{}, err)
+}
+
+func (t *SecretTestSuite) Test_Rewrap_moves_envelopes_to_the_active_key() {
+	old, _ := NewKeyring(t.old)
+	e, _ := old.Seal([]byte("secret"))
+
+	rotated, _ := NewKeyring(t.old, t.new)
+
+	rewrapped, err := rotated.Rewrap(e)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), KeyID(t.new), rewrapped.KeyID)
+	assert.Equal(t.T(), e.Ciphertext, rewrapped.Ciphertext)
+
+	current, _ := NewKeyring(t.new)
+	plain, err := current.Open(rewrapped)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "secret", string(plain))
+}
+
+func (t *SecretTestSuite) Test_AppendKey_makes_the_new_key_active() {
+	dir, _ := ioutil.TempDir("", "deviceio-hub-secret")
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "master.key")
+
+	first, err := AppendKey(path)
+	assert.Nil(t.T(), err)
+
+	second, err := AppendKey(path)
+	assert.Nil(t.T(), err)
+
+	k, err := LoadKeyring(path)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), second, k.Active())
+	assert.Contains(t.T(), k.KeyIDs(), first)
+}
+
+func (t *SecretTestSuite) Test_LoadKeyring_prefers_the_environment() {
+	os.Setenv(EnvVar, base64.StdEncoding.EncodeToString(t.new))
+	defer os.Unsetenv(EnvVar)
+
+	k, err := LoadKeyring("/nonexistent/master.key")
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), KeyID(t.new), k.Active())
+}
+
+func TestSecretTestSuite(t *testing.T) {
+	suite.Run(t, new(SecretTestSuite))
+}
@@ -0,0 +1,194 @@
+// Package sshsig signs and verifies messages in the OpenSSH SSHSIG format, the
+// format of ssh-keygen -Y sign. Signing goes through an ssh.Signer, such as a
+// key held by ssh-agent, so the private key never has to be exported.
+package sshsig
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"hash"
+
+	"github.com/palantir/stacktrace"
+	"golang.org/x/crypto/ssh"
+)
+
+// Namespace is the namespace of hub request signatures. A signature made for
+// another namespace, such as git commits or files, never verifies as a request.
+const Namespace = "deviceio-hub"
+
+// magic prefixes both the signature blob and the data that is signed
+const magic = "SSHSIG"
+
+// version is the version of the signature blob
+const version = 1
+
+// hashes are the message hash algorithms accepted, by SSHSIG name. Signatures
+// are made with sha512.
+var hashes = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Signature is a parsed SSHSIG signature
+type Signature struct {
+	PublicKey     ssh.PublicKey
+	Namespace     string
+	HashAlgorithm string
+	Signature     *ssh.Signature
+}
+
+// Sign signs the message for the namespace and returns the signature blob
+func Sign(signer ssh.Signer, namespace string, message []byte) ([]byte, error) {
+	if namespace == "" {
+		return nil, stacktrace.NewError("namespace empty")
+	}
+
+	sig, err := signer.Sign(rand.Reader, signedData(namespace, "sha512", digest(sha512.New, message)))
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to sign with %v key", signer.PublicKey().Type())
+	}
+
+	return Marshal(&Signature{
+		PublicKey:     signer.PublicKey(),
+		Namespace:     namespace,
+		HashAlgorithm: "sha512",
+		Signature:     sig,
+	}), nil
+}
+
+// Marshal returns the blob of the signature. Armored with BEGIN SSH SIGNATURE
+// lines it is the output of ssh-keygen -Y sign.
+func Marshal(sig *Signature) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(magic)
+	binary.Write(buf, binary.BigEndian, uint32(version))
+	writeString(buf, sig.PublicKey.Marshal())
+	writeString(buf, []byte(sig.Namespace))
+	writeString(buf, nil)
+	writeString(buf, []byte(sig.HashAlgorithm))
+	writeString(buf, ssh.Marshal(sig.Signature))
+
+	return buf.Bytes()
+}
+
+// Parse parses a signature blob
+func Parse(blob []byte) (*Signature, error) {
+	if !bytes.HasPrefix(blob, []byte(magic)) {
+		return nil, stacktrace.NewError("not an sshsig signature")
+	}
+
+	rest := blob[len(magic):]
+
+	if len(rest) < 4 || binary.BigEndian.Uint32(rest) != version {
+		return nil, stacktrace.NewError("unsupported sshsig version")
+	}
+
+	rest = rest[4:]
+	fields := make([][]byte, 5)
+
+	for i := range fields {
+		var ok bool
+
+		if fields[i], rest, ok = readString(rest); !ok {
+			return nil, stacktrace.NewError("sshsig signature is truncated")
+		}
+	}
+
+	if len(rest) != 0 {
+		return nil, stacktrace.NewError("sshsig signature has trailing data")
+	}
+
+	publicKey, err := ssh.ParsePublicKey(fields[0])
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "sshsig public key is malformed")
+	}
+
+	format, sigRest, ok := readString(fields[4])
+
+	if !ok {
+		return nil, stacktrace.NewError("sshsig signature is malformed")
+	}
+
+	sigBlob, sigRest, ok := readString(sigRest)
+
+	if !ok || len(sigRest) != 0 {
+		return nil, stacktrace.NewError("sshsig signature is malformed")
+	}
+
+	return &Signature{
+		PublicKey:     publicKey,
+		Namespace:     string(fields[1]),
+		HashAlgorithm: string(fields[3]),
+		Signature: &ssh.Signature{
+			Format: string(format),
+			Blob:   sigBlob,
+		},
+	}, nil
+}
+
+// Verify checks the signature is of the message for the namespace and made by
+// the key it carries. Callers decide if that key is trusted.
+func (t *Signature) Verify(namespace string, message []byte) error {
+	if t.Namespace != namespace {
+		return stacktrace.NewError("signature namespace '%v' is not '%v'", t.Namespace, namespace)
+	}
+
+	newHash, ok := hashes[t.HashAlgorithm]
+
+	if !ok {
+		return stacktrace.NewError("unsupported sshsig hash algorithm '%v'", t.HashAlgorithm)
+	}
+
+	data := signedData(namespace, t.HashAlgorithm, digest(newHash, message))
+
+	if err := t.PublicKey.Verify(data, t.Signature); err != nil {
+		return stacktrace.Propagate(err, "signature mismatch")
+	}
+
+	return nil
+}
+
+// signedData is the data the key signs for a message hash
+func signedData(namespace string, hashAlgorithm string, messageHash []byte) []byte {
+	buf := &bytes.Buffer{}
+	buf.WriteString(magic)
+	writeString(buf, []byte(namespace))
+	writeString(buf, nil)
+	writeString(buf, []byte(hashAlgorithm))
+	writeString(buf, messageHash)
+
+	return buf.Bytes()
+}
+
+func digest(newHash func() hash.Hash, message []byte) []byte {
+	h := newHash()
+	h.Write(message)
+	return h.Sum(nil)
+}
+
+// writeString writes the value as an ssh wire format string
+func writeString(buf *bytes.Buffer, value []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(value)))
+	buf.Write(value)
+}
+
+// readString reads an ssh wire format string
+func readString(in []byte) (value []byte, rest []byte, ok bool) {
+	if len(in) < 4 {
+		return nil, nil, false
+	}
+
+	length := binary.BigEndian.Uint32(in)
+	in = in[4:]
+
+	if uint32(len(in)) < length {
+		return nil, nil, false
+	}
+
+	return in[:length], in[length:], true
+}
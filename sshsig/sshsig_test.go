@@ -0,0 +1,111 @@
+package sshsig
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// keygenPublicKey and keygenSignature are the key and the output of
+// ssh-keygen -Y sign -n deviceio-hub over keygenMessage
+const keygenPublicKey = "ssh-ed25519 AAAAC3NzaC1lZDI1NTE5AAAAIMPKsU5C9NiXSCY0YZPaPTlmmIVaeFfciEy+JGDCJ6YX test"
+
+const keygenSignature = `-----BEGIN SSH SIGNATURE-----
+U1NIU0lHAAAAAQAAADMAAAALc3NoLWVkMjU1MTkAAAAgw8qxTkL02JdIJjRhk9o9OWaYhV
+p4V9yITL4kYMInphcAAAAMZGV2aWNlaW8taHViAAAAAAAAAAZzaGE1MTIAAABTAAAAC3Nz
+aC1lZDI1NTE5AAAAQDfgipK97nqrEXP+GkHXaAatucfhJuc1+SZpJl2z38cKgYBvmzPRXc
+xjWEedAUrjG5jXs9UwJUkWVgQTdBsSugY=
+-----END SSH SIGNATURE-----`
+
+const keygenMessage = "hello hub"
+
+type SignatureTestSuite struct {
+	suite.Suite
+}
+
+func TestSignatureTestSuite(t *testing.T) {
+	suite.Run(t, new(SignatureTestSuite))
+}
+
+func (t *SignatureTestSuite) Test_Verify_accepts_ssh_keygen_signatures() {
+	lines := strings.Split(keygenSignature, "\n")
+	blob, err := base64.StdEncoding.DecodeString(strings.Join(lines[1:len(lines)-1], ""))
+	t.Require().NoError(err)
+
+	sig, err := Parse(blob)
+	t.Require().NoError(err)
+
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(keygenPublicKey))
+	t.Require().NoError(err)
+
+	t.Equal(key.Marshal(), sig.PublicKey.Marshal())
+	t.Equal("sha512", sig.HashAlgorithm)
+	t.NoError(sig.Verify(Namespace, []byte(keygenMessage)))
+	t.Error(sig.Verify(Namespace, []byte(keygenMessage+"!")))
+	t.Error(sig.Verify("git", []byte(keygenMessage)))
+
+	t.Equal(blob, Marshal(sig))
+}
+
+func (t *SignatureTestSuite) Test_Sign_through_an_agent() {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	t.Require().NoError(err)
+
+	keyring := agent.NewKeyring()
+	t.Require().NoError(keyring.Add(agent.AddedKey{PrivateKey: &edKey}))
+	t.Require().NoError(keyring.Add(agent.AddedKey{PrivateKey: ecKey}))
+
+	signers, err := keyring.Signers()
+	t.Require().NoError(err)
+	t.Require().Len(signers, 2)
+
+	for _, signer := range signers {
+		blob, err := Sign(signer, Namespace, []byte("message"))
+		t.Require().NoError(err)
+
+		sig, err := Parse(blob)
+		t.Require().NoError(err)
+
+		t.Equal(signer.PublicKey().Marshal(), sig.PublicKey.Marshal())
+		t.NoError(sig.Verify(Namespace, []byte("message")), signer.PublicKey().Type())
+		t.Error(sig.Verify(Namespace, []byte("other message")))
+	}
+}
+
+func (t *SignatureTestSuite) Test_Parse_rejects_malformed_blobs() {
+	blob, err := Sign(newSigner(t), Namespace, []byte("message"))
+	t.Require().NoError(err)
+
+	_, err = Parse(blob[:len(blob)-1])
+	t.Error(err)
+
+	_, err = Parse(append(blob, 0))
+	t.Error(err)
+
+	_, err = Parse([]byte("SSHSIG"))
+	t.Error(err)
+
+	_, err = Parse([]byte("not a signature"))
+	t.Error(err)
+}
+
+func newSigner(t *SignatureTestSuite) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	t.Require().NoError(err)
+
+	signer, err := ssh.NewSignerFromKey(key)
+	t.Require().NoError(err)
+
+	return signer
+}
@@ -0,0 +1,165 @@
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// RequestIDHeader carries the correlation id of an api request to the device
+	// and back to the caller
+	RequestIDHeader = "X-Request-ID"
+
+	// TraceparentHeader is the W3C trace context header
+	TraceparentHeader = "Traceparent"
+
+	// maxRequestIDLength bounds caller supplied request ids
+	maxRequestIDLength = 128
+)
+
+type contextKey int
+
+const (
+	requestIDKey contextKey = iota
+	spanKey
+)
+
+// RequestID returns the request id carried by the context or an empty string
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// WithRequestID returns a copy of the context carrying the request id
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// EnsureRequestID returns the request id supplied in the X-Request-ID header or a
+// newly generated one if the header is missing or invalid. The id is set on the
+// request header so it is forwarded with the request, and on the request context.
+func EnsureRequestID(r *http.Request) (*http.Request, string) {
+	id := r.Header.Get(RequestIDHeader)
+
+	if !ValidRequestID(id) {
+		id = uuid.New().String()
+	}
+
+	r.Header.Set(RequestIDHeader, id)
+
+	return r.WithContext(WithRequestID(r.Context(), id)), id
+}
+
+// ValidRequestID reports if a caller supplied request id is acceptable. Ids must
+// be 1 to 128 printable ascii characters without spaces.
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// SpanContext identifies a span within a trace as described by the W3C trace
+// context specification
+type SpanContext struct {
+	TraceID [16]byte
+	SpanID  [8]byte
+	Flags   byte
+}
+
+// TraceIDString returns the hex encoded trace id
+func (t SpanContext) TraceIDString() string {
+	return hex.EncodeToString(t.TraceID[:])
+}
+
+// SpanIDString returns the hex encoded span id
+func (t SpanContext) SpanIDString() string {
+	return hex.EncodeToString(t.SpanID[:])
+}
+
+// IsValid reports if both the trace and span ids are non zero
+func (t SpanContext) IsValid() bool {
+	return t.TraceID != [16]byte{} && t.SpanID != [8]byte{}
+}
+
+// Traceparent formats the span context as a version 00 traceparent header value
+func (t SpanContext) Traceparent() string {
+	return fmt.Sprintf("00-%v-%v-%02x", t.TraceIDString(), t.SpanIDString(), t.Flags)
+}
+
+// ParseTraceparent parses a traceparent header value. Unknown future versions are
+// accepted as long as the version 00 fields can be read.
+func ParseTraceparent(value string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(value), "-")
+
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return sc, false
+	}
+
+	if parts[0] == "00" && len(parts) != 4 {
+		return sc, false
+	}
+
+	version, err := hex.DecodeString(parts[0])
+
+	if err != nil || len(version) != 1 {
+		return sc, false
+	}
+
+	traceID, err := hex.DecodeString(parts[1])
+
+	if err != nil || len(traceID) != 16 || parts[1] != strings.ToLower(parts[1]) {
+		return sc, false
+	}
+
+	spanID, err := hex.DecodeString(parts[2])
+
+	if err != nil || len(spanID) != 8 || parts[2] != strings.ToLower(parts[2]) {
+		return sc, false
+	}
+
+	flags, err := hex.DecodeString(parts[3])
+
+	if err != nil || len(flags) != 1 {
+		return sc, false
+	}
+
+	copy(sc.TraceID[:], traceID)
+	copy(sc.SpanID[:], spanID)
+	sc.Flags = flags[0]
+
+	if !sc.IsValid() {
+		return SpanContext{}, false
+	}
+
+	return sc, true
+}
+
+func newTraceID() (id [16]byte) {
+	rand.Read(id[:])
+	return id
+}
+
+func newSpanID() (id [8]byte) {
+	rand.Read(id[:])
+	return id
+}
@@ -0,0 +1,252 @@
+package trace
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	// exportBatchSize is the maximum number of spans written per line
+	exportBatchSize = 100
+
+	// exportInterval is how often buffered spans are flushed
+	exportInterval = 1 * time.Second
+
+	// exportQueueSize bounds the spans waiting to be written. Spans are dropped
+	// rather than blocking requests when the queue is full.
+	exportQueueSize = 4096
+)
+
+// Exporter receives finished spans
+type Exporter interface {
+	Export(span *Span)
+}
+
+var (
+	exporterMu sync.RWMutex
+	exporter   Exporter
+)
+
+// SetExporter sets the exporter receiving every finished span. Spans are not
+// recorded when no exporter is set.
+func SetExporter(e Exporter) {
+	exporterMu.Lock()
+	defer exporterMu.Unlock()
+
+	exporter = e
+}
+
+func currentExporter() Exporter {
+	exporterMu.RLock()
+	defer exporterMu.RUnlock()
+
+	return exporter
+}
+
+// FileExporter appends spans to a file as OTLP/JSON, one ExportTraceServiceRequest
+// per line, in the format read by the OpenTelemetry collector file receiver
+type FileExporter struct {
+	service string
+	w       io.WriteCloser
+	queue   chan *Span
+	done    chan struct{}
+}
+
+// NewFileExporter opens path for appending and starts writing spans reported by
+// the named service
+func NewFileExporter(path string, service string) (*FileExporter, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to open trace file '%v'", path)
+	}
+
+	return newExporter(f, service), nil
+}
+
+func newExporter(w io.WriteCloser, service string) *FileExporter {
+	e := &FileExporter{
+		service: service,
+		w:       w,
+		queue:   make(chan *Span, exportQueueSize),
+		done:    make(chan struct{}),
+	}
+
+	go e.loop()
+
+	return e
+}
+
+// Export queues the span to be written
+func (t *FileExporter) Export(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+	}
+}
+
+// Close flushes queued spans and closes the file
+func (t *FileExporter) Close() error {
+	close(t.queue)
+	<-t.done
+
+	return t.w.Close()
+}
+
+func (t *FileExporter) loop() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(exportInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				t.write(batch)
+				return
+			}
+
+			batch = append(batch, span)
+
+			if len(batch) >= exportBatchSize {
+				t.write(batch)
+				batch = []*Span{}
+			}
+		case <-ticker.C:
+			t.write(batch)
+			batch = []*Span{}
+		}
+	}
+}
+
+func (t *FileExporter) write(batch []*Span) {
+	if len(batch) == 0 {
+		return
+	}
+
+	spans := make([]otlpSpan, 0, len(batch))
+
+	for _, span := range batch {
+		spans = append(spans, newOTLPSpan(span))
+	}
+
+	line, err := json.Marshal(&otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{newAttribute("service.name", t.service)},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/deviceio/hub/trace"},
+				Spans: spans,
+			}},
+		}},
+	})
+
+	if err != nil {
+		return
+	}
+
+	t.w.Write(append(line, '\n'))
+}
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+func newAttribute(key string, value string) otlpAttribute {
+	return otlpAttribute{
+		Key:   key,
+		Value: otlpAnyValue{StringValue: value},
+	}
+}
+
+func newOTLPSpan(span *Span) otlpSpan {
+	span.mu.Lock()
+	defer span.mu.Unlock()
+
+	s := otlpSpan{
+		TraceID:           span.Context.TraceIDString(),
+		SpanID:            span.Context.SpanIDString(),
+		Name:              span.Name,
+		Kind:              span.Kind,
+		StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+	}
+
+	if span.Parent.IsValid() {
+		s.ParentSpanID = span.Parent.SpanIDString()
+	}
+
+	keys := make([]string, 0, len(span.Attributes))
+
+	for key := range span.Attributes {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		s.Attributes = append(s.Attributes, newAttribute(key, span.Attributes[key]))
+	}
+
+	if span.Error != "" {
+		// STATUS_CODE_ERROR
+		s.Status = otlpStatus{Code: 2, Message: span.Error}
+	}
+
+	return s
+}
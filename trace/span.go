@@ -0,0 +1,152 @@
+package trace
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// SpanKindInternal is a span of work within the hub
+	SpanKindInternal = 1
+
+	// SpanKindServer is a span handling an inbound request
+	SpanKindServer = 2
+
+	// SpanKindClient is a span issuing an outbound request
+	SpanKindClient = 3
+
+	// flagSampled is the W3C sampled trace flag
+	flagSampled = 0x01
+)
+
+// Span is a timed operation within a trace
+type Span struct {
+	Name       string
+	Kind       int
+	Context    SpanContext
+	Parent     SpanContext
+	Start      time.Time
+	End        time.Time
+	Attributes map[string]string
+
+	// Error is set when the operation failed
+	Error string
+
+	mu    sync.Mutex
+	ended bool
+}
+
+// SetAttribute records a key value attribute on the span
+func (t *Span) SetAttribute(key string, value string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Attributes[key] = value
+}
+
+// SetError marks the span as failed
+func (t *Span) SetError(err error) {
+	if err == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the configured exporter. Finishing a span
+// more than once has no effect.
+func (t *Span) Finish() {
+	t.mu.Lock()
+
+	if t.ended {
+		t.mu.Unlock()
+		return
+	}
+
+	t.ended = true
+	t.End = time.Now()
+	t.mu.Unlock()
+
+	if exporter := currentExporter(); exporter != nil && t.Context.Flags&flagSampled != 0 {
+		exporter.Export(t)
+	}
+}
+
+// SpanFromContext returns the span carried by the context or nil
+func SpanFromContext(ctx context.Context) *Span {
+	if ctx == nil {
+		return nil
+	}
+
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// StartSpan starts a span as a child of the span carried by ctx, or as the root
+// of a new trace. The returned context carries the new span.
+func StartSpan(ctx context.Context, name string, kind int) (context.Context, *Span) {
+	var parent SpanContext
+
+	if current := SpanFromContext(ctx); current != nil {
+		parent = current.Context
+	}
+
+	return startSpan(ctx, name, kind, parent)
+}
+
+// StartServerSpan starts a span for an inbound request continuing the trace
+// described by its traceparent header if present. The request id is recorded as
+// an attribute of the span.
+func StartServerSpan(r *http.Request, name string) (*http.Request, *Span) {
+	parent, _ := ParseTraceparent(r.Header.Get(TraceparentHeader))
+
+	ctx, span := startSpan(r.Context(), name, SpanKindServer, parent)
+
+	span.Attributes["http.method"] = r.Method
+	span.Attributes["http.target"] = r.URL.RequestURI()
+
+	if id := RequestID(ctx); id != "" {
+		span.Attributes["request.id"] = id
+	}
+
+	return r.WithContext(ctx), span
+}
+
+// Inject sets the traceparent header of an outbound request to the span carried
+// by the request context
+func Inject(r *http.Request) {
+	if span := SpanFromContext(r.Context()); span != nil {
+		r.Header.Set(TraceparentHeader, span.Context.Traceparent())
+	}
+}
+
+func startSpan(ctx context.Context, name string, kind int, parent SpanContext) (context.Context, *Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	span := &Span{
+		Name:       name,
+		Kind:       kind,
+		Parent:     parent,
+		Start:      time.Now(),
+		Attributes: map[string]string{},
+	}
+
+	if parent.IsValid() {
+		span.Context.TraceID = parent.TraceID
+		span.Context.Flags = parent.Flags
+	} else {
+		span.Context.TraceID = newTraceID()
+		span.Context.Flags = flagSampled
+	}
+
+	span.Context.SpanID = newSpanID()
+
+	return context.WithValue(ctx, spanKey, span), span
+}
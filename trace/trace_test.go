@@ -0,0 +1,124 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type bufferCloser struct {
+	bytes.Buffer
+}
+
+func (t *bufferCloser) Close() error {
+	return nil
+}
+
+type TraceTestSuite struct {
+	suite.Suite
+}
+
+func (t *TraceTestSuite) TearDownTest() {
+	SetExporter(nil)
+}
+
+func (t *TraceTestSuite) Test_ParseTraceparent_round_trips() {
+	value := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+	sc, ok := ParseTraceparent(value)
+
+	assert.True(t.T(), ok)
+	assert.Equal(t.T(), "4bf92f3577b34da6a3ce929d0e0e4736", sc.TraceIDString())
+	assert.Equal(t.T(), "00f067aa0ba902b7", sc.SpanIDString())
+	assert.Equal(t.T(), value, sc.Traceparent())
+}
+
+func (t *TraceTestSuite) Test_ParseTraceparent_rejects_invalid_values() {
+	for _, value := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+	} {
+		_, ok := ParseTraceparent(value)
+		assert.False(t.T(), ok, value)
+	}
+}
+
+func (t *TraceTestSuite) Test_EnsureRequestID_keeps_valid_and_replaces_invalid_ids() {
+	r, _ := http.NewRequest("GET", "https://hub/v1/status", nil)
+	r.Header.Set(RequestIDHeader, "abc-123")
+
+	r, id := EnsureRequestID(r)
+
+	assert.Equal(t.T(), "abc-123", id)
+	assert.Equal(t.T(), "abc-123", RequestID(r.Context()))
+
+	r, _ = http.NewRequest("GET", "https://hub/v1/status", nil)
+	r.Header.Set(RequestIDHeader, "has space")
+
+	r, id = EnsureRequestID(r)
+
+	assert.NotEqual(t.T(), "has space", id)
+	assert.Equal(t.T(), id, r.Header.Get(RequestIDHeader))
+}
+
+func (t *TraceTestSuite) Test_StartServerSpan_continues_the_callers_trace() {
+	r, _ := http.NewRequest("GET", "https://hub/device/d1/info", nil)
+	r.Header.Set(TraceparentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	r, server := StartServerSpan(r, "GET /device/{deviceid}")
+	ctx, child := StartSpan(r.Context(), "gateway.ProxyHTTPRequest", SpanKindClient)
+
+	assert.Equal(t.T(), "4bf92f3577b34da6a3ce929d0e0e4736", server.Context.TraceIDString())
+	assert.Equal(t.T(), "00f067aa0ba902b7", server.Parent.SpanIDString())
+	assert.Equal(t.T(), server.Context.TraceID, child.Context.TraceID)
+	assert.Equal(t.T(), server.Context.SpanID, child.Parent.SpanID)
+
+	Inject(r.WithContext(ctx))
+
+	assert.Equal(t.T(), child.Context.Traceparent(), r.Header.Get(TraceparentHeader))
+}
+
+func (t *TraceTestSuite) Test_FileExporter_writes_otlp_json_lines() {
+	buf := &bufferCloser{}
+	exporter := newExporter(buf, "deviceio-hub")
+	SetExporter(exporter)
+
+	_, span := StartSpan(context.Background(), "cluster.ProxyDeviceRequest", SpanKindInternal)
+	span.SetAttribute("device.id", "d1")
+	span.SetError(assert.AnError)
+	span.Finish()
+	span.Finish()
+
+	exporter.Close()
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Equal(t.T(), 1, len(lines))
+
+	var decoded otlpRequest
+	assert.Nil(t.T(), json.Unmarshal([]byte(lines[0]), &decoded))
+
+	spans := decoded.ResourceSpans[0].ScopeSpans[0].Spans
+
+	assert.Equal(t.T(), "deviceio-hub", decoded.ResourceSpans[0].Resource.Attributes[0].Value.StringValue)
+	assert.Equal(t.T(), 1, len(spans))
+	assert.Equal(t.T(), "cluster.ProxyDeviceRequest", spans[0].Name)
+	assert.Equal(t.T(), span.Context.TraceIDString(), spans[0].TraceID)
+	assert.Equal(t.T(), "", spans[0].ParentSpanID)
+	assert.Equal(t.T(), 2, spans[0].Status.Code)
+	assert.Equal(t.T(), "device.id", spans[0].Attributes[0].Key)
+}
+
+func TestTraceTestSuite(t *testing.T) {
+	suite.Run(t, new(TraceTestSuite))
+}
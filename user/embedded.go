@@ -0,0 +1,107 @@
+package user
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/embedded"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+)
+
+// EmbeddedRepository is the Repository of single node hubs using the embedded
+// database
+type EmbeddedRepository struct {
+	DB *embedded.DB
+}
+
+func (t *EmbeddedRepository) GetByHmacKey(key string) (*Entity, error) {
+	var found *Entity
+
+	err := t.DB.Scan(string(db.HmacKeyTable), false, func(id string, doc []byte) (bool, error) {
+		entity := &Entity{}
+
+		if err := json.Unmarshal(doc, entity); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode hmac key '%v'", id)
+		}
+
+		if entity.HmacKey == key {
+			found = entity
+			return false, nil
+		}
+
+		return true, nil
+	})
+
+	return found, err
+}
+
+func (t *EmbeddedRepository) ExistsByHmacKey(key string) (bool, error) {
+	entity, err := t.GetByHmacKey(key)
+	return entity != nil, err
+}
+
+func (t *EmbeddedRepository) List(username string) ([]*Entity, error) {
+	entities := []*Entity{}
+
+	err := t.DB.Scan(string(db.HmacKeyTable), false, func(id string, doc []byte) (bool, error) {
+		entity := &Entity{}
+
+		if err := json.Unmarshal(doc, entity); err != nil {
+			return false, stacktrace.Propagate(err, "failed to decode hmac key '%v'", id)
+		}
+
+		if username == "" || entity.Username == username {
+			entities = append(entities, entity)
+		}
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(entities, func(i, j int) bool {
+		return entities[i].Created.Before(entities[j].Created)
+	})
+
+	return entities, nil
+}
+
+func (t *EmbeddedRepository) Insert(entity *Entity) (string, error) {
+	if entity.ID == "" {
+		entity.ID = uuid.New().String()
+	}
+
+	if err := t.DB.Insert(string(db.HmacKeyTable), entity.ID, entity); err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert hmac key")
+	}
+
+	return entity.ID, nil
+}
+
+func (t *EmbeddedRepository) Update(entity *Entity) error {
+	err := t.DB.Update(string(db.HmacKeyTable), entity.ID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.HmacKeyTable), ID: entity.ID}
+		}
+
+		return entity, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update hmac key")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedRepository) Delete(id string) error {
+	if _, err := t.DB.Delete(string(db.HmacKeyTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete hmac key")
+	}
+
+	return nil
+}
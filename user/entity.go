@@ -1,9 +1,27 @@
 package user
 
+import (
+	"time"
+
+	"github.com/deviceio/hub/secret"
+)
+
+// Entity is an hmac credential of a hub user, for integrations that cannot sign
+// requests with ed25519. Requests signed with it are made as the user with the
+// login Username.
 type Entity struct {
-	ID         string
-	Username   string
-	HmacKey    string
-	HmacSecret string
-	PermitAddr []string
+	ID       string `gorethink:"id,omitempty"`
+	Username string `gorethink:"username"`
+
+	// HmacKey identifies the credential in the Authorization header
+	HmacKey string `gorethink:"hmac_key"`
+
+	// HmacSecret is the shared secret signing requests, sealed by the master key
+	HmacSecret *secret.Envelope `gorethink:"hmac_secret"`
+
+	// PermitAddr are the ip addresses and CIDR ranges requests signed with the
+	// credential may come from. Requests may come from any address if empty.
+	PermitAddr []string `gorethink:"permit_addr,omitempty"`
+
+	Created time.Time `gorethink:"created"`
 }
@@ -0,0 +1,5 @@
+package user
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("user")
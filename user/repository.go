@@ -3,4 +3,14 @@ package user
 type Repository interface {
 	GetByHmacKey(key string) (user *Entity, err error)
 	ExistsByHmacKey(key string) (exists bool, err error)
+
+	// List returns every credential, or those of the user if username is not
+	// empty
+	List(username string) ([]*Entity, error)
+
+	// Insert stores a new credential generating its ID if empty
+	Insert(user *Entity) (id string, err error)
+
+	Update(user *Entity) error
+	Delete(id string) error
 }
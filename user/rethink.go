@@ -0,0 +1,103 @@
+package user
+
+import (
+	"github.com/deviceio/hub/db"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// RethinkRepository is the rethinkdb backed Repository. It uses the global
+// db.Session.
+type RethinkRepository struct {
+}
+
+func (t *RethinkRepository) GetByHmacKey(key string) (*Entity, error) {
+	cursor, err := db.Table(db.HmacKeyTable).GetAllByIndex("hmac_key", key).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query hmac key")
+	}
+
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	entity := &Entity{}
+
+	if err = cursor.One(entity); err == r.ErrEmptyResult {
+		return nil, nil
+	} else if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read hmac key")
+	}
+
+	return entity, nil
+}
+
+func (t *RethinkRepository) ExistsByHmacKey(key string) (bool, error) {
+	cursor, err := db.Table(db.HmacKeyTable).GetAllByIndex("hmac_key", key).Count().Run(db.Session)
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to query hmac key")
+	}
+
+	count := 0
+
+	if err = cursor.One(&count); err != nil {
+		return false, stacktrace.Propagate(err, "failed to read hmac key count")
+	}
+
+	return count > 0, nil
+}
+
+func (t *RethinkRepository) List(username string) ([]*Entity, error) {
+	entities := []*Entity{}
+	query := db.Table(db.HmacKeyTable)
+
+	if username != "" {
+		query = query.Filter(map[string]interface{}{"username": username})
+	}
+
+	cursor, err := query.OrderBy("created").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query hmac keys")
+	}
+
+	if err = cursor.All(&entities); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read hmac keys")
+	}
+
+	return entities, nil
+}
+
+func (t *RethinkRepository) Insert(entity *Entity) (string, error) {
+	resp, err := db.Table(db.HmacKeyTable).Insert(entity).RunWrite(db.Session)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert hmac key")
+	}
+
+	if entity.ID == "" && len(resp.GeneratedKeys) > 0 {
+		entity.ID = resp.GeneratedKeys[0]
+	}
+
+	return entity.ID, nil
+}
+
+func (t *RethinkRepository) Update(entity *Entity) error {
+	if _, err := db.Table(db.HmacKeyTable).Get(entity.ID).Replace(entity).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to update hmac key")
+	}
+
+	return nil
+}
+
+func (t *RethinkRepository) Delete(id string) error {
+	if _, err := db.Table(db.HmacKeyTable).Get(id).Delete().RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to delete hmac key")
+	}
+
+	return nil
+}
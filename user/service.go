@@ -1,5 +1,431 @@
 package user
 
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/deviceio/hub/audit"
+	"github.com/deviceio/hub/secret"
+	"github.com/palantir/stacktrace"
+)
+
+// AuthScheme is the Authorization header scheme of hmac signed requests
+const AuthScheme = "DEVICEIO-HUB-HMAC"
+
+// TimestampHeader carries the unix time in seconds an hmac signed request was
+// signed at
+const TimestampHeader = "X-Deviceio-Timestamp"
+
+// MaxClockSkew is how far the time a request was signed at may be from the
+// hub's clock
+const MaxClockSkew = 5 * time.Minute
+
+// Service authenticates hmac signed requests and manages the hmac credentials of
+// hub users
 type Service struct {
 	Repository Repository
+
+	// Audit records credentials being added and deleted. Nothing is recorded if
+	// nil.
+	Audit *audit.Log
+}
+
+// Actor is the user making a change through the api
+type Actor struct {
+	ID    string
+	Login string
+}
+
+// Codes of hmac authentication failures, matching those the hub counts api
+// authentication failures by
+const (
+	FailureMalformed    = "malformed"
+	FailureUnknownUser  = "unknown_user"
+	FailureBadSignature = "bad_signature"
+	FailureExpired      = "expired"
+	FailureScope        = "scope"
+)
+
+// AuthenticationFailed is returned when a request fails hmac authentication
+type AuthenticationFailed struct {
+	Reason string
+	Code   string
+}
+
+func (t *AuthenticationFailed) Error() string {
+	return t.Reason
+}
+
+// Invalid is returned when the arguments of a change are not acceptable
+type Invalid struct {
+	Reason string
+}
+
+func (t *Invalid) Error() string {
+	return t.Reason
+}
+
+// NotFound is returned when the credential to change does not exist
+type NotFound struct {
+	Reason string
+}
+
+func (t *NotFound) Error() string {
+	return t.Reason
+}
+
+// Authenticate returns the credential that signed the request. Requests must be
+// signed within MaxClockSkew and come from an address the credential permits.
+func (t *Service) Authenticate(r *http.Request) (*Entity, error) {
+	typeAndValue := strings.Split(strings.TrimSpace(r.Header.Get("Authorization")), " ")
+
+	if len(typeAndValue) != 2 || typeAndValue[0] != AuthScheme {
+		return nil, &AuthenticationFailed{
+			Reason: "authorization header <type> must be '" + AuthScheme + "'",
+			Code:   FailureMalformed,
+		}
+	}
+
+	values := strings.Split(typeAndValue[1], ":")
+
+	if len(values) != 2 {
+		return nil, &AuthenticationFailed{
+			Reason: "authorization value does not have required format <hmac_key>:<hmac_sha256_base64>",
+			Code:   FailureMalformed,
+		}
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(values[1])
+
+	if err != nil {
+		return nil, &AuthenticationFailed{
+			Reason: err.Error(),
+			Code:   FailureMalformed,
+		}
+	}
+
+	entity, err := t.Repository.GetByHmacKey(values[0])
+
+	if err != nil {
+		return nil, err
+	}
+
+	if entity == nil {
+		return nil, &AuthenticationFailed{
+			Reason: "no such hmac key",
+			Code:   FailureUnknownUser,
+		}
+	}
+
+	timestamp := r.Header.Get(TimestampHeader)
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+
+	if err != nil {
+		return nil, &AuthenticationFailed{
+			Reason: TimestampHeader + " header must be the unix time the request was signed at",
+			Code:   FailureMalformed,
+		}
+	}
+
+	if skew := time.Since(time.Unix(seconds, 0)); skew > MaxClockSkew || skew < -MaxClockSkew {
+		return nil, &AuthenticationFailed{
+			Reason: "request timestamp outside the allowed clock skew",
+			Code:   FailureExpired,
+		}
+	}
+
+	hmacSecret, err := secret.Open(entity.HmacSecret)
+
+	if err != nil {
+		logger.WithFields(logrus.Fields{
+			"hmacKey": entity.HmacKey,
+			"error":   err.Error(),
+		}).Error("failed to decrypt hmac secret")
+
+		return nil, &AuthenticationFailed{
+			Reason: "failed to decrypt hmac secret",
+			Code:   FailureBadSignature,
+		}
+	}
+
+	if !hmac.Equal(signature, sign(r, entity.HmacKey, string(hmacSecret), timestamp)) {
+		return nil, &AuthenticationFailed{
+			Reason: "signature mismatch",
+			Code:   FailureBadSignature,
+		}
+	}
+
+	if !permitted(entity.PermitAddr, r.RemoteAddr) {
+		return nil, &AuthenticationFailed{
+			Reason: "source address not permitted",
+			Code:   FailureScope,
+		}
+	}
+
+	return entity, nil
+}
+
+// Sign sets the Authorization and timestamp headers of the request for the hmac
+// credential. The HMAC-SHA256 signature covers the key, the time, the method,
+// host, path, raw query and Content-Type of the request.
+func Sign(r *http.Request, hmacKey string, hmacSecret string, at time.Time) {
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+
+	r.Header.Set(TimestampHeader, timestamp)
+	r.Header.Set("Authorization", AuthScheme+" "+hmacKey+":"+base64.StdEncoding.EncodeToString(sign(r, hmacKey, hmacSecret, timestamp)))
+}
+
+func sign(r *http.Request, hmacKey string, hmacSecret string, timestamp string) []byte {
+	method := r.Method
+
+	if method == "" {
+		method = "GET"
+	}
+
+	host := r.Host
+
+	if host == "" {
+		host = r.URL.Host
+	}
+
+	message := strings.Join(
+		[]string{
+			hmacKey,
+			timestamp,
+			method,
+			host,
+			r.URL.Path,
+			r.URL.RawQuery,
+			r.Header.Get("Content-Type"),
+		},
+		"\r\n",
+	)
+
+	mac := hmac.New(sha256.New, []byte(hmacSecret))
+	mac.Write([]byte(message))
+
+	return mac.Sum(nil)
+}
+
+// permitted reports if the remote address is one of the permitted addresses or
+// ranges. Every address is permitted if there are none.
+func permitted(permitAddr []string, remoteAddr string) bool {
+	if len(permitAddr) == 0 {
+		return true
+	}
+
+	host, _, err := net.SplitHostPort(remoteAddr)
+
+	if err != nil {
+		host = remoteAddr
+	}
+
+	ip := net.ParseIP(host)
+
+	if ip == nil {
+		return false
+	}
+
+	for _, addr := range permitAddr {
+		if _, network, err := net.ParseCIDR(addr); err == nil && network.Contains(ip) {
+			return true
+		}
+
+		if permittedIP := net.ParseIP(addr); permittedIP != nil && permittedIP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// List returns the credentials of the user with the login, or every credential
+// if username is empty
+func (t *Service) List(username string) ([]*Entity, error) {
+	return t.Repository.List(username)
+}
+
+// Add issues an hmac credential to the user with the login. The secret is
+// returned only here.
+func (t *Service) Add(actor *Actor, username string, permitAddr []string) (*Entity, string, error) {
+	if username == "" {
+		return nil, "", &Invalid{
+			Reason: "username is required",
+		}
+	}
+
+	for _, addr := range permitAddr {
+		_, _, cidrErr := net.ParseCIDR(addr)
+
+		if cidrErr != nil && net.ParseIP(addr) == nil {
+			return nil, "", &Invalid{
+				Reason: "permitted address '" + addr + "' is not an ip address or CIDR range",
+			}
+		}
+	}
+
+	key := make([]byte, 16)
+	plain := make([]byte, 32)
+
+	if _, err := rand.Read(key); err != nil {
+		return nil, "", stacktrace.Propagate(err, "error generating hmac key")
+	}
+
+	if _, err := rand.Read(plain); err != nil {
+		return nil, "", stacktrace.Propagate(err, "error generating hmac secret")
+	}
+
+	hmacSecret := hex.EncodeToString(plain)
+	sealed, err := secret.Seal([]byte(hmacSecret))
+
+	if err != nil {
+		return nil, "", stacktrace.Propagate(err, "error encrypting hmac secret")
+	}
+
+	entity := &Entity{
+		Username:   username,
+		HmacKey:    hex.EncodeToString(key),
+		HmacSecret: sealed,
+		PermitAddr: permitAddr,
+		Created:    time.Now().UTC(),
+	}
+
+	if _, err = t.Repository.Insert(entity); err != nil {
+		return nil, "", err
+	}
+
+	if err = t.audit(actor, audit.UserHmacKeyAdd, entity); err != nil {
+		return nil, "", err
+	}
+
+	return entity, hmacSecret, nil
+}
+
+// Delete removes the credential of the user with the login that has the id or
+// hmac key
+func (t *Service) Delete(actor *Actor, username string, idOrKey string) error {
+	entities, err := t.Repository.List(username)
+
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		if entity.ID != idOrKey && entity.HmacKey != idOrKey {
+			continue
+		}
+
+		if err = t.Repository.Delete(entity.ID); err != nil {
+			return err
+		}
+
+		return t.audit(actor, audit.UserHmacKeyDelete, entity)
+	}
+
+	return &NotFound{
+		Reason: "user '" + username + "' has no hmac key '" + idOrKey + "'",
+	}
+}
+
+// DeleteAll removes every credential of the user with the login, returning the
+// number removed. Used when the user's credentials are replaced as a whole.
+func (t *Service) DeleteAll(actor *Actor, username string) (int, error) {
+	if username == "" {
+		return 0, &Invalid{
+			Reason: "username is required",
+		}
+	}
+
+	entities, err := t.Repository.List(username)
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, entity := range entities {
+		if err = t.Repository.Delete(entity.ID); err != nil {
+			return i, err
+		}
+
+		if err = t.audit(actor, audit.UserHmacKeyDelete, entity); err != nil {
+			return i + 1, err
+		}
+	}
+
+	return len(entities), nil
+}
+
+// Rewrap re-wraps the secrets sealed by a retired master key with the active
+// key, returning the number re-wrapped
+func (t *Service) Rewrap() (int, error) {
+	keyring := secret.Default()
+
+	if keyring == nil {
+		return 0, nil
+	}
+
+	entities, err := t.Repository.List("")
+
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+
+	for _, entity := range entities {
+		if entity.HmacSecret == nil || entity.HmacSecret.KeyID == keyring.Active() {
+			continue
+		}
+
+		if entity.HmacSecret, err = keyring.Rewrap(entity.HmacSecret); err != nil {
+			return rewrapped, stacktrace.Propagate(err, "failed to re-wrap hmac secret of '%v'", entity.HmacKey)
+		}
+
+		if err = t.Repository.Update(entity); err != nil {
+			return rewrapped, err
+		}
+
+		rewrapped++
+	}
+
+	return rewrapped, nil
+}
+
+// audit writes the audit record of a change to a credential
+func (t *Service) audit(actor *Actor, kind string, entity *Entity) error {
+	if t.Audit == nil {
+		return nil
+	}
+
+	rec := &audit.Record{
+		Kind:   kind,
+		Target: entity.ID,
+		Detail: map[string]string{
+			"login":      entity.Username,
+			"hmacKey":    entity.HmacKey,
+			"permitAddr": strings.Join(entity.PermitAddr, ","),
+			"source":     "cli",
+		},
+	}
+
+	if actor != nil {
+		rec.Detail["source"] = "api"
+		rec.UserID = actor.ID
+		rec.UserLogin = actor.Login
+	}
+
+	if err := t.Audit.Write(rec); err != nil {
+		return stacktrace.Propagate(err, "failed to write audit record")
+	}
+
+	return nil
 }
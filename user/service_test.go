@@ -0,0 +1,173 @@
+package user
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/deviceio/hub/embedded"
+	"github.com/deviceio/hub/secret"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServiceTestSuite struct {
+	suite.Suite
+	edb     *embedded.DB
+	key     []byte
+	service *Service
+}
+
+func (t *ServiceTestSuite) SetupTest() {
+	t.key, _ = secret.GenerateKey()
+	keyring, _ := secret.NewKeyring(t.key)
+	secret.SetKeyring(keyring)
+
+	t.edb, _ = embedded.Open("")
+	t.service = &Service{
+		Repository: &EmbeddedRepository{DB: t.edb},
+	}
+}
+
+func (t *ServiceTestSuite) TearDownTest() {
+	t.edb.Close()
+}
+
+func (t *ServiceTestSuite) request(remoteAddr string) *http.Request {
+	r, _ := http.NewRequest("GET", "https://hub.example.com/v1/devices?limit=5", nil)
+	r.RemoteAddr = remoteAddr
+
+	return r
+}
+
+func (t *ServiceTestSuite) Test_Authenticate_accepts_signed_requests() {
+	entity, hmacSecret, err := t.service.Add(nil, "ops", nil)
+	assert.Nil(t.T(), err)
+
+	r := t.request("203.0.113.7:52000")
+	Sign(r, entity.HmacKey, hmacSecret, time.Now())
+
+	authenticated, err := t.service.Authenticate(r)
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "ops", authenticated.Username)
+	assert.Equal(t.T(), entity.HmacKey, authenticated.HmacKey)
+}
+
+func (t *ServiceTestSuite) Test_Authenticate_failures() {
+	entity, hmacSecret, _ := t.service.Add(nil, "ops", nil)
+
+	reason := func(r *http.Request) string {
+		_, err := t.service.Authenticate(r)
+
+		if failed, ok := err.(*AuthenticationFailed); ok {
+			return failed.Reason
+		}
+
+		return ""
+	}
+
+	r := t.request("203.0.113.7:52000")
+	Sign(r, "unknown", hmacSecret, time.Now())
+	assert.Equal(t.T(), "no such hmac key", reason(r))
+
+	r = t.request("203.0.113.7:52000")
+	Sign(r, entity.HmacKey, "wrong", time.Now())
+	assert.Equal(t.T(), "signature mismatch", reason(r))
+
+	// the signature covers the query
+	r = t.request("203.0.113.7:52000")
+	Sign(r, entity.HmacKey, hmacSecret, time.Now())
+	r.URL.RawQuery = "limit=500"
+	assert.Equal(t.T(), "signature mismatch", reason(r))
+
+	r = t.request("203.0.113.7:52000")
+	Sign(r, entity.HmacKey, hmacSecret, time.Now().Add(-MaxClockSkew-time.Minute))
+	assert.Equal(t.T(), "request timestamp outside the allowed clock skew", reason(r))
+
+	r = t.request("203.0.113.7:52000")
+	Sign(r, entity.HmacKey, hmacSecret, time.Now())
+	r.Header.Del(TimestampHeader)
+	assert.Equal(t.T(), TimestampHeader+" header must be the unix time the request was signed at", reason(r))
+}
+
+func (t *ServiceTestSuite) Test_Authenticate_enforces_permitted_addresses() {
+	entity, hmacSecret, err := t.service.Add(nil, "ops", []string{"10.0.0.0/8", "2001:db8::1"})
+	assert.Nil(t.T(), err)
+
+	for remoteAddr, allowed := range map[string]bool{
+		"10.1.2.3:4000":      true,
+		"[2001:db8::1]:4000": true,
+		"11.1.2.3:4000":      false,
+		"[2001:db8::2]:4000": false,
+	} {
+		r := t.request(remoteAddr)
+		Sign(r, entity.HmacKey, hmacSecret, time.Now())
+
+		_, err := t.service.Authenticate(r)
+
+		if allowed {
+			assert.Nil(t.T(), err, remoteAddr)
+			continue
+		}
+
+		assert.Equal(t.T(), "source address not permitted", err.Error(), remoteAddr)
+	}
+}
+
+func (t *ServiceTestSuite) Test_Add_rejects_invalid_permitted_addresses() {
+	_, _, err := t.service.Add(nil, "ops", []string{"10.0.0.0/33"})
+
+	_, ok := err.(*Invalid)
+	assert.True(t.T(), ok)
+}
+
+func (t *ServiceTestSuite) Test_Delete_and_Rewrap() {
+	entity, hmacSecret, _ := t.service.Add(nil, "ops", nil)
+	other, _, _ := t.service.Add(nil, "dev", nil)
+
+	// another user's key cannot be deleted through this user
+	_, ok := t.service.Delete(nil, "ops", other.HmacKey).(*NotFound)
+	assert.True(t.T(), ok)
+
+	active, _ := secret.GenerateKey()
+	keyring, _ := secret.NewKeyring(t.key, active)
+	secret.SetKeyring(keyring)
+
+	rewrapped, err := t.service.Rewrap()
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 2, rewrapped)
+
+	r := t.request("203.0.113.7:52000")
+	Sign(r, entity.HmacKey, hmacSecret, time.Now())
+
+	_, err = t.service.Authenticate(r)
+	assert.Nil(t.T(), err)
+
+	assert.Nil(t.T(), t.service.Delete(nil, "ops", entity.HmacKey))
+
+	entities, _ := t.service.List("")
+	assert.Len(t.T(), entities, 1)
+	assert.Equal(t.T(), "dev", entities[0].Username)
+}
+
+func (t *ServiceTestSuite) Test_DeleteAll_removes_only_the_users_keys() {
+	t.service.Add(nil, "ops", nil)
+	t.service.Add(nil, "ops", nil)
+	t.service.Add(nil, "dev", nil)
+
+	deleted, err := t.service.DeleteAll(nil, "ops")
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 2, deleted)
+
+	entities, _ := t.service.List("")
+	assert.Len(t.T(), entities, 1)
+	assert.Equal(t.T(), "dev", entities[0].Username)
+
+	_, err = t.service.DeleteAll(nil, "")
+	assert.IsType(t.T(), &Invalid{}, err)
+}
+
+func TestServiceTestSuite(t *testing.T) {
+	suite.Run(t, new(ServiceTestSuite))
+}
@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"encoding/json"
+	"sort"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/embedded"
+	"github.com/deviceio/hub/secret"
+	"github.com/google/uuid"
+	"github.com/palantir/stacktrace"
+)
+
+// EmbeddedStore is the Store of single node hubs using the embedded database
+type EmbeddedStore struct {
+	DB *embedded.DB
+}
+
+func (t *EmbeddedStore) Source() cache.Source {
+	return t.DB.Source(string(db.WebhookTable), func() interface{} {
+		return &Subscription{}
+	})
+}
+
+func (t *EmbeddedStore) Subscriptions() ([]*Subscription, error) {
+	subs := []*Subscription{}
+
+	err := t.DB.Scan(string(db.WebhookTable), false, func(id string, doc []byte) (bool, error) {
+		sub := &Subscription{}
+
+		if err := json.Unmarshal(doc, sub); err != nil {
+			return false, err
+		}
+
+		subs = append(subs, sub)
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook subscriptions")
+	}
+
+	sort.SliceStable(subs, func(i, j int) bool {
+		return subs[i].CreatedAt.Before(subs[j].CreatedAt)
+	})
+
+	return subs, nil
+}
+
+func (t *EmbeddedStore) Subscription(id string) (*Subscription, error) {
+	sub := &Subscription{}
+
+	found, err := t.DB.Get(string(db.WebhookTable), id, sub)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook subscription")
+	}
+
+	if !found {
+		return nil, nil
+	}
+
+	return sub, nil
+}
+
+func (t *EmbeddedStore) InsertSubscription(sub *Subscription) (string, error) {
+	if sub.ID == "" {
+		sub.ID = uuid.New().String()
+	}
+
+	if err := t.DB.Insert(string(db.WebhookTable), sub.ID, sub); err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert webhook subscription")
+	}
+
+	return sub.ID, nil
+}
+
+func (t *EmbeddedStore) UpdateSubscription(sub *Subscription) error {
+	err := t.DB.Update(string(db.WebhookTable), sub.ID, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &embedded.ErrNotFound{Table: string(db.WebhookTable), ID: sub.ID}
+		}
+
+		return sub, nil
+	})
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update webhook subscription")
+	}
+
+	return nil
+}
+
+// unchanged aborts an embedded update whose condition no longer holds
+type unchanged struct{}
+
+func (t *unchanged) Error() string {
+	return "document changed"
+}
+
+func (t *EmbeddedStore) RewrapSecret(id string, prevKeyID string, envelope *secret.Envelope) (bool, error) {
+	err := t.DB.Update(string(db.WebhookTable), id, func(current []byte) (interface{}, error) {
+		if current == nil {
+			return nil, &unchanged{}
+		}
+
+		sub := &Subscription{}
+
+		if err := json.Unmarshal(current, sub); err != nil {
+			return nil, err
+		}
+
+		if sub.SealedSecret == nil || sub.SealedSecret.KeyID != prevKeyID {
+			return nil, &unchanged{}
+		}
+
+		sub.SealedSecret = envelope
+
+		return sub, nil
+	})
+
+	if _, ok := err.(*unchanged); ok {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to update webhook subscription secret")
+	}
+
+	return true, nil
+}
+
+func (t *EmbeddedStore) DeleteSubscription(id string) error {
+	if _, err := t.DB.Delete(string(db.WebhookTable), id); err != nil {
+		return stacktrace.Propagate(err, "failed to delete webhook subscription")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedStore) InsertDelivery(delivery *Delivery) error {
+	if delivery.ID == "" {
+		delivery.ID = uuid.New().String()
+	}
+
+	if err := t.DB.Insert(string(db.WebhookDeliveryTable), delivery.ID, delivery); err != nil {
+		return stacktrace.Propagate(err, "failed to insert webhook delivery")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedStore) Deliveries(subscriptionID string, limit int) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+
+	err := t.DB.Scan(string(db.WebhookDeliveryTable), false, func(id string, doc []byte) (bool, error) {
+		delivery := &Delivery{}
+
+		if err := json.Unmarshal(doc, delivery); err != nil {
+			return false, err
+		}
+
+		if delivery.SubscriptionID == subscriptionID {
+			deliveries = append(deliveries, delivery)
+		}
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook deliveries")
+	}
+
+	sort.SliceStable(deliveries, func(i, j int) bool {
+		return deliveries[i].Time.After(deliveries[j].Time)
+	})
+
+	if limit > 0 && len(deliveries) > limit {
+		deliveries = deliveries[:limit]
+	}
+
+	return deliveries, nil
+}
+
+func (t *EmbeddedStore) InsertDeadLetter(letter *DeadLetter) error {
+	if letter.ID == "" {
+		letter.ID = uuid.New().String()
+	}
+
+	if err := t.DB.Insert(string(db.WebhookDeadLetterTable), letter.ID, letter); err != nil {
+		return stacktrace.Propagate(err, "failed to insert webhook dead letter")
+	}
+
+	return nil
+}
+
+func (t *EmbeddedStore) DeadLetters(subscriptionID string, limit int) ([]*DeadLetter, error) {
+	letters := []*DeadLetter{}
+
+	err := t.DB.Scan(string(db.WebhookDeadLetterTable), false, func(id string, doc []byte) (bool, error) {
+		letter := &DeadLetter{}
+
+		if err := json.Unmarshal(doc, letter); err != nil {
+			return false, err
+		}
+
+		if letter.SubscriptionID == subscriptionID {
+			letters = append(letters, letter)
+		}
+
+		return true, nil
+	})
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook dead letters")
+	}
+
+	sort.SliceStable(letters, func(i, j int) bool {
+		return letters[i].Time.After(letters[j].Time)
+	})
+
+	if limit > 0 && len(letters) > limit {
+		letters = letters[:limit]
+	}
+
+	return letters, nil
+}
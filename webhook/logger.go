@@ -0,0 +1,5 @@
+package webhook
+
+import "github.com/deviceio/hub/logging"
+
+var logger = logging.Component("webhook")
@@ -0,0 +1,14 @@
+package webhook
+
+import "github.com/prometheus/client_golang/prometheus"
+
+var (
+	eventsDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "deviceio_hub_webhook_events_dropped_total",
+		Help: "Number of events dropped because the delivery queue of the subscription was full",
+	}, []string{"subscription"})
+)
+
+func init() {
+	prometheus.MustRegister(eventsDropped)
+}
@@ -0,0 +1,166 @@
+package webhook
+
+import (
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/db"
+	"github.com/deviceio/hub/secret"
+	"github.com/palantir/stacktrace"
+	r "gopkg.in/gorethink/gorethink.v2"
+)
+
+// RethinkStore is the rethinkdb backed Store
+type RethinkStore struct {
+}
+
+func (t *RethinkStore) Source() cache.Source {
+	return &cache.RethinkSource{
+		Table: string(db.WebhookTable),
+		New: func() interface{} {
+			return &Subscription{}
+		},
+	}
+}
+
+func (t *RethinkStore) Subscriptions() ([]*Subscription, error) {
+	subs := []*Subscription{}
+
+	cursor, err := db.Table(db.WebhookTable).OrderBy("created_at").Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query webhook subscriptions")
+	}
+
+	if err = cursor.All(&subs); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook subscriptions")
+	}
+
+	return subs, nil
+}
+
+func (t *RethinkStore) Subscription(id string) (*Subscription, error) {
+	cursor, err := db.Table(db.WebhookTable).Get(id).Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query webhook subscription")
+	}
+
+	defer cursor.Close()
+
+	if cursor.IsNil() {
+		return nil, nil
+	}
+
+	sub := &Subscription{}
+
+	if err = cursor.One(sub); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook subscription")
+	}
+
+	return sub, nil
+}
+
+func (t *RethinkStore) InsertSubscription(sub *Subscription) (string, error) {
+	resp, err := db.Table(db.WebhookTable).Insert(sub).RunWrite(db.Session)
+
+	if err != nil {
+		return "", stacktrace.Propagate(err, "failed to insert webhook subscription")
+	}
+
+	if sub.ID != "" {
+		return sub.ID, nil
+	}
+
+	return resp.GeneratedKeys[0], nil
+}
+
+func (t *RethinkStore) UpdateSubscription(sub *Subscription) error {
+	_, err := db.Table(db.WebhookTable).Get(sub.ID).Replace(sub).RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to update webhook subscription")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) RewrapSecret(id string, prevKeyID string, envelope *secret.Envelope) (bool, error) {
+	resp, err := db.Table(db.WebhookTable).Get(id).Update(func(sub r.Term) interface{} {
+		return r.Branch(
+			sub.Field("secret").Field("kid").Default("").Eq(prevKeyID),
+			map[string]interface{}{"secret": r.Literal(envelope)},
+			map[string]interface{}{},
+		)
+	}).RunWrite(db.Session)
+
+	if err != nil {
+		return false, stacktrace.Propagate(err, "failed to update webhook subscription secret")
+	}
+
+	return resp.Replaced > 0, nil
+}
+
+func (t *RethinkStore) DeleteSubscription(id string) error {
+	_, err := db.Table(db.WebhookTable).Get(id).Delete().RunWrite(db.Session)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to delete webhook subscription")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) InsertDelivery(delivery *Delivery) error {
+	if _, err := db.Table(db.WebhookDeliveryTable).Insert(delivery).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to insert webhook delivery")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) Deliveries(subscriptionID string, limit int) ([]*Delivery, error) {
+	deliveries := []*Delivery{}
+
+	cursor, err := db.Table(db.WebhookDeliveryTable).
+		GetAllByIndex("subscription_id", subscriptionID).
+		OrderBy(r.Desc("time")).
+		Limit(limit).
+		Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query webhook deliveries")
+	}
+
+	if err = cursor.All(&deliveries); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook deliveries")
+	}
+
+	return deliveries, nil
+}
+
+func (t *RethinkStore) InsertDeadLetter(letter *DeadLetter) error {
+	if _, err := db.Table(db.WebhookDeadLetterTable).Insert(letter).RunWrite(db.Session); err != nil {
+		return stacktrace.Propagate(err, "failed to insert webhook dead letter")
+	}
+
+	return nil
+}
+
+func (t *RethinkStore) DeadLetters(subscriptionID string, limit int) ([]*DeadLetter, error) {
+	letters := []*DeadLetter{}
+
+	cursor, err := db.Table(db.WebhookDeadLetterTable).
+		GetAllByIndex("subscription_id", subscriptionID).
+		OrderBy(r.Desc("time")).
+		Limit(limit).
+		Run(db.Session)
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to query webhook dead letters")
+	}
+
+	if err = cursor.All(&letters); err != nil {
+		return nil, stacktrace.Propagate(err, "failed to read webhook dead letters")
+	}
+
+	return letters, nil
+}
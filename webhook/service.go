@@ -0,0 +1,518 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/cenk/backoff"
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+	"github.com/palantir/stacktrace"
+)
+
+const (
+	// SignatureHeader carries the hex encoded HMAC-SHA256 of "<timestamp>.<body>"
+	// keyed with the subscription secret, prefixed with "sha256=".
+	SignatureHeader = "X-Deviceio-Signature"
+
+	// TimestampHeader carries the unix time the delivery attempt was signed
+	TimestampHeader = "X-Deviceio-Timestamp"
+
+	// EventHeader carries the delivered event type
+	EventHeader = "X-Deviceio-Event"
+
+	// DeliveryHeader carries the delivered event id, identical across retries
+	DeliveryHeader = "X-Deviceio-Delivery"
+)
+
+// Events delivered to webhooks by default: device connectivity and security events
+var DefaultTypes = []string{
+	event.DeviceConnected,
+	event.DeviceDisconnected,
+	event.AuthFailed,
+	event.UserRecovered,
+}
+
+// Service delivers events published on this member's bus to matching webhook
+// subscriptions. Only events originating on this member are delivered so each event
+// is delivered once across the cluster. Each subscription has its own bounded
+// queue so a slow receiver never holds up the bus or other subscriptions.
+type Service struct {
+	Events *event.Bus
+	Store  Store
+
+	// Client issues delivery requests. http.DefaultClient with a 10 second
+	// timeout is used if nil.
+	Client *http.Client
+
+	// MaxAttempts is the number of delivery attempts before an event is dead
+	// lettered. Defaults to 8.
+	MaxAttempts int
+
+	// InitialInterval is the delay before the first retry, doubling each retry up to
+	// MaxInterval. Defaults to 1s and 5m.
+	InitialInterval time.Duration
+	MaxInterval     time.Duration
+
+	// QueueSize bounds the events waiting for delivery to each subscription.
+	// Events arriving while the queue is full are dropped. Defaults to 256.
+	QueueSize int
+
+	subs   *cache.Cache
+	queues map[string]chan *event.Event
+	mu     sync.Mutex
+}
+
+// Start consumes events from the bus until it is closed
+func (t *Service) Start() {
+	t.init()
+
+	t.subs = cache.New(&cache.Config{
+		Name:   "webhook",
+		Source: t.Store.Source(),
+		Key: func(item interface{}) string {
+			return item.(*Subscription).ID
+		},
+		OnChange: func(old interface{}, new interface{}) {
+			if new == nil {
+				t.closeQueue(old.(*Subscription).ID)
+			}
+		},
+	})
+
+	go t.subs.Start()
+	defer t.subs.Stop()
+
+	for t.subs.WaitReady(time.Minute) != nil {
+		logger.Warn("waiting for webhook subscriptions to load")
+	}
+
+	sub := t.Events.Subscribe(4096)
+	defer sub.Close()
+
+	logger.Info("webhooks starting")
+
+	for e := range sub.C {
+		for _, item := range t.subs.List() {
+			if s := item.(*Subscription); s.Matches(e) {
+				t.enqueue(s.ID, e)
+			}
+		}
+	}
+}
+
+// enqueue queues the event for delivery to the subscription, dropping it if the
+// subscription's queue is full
+func (t *Service) enqueue(id string, e *event.Event) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	queue, ok := t.queues[id]
+
+	if !ok {
+		// the subscription may have been deleted, and its queue closed, since the
+		// event was matched against it. Deletions leave the cache before closeQueue
+		// takes the lock, so a queue is never opened after it was closed.
+		if t.subs.Get(id) == nil {
+			return
+		}
+
+		queue = make(chan *event.Event, t.QueueSize)
+		t.queues[id] = queue
+
+		go t.deliverQueue(id, queue)
+	}
+
+	select {
+	case queue <- e:
+	default:
+		eventsDropped.WithLabelValues(id).Inc()
+
+		logger.WithFields(logrus.Fields{
+			"subscriptionId": id,
+			"eventId":        e.ID,
+			"eventType":      e.Type,
+		}).Warn("webhook delivery queue full, event dropped")
+	}
+}
+
+// deliverQueue delivers the queued events of the subscription in order until the
+// queue is closed. The subscription is read from the cache for each event so
+// changes to its url, secret or disabled state apply to queued events.
+func (t *Service) deliverQueue(id string, queue chan *event.Event) {
+	for e := range queue {
+		if s, ok := t.subs.Get(id).(*Subscription); ok && !s.Disabled {
+			t.Deliver(s, e)
+		}
+	}
+}
+
+// closeQueue ends delivery to a deleted subscription
+func (t *Service) closeQueue(id string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if queue, ok := t.queues[id]; ok {
+		close(queue)
+		delete(t.queues, id)
+	}
+}
+
+// Deliver posts the event to the subscription retrying with exponential backoff.
+// Every attempt is recorded as a Delivery. If all attempts fail a DeadLetter is
+// recorded and an error returned.
+func (t *Service) Deliver(sub *Subscription, e *event.Event) error {
+	t.init()
+
+	body, err := json.Marshal(e)
+
+	if err != nil {
+		return stacktrace.Propagate(err, "failed to encode event")
+	}
+
+	b := backoff.NewExponentialBackOff()
+	b.InitialInterval = t.InitialInterval
+	b.MaxInterval = t.MaxInterval
+	b.MaxElapsedTime = 0
+	b.Reset()
+
+	var lastErr error
+
+	for attempt := 1; attempt <= t.MaxAttempts; attempt++ {
+		lastErr = t.attempt(sub, e, body, attempt)
+
+		if lastErr == nil {
+			return nil
+		}
+
+		if attempt < t.MaxAttempts {
+			time.Sleep(b.NextBackOff())
+		}
+	}
+
+	letter := &DeadLetter{
+		SubscriptionID: sub.ID,
+		Event:          e,
+		Attempts:       t.MaxAttempts,
+		LastError:      lastErr.Error(),
+		Time:           time.Now().UTC(),
+	}
+
+	if err = t.Store.InsertDeadLetter(letter); err != nil {
+		logger.WithField("error", err.Error()).Error("failed to record webhook dead letter")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"subscriptionId": sub.ID,
+		"eventId":        e.ID,
+		"error":          lastErr.Error(),
+	}).Error("webhook delivery failed")
+
+	return stacktrace.Propagate(lastErr, "webhook delivery failed after %v attempts", t.MaxAttempts)
+}
+
+func (t *Service) attempt(sub *Subscription, e *event.Event, body []byte, attempt int) error {
+	start := time.Now()
+	timestamp := strconv.FormatInt(start.Unix(), 10)
+
+	delivery := &Delivery{
+		SubscriptionID: sub.ID,
+		EventID:        e.ID,
+		EventType:      e.Type,
+		Attempt:        attempt,
+		Time:           start.UTC(),
+	}
+
+	err := func() error {
+		key, err := secret.Open(sub.SealedSecret)
+
+		if err != nil {
+			return stacktrace.Propagate(err, "failed to decrypt webhook secret")
+		}
+
+		req, err := http.NewRequest("POST", sub.URL, bytes.NewReader(body))
+
+		if err != nil {
+			return err
+		}
+
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "deviceio-hub-webhook")
+		req.Header.Set(EventHeader, e.Type)
+		req.Header.Set(DeliveryHeader, e.ID)
+		req.Header.Set(TimestampHeader, timestamp)
+		req.Header.Set(SignatureHeader, "sha256="+Sign(string(key), timestamp, body))
+
+		resp, err := t.Client.Do(req)
+
+		if err != nil {
+			return err
+		}
+
+		io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+
+		delivery.StatusCode = resp.StatusCode
+
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("receiver responded with status %v", resp.StatusCode)
+		}
+
+		return nil
+	}()
+
+	delivery.Duration = float64(time.Since(start)) / float64(time.Millisecond)
+
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	if serr := t.Store.InsertDelivery(delivery); serr != nil {
+		logger.WithField("error", serr.Error()).Error("failed to record webhook delivery")
+	}
+
+	return err
+}
+
+// Create validates and stores a new subscription, generating a secret if none was
+// supplied. The returned subscription includes the secret.
+func (t *Service) Create(sub *Subscription) (*Subscription, error) {
+	if err := validate(sub); err != nil {
+		return nil, err
+	}
+
+	plain := sub.Secret
+
+	if plain == "" {
+		key := make([]byte, 32)
+
+		if _, err := rand.Read(key); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to generate webhook secret")
+		}
+
+		plain = hex.EncodeToString(key)
+	}
+
+	sealed, err := secret.Seal([]byte(plain))
+
+	if err != nil {
+		return nil, stacktrace.Propagate(err, "failed to encrypt webhook secret")
+	}
+
+	sub.Secret = ""
+	sub.SealedSecret = sealed
+
+	if sub.Types == nil {
+		sub.Types = DefaultTypes
+	}
+
+	if sub.Devices == nil {
+		sub.Devices = []string{}
+	}
+
+	sub.ID = ""
+	sub.CreatedAt = time.Now().UTC()
+
+	id, err := t.Store.InsertSubscription(sub)
+
+	if err != nil {
+		return nil, err
+	}
+
+	sub.ID = id
+	sub.Secret = plain
+	sub.SealedSecret = nil
+
+	return sub, nil
+}
+
+// Update replaces the url, types, devices and disabled state of an existing
+// subscription. The secret is only replaced when one is supplied.
+func (t *Service) Update(id string, sub *Subscription) (*Subscription, error) {
+	existing, err := t.Store.Subscription(id)
+
+	if err != nil || existing == nil {
+		return nil, err
+	}
+
+	if err = validate(sub); err != nil {
+		return nil, err
+	}
+
+	existing.URL = sub.URL
+	existing.Types = sub.Types
+	existing.Devices = sub.Devices
+	existing.Disabled = sub.Disabled
+
+	if sub.Secret != "" {
+		if existing.SealedSecret, err = secret.Seal([]byte(sub.Secret)); err != nil {
+			return nil, stacktrace.Propagate(err, "failed to encrypt webhook secret")
+		}
+	}
+
+	if err = t.Store.UpdateSubscription(existing); err != nil {
+		return nil, err
+	}
+
+	return redact(existing), nil
+}
+
+// List returns every subscription with secrets removed
+func (t *Service) List() ([]*Subscription, error) {
+	subs, err := t.Store.Subscriptions()
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, sub := range subs {
+		redact(sub)
+	}
+
+	return subs, nil
+}
+
+// Get returns the subscription with its secret removed or nil if it does not exist
+func (t *Service) Get(id string) (*Subscription, error) {
+	sub, err := t.Store.Subscription(id)
+
+	if err != nil || sub == nil {
+		return nil, err
+	}
+
+	return redact(sub), nil
+}
+
+// Rewrap re-wraps the secrets sealed by a retired master key with the active
+// one, returning the number of subscriptions re-wrapped
+func (t *Service) Rewrap() (int, error) {
+	keyring := secret.Default()
+
+	if keyring == nil {
+		return 0, nil
+	}
+
+	subs, err := t.Store.Subscriptions()
+
+	if err != nil {
+		return 0, err
+	}
+
+	rewrapped := 0
+
+	for _, sub := range subs {
+		if sub.SealedSecret == nil || sub.SealedSecret.KeyID == keyring.Active() {
+			continue
+		}
+
+		next, err := keyring.Rewrap(sub.SealedSecret)
+
+		if err != nil {
+			return rewrapped, stacktrace.Propagate(err, "failed to re-wrap secret of webhook subscription '%v'", sub.ID)
+		}
+
+		ok, err := t.Store.RewrapSecret(sub.ID, sub.SealedSecret.KeyID, next)
+
+		if err != nil {
+			return rewrapped, err
+		}
+
+		if ok {
+			rewrapped++
+		}
+	}
+
+	return rewrapped, nil
+}
+
+func (t *Service) Delete(id string) error {
+	return t.Store.DeleteSubscription(id)
+}
+
+func (t *Service) Deliveries(id string, limit int) ([]*Delivery, error) {
+	return t.Store.Deliveries(id, limit)
+}
+
+func (t *Service) DeadLetters(id string, limit int) ([]*DeadLetter, error) {
+	return t.Store.DeadLetters(id, limit)
+}
+
+func (t *Service) init() {
+	if t.queues == nil {
+		t.queues = map[string]chan *event.Event{}
+	}
+
+	if t.QueueSize <= 0 {
+		t.QueueSize = 256
+	}
+
+	if t.Client == nil {
+		t.Client = &http.Client{
+			Timeout: 10 * time.Second,
+		}
+	}
+
+	if t.MaxAttempts <= 0 {
+		t.MaxAttempts = 8
+	}
+
+	if t.InitialInterval <= 0 {
+		t.InitialInterval = 1 * time.Second
+	}
+
+	if t.MaxInterval <= 0 {
+		t.MaxInterval = 5 * time.Minute
+	}
+}
+
+// Sign computes the hex encoded HMAC-SHA256 of "<timestamp>.<body>" keyed by secret.
+// Receivers recompute it to verify a delivery originated from the hub.
+func Sign(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// ErrInvalidSubscription is returned when a subscription fails validation
+type ErrInvalidSubscription struct {
+	Message string
+}
+
+func (t *ErrInvalidSubscription) Error() string {
+	return t.Message
+}
+
+func validate(sub *Subscription) error {
+	u, err := url.Parse(sub.URL)
+
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return &ErrInvalidSubscription{
+			Message: "url must be an absolute http or https url",
+		}
+	}
+
+	return nil
+}
+
+func redact(sub *Subscription) *Subscription {
+	sub.Secret = ""
+	sub.SealedSecret = nil
+	return sub
+}
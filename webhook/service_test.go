@@ -0,0 +1,484 @@
+package webhook
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/suite"
+)
+
+type memoryStore struct {
+	subs        map[string]*Subscription
+	deliveries  []*Delivery
+	deadLetters []*DeadLetter
+	mu          *sync.Mutex
+}
+
+func (t *memoryStore) Source() cache.Source {
+	return &memorySource{store: t}
+}
+
+// memorySource reports the subscriptions stored when the feed opens and no
+// later changes
+type memorySource struct {
+	store *memoryStore
+}
+
+func (t *memorySource) Changes(includeInitial bool) (cache.Feed, error) {
+	feed := &memoryFeed{
+		changes: make(chan *cache.Change, len(t.store.subs)+2),
+		closed:  make(chan struct{}),
+	}
+
+	subs, _ := t.store.Subscriptions()
+
+	feed.changes <- &cache.Change{State: cache.StateInitializing}
+
+	for _, sub := range subs {
+		feed.changes <- &cache.Change{New: sub}
+	}
+
+	feed.changes <- &cache.Change{State: cache.StateReady}
+
+	return feed, nil
+}
+
+type memoryFeed struct {
+	changes   chan *cache.Change
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (t *memoryFeed) Next() (*cache.Change, bool) {
+	select {
+	case change := <-t.changes:
+		return change, true
+	case <-t.closed:
+		return nil, false
+	}
+}
+
+func (t *memoryFeed) Err() error {
+	return nil
+}
+
+func (t *memoryFeed) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.closed)
+	})
+
+	return nil
+}
+
+func (t *memoryStore) Subscriptions() ([]*Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	subs := []*Subscription{}
+
+	for _, sub := range t.subs {
+		copied := *sub
+		subs = append(subs, &copied)
+	}
+
+	return subs, nil
+}
+
+func (t *memoryStore) Subscription(id string) (*Subscription, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sub, ok := t.subs[id]
+
+	if !ok {
+		return nil, nil
+	}
+
+	copied := *sub
+
+	return &copied, nil
+}
+
+func (t *memoryStore) InsertSubscription(sub *Subscription) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	id := fmt.Sprintf("sub-%v", len(t.subs)+1)
+	copied := *sub
+	copied.ID = id
+	t.subs[id] = &copied
+
+	return id, nil
+}
+
+func (t *memoryStore) UpdateSubscription(sub *Subscription) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	copied := *sub
+	t.subs[sub.ID] = &copied
+
+	return nil
+}
+
+func (t *memoryStore) RewrapSecret(id string, prevKeyID string, envelope *secret.Envelope) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	sub, ok := t.subs[id]
+
+	if !ok || sub.SealedSecret == nil || sub.SealedSecret.KeyID != prevKeyID {
+		return false, nil
+	}
+
+	copied := *sub
+	copied.SealedSecret = envelope
+	t.subs[id] = &copied
+
+	return true, nil
+}
+
+func (t *memoryStore) DeleteSubscription(id string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.subs, id)
+
+	return nil
+}
+
+func (t *memoryStore) InsertDelivery(delivery *Delivery) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deliveries = append(t.deliveries, delivery)
+
+	return nil
+}
+
+func (t *memoryStore) Deliveries(subscriptionID string, limit int) ([]*Delivery, error) {
+	return t.deliveries, nil
+}
+
+func (t *memoryStore) InsertDeadLetter(letter *DeadLetter) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.deadLetters = append(t.deadLetters, letter)
+
+	return nil
+}
+
+func (t *memoryStore) DeadLetters(subscriptionID string, limit int) ([]*DeadLetter, error) {
+	return t.deadLetters, nil
+}
+
+type ServiceTestSuite struct {
+	suite.Suite
+	store   *memoryStore
+	service *Service
+	key     []byte
+}
+
+func (t *ServiceTestSuite) SetupTest() {
+	t.key, _ = secret.GenerateKey()
+	keyring, _ := secret.NewKeyring(t.key)
+	secret.SetKeyring(keyring)
+
+	t.store = &memoryStore{
+		subs: map[string]*Subscription{},
+		mu:   &sync.Mutex{},
+	}
+
+	t.service = &Service{
+		Store:           t.store,
+		MaxAttempts:     3,
+		InitialInterval: time.Millisecond,
+		MaxInterval:     time.Millisecond,
+	}
+}
+
+func (t *ServiceTestSuite) Test_Deliver_signs_payload() {
+	var body []byte
+	var headers http.Header
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		headers = r.Header
+	}))
+	defer receiver.Close()
+
+	sub, err := t.service.Create(&Subscription{
+		URL:    receiver.URL,
+		Secret: "s3cret",
+	})
+
+	assert.Nil(t.T(), err)
+
+	stored, _ := t.store.Subscription(sub.ID)
+	e := event.New(event.AuthFailed, map[string]interface{}{"reason": "no such user"})
+
+	assert.Nil(t.T(), t.service.Deliver(stored, e))
+	assert.Equal(t.T(), event.AuthFailed, headers.Get(EventHeader))
+	assert.Equal(t.T(), e.ID, headers.Get(DeliveryHeader))
+	assert.Equal(t.T(), "sha256="+Sign("s3cret", headers.Get(TimestampHeader), body), headers.Get(SignatureHeader))
+	assert.Equal(t.T(), 1, len(t.store.deliveries))
+	assert.Equal(t.T(), http.StatusOK, t.store.deliveries[0].StatusCode)
+	assert.Equal(t.T(), 0, len(t.store.deadLetters))
+}
+
+func (t *ServiceTestSuite) Test_Deliver_retries_then_dead_letters() {
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts++
+		rw.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer receiver.Close()
+
+	sub, _ := t.service.Create(&Subscription{URL: receiver.URL})
+	stored, _ := t.store.Subscription(sub.ID)
+
+	err := t.service.Deliver(stored, event.New(event.DeviceDisconnected, nil))
+
+	assert.NotNil(t.T(), err)
+	assert.Equal(t.T(), 3, attempts)
+	assert.Equal(t.T(), 3, len(t.store.deliveries))
+	assert.Equal(t.T(), 3, t.store.deliveries[2].Attempt)
+	assert.Equal(t.T(), 1, len(t.store.deadLetters))
+	assert.Equal(t.T(), "receiver responded with status 503", t.store.deadLetters[0].LastError)
+}
+
+func (t *ServiceTestSuite) Test_Deliver_succeeds_after_transient_failure() {
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		attempts++
+
+		if attempts == 1 {
+			rw.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	sub, _ := t.service.Create(&Subscription{URL: receiver.URL})
+	stored, _ := t.store.Subscription(sub.ID)
+
+	assert.Nil(t.T(), t.service.Deliver(stored, event.New(event.DeviceConnected, nil)))
+	assert.Equal(t.T(), 2, attempts)
+	assert.Equal(t.T(), 0, len(t.store.deadLetters))
+}
+
+func (t *ServiceTestSuite) Test_Start_delivers_matching_events() {
+	received := make(chan string, 10)
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Get(EventHeader)
+	}))
+	defer receiver.Close()
+
+	t.service.Events = event.NewBus()
+
+	t.service.Create(&Subscription{
+		URL:     receiver.URL,
+		Types:   []string{"device.*"},
+		Devices: []string{"web-*"},
+	})
+
+	go t.service.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	other := event.New(event.DeviceDisconnected, nil)
+	other.DeviceID = "a"
+	other.Hostname = "db-1"
+
+	matching := event.New(event.DeviceDisconnected, nil)
+	matching.DeviceID = "b"
+	matching.Hostname = "web-1"
+
+	t.service.Events.Publish(event.New(event.AuthFailed, nil))
+	t.service.Events.Publish(other)
+	t.service.Events.Publish(matching)
+
+	select {
+	case typ := <-received:
+		assert.Equal(t.T(), event.DeviceDisconnected, typ)
+	case <-time.After(5 * time.Second):
+		t.T().Fatal("event was not delivered")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t.T(), 0, len(received))
+}
+
+func (t *ServiceTestSuite) Test_Start_drops_events_for_a_full_queue_without_blocking() {
+	release := make(chan bool)
+	slowReceived := make(chan bool, 10)
+	fastReceived := make(chan bool, 10)
+
+	slow := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		<-release
+		slowReceived <- true
+	}))
+	defer slow.Close()
+	defer close(release)
+
+	fast := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		fastReceived <- true
+	}))
+	defer fast.Close()
+
+	t.service.Events = event.NewBus()
+	t.service.QueueSize = 1
+
+	slowSub, _ := t.service.Create(&Subscription{URL: slow.URL, Types: []string{"device.*"}})
+	t.service.Create(&Subscription{URL: fast.URL, Types: []string{"device.*"}})
+
+	go t.service.Start()
+	time.Sleep(50 * time.Millisecond)
+
+	dropped := testutil.ToFloat64(eventsDropped.WithLabelValues(slowSub.ID))
+
+	// the first event is in delivery, the second queued and the third dropped
+	for i := 0; i < 3; i++ {
+		t.service.Events.Publish(event.New(event.DeviceConnected, nil))
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for i := 0; i < 3; i++ {
+		select {
+		case <-fastReceived:
+		case <-time.After(5 * time.Second):
+			t.T().Fatal("event was not delivered to the fast receiver")
+		}
+	}
+
+	assert.Equal(t.T(), dropped+1, testutil.ToFloat64(eventsDropped.WithLabelValues(slowSub.ID)))
+}
+
+func (t *ServiceTestSuite) Test_secrets_are_stored_sealed() {
+	sub, err := t.service.Create(&Subscription{
+		URL:    "https://example.com/hook",
+		Secret: "s3cret",
+	})
+
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "s3cret", sub.Secret)
+	assert.Nil(t.T(), sub.SealedSecret)
+
+	stored, _ := t.store.Subscription(sub.ID)
+	assert.Equal(t.T(), "", stored.Secret)
+
+	plain, err := secret.Open(stored.SealedSecret)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "s3cret", string(plain))
+
+	updated, err := t.service.Update(sub.ID, &Subscription{URL: sub.URL, Secret: "n3w"})
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "", updated.Secret)
+	assert.Nil(t.T(), updated.SealedSecret)
+
+	stored, _ = t.store.Subscription(sub.ID)
+	plain, _ = secret.Open(stored.SealedSecret)
+	assert.Equal(t.T(), "n3w", string(plain))
+
+	listed, _ := t.service.Get(sub.ID)
+	assert.Nil(t.T(), listed.SealedSecret)
+}
+
+func (t *ServiceTestSuite) Test_Rewrap_moves_secrets_to_the_active_key() {
+	sub, _ := t.service.Create(&Subscription{URL: "https://example.com/hook", Secret: "s3cret"})
+
+	active, _ := secret.GenerateKey()
+	keyring, _ := secret.NewKeyring(t.key, active)
+	secret.SetKeyring(keyring)
+
+	rewrapped, err := t.service.Rewrap()
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), 1, rewrapped)
+
+	rewrapped, _ = t.service.Rewrap()
+	assert.Equal(t.T(), 0, rewrapped)
+
+	stored, _ := t.store.Subscription(sub.ID)
+	assert.Equal(t.T(), secret.KeyID(active), stored.SealedSecret.KeyID)
+
+	keyring, _ = secret.NewKeyring(active)
+	plain, err := keyring.Open(stored.SealedSecret)
+	assert.Nil(t.T(), err)
+	assert.Equal(t.T(), "s3cret", string(plain))
+}
+
+func (t *ServiceTestSuite) Test_enqueue_opens_no_queue_for_deleted_subscriptions() {
+	t.service.init()
+	t.service.subs = cache.New(&cache.Config{
+		Name:   "webhook",
+		Source: t.store.Source(),
+		Key: func(item interface{}) string {
+			return item.(*Subscription).ID
+		},
+		OnChange: func(old interface{}, new interface{}) {
+			if new == nil {
+				t.service.closeQueue(old.(*Subscription).ID)
+			}
+		},
+	})
+
+	sub := &Subscription{ID: "sub-1", URL: "https://example.com/hook", Disabled: true}
+	t.service.subs.Replace(sub)
+
+	// the event was matched before the subscription was deleted
+	t.service.subs.Replace()
+	t.service.enqueue(sub.ID, event.New(event.DeviceConnected, nil))
+
+	t.service.mu.Lock()
+	assert.Len(t.T(), t.service.queues, 0)
+	t.service.mu.Unlock()
+
+	t.service.subs.Replace(sub)
+	t.service.enqueue(sub.ID, event.New(event.DeviceConnected, nil))
+
+	t.service.mu.Lock()
+	assert.Len(t.T(), t.service.queues, 1)
+	t.service.mu.Unlock()
+
+	t.service.subs.Replace()
+
+	t.service.mu.Lock()
+	assert.Len(t.T(), t.service.queues, 0)
+	t.service.mu.Unlock()
+}
+
+func (t *ServiceTestSuite) Test_Create_rejects_invalid_url() {
+	_, err := t.service.Create(&Subscription{URL: "ftp://example.com"})
+
+	_, ok := err.(*ErrInvalidSubscription)
+	assert.True(t.T(), ok)
+}
+
+func (t *ServiceTestSuite) Test_Subscription_Matches_tag_selector() {
+	sub := &Subscription{Devices: []string{"tag:prod-*"}}
+
+	e := event.New(event.DeviceConnected, map[string]interface{}{"tags": []string{"prod-web"}})
+	e.DeviceID = "x"
+
+	assert.True(t.T(), sub.Matches(e))
+
+	e.Data["tags"] = []string{"dev"}
+
+	assert.False(t.T(), sub.Matches(e))
+}
+
+func TestServiceTestSuite(t *testing.T) {
+	suite.Run(t, new(ServiceTestSuite))
+}
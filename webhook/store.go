@@ -0,0 +1,28 @@
+package webhook
+
+import (
+	"github.com/deviceio/hub/cache"
+	"github.com/deviceio/hub/secret"
+)
+
+// Store persists webhook subscriptions and their delivery history
+type Store interface {
+	// Source is the changefeed the subscription cache follows
+	Source() cache.Source
+
+	Subscriptions() ([]*Subscription, error)
+	Subscription(id string) (*Subscription, error)
+	InsertSubscription(sub *Subscription) (id string, err error)
+	UpdateSubscription(sub *Subscription) error
+	DeleteSubscription(id string) error
+
+	// RewrapSecret replaces the sealed secret of the subscription with envelope
+	// if it is still sealed by the master key prevKeyID, reporting if it was
+	// replaced
+	RewrapSecret(id string, prevKeyID string, envelope *secret.Envelope) (bool, error)
+
+	InsertDelivery(delivery *Delivery) error
+	Deliveries(subscriptionID string, limit int) ([]*Delivery, error)
+	InsertDeadLetter(letter *DeadLetter) error
+	DeadLetters(subscriptionID string, limit int) ([]*DeadLetter, error)
+}
@@ -0,0 +1,104 @@
+package webhook
+
+import (
+	"path"
+	"strings"
+	"time"
+
+	"github.com/deviceio/hub/event"
+	"github.com/deviceio/hub/secret"
+)
+
+// Subscription registers an external http endpoint to receive hub events
+type Subscription struct {
+	ID  string `gorethink:"id,omitempty" json:"id"`
+	URL string `gorethink:"url" json:"url"`
+
+	// Secret is the key used to HMAC sign delivered payloads. It is supplied to
+	// and returned from Create and stored only as SealedSecret.
+	Secret string `gorethink:"-" json:"secret,omitempty"`
+
+	// SealedSecret is the Secret sealed by the master key
+	SealedSecret *secret.Envelope `gorethink:"secret" json:"sealedSecret,omitempty"`
+
+	// Types are event type patterns (device.*, auth.failed) delivered to this
+	// subscription. Empty delivers every type.
+	Types []string `gorethink:"types" json:"types"`
+
+	// Devices are device selectors limiting delivery to events of matching devices.
+	// A selector is a device id or hostname glob (web-*) or tag:<tag-glob>. Empty
+	// delivers events regardless of device.
+	Devices []string `gorethink:"devices" json:"devices"`
+
+	Disabled  bool      `gorethink:"disabled" json:"disabled"`
+	CreatedAt time.Time `gorethink:"created_at" json:"createdAt"`
+}
+
+// Matches reports if the event should be delivered to this subscription
+func (t *Subscription) Matches(e *event.Event) bool {
+	if t.Disabled || !event.MatchAny(t.Types, e.Type) {
+		return false
+	}
+
+	if len(t.Devices) == 0 {
+		return true
+	}
+
+	if e.DeviceID == "" {
+		return false
+	}
+
+	for _, selector := range t.Devices {
+		if matchDevice(strings.ToLower(selector), e) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func matchDevice(selector string, e *event.Event) bool {
+	if strings.HasPrefix(selector, "tag:") {
+		tags, _ := e.Data["tags"].([]string)
+
+		for _, tag := range tags {
+			if ok, _ := path.Match(strings.TrimPrefix(selector, "tag:"), strings.ToLower(tag)); ok {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if ok, _ := path.Match(selector, e.DeviceID); ok {
+		return true
+	}
+
+	ok, _ := path.Match(selector, e.Hostname)
+
+	return ok
+}
+
+// Delivery records a single attempt to deliver an event to a subscription
+type Delivery struct {
+	ID             string    `gorethink:"id,omitempty" json:"id"`
+	SubscriptionID string    `gorethink:"subscription_id" json:"subscriptionId"`
+	EventID        string    `gorethink:"event_id" json:"eventId"`
+	EventType      string    `gorethink:"event_type" json:"eventType"`
+	Attempt        int       `gorethink:"attempt" json:"attempt"`
+	StatusCode     int       `gorethink:"status_code,omitempty" json:"statusCode,omitempty"`
+	Error          string    `gorethink:"error,omitempty" json:"error,omitempty"`
+	Duration       float64   `gorethink:"duration_ms" json:"durationMs"`
+	Time           time.Time `gorethink:"time" json:"time"`
+}
+
+// DeadLetter records an event that could not be delivered to a subscription after
+// every retry was exhausted.
+type DeadLetter struct {
+	ID             string       `gorethink:"id,omitempty" json:"id"`
+	SubscriptionID string       `gorethink:"subscription_id" json:"subscriptionId"`
+	Event          *event.Event `gorethink:"event" json:"event"`
+	Attempts       int          `gorethink:"attempts" json:"attempts"`
+	LastError      string       `gorethink:"last_error" json:"lastError"`
+	Time           time.Time    `gorethink:"time" json:"time"`
+}